@@ -0,0 +1,538 @@
+// Package alerting detects the anomalies in the requests of the clients and
+// notifies about them.
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"github.com/jynychen/AdGuardHome/pkg/stats"
+	"golang.org/x/exp/slices"
+)
+
+// Default values of the configuration.
+const (
+	// DefaultWindow is the default duration of the window, within which the
+	// requests are counted.
+	DefaultWindow = time.Minute
+
+	// DefaultBaselineWindows is the default number of windows, over which the
+	// baseline number of requests of a client is averaged.
+	DefaultBaselineWindows = 60
+
+	// DefaultDedupInterval is the default interval, within which the repeated
+	// alerts of the same rule for the same client aren't delivered.
+	DefaultDedupInterval = time.Hour
+
+	// DefaultHistorySize is the default number of the last alerts kept in the
+	// history.
+	DefaultHistorySize = 100
+)
+
+const (
+	// maxClients is the maximum number of the tracked clients.  The requests
+	// of the clients beyond that are ignored.
+	maxClients = 10_000
+
+	// queueSize is the maximum number of the alerts waiting for delivery.
+	queueSize = 100
+)
+
+// Config is the configuration of the alerting.
+type Config struct {
+	// HTTPRegister registers the HTTP handlers.  It may be nil.
+	HTTPRegister aghhttp.RegisterFunc
+
+	// HTTPClient is the client used to deliver the alerts to the webhooks.
+	// It must not be nil if there are webhook sinks.
+	HTTPClient *http.Client
+
+	// Rules are the rules to evaluate.
+	Rules []*Rule
+
+	// Sinks are the sinks to deliver the alerts to.
+	Sinks []*SinkConfig
+
+	// Window is the duration of the window, within which the requests are
+	// counted.  If it's zero, [DefaultWindow] is used.
+	Window time.Duration
+
+	// DedupInterval is the interval, within which the repeated alerts of the
+	// same rule for the same client aren't delivered.  If it's zero,
+	// [DefaultDedupInterval] is used.
+	DedupInterval time.Duration
+
+	// BaselineWindows is the number of windows, over which the baseline number
+	// of requests of a client is averaged.  If it's zero,
+	// [DefaultBaselineWindows] is used.
+	BaselineWindows uint32
+
+	// HistorySize is the number of the last alerts kept in the history.  If
+	// it's zero, [DefaultHistorySize] is used.
+	HistorySize uint32
+}
+
+// validate returns an error if conf is invalid.
+func (conf *Config) validate() (err error) {
+	if conf.Window < 0 {
+		return errors.Error("window: negative value")
+	} else if conf.DedupInterval < 0 {
+		return errors.Error("dedup interval: negative value")
+	}
+
+	names := map[string]struct{}{}
+	for i, r := range conf.Rules {
+		err = r.validate()
+		if err != nil {
+			return fmt.Errorf("rules: at index %d: %w", i, err)
+		}
+
+		if _, ok := names[r.Name]; ok {
+			return fmt.Errorf("rules: at index %d: duplicate name %q", i, r.Name)
+		}
+
+		names[r.Name] = struct{}{}
+	}
+
+	for i, s := range conf.Sinks {
+		err = s.validate()
+		if err != nil {
+			return fmt.Errorf("sinks: at index %d: %w", i, err)
+		}
+
+		if s.Type == SinkTypeWebhook && conf.HTTPClient == nil {
+			return fmt.Errorf("sinks: at index %d: no http client", i)
+		}
+	}
+
+	return nil
+}
+
+// Alert is a single fired rule.
+type Alert struct {
+	// Time is the time of the end of the window, within which the rule has
+	// fired first.
+	Time time.Time `json:"time"`
+
+	// LastSeen is the time of the end of the last window, within which the
+	// rule has fired.
+	LastSeen time.Time `json:"last_seen"`
+
+	// Rule is the name of the rule.
+	Rule string `json:"rule"`
+
+	// Type is the type of the rule.
+	Type RuleType `json:"type"`
+
+	// Client is the IP address or the ClientID of the client.
+	Client string `json:"client"`
+
+	// Message is the human-readable description of the alert.
+	Message string `json:"message"`
+
+	// Value is the value of the metric of the rule.
+	Value float64 `json:"value"`
+
+	// Threshold is the threshold of the rule.
+	Threshold float64 `json:"threshold"`
+
+	// Count is the number of the windows, within which the rule has fired,
+	// including the ones with the deduplicated alerts.
+	Count uint64 `json:"count"`
+}
+
+// alertKey is the key used to deduplicate the alerts.
+type alertKey struct {
+	rule   string
+	client string
+}
+
+// Alerter evaluates the rules over the requests and delivers the alerts to the
+// sinks.
+type Alerter struct {
+	// mu protects counts and seen.
+	mu *sync.Mutex
+
+	// counts are the numbers of requests within the current window by the IDs
+	// of the clients.
+	counts map[string]*counters
+
+	// seen are the domain names requested by the clients.  It's nil if there
+	// are no rules of [RuleTypeNewDomainRate].
+	seen *seenDomains
+
+	// stateMu protects clients, lastAlerts, history, and window.
+	stateMu *sync.Mutex
+
+	// clients are the states of the tracked clients by their IDs.
+	clients map[string]*clientState
+
+	// lastAlerts are the alerts fired within the deduplication interval.
+	lastAlerts map[alertKey]*Alert
+
+	// history are the last alerts, from older to newer.
+	history []*Alert
+
+	// now returns the current time.
+	now func() (t time.Time)
+
+	// queue contains the alerts waiting for delivery.
+	queue chan *Alert
+
+	// done is closed when the alerter is closed.
+	done chan struct{}
+
+	// wg waits for the evaluating and the delivering goroutines to exit.
+	wg *sync.WaitGroup
+
+	// closeOnce makes sure that done is only closed once.
+	closeOnce *sync.Once
+
+	// rules are the rules to evaluate.
+	rules []*Rule
+
+	// sinks are the sinks to deliver the alerts to.
+	sinks []sink
+
+	// window is the number of the current window since the Unix epoch.
+	window int64
+
+	// windowDur is the duration of a window.
+	windowDur time.Duration
+
+	// dedupIvl is the deduplication interval.
+	dedupIvl time.Duration
+
+	// alpha is the smoothing factor of the baseline.
+	alpha float64
+
+	// baselineWindows is the number of windows, over which the baseline is
+	// averaged.  The clients idle for longer are forgotten.
+	baselineWindows uint64
+
+	// historySize is the maximum number of the alerts in history.
+	historySize int
+}
+
+// New returns a new properly initialized *Alerter.  conf must not be nil.
+func New(conf *Config) (a *Alerter, err error) {
+	err = conf.validate()
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	a = &Alerter{
+		mu:              &sync.Mutex{},
+		counts:          map[string]*counters{},
+		stateMu:         &sync.Mutex{},
+		clients:         map[string]*clientState{},
+		lastAlerts:      map[alertKey]*Alert{},
+		now:             time.Now,
+		queue:           make(chan *Alert, queueSize),
+		done:            make(chan struct{}),
+		wg:              &sync.WaitGroup{},
+		closeOnce:       &sync.Once{},
+		rules:           conf.Rules,
+		windowDur:       conf.Window,
+		dedupIvl:        conf.DedupInterval,
+		baselineWindows: uint64(conf.BaselineWindows),
+		historySize:     int(conf.HistorySize),
+	}
+
+	if a.windowDur == 0 {
+		a.windowDur = DefaultWindow
+	}
+
+	if a.dedupIvl == 0 {
+		a.dedupIvl = DefaultDedupInterval
+	}
+
+	if a.baselineWindows == 0 {
+		a.baselineWindows = DefaultBaselineWindows
+	}
+
+	if a.historySize == 0 {
+		a.historySize = DefaultHistorySize
+	}
+
+	a.alpha = 2 / float64(a.baselineWindows+1)
+
+	for _, r := range a.rules {
+		if r.Type == RuleTypeNewDomainRate {
+			a.seen = newSeenDomains()
+
+			break
+		}
+	}
+
+	for _, s := range conf.Sinks {
+		a.sinks = append(a.sinks, newSink(s, conf.HTTPClient))
+	}
+
+	if conf.HTTPRegister != nil {
+		conf.HTTPRegister(http.MethodGet, "/control/alerting/history", a.handleHistory)
+	}
+
+	return a, nil
+}
+
+// Start starts evaluating the rules at the end of each window and delivering
+// the alerts in separate goroutines.
+func (a *Alerter) Start() {
+	func() {
+		a.stateMu.Lock()
+		defer a.stateMu.Unlock()
+
+		a.window = a.now().UnixNano() / int64(a.windowDur)
+	}()
+
+	a.wg.Add(2)
+	go a.runEvaluation()
+	go a.run()
+}
+
+// Close stops evaluating the rules and delivering the alerts.  The undelivered
+// alerts are dropped.  It's safe to call it several times.
+func (a *Alerter) Close() {
+	a.closeOnce.Do(func() { close(a.done) })
+
+	a.wg.Wait()
+}
+
+// Observe counts e within the current window.  It's safe for concurrent use.
+// a may be nil, in which case Observe does nothing.
+func (a *Alerter) Observe(e *stats.Entry) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cnt := a.counts[e.Client]
+	if cnt == nil {
+		if len(a.counts) >= maxClients {
+			return
+		}
+
+		cnt = &counters{}
+		a.counts[e.Client] = cnt
+	}
+
+	isNew := false
+	if a.seen != nil {
+		isNew = a.seen.markSeen(e.Client, e.Domain)
+	}
+
+	cnt.add(e, isNew)
+}
+
+// runEvaluation finishes the windows and evaluates the rules at the end of
+// each window until a is closed.  It's intended to be used as a goroutine.
+func (a *Alerter) runEvaluation() {
+	defer log.OnPanic("alerting")
+	defer a.wg.Done()
+
+	timer := time.NewTimer(a.untilNextWindow())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			a.tick(a.now())
+			timer.Reset(a.untilNextWindow())
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// untilNextWindow returns the duration until the start of the next window.
+func (a *Alerter) untilNextWindow() (d time.Duration) {
+	return a.windowDur - time.Duration(a.now().UnixNano()%int64(a.windowDur))
+}
+
+// tick finishes the current window if now is after it, so that the windows
+// without any requests are finished as well.
+func (a *Alerter) tick(now time.Time) {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+
+	w := now.UnixNano() / int64(a.windowDur)
+	if w <= a.window {
+		return
+	}
+
+	var counts map[string]*counters
+	func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		counts, a.counts = a.counts, make(map[string]*counters, len(a.counts))
+	}()
+
+	skipped := mathutil.Min(uint64(w-a.window-1), a.baselineWindows)
+	a.finishWindow(counts, time.Unix(0, (a.window+1)*int64(a.windowDur)), skipped)
+	a.window = w
+}
+
+// finishWindow forgets the alerts outside of the deduplication interval,
+// evaluates the rules for each client with the numbers of requests counts,
+// updates the baselines, and forgets the idle clients.  end is the end of the
+// finished window, and skipped is the number of the empty windows after it.
+// a.stateMu is expected to be locked.
+func (a *Alerter) finishWindow(counts map[string]*counters, end time.Time, skipped uint64) {
+	for k, al := range a.lastAlerts {
+		if end.Sub(al.Time) >= a.dedupIvl {
+			delete(a.lastAlerts, k)
+		}
+	}
+
+	for id, cnt := range counts {
+		c := a.clients[id]
+		if c == nil {
+			if len(a.clients) >= maxClients {
+				continue
+			}
+
+			c = &clientState{}
+			a.clients[id] = c
+		}
+
+		c.counters = *cnt
+	}
+
+	for id, c := range a.clients {
+		if c.total > 0 {
+			for _, r := range a.rules {
+				a.evaluate(r, id, c, end)
+			}
+		}
+
+		c.finish(a.alpha, skipped)
+		if c.idle > a.baselineWindows {
+			delete(a.clients, id)
+		}
+	}
+}
+
+// evaluate fires an alert if r applies to the client with c and id.  The
+// alert isn't delivered if the same rule has already fired for the same
+// client within the deduplication interval.  a.stateMu is expected to be
+// locked.
+func (a *Alerter) evaluate(r *Rule, id string, c *clientState, end time.Time) {
+	v, ok := c.value(r)
+	if !ok || v < r.Threshold {
+		return
+	}
+
+	key := alertKey{rule: r.Name, client: id}
+	if prev := a.lastAlerts[key]; prev != nil {
+		prev.Count++
+		prev.LastSeen = end
+
+		return
+	}
+
+	al := &Alert{
+		Time:      end,
+		LastSeen:  end,
+		Rule:      r.Name,
+		Type:      r.Type,
+		Client:    id,
+		Message:   c.describe(r, v, a.windowDur),
+		Value:     v,
+		Threshold: r.Threshold,
+		Count:     1,
+	}
+
+	log.Info("alerting: rule %q fired for client %q: %s", r.Name, id, al.Message)
+
+	a.lastAlerts[key] = al
+	a.history = append(a.history, al)
+	if len(a.history) > a.historySize {
+		a.history = slices.Delete(a.history, 0, len(a.history)-a.historySize)
+	}
+
+	// Copy the alert, since the original one is modified when deduplicating.
+	alCopy := *al
+	select {
+	case a.queue <- &alCopy:
+		// Go on.
+	default:
+		log.Error("alerting: queue is full, dropping alert of rule %q", r.Name)
+	}
+}
+
+// run delivers the queued alerts until a is closed.  It's intended to be used
+// as a goroutine.
+func (a *Alerter) run() {
+	defer log.OnPanic("alerting")
+	defer a.wg.Done()
+
+	for {
+		select {
+		case al := <-a.queue:
+			a.deliver(al)
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// deliver sends al to each sink.
+func (a *Alerter) deliver(al *Alert) {
+	data, err := json.Marshal(al)
+	if err != nil {
+		log.Error("alerting: encoding alert: %s", err)
+
+		return
+	}
+
+	for _, s := range a.sinks {
+		func() {
+			ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+			defer cancel()
+
+			err = s.send(ctx, data)
+			if err != nil {
+				log.Error("alerting: delivering to %s: %s", s, err)
+			} else {
+				log.Debug("alerting: delivered alert of rule %q to %s", al.Rule, s)
+			}
+		}()
+	}
+}
+
+// historyResp is the response to the GET /control/alerting/history HTTP API.
+type historyResp struct {
+	// Alerts are the last alerts, from newer to older.
+	Alerts []*Alert `json:"alerts"`
+}
+
+// handleHistory is the handler for the GET /control/alerting/history HTTP API.
+func (a *Alerter) handleHistory(w http.ResponseWriter, r *http.Request) {
+	resp := &historyResp{}
+
+	func() {
+		a.stateMu.Lock()
+		defer a.stateMu.Unlock()
+
+		resp.Alerts = make([]*Alert, 0, len(a.history))
+		for i := len(a.history) - 1; i >= 0; i-- {
+			al := *a.history[i]
+			resp.Alerts = append(resp.Alerts, &al)
+		}
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
@@ -0,0 +1,425 @@
+package alerting
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/jynychen/AdGuardHome/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient is the client of the requests in tests.
+const testClient = "192.0.2.1"
+
+// testStart is the start of the first window in tests.  It's in the local time
+// zone, like the times of the alerts.
+var testStart = time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)
+
+// testAlerter is an *Alerter with the controlled time.
+type testAlerter struct {
+	*Alerter
+
+	// now is the current time of the alerter.
+	now time.Time
+}
+
+// newTestAlerter returns a new *testAlerter with the default window starting
+// at testStart.
+func newTestAlerter(t *testing.T, conf *Config) (ta *testAlerter) {
+	t.Helper()
+
+	a, err := New(conf)
+	require.NoError(t, err)
+
+	ta = &testAlerter{
+		Alerter: a,
+		now:     testStart,
+	}
+	a.now = func() (now time.Time) { return ta.now }
+	a.window = testStart.UnixNano() / int64(a.windowDur)
+
+	return ta
+}
+
+// observe observes n requests from testClient for the domains returned by
+// domain with the result res and the response code rcode.
+func (ta *testAlerter) observe(n int, res stats.Result, rcode string, domain func(i int) string) {
+	for i := 0; i < n; i++ {
+		ta.Observe(&stats.Entry{
+			Domain: domain(i),
+			Client: testClient,
+			Result: res,
+			RCode:  rcode,
+		})
+	}
+}
+
+// nextWindow moves the time of ta to the next window.
+func (ta *testAlerter) nextWindow() {
+	ta.now = ta.now.Add(DefaultWindow)
+}
+
+// finish finishes the current window of ta by moving to the next one.
+func (ta *testAlerter) finish() {
+	ta.nextWindow()
+	ta.tick(ta.now)
+}
+
+// sameDomain returns the same domain name for each request.
+func sameDomain(_ int) (domain string) { return "example.org" }
+
+// newDomain returns a new domain name for each request.
+func newDomain(i int) (domain string) { return string(rune('a'+i)) + ".example" }
+
+func TestAlerter_rules(t *testing.T) {
+	const nxDomain = "NXDOMAIN"
+
+	// usualWindows observes the usual requests within three windows.
+	usualWindows := func(ta *testAlerter) {
+		for i := 0; i < 3; i++ {
+			ta.observe(5, stats.RNotFiltered, "NOERROR", sameDomain)
+			ta.finish()
+		}
+	}
+
+	testCases := []struct {
+		rule      *Rule
+		observe   func(ta *testAlerter)
+		name      string
+		wantValue float64
+	}{{
+		rule: &Rule{Name: "rate", Type: RuleTypeClientRate, Threshold: 10, MinQueries: 10},
+		observe: func(ta *testAlerter) {
+			usualWindows(ta)
+			ta.observe(60, stats.RNotFiltered, "NOERROR", sameDomain)
+		},
+		name:      "client_rate",
+		wantValue: 12,
+	}, {
+		rule: &Rule{Name: "rate", Type: RuleTypeClientRate, Threshold: 10, MinQueries: 10},
+		observe: func(ta *testAlerter) {
+			usualWindows(ta)
+			ta.observe(45, stats.RNotFiltered, "NOERROR", sameDomain)
+		},
+		name:      "client_rate_below",
+		wantValue: 0,
+	}, {
+		rule: &Rule{Name: "rate", Type: RuleTypeClientRate, Threshold: 10, MinQueries: 10},
+		observe: func(ta *testAlerter) {
+			ta.observe(5, stats.RNotFiltered, "NOERROR", sameDomain)
+			ta.finish()
+			ta.observe(60, stats.RNotFiltered, "NOERROR", sameDomain)
+		},
+		name:      "client_rate_new_client",
+		wantValue: 0,
+	}, {
+		rule: &Rule{Name: "blocked", Type: RuleTypeBlockedRatio, Threshold: 0.5, MinQueries: 10},
+		observe: func(ta *testAlerter) {
+			ta.observe(6, stats.RFiltered, "NOERROR", sameDomain)
+			ta.observe(4, stats.RNotFiltered, "NOERROR", sameDomain)
+		},
+		name:      "blocked_ratio",
+		wantValue: 0.6,
+	}, {
+		rule: &Rule{Name: "blocked", Type: RuleTypeBlockedRatio, Threshold: 0.5, MinQueries: 20},
+		observe: func(ta *testAlerter) {
+			ta.observe(6, stats.RFiltered, "NOERROR", sameDomain)
+			ta.observe(4, stats.RNotFiltered, "NOERROR", sameDomain)
+		},
+		name:      "blocked_ratio_few_queries",
+		wantValue: 0,
+	}, {
+		rule: &Rule{Name: "nxdomain", Type: RuleTypeNXDomainRatio, Threshold: 0.5, MinQueries: 1},
+		observe: func(ta *testAlerter) {
+			ta.observe(3, stats.RNotFiltered, nxDomain, newDomain)
+			ta.observe(1, stats.RNotFiltered, "NOERROR", sameDomain)
+		},
+		name:      "nxdomain_ratio",
+		wantValue: 0.75,
+	}, {
+		rule: &Rule{Name: "new", Type: RuleTypeNewDomainRate, Threshold: 5, MinQueries: 1},
+		observe: func(ta *testAlerter) {
+			usualWindows(ta)
+			ta.observe(6, stats.RNotFiltered, nxDomain, newDomain)
+		},
+		name:      "new_domain_rate",
+		wantValue: 6,
+	}, {
+		rule: &Rule{Name: "new", Type: RuleTypeNewDomainRate, Threshold: 5, MinQueries: 1},
+		observe: func(ta *testAlerter) {
+			ta.observe(6, stats.RNotFiltered, nxDomain, newDomain)
+		},
+		name:      "new_domain_rate_new_client",
+		wantValue: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ta := newTestAlerter(t, &Config{Rules: []*Rule{tc.rule}})
+
+			tc.observe(ta)
+			ta.finish()
+
+			if tc.wantValue == 0 {
+				assert.Empty(t, ta.history)
+
+				return
+			}
+
+			require.Len(t, ta.history, 1)
+
+			al := ta.history[0]
+			assert.Equal(t, tc.rule.Name, al.Rule)
+			assert.Equal(t, tc.rule.Type, al.Type)
+			assert.Equal(t, testClient, al.Client)
+			assert.Equal(t, ta.now, al.Time)
+			assert.InDelta(t, tc.wantValue, al.Value, 0.001)
+		})
+	}
+}
+
+func TestAlerter_dedup(t *testing.T) {
+	const dedupIvl = 3 * DefaultWindow
+
+	ta := newTestAlerter(t, &Config{
+		Rules: []*Rule{{
+			Name:      "blocked",
+			Type:      RuleTypeBlockedRatio,
+			Threshold: 0.5,
+		}},
+		DedupInterval: dedupIvl,
+	})
+
+	for i := 0; i < 4; i++ {
+		ta.observe(1, stats.RFiltered, "NOERROR", sameDomain)
+		ta.finish()
+	}
+
+	require.Len(t, ta.history, 2)
+
+	assert.Equal(t, testStart.Add(DefaultWindow), ta.history[0].Time)
+	assert.Equal(t, testStart.Add(dedupIvl), ta.history[0].LastSeen)
+	assert.Equal(t, uint64(3), ta.history[0].Count)
+
+	assert.Equal(t, testStart.Add(4*DefaultWindow), ta.history[1].Time)
+	assert.Equal(t, uint64(1), ta.history[1].Count)
+
+	require.Len(t, ta.queue, 2)
+}
+
+func TestAlerter_silence(t *testing.T) {
+	ta := newTestAlerter(t, &Config{
+		Rules: []*Rule{{
+			Name:      "nxdomain",
+			Type:      RuleTypeNXDomainRatio,
+			Threshold: 0.5,
+		}},
+	})
+
+	ta.observe(2, stats.RNotFiltered, "NXDOMAIN", newDomain)
+
+	// No requests follow the burst, but the window is finished anyway.
+	ta.now = ta.now.Add(5 * DefaultWindow)
+	ta.tick(ta.now)
+
+	require.Len(t, ta.history, 1)
+
+	assert.Equal(t, testStart.Add(DefaultWindow), ta.history[0].Time)
+
+	// The client is still remembered, but it's idle.
+	require.Contains(t, ta.clients, testClient)
+
+	assert.Equal(t, uint64(4), ta.clients[testClient].idle)
+}
+
+func TestAlerter_history(t *testing.T) {
+	ta := newTestAlerter(t, &Config{
+		Rules: []*Rule{{
+			Name:      "blocked",
+			Type:      RuleTypeBlockedRatio,
+			Threshold: 0.5,
+		}},
+		DedupInterval: DefaultWindow,
+		HistorySize:   2,
+	})
+
+	for i := 0; i < 3; i++ {
+		ta.observe(1, stats.RFiltered, "NOERROR", sameDomain)
+		ta.finish()
+	}
+
+	w := httptest.NewRecorder()
+	ta.handleHistory(w, httptest.NewRequest(http.MethodGet, "/control/alerting/history", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &historyResp{}
+	err := json.Unmarshal(w.Body.Bytes(), resp)
+	require.NoError(t, err)
+
+	require.Len(t, resp.Alerts, 2)
+
+	assert.WithinDuration(t, testStart.Add(3*DefaultWindow), resp.Alerts[0].Time, 0)
+	assert.WithinDuration(t, testStart.Add(2*DefaultWindow), resp.Alerts[1].Time, 0)
+}
+
+func TestAlerter_webhook(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(testutil.PanicT{}, err)
+
+		assert.Equal(testutil.PanicT{}, http.MethodPost, r.Method)
+		assert.Equal(testutil.PanicT{}, "application/json", r.Header.Get("Content-Type"))
+
+		bodies <- body
+	}))
+	t.Cleanup(srv.Close)
+
+	ta := newTestAlerter(t, &Config{
+		HTTPClient: srv.Client(),
+		Rules: []*Rule{{
+			Name:      "nxdomain",
+			Type:      RuleTypeNXDomainRatio,
+			Threshold: 0.5,
+		}},
+		Sinks: []*SinkConfig{{
+			Type: SinkTypeWebhook,
+			URL:  srv.URL + "/alerts",
+		}},
+	})
+
+	ta.observe(2, stats.RNotFiltered, "NXDOMAIN", newDomain)
+	ta.finish()
+
+	// Start after finishing the window, since the evaluating goroutine reads
+	// the time of ta.
+	ta.Start()
+	t.Cleanup(ta.Close)
+
+	var body []byte
+	require.Eventually(t, func() (ok bool) {
+		select {
+		case body = <-bodies:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	al := &Alert{}
+	err := json.Unmarshal(body, al)
+	require.NoError(t, err)
+
+	assert.Equal(t, "nxdomain", al.Rule)
+	assert.Equal(t, testClient, al.Client)
+	assert.Equal(t, "100% of 2 requests resulted in NXDOMAIN", al.Message)
+}
+
+func TestSeenDomains_markSeen(t *testing.T) {
+	const otherClient = "192.0.2.2"
+
+	s := newSeenDomains()
+
+	// The domain names of all the clients share the same limit.
+	for i := 0; i < maxSeenDomains/2; i++ {
+		domain := strconv.Itoa(i) + ".example"
+		require.True(t, s.markSeen(testClient, domain))
+		require.True(t, s.markSeen(otherClient, domain))
+	}
+
+	assert.False(t, s.markSeen(testClient, "0.example"))
+	assert.False(t, s.markSeen(otherClient, "0.example"))
+
+	// Start a new generation.
+	assert.True(t, s.markSeen(testClient, "new.example"))
+	assert.False(t, s.markSeen(otherClient, "1.example"))
+	assert.False(t, s.markSeen(testClient, "new.example"))
+	assert.True(t, s.markSeen(otherClient, "new.example"))
+}
+
+func TestNew_seen(t *testing.T) {
+	a, err := New(&Config{
+		Rules: []*Rule{{Name: "rate", Type: RuleTypeClientRate, Threshold: 10}},
+	})
+	require.NoError(t, err)
+
+	assert.Nil(t, a.seen)
+
+	a, err = New(&Config{
+		Rules: []*Rule{{Name: "new", Type: RuleTypeNewDomainRate, Threshold: 10}},
+	})
+	require.NoError(t, err)
+
+	assert.NotNil(t, a.seen)
+}
+
+func TestConfig_validate(t *testing.T) {
+	validRule := &Rule{Name: "rate", Type: RuleTypeClientRate, Threshold: 50}
+
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf: &Config{
+			HTTPClient: http.DefaultClient,
+			Rules:      []*Rule{validRule},
+			Sinks: []*SinkConfig{{
+				Type: SinkTypeWebhook,
+				URL:  "https://alerts.example/hook",
+			}, {
+				Type:    SinkTypeCommand,
+				Command: "/usr/local/bin/notify",
+			}},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &Config{Rules: []*Rule{validRule, validRule}},
+		name:       "duplicate_rule",
+		wantErrMsg: `rules: at index 1: duplicate name "rate"`,
+	}, {
+		conf: &Config{Rules: []*Rule{{
+			Name:      "blocked",
+			Type:      RuleTypeBlockedRatio,
+			Threshold: 2,
+		}}},
+		name:       "bad_ratio",
+		wantErrMsg: "rules: at index 0: threshold: must be greater than 0 and at most 1, got 2",
+	}, {
+		conf:       &Config{Rules: []*Rule{{Name: "bad", Type: "bad", Threshold: 1}}},
+		name:       "bad_rule_type",
+		wantErrMsg: `rules: at index 0: type: unsupported value "bad"`,
+	}, {
+		conf: &Config{Sinks: []*SinkConfig{{
+			Type: SinkTypeWebhook,
+			URL:  "ftp://alerts.example",
+		}}},
+		name:       "bad_url",
+		wantErrMsg: `sinks: at index 0: url: unsupported scheme "ftp"`,
+	}, {
+		conf: &Config{Sinks: []*SinkConfig{{
+			Type: SinkTypeWebhook,
+			URL:  "https://alerts.example",
+		}}},
+		name:       "no_http_client",
+		wantErrMsg: "sinks: at index 0: no http client",
+	}, {
+		conf:       &Config{Sinks: []*SinkConfig{{Type: SinkTypeCommand}}},
+		name:       "empty_command",
+		wantErrMsg: "sinks: at index 0: command: empty",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
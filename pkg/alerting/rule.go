@@ -0,0 +1,267 @@
+package alerting
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/jynychen/AdGuardHome/pkg/stats"
+	"github.com/miekg/dns"
+)
+
+// RuleType is the type of an alerting rule.
+type RuleType string
+
+// Supported rule types.
+const (
+	// RuleTypeClientRate fires when the number of requests from a client
+	// within a window is at least Threshold times its baseline.
+	RuleTypeClientRate RuleType = "client_rate"
+
+	// RuleTypeBlockedRatio fires when the share of the blocked requests from a
+	// client within a window is at least Threshold.
+	RuleTypeBlockedRatio RuleType = "blocked_ratio"
+
+	// RuleTypeNXDomainRatio fires when the share of the requests from a client
+	// resulted in NXDOMAIN within a window is at least Threshold.
+	RuleTypeNXDomainRatio RuleType = "nxdomain_ratio"
+
+	// RuleTypeNewDomainRate fires when the number of the domain names never
+	// requested by a client before is at least Threshold within a window.
+	RuleTypeNewDomainRate RuleType = "new_domain_rate"
+)
+
+const (
+	// minHistoryWindows is the number of windows a client must be seen for
+	// before the rules comparing its requests to the previous ones apply.
+	minHistoryWindows = 3
+
+	// maxSeenDomains is the maximum number of the domain names remembered for
+	// all the clients in each of the two generations, see
+	// [seenDomains.markSeen].
+	maxSeenDomains = 65_536
+)
+
+// rcodeNXDomain is the string representation of the NXDOMAIN response code as
+// used in [stats.Entry].
+var rcodeNXDomain = dns.RcodeToString[dns.RcodeNameError]
+
+// Rule is an alerting rule evaluated for each client at the end of each
+// window.
+type Rule struct {
+	// Name is the unique name of the rule.
+	Name string `yaml:"name"`
+
+	// Type is the type of the rule.
+	Type RuleType `yaml:"type"`
+
+	// Threshold is the value, at which the rule fires.  It's the factor of the
+	// baseline for [RuleTypeClientRate], the share from 0 to 1 for
+	// [RuleTypeBlockedRatio] and [RuleTypeNXDomainRatio], and the number of
+	// domain names for [RuleTypeNewDomainRate].
+	Threshold float64 `yaml:"threshold"`
+
+	// MinQueries is the minimum number of requests from a client within a
+	// window for the rule to apply.
+	MinQueries uint64 `yaml:"min_queries"`
+}
+
+// validate returns an error if r is invalid.
+func (r *Rule) validate() (err error) {
+	if r == nil {
+		return errors.Error("no rule")
+	} else if r.Name == "" {
+		return errors.Error("name: empty")
+	}
+
+	switch r.Type {
+	case RuleTypeBlockedRatio, RuleTypeNXDomainRatio:
+		if r.Threshold <= 0 || r.Threshold > 1 {
+			return fmt.Errorf("threshold: must be greater than 0 and at most 1, got %g", r.Threshold)
+		}
+	case RuleTypeClientRate, RuleTypeNewDomainRate:
+		if r.Threshold <= 0 {
+			return fmt.Errorf("threshold: must be positive, got %g", r.Threshold)
+		}
+	default:
+		return fmt.Errorf("type: unsupported value %q", r.Type)
+	}
+
+	return nil
+}
+
+// counters are the numbers of requests from a single client within a window.
+type counters struct {
+	// total is the number of requests.
+	total uint64
+
+	// blocked is the number of blocked requests.
+	blocked uint64
+
+	// nxDomain is the number of requests resulted in NXDOMAIN.
+	nxDomain uint64
+
+	// newDomains is the number of the newly seen domain names.
+	newDomains uint64
+}
+
+// add counts e.  isNew is true if the domain name of e hasn't been requested by
+// the client before.
+func (cnt *counters) add(e *stats.Entry, isNew bool) {
+	cnt.total++
+
+	switch e.Result {
+	case stats.RFiltered, stats.RSafeBrowsing, stats.RParental:
+		cnt.blocked++
+	}
+
+	if e.RCode == rcodeNXDomain {
+		cnt.nxDomain++
+	}
+
+	if isNew {
+		cnt.newDomains++
+	}
+}
+
+// seenKey is the key of a domain name requested by a client.
+type seenKey struct {
+	// client is the ID of the client.
+	client string
+
+	// domain is the requested domain name.
+	domain string
+}
+
+// seenDomains are the domain names requested by the clients.
+type seenDomains struct {
+	// cur are the domain names requested recently.
+	cur map[seenKey]struct{}
+
+	// prev are the domain names requested before cur has become full.
+	prev map[seenKey]struct{}
+}
+
+// newSeenDomains returns a new properly initialized *seenDomains.
+func newSeenDomains() (s *seenDomains) {
+	return &seenDomains{
+		cur:  map[seenKey]struct{}{},
+		prev: map[seenKey]struct{}{},
+	}
+}
+
+// markSeen remembers domain requested by the client with the ID client and
+// returns true if it hasn't been seen before.  To limit the memory usage, only
+// two generations of at most maxSeenDomains domain names of all the clients
+// are kept, and the older one is forgotten when the newer one is full.  So the
+// domain names of the idle clients are eventually forgotten as well.
+func (s *seenDomains) markSeen(client, domain string) (isNew bool) {
+	k := seenKey{client: client, domain: domain}
+	if _, ok := s.cur[k]; ok {
+		return false
+	}
+
+	_, wasSeen := s.prev[k]
+	if len(s.cur) >= maxSeenDomains {
+		s.prev, s.cur = s.cur, make(map[seenKey]struct{}, maxSeenDomains)
+	}
+
+	s.cur[k] = struct{}{}
+
+	return !wasSeen
+}
+
+// clientState contains the numbers of requests from a single client.
+type clientState struct {
+	// counters are the numbers of requests within the finished window.
+	counters
+
+	// baseline is the moving average of the numbers of requests within the
+	// previous windows.
+	baseline float64
+
+	// windows is the number of the finished windows since the client has
+	// been seen first.
+	windows uint64
+
+	// idle is the number of the last finished windows without requests.
+	idle uint64
+}
+
+// value returns the value of the metric of r for the current window.  ok is
+// false if r doesn't apply to c yet.  c.total must not be zero.
+func (c *clientState) value(r *Rule) (v float64, ok bool) {
+	if c.total < r.MinQueries {
+		return 0, false
+	}
+
+	switch r.Type {
+	case RuleTypeClientRate:
+		if c.windows < minHistoryWindows || c.baseline == 0 {
+			return 0, false
+		}
+
+		return float64(c.total) / c.baseline, true
+	case RuleTypeBlockedRatio:
+		return float64(c.blocked) / float64(c.total), true
+	case RuleTypeNXDomainRatio:
+		return float64(c.nxDomain) / float64(c.total), true
+	case RuleTypeNewDomainRate:
+		// All the domain names of a new client are new.
+		if c.windows < minHistoryWindows {
+			return 0, false
+		}
+
+		return float64(c.newDomains), true
+	default:
+		return 0, false
+	}
+}
+
+// describe returns the human-readable description of the value v of the
+// metric of r.
+func (c *clientState) describe(r *Rule, v float64, window time.Duration) (msg string) {
+	switch r.Type {
+	case RuleTypeClientRate:
+		return fmt.Sprintf(
+			"%d requests within %s, %.1f times the usual %.1f",
+			c.total,
+			window,
+			v,
+			c.baseline,
+		)
+	case RuleTypeBlockedRatio:
+		return fmt.Sprintf("%.0f%% of %d requests blocked", v*100, c.total)
+	case RuleTypeNXDomainRatio:
+		return fmt.Sprintf("%.0f%% of %d requests resulted in NXDOMAIN", v*100, c.total)
+	default:
+		return fmt.Sprintf("%d new domain names among %d requests", c.newDomains, c.total)
+	}
+}
+
+// finish adds the numbers of the current window followed by skipped empty
+// windows to the baseline and resets them.  The baseline is the average of
+// the previous windows until there are enough of those, and the exponentially
+// weighted moving average with alpha afterwards.
+func (c *clientState) finish(alpha float64, skipped uint64) {
+	c.addToBaseline(alpha, c.total)
+	for i := uint64(0); i < skipped; i++ {
+		c.addToBaseline(alpha, 0)
+	}
+
+	if c.total == 0 {
+		c.idle += 1 + skipped
+	} else {
+		c.idle = skipped
+	}
+
+	c.counters = counters{}
+}
+
+// addToBaseline adds the number of requests n within a finished window to the
+// baseline.
+func (c *clientState) addToBaseline(alpha float64, n uint64) {
+	c.windows++
+	c.baseline += math.Max(alpha, 1/float64(c.windows)) * (float64(n) - c.baseline)
+}
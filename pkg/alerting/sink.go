@@ -0,0 +1,170 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"github.com/jynychen/AdGuardHome/pkg/aghos"
+)
+
+// SinkType is the type of an alert sink.
+type SinkType string
+
+// Supported sink types.
+const (
+	// SinkTypeWebhook sends the alerts as JSON in the body of a POST request
+	// to URL.
+	SinkTypeWebhook SinkType = "webhook"
+
+	// SinkTypeCommand runs Command with Args and writes the alert as JSON to
+	// its standard input.
+	SinkTypeCommand SinkType = "command"
+)
+
+// sinkTimeout is the timeout for delivering an alert to a single sink.
+const sinkTimeout = 10 * time.Second
+
+// SinkConfig is the configuration of an alert sink.
+type SinkConfig struct {
+	// Type is the type of the sink.
+	Type SinkType `yaml:"type"`
+
+	// URL is the URL of the webhook for [SinkTypeWebhook].
+	URL string `yaml:"url"`
+
+	// Command is the path to the command to run for [SinkTypeCommand].
+	Command string `yaml:"command"`
+
+	// Args are the arguments of Command.
+	Args []string `yaml:"args"`
+}
+
+// validate returns an error if c is invalid.
+func (c *SinkConfig) validate() (err error) {
+	if c == nil {
+		return errors.Error("no sink")
+	}
+
+	switch c.Type {
+	case SinkTypeWebhook:
+		var u *url.URL
+		u, err = url.ParseRequestURI(c.URL)
+		if err != nil {
+			return fmt.Errorf("url: %w", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("url: unsupported scheme %q", u.Scheme)
+		}
+	case SinkTypeCommand:
+		if c.Command == "" {
+			return errors.Error("command: empty")
+		}
+	default:
+		return fmt.Errorf("type: unsupported value %q", c.Type)
+	}
+
+	return nil
+}
+
+// sink delivers the alerts.
+type sink interface {
+	// send delivers the JSON-encoded alert data.
+	send(ctx context.Context, data []byte) (err error)
+
+	// String returns the description of the sink for logging.
+	String() (s string)
+}
+
+// newSink returns a new sink for c.  c must be valid.
+func newSink(c *SinkConfig, client *http.Client) (s sink) {
+	if c.Type == SinkTypeWebhook {
+		return &webhookSink{
+			client: client,
+			url:    c.URL,
+		}
+	}
+
+	return &commandSink{
+		command: c.Command,
+		args:    c.Args,
+	}
+}
+
+// webhookSink is a sink sending the alerts to a webhook.
+type webhookSink struct {
+	client *http.Client
+	url    string
+}
+
+// type check
+var _ sink = (*webhookSink)(nil)
+
+// send implements the [sink] interface for *webhookSink.
+func (s *webhookSink) send(ctx context.Context, data []byte) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(httphdr.ContentType, aghhttp.HdrValApplicationJSON)
+	req.Header.Set(httphdr.UserAgent, aghhttp.UserAgent())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	// Drain the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, aghos.MaxCmdOutputSize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// String implements the [sink] interface for *webhookSink.
+func (s *webhookSink) String() (str string) {
+	return fmt.Sprintf("webhook %q", s.url)
+}
+
+// commandSink is a sink running a command for each alert.
+type commandSink struct {
+	command string
+	args    []string
+}
+
+// type check
+var _ sink = (*commandSink)(nil)
+
+// send implements the [sink] interface for *commandSink.
+func (s *commandSink) send(ctx context.Context, data []byte) (err error) {
+	cmd := exec.CommandContext(ctx, s.command, s.args...)
+	cmd.Stdin = bytes.NewReader(data)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = out[:mathutil.Min(len(out), aghos.MaxCmdOutputSize)]
+
+		return fmt.Errorf("%w: %s", err, out)
+	}
+
+	return nil
+}
+
+// String implements the [sink] interface for *commandSink.
+func (s *commandSink) String() (str string) {
+	return fmt.Sprintf("command %q", s.command)
+}
@@ -0,0 +1,236 @@
+// Package blockpage contains the HTTP(S) server showing a page that explains
+// why a domain name has been blocked.  The custom blocking IP addresses are
+// expected to point to this server.
+package blockpage
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// defaultTemplate is the default template of the block page.
+//
+//go:embed blockpage.html
+var defaultTemplate string
+
+// readHdrTimeout is the amount of time allowed to read the request headers.
+const readHdrTimeout = 10 * time.Second
+
+// Config is the configuration of the block page server.
+type Config struct {
+	// Tokens keeps the tokens of the blocked requests.  It must not be nil.
+	Tokens *Tokens
+
+	// FilterListName returns the name of the filter list with the given ID.
+	// It must not be nil.
+	FilterListName func(id int64) (name string)
+
+	// TLSConfig is the TLS configuration for the HTTPS listener.  It must not
+	// be nil if TLSAddr is set.
+	TLSConfig *tls.Config
+
+	// TemplatePath is the path to the file with the template of the page.  If
+	// the file doesn't exist, the default template is used.
+	TemplatePath string
+
+	// Addr is the address to serve the page over HTTP on.  The HTTP listener
+	// is disabled if it's not valid.
+	Addr netip.AddrPort
+
+	// TLSAddr is the address to serve the page over HTTPS on.  The HTTPS
+	// listener is disabled if it's not valid.
+	TLSAddr netip.AddrPort
+}
+
+// Server serves the block page.
+type Server struct {
+	tokens         *Tokens
+	filterListName func(id int64) (name string)
+	tmpl           *template.Template
+	servers        []*http.Server
+}
+
+// New returns a new properly initialized *Server.  conf must not be nil.
+func New(conf *Config) (s *Server, err error) {
+	text, err := os.ReadFile(conf.TemplatePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		text = []byte(defaultTemplate)
+	} else if err != nil {
+		return nil, fmt.Errorf("reading template: %w", err)
+	} else {
+		log.Debug("blockpage: using template from %q", conf.TemplatePath)
+	}
+
+	tmpl, err := template.New("blockpage").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+
+	s = &Server{
+		tokens:         conf.Tokens,
+		filterListName: conf.FilterListName,
+		tmpl:           tmpl,
+	}
+
+	if conf.Addr.IsValid() {
+		s.servers = append(s.servers, s.newHTTPServer(conf.Addr, nil))
+	}
+
+	if conf.TLSAddr.IsValid() {
+		s.servers = append(s.servers, s.newHTTPServer(conf.TLSAddr, conf.TLSConfig))
+	}
+
+	return s, nil
+}
+
+// newHTTPServer returns a new HTTP server of the page listening on addr.
+func (s *Server) newHTTPServer(addr netip.AddrPort, tlsConf *tls.Config) (srv *http.Server) {
+	return &http.Server{
+		Addr:              addr.String(),
+		Handler:           s,
+		TLSConfig:         tlsConf,
+		ReadHeaderTimeout: readHdrTimeout,
+	}
+}
+
+// Start starts serving the page.  The listening errors are returned, the
+// serving ones are logged.
+func (s *Server) Start() (err error) {
+	for _, srv := range s.servers {
+		var l net.Listener
+		l, err = net.Listen("tcp", srv.Addr)
+		if err != nil {
+			return fmt.Errorf("listening on %s: %w", srv.Addr, err)
+		}
+
+		if srv.TLSConfig != nil {
+			l = tls.NewListener(l, srv.TLSConfig)
+		}
+
+		log.Info("blockpage: serving on %s", srv.Addr)
+
+		go serve(srv, l)
+	}
+
+	return nil
+}
+
+// serve serves the requests from l with srv.  It's intended to be used as a
+// goroutine.
+func serve(srv *http.Server, l net.Listener) {
+	defer log.OnPanic("blockpage")
+
+	err := srv.Serve(l)
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Error("blockpage: serving on %s: %s", srv.Addr, err)
+	}
+}
+
+// Shutdown gracefully stops serving the page.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	var errs []error
+	for _, srv := range s.servers {
+		errs = append(errs, srv.Shutdown(ctx))
+	}
+
+	return errors.Annotate(errors.Join(errs...), "shutting down block page: %w")
+}
+
+// pageData is the data passed to the template of the page.
+type pageData struct {
+	// Host is the blocked domain name.
+	Host string
+
+	// Reason is the string representation of the filtering reason.
+	Reason string
+
+	// Rule is the text of the rule that blocked the request.
+	Rule string
+
+	// FilterListName is the name of the filter list containing the rule.
+	FilterListName string
+
+	// ClientName is the name of the persistent client, if any.
+	ClientName string
+
+	// FilterListID is the ID of the filter list containing the rule.
+	FilterListID int64
+
+	// Known is true if the blocked request has been found.
+	Known bool
+}
+
+// type check
+var _ http.Handler = (*Server)(nil)
+
+// ServeHTTP implements the [http.Handler] interface for *Server.  The token is
+// taken from the token query parameter or found by the client's address and
+// the requested host.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, err := netutil.SplitHost(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	data := &pageData{
+		Host: host,
+	}
+
+	info, err := s.requestInfo(r, host)
+	if err != nil {
+		log.Debug("blockpage: request for %q: %s", host, err)
+	} else {
+		data.Host = info.Host
+		data.Reason = info.Reason
+		data.Rule = info.Rule
+		data.FilterListID = info.FilterListID
+		data.FilterListName = s.filterListName(info.FilterListID)
+		data.ClientName = info.ClientName
+		data.Known = true
+	}
+
+	h := w.Header()
+	h.Set(httphdr.ContentType, "text/html; charset=utf-8")
+	h.Set(httphdr.CacheControl, "no-store")
+
+	w.WriteHeader(http.StatusForbidden)
+
+	err = s.tmpl.Execute(w, data)
+	if err != nil {
+		log.Debug("blockpage: executing template: %s", err)
+	}
+}
+
+// requestInfo returns the information about the blocked request r for host.
+func (s *Server) requestInfo(r *http.Request, host string) (info *Info, err error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing remote addr: %w", err)
+		}
+
+		var ok bool
+		token, ok = s.tokens.Token(addr.Addr(), host)
+		if !ok {
+			return nil, errors.Error("no token")
+		}
+	}
+
+	return s.tokens.Verify(token)
+}
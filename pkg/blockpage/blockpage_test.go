@@ -0,0 +1,143 @@
+package blockpage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey is the key to sign the tokens with in tests.
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// testClient is the address of the client in tests.
+var testClient = netip.MustParseAddr("192.0.2.1")
+
+func TestTokens(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	tokens := NewTokens(testKey, time.Minute)
+	tokens.now = func() (n time.Time) { return now }
+
+	info := &Info{
+		Host:         "blocked.example",
+		Reason:       "FilteredBlackList",
+		Rule:         "||blocked.example^",
+		ClientName:   "laptop",
+		FilterListID: 1,
+	}
+
+	token := tokens.Attach(testClient, info)
+
+	got, ok := tokens.Token(testClient, "BLOCKED.example")
+	require.True(t, ok)
+	assert.Equal(t, token, got)
+
+	_, ok = tokens.Token(netip.MustParseAddr("192.0.2.2"), "blocked.example")
+	assert.False(t, ok)
+
+	gotInfo, err := tokens.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, info, gotInfo)
+
+	other := NewTokens([]byte("another key"), time.Minute)
+	_, err = other.Verify(token)
+	assert.ErrorIs(t, err, ErrBadToken)
+
+	_, err = tokens.Verify("bad")
+	assert.ErrorIs(t, err, ErrBadToken)
+
+	now = now.Add(2 * time.Minute)
+	_, err = tokens.Verify(token)
+	assert.ErrorIs(t, err, ErrExpiredToken)
+}
+
+func TestServer_ServeHTTP(t *testing.T) {
+	tokens := NewTokens(testKey, time.Minute)
+	token := tokens.Attach(testClient, &Info{
+		Host:         "blocked.example",
+		Reason:       "FilteredBlackList",
+		Rule:         "||blocked.example^",
+		ClientName:   "laptop",
+		FilterListID: 1,
+	})
+
+	srv, err := New(&Config{
+		Tokens: tokens,
+		FilterListName: func(id int64) (name string) {
+			return "List <1>"
+		},
+		TemplatePath: filepath.Join(t.TempDir(), "blockpage.html"),
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		target     string
+		wantBody   []string
+	}{{
+		name:       "by_address",
+		remoteAddr: "192.0.2.1:12345",
+		target:     "http://blocked.example/some/path",
+		wantBody: []string{
+			"blocked.example",
+			"FilteredBlackList",
+			"||blocked.example^",
+			"List &lt;1&gt;",
+			"laptop",
+		},
+	}, {
+		name:       "by_token",
+		remoteAddr: "192.0.2.2:12345",
+		target:     "http://192.0.2.100/?token=" + token,
+		wantBody:   []string{"blocked.example", "laptop"},
+	}, {
+		name:       "unknown",
+		remoteAddr: "192.0.2.2:12345",
+		target:     "http://blocked.example/",
+		wantBody:   []string{"blocked.example"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			r.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+
+			srv.ServeHTTP(w, r)
+			require.Equal(t, http.StatusForbidden, w.Code)
+
+			body := w.Body.String()
+			for _, s := range tc.wantBody {
+				assert.Contains(t, body, s)
+			}
+		})
+	}
+}
+
+func TestNew_template(t *testing.T) {
+	tmplPath := filepath.Join(t.TempDir(), "blockpage.html")
+	err := os.WriteFile(tmplPath, []byte("custom {{.Host}}"), 0o600)
+	require.NoError(t, err)
+
+	srv, err := New(&Config{
+		Tokens:         NewTokens(testKey, time.Minute),
+		FilterListName: func(_ int64) (name string) { return "" },
+		TemplatePath:   tmplPath,
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "http://blocked.example/", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	assert.Equal(t, "custom blocked.example", strings.TrimSpace(w.Body.String()))
+}
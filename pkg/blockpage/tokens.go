@@ -0,0 +1,158 @@
+package blockpage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bluele/gcache"
+)
+
+// Info is the information about a blocked request shown on the block page.
+type Info struct {
+	// Host is the blocked domain name.
+	Host string `json:"host"`
+
+	// Reason is the string representation of the filtering reason.
+	Reason string `json:"reason"`
+
+	// Rule is the text of the rule that blocked the request, if any.
+	Rule string `json:"rule,omitempty"`
+
+	// ClientName is the name of the persistent client, if any.
+	ClientName string `json:"client,omitempty"`
+
+	// FilterListID is the ID of the filter list containing the rule.
+	FilterListID int64 `json:"list"`
+
+	// Expire is the Unix time at which the token expires.
+	Expire int64 `json:"exp"`
+}
+
+// maxTokens is the maximum number of the tokens kept for the clients.
+const maxTokens = 10_000
+
+// Tokens issues the short-lived signed tokens describing the blocked requests
+// and keeps them for the clients, so that the block page can find the token of
+// the request.  It is safe for concurrent use.
+type Tokens struct {
+	// issued contains the tokens by the client address and the blocked host.
+	issued gcache.Cache
+
+	// now returns the current time.
+	now func() (now time.Time)
+
+	// key is the secret key the tokens are signed with.
+	key []byte
+
+	// ttl is the lifetime of the tokens.
+	ttl time.Duration
+}
+
+// NewTokens returns a new properly initialized *Tokens.  key is the secret key
+// to sign the tokens with, it must not be empty.  ttl is the lifetime of the
+// tokens, it must be positive.
+func NewTokens(key []byte, ttl time.Duration) (t *Tokens) {
+	return &Tokens{
+		issued: gcache.New(maxTokens).LRU().Expiration(ttl).Build(),
+		now:    time.Now,
+		key:    key,
+		ttl:    ttl,
+	}
+}
+
+// tokenKey returns the key of the token issued to client for host.
+func tokenKey(client netip.Addr, host string) (key string) {
+	return client.Unmap().String() + " " + strings.ToLower(host)
+}
+
+// Attach issues a token for the request from client blocked with info and
+// keeps it for the block page.  info.Expire is set by Attach.
+func (t *Tokens) Attach(client netip.Addr, info *Info) (token string) {
+	info.Expire = t.now().Add(t.ttl).Unix()
+
+	token = t.sign(info)
+
+	err := t.issued.Set(tokenKey(client, info.Host), token)
+	if err != nil {
+		// Shouldn't happen, since the cache has no loader functions.
+		log.Debug("blockpage: storing token: %s", err)
+	}
+
+	return token
+}
+
+// Token returns the token issued to client for host, if any.
+func (t *Tokens) Token(client netip.Addr, host string) (token string, ok bool) {
+	v, err := t.issued.Get(tokenKey(client, host))
+	if err != nil {
+		return "", false
+	}
+
+	return v.(string), true
+}
+
+// sign returns the token containing info.
+func (t *Tokens) sign(info *Info) (token string) {
+	// Don't check the error, since Info is always encodable.
+	data, _ := json.Marshal(info)
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(t.mac(payload))
+}
+
+// mac returns the signature of payload.
+func (t *Tokens) mac(payload string) (sum []byte) {
+	h := hmac.New(sha256.New, t.key)
+
+	// Don't check the error, since hash.Hash never returns one.
+	_, _ = h.Write([]byte(payload))
+
+	return h.Sum(nil)
+}
+
+// ErrBadToken is returned by [Tokens.Verify] when the token is malformed or its
+// signature is invalid.
+const ErrBadToken errors.Error = "bad token"
+
+// ErrExpiredToken is returned by [Tokens.Verify] when the token has expired.
+const ErrExpiredToken errors.Error = "token expired"
+
+// Verify checks the signature and the expiration time of token and returns the
+// information it contains.
+func (t *Tokens) Verify(token string) (info *Info, err error) {
+	payload, sigStr, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrBadToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(sigStr)
+	if err != nil || !hmac.Equal(sig, t.mac(payload)) {
+		return nil, ErrBadToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+
+	info = &Info{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadToken, err)
+	}
+
+	if t.now().Unix() > info.Expire {
+		return nil, ErrExpiredToken
+	}
+
+	return info, nil
+}
@@ -1646,3 +1646,97 @@ func TestUpgradeSchema26to27(t *testing.T) {
 		})
 	}
 }
+
+func TestUpgradeSchema27to28(t *testing.T) {
+	const newSchemaVer = 28
+
+	// newRule returns a migrated forwarding rule for domain.
+	newRule := func(domain string, ups ...any) (rule yobj) {
+		return yobj{
+			"domain":             domain,
+			"comment":            "",
+			"upstreams":          yarr(ups),
+			"bootstrap_dns":      yarr{},
+			"exclude_subdomains": false,
+			"enabled":            true,
+		}
+	}
+
+	testCases := []struct {
+		in   yobj
+		want yobj
+		name string
+	}{{
+		name: "empty",
+		in:   yobj{},
+		want: yobj{
+			"schema_version": newSchemaVer,
+		},
+	}, {
+		name: "no_domain_specific",
+		in: yobj{
+			"dns": yobj{
+				"upstream_dns": yarr{"# comment", "1.1.1.1", "[//]192.168.0.1"},
+			},
+		},
+		want: yobj{
+			"dns": yobj{
+				"upstream_dns": yarr{"# comment", "1.1.1.1", "[//]192.168.0.1"},
+			},
+			"schema_version": newSchemaVer,
+		},
+	}, {
+		name: "domain_specific",
+		in: yobj{
+			"dns": yobj{
+				"upstream_dns": yarr{
+					"[/example.org/example.net/]tls://dns.example",
+					"1.1.1.1",
+					"[/*.example.com/]1.2.3.4",
+					"[/Example.org/]#",
+					"[//example.info/]5.6.7.8",
+					"[/broken.example/]",
+				},
+			},
+		},
+		want: yobj{
+			"dns": yobj{
+				"upstream_dns": yarr{
+					"1.1.1.1",
+					"[//example.info/]5.6.7.8",
+					"[/broken.example/]",
+				},
+				"forwarding_rules": yarr{
+					newRule("example.org", "tls://dns.example", "#"),
+					newRule("example.net", "tls://dns.example"),
+					newRule("*.example.com", "1.2.3.4"),
+				},
+			},
+			"schema_version": newSchemaVer,
+		},
+	}, {
+		name: "upstream_dns_file",
+		in: yobj{
+			"dns": yobj{
+				"upstream_dns":      yarr{"[/example.org/]tls://dns.example", "1.1.1.1"},
+				"upstream_dns_file": "/etc/upstreams.txt",
+			},
+		},
+		want: yobj{
+			"dns": yobj{
+				"upstream_dns":      yarr{"[/example.org/]tls://dns.example", "1.1.1.1"},
+				"upstream_dns_file": "/etc/upstreams.txt",
+			},
+			"schema_version": newSchemaVer,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := migrateTo28(tc.in)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, tc.in)
+		})
+	}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 // LastSchemaVersion is the most recent schema version.
-const LastSchemaVersion uint = 27
+const LastSchemaVersion uint = 28
 
 // Config is a the configuration for initializing a [Migrator].
 type Config struct {
@@ -123,6 +123,7 @@ func (m *Migrator) upgradeConfigSchema(current, target uint, diskConf yobj) (err
 		24: migrateTo25,
 		25: migrateTo26,
 		26: migrateTo27,
+		27: migrateTo28,
 	}
 
 	for i, migrate := range upgrades[current:target] {
@@ -0,0 +1,157 @@
+package confmigrate
+
+import (
+	"strings"
+)
+
+// migrateTo28 performs the following changes:
+//
+//	# BEFORE:
+//	'schema_version': 27
+//	'dns':
+//	  'upstream_dns':
+//	  - '[/example.org/example.net/]tls://dns.example'
+//	  - '[/*.example.com/]1.2.3.4'
+//	  - '[/example.org/]#'
+//	  - 'https://dns.adguard-dns.com/dns-query'
+//	  # …
+//	# …
+//
+//	# AFTER:
+//	'schema_version': 28
+//	'dns':
+//	  'upstream_dns':
+//	  - 'https://dns.adguard-dns.com/dns-query'
+//	  'forwarding_rules':
+//	  - 'domain': 'example.org'
+//	    'comment': ''
+//	    'upstreams':
+//	    - 'tls://dns.example'
+//	    - '#'
+//	    'bootstrap_dns': []
+//	    'exclude_subdomains': false
+//	    'enabled': true
+//	  - 'domain': 'example.net'
+//	    'comment': ''
+//	    'upstreams':
+//	    - 'tls://dns.example'
+//	    'bootstrap_dns': []
+//	    'exclude_subdomains': false
+//	    'enabled': true
+//	  - 'domain': '*.example.com'
+//	    'comment': ''
+//	    'upstreams':
+//	    - '1.2.3.4'
+//	    'bootstrap_dns': []
+//	    'exclude_subdomains': false
+//	    'enabled': true
+//	  # …
+//	# …
+//
+// The upstreams of the same domain keep their order, so the rules are
+// equivalent to the original lines.  The lines for unqualified names and the
+// lines which can't be parsed are kept as is.  Nothing is moved if
+// 'upstream_dns_file' is set, since the lines of 'upstream_dns' are ignored in
+// that case, while the forwarding rules are always applied.
+func migrateTo28(diskConf yobj) (err error) {
+	diskConf["schema_version"] = 28
+
+	dns, ok, err := fieldVal[yobj](diskConf, "dns")
+	if !ok {
+		return err
+	}
+
+	fileName, _, err := fieldVal[string](dns, "upstream_dns_file")
+	if err != nil {
+		return err
+	} else if fileName != "" {
+		return nil
+	}
+
+	upstreams, ok, err := fieldVal[yarr](dns, "upstream_dns")
+	if !ok {
+		return err
+	}
+
+	rules, _, err := fieldVal[yarr](dns, "forwarding_rules")
+	if err != nil {
+		return err
+	}
+
+	// byDomain maps the lowercased domains to their rules.
+	byDomain := map[string]yobj{}
+	kept := yarr{}
+	for _, v := range upstreams {
+		line, isStr := v.(string)
+		if !isStr {
+			kept = append(kept, v)
+
+			continue
+		}
+
+		domains, ups, isRule := parseDomainSpecificUpstream(line)
+		if !isRule {
+			kept = append(kept, v)
+
+			continue
+		}
+
+		for _, domain := range domains {
+			key := strings.ToLower(domain)
+			rule, exists := byDomain[key]
+			if !exists {
+				rule = yobj{
+					"domain":             domain,
+					"comment":            "",
+					"upstreams":          yarr{},
+					"bootstrap_dns":      yarr{},
+					"exclude_subdomains": false,
+					"enabled":            true,
+				}
+				byDomain[key] = rule
+				rules = append(rules, rule)
+			}
+
+			rule["upstreams"] = append(rule["upstreams"].(yarr), ups)
+		}
+	}
+
+	if len(byDomain) == 0 {
+		return nil
+	}
+
+	dns["upstream_dns"] = kept
+	dns["forwarding_rules"] = rules
+
+	return nil
+}
+
+// parseDomainSpecificUpstream parses the "[/domain1/../domainN/]upstream" line.
+// ok is false if line isn't a domain-specific upstream, contains an empty
+// domain, which stands for unqualified names, or can't be parsed.
+func parseDomainSpecificUpstream(line string) (domains []string, ups string, ok bool) {
+	rest, ok := strings.CutPrefix(line, "[/")
+	if !ok {
+		return nil, "", false
+	}
+
+	parts := strings.Split(rest, "/]")
+	if len(parts) != 2 {
+		return nil, "", false
+	}
+
+	ups = parts[1]
+	if ups == "" || strings.ContainsAny(ups, " \t") {
+		return nil, "", false
+	}
+
+	for _, domain := range strings.Split(parts[0], "/") {
+		if domain == "" {
+			return nil, "", false
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains, ups, true
+}
@@ -0,0 +1,54 @@
+package dnsforward
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/jynychen/AdGuardHome/pkg/blockpage"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/miekg/dns"
+)
+
+// attachBlockPageToken issues the block page token for the request blocked
+// with res, so that the block page is able to explain the blocking to the
+// client.  The tokens are only issued for the A and AAAA requests blocked by
+// the filter lists or the blocked services in the custom IP blocking mode,
+// since only those are answered with the address of the block page.
+func (s *Server) attachBlockPageToken(dctx *dnsContext, res *filtering.Result) {
+	if s.blockPageTokens == nil || res.DNSRewriteResult != nil || !res.Reason.In(
+		filtering.FilteredBlockList,
+		filtering.FilteredBlockedService,
+	) {
+		return
+	}
+
+	q := dctx.proxyCtx.Req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return
+	}
+
+	if mode, _, _ := s.dnsFilter.BlockingMode(); mode != filtering.BlockingModeCustomIP {
+		return
+	}
+
+	client := netutil.NetAddrToAddrPort(dctx.proxyCtx.Addr).Addr()
+	if !client.IsValid() {
+		return
+	}
+
+	info := &blockpage.Info{
+		Host:   strings.ToLower(strings.TrimSuffix(q.Name, ".")),
+		Reason: res.Reason.String(),
+	}
+
+	if len(res.Rules) > 0 {
+		info.Rule = res.Rules[0].Text
+		info.FilterListID = res.Rules[0].FilterListID
+	}
+
+	if dctx.setts != nil {
+		info.ClientName = dctx.setts.ClientName
+	}
+
+	s.blockPageTokens.Attach(client, info)
+}
@@ -0,0 +1,135 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/jynychen/AdGuardHome/pkg/blockpage"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_AttachBlockPageToken(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{
+		ProtectionEnabled: true,
+		BlockingMode:      filtering.BlockingModeCustomIP,
+		BlockingIPv4:      netip.MustParseAddr("192.0.2.100"),
+		BlockingIPv6:      netip.MustParseAddr("2001:db8::100"),
+	}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		Config: Config{
+			EDNSClientSubnet: &EDNSClientSubnet{Enabled: false},
+		},
+	}, nil)
+
+	tokens := blockpage.NewTokens([]byte("key"), time.Minute)
+	s.blockPageTokens = tokens
+
+	const rule = "||blocked.example^"
+
+	client := netip.MustParseAddr("192.0.2.1")
+	blockedRules := []*filtering.ResultRule{{Text: rule, FilterListID: 1}}
+
+	testCases := []struct {
+		res    *filtering.Result
+		name   string
+		host   string
+		qtype  uint16
+		wantOK bool
+	}{{
+		res: &filtering.Result{
+			Rules:      blockedRules,
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		name:   "blocked_a",
+		host:   "blocked.example",
+		qtype:  dns.TypeA,
+		wantOK: true,
+	}, {
+		res: &filtering.Result{
+			Rules:       blockedRules,
+			ServiceName: "example",
+			Reason:      filtering.FilteredBlockedService,
+			IsFiltered:  true,
+		},
+		name:   "blocked_service_aaaa",
+		host:   "service.example",
+		qtype:  dns.TypeAAAA,
+		wantOK: true,
+	}, {
+		res: &filtering.Result{
+			Rules:      blockedRules,
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		name:   "blocked_txt",
+		host:   "txt.example",
+		qtype:  dns.TypeTXT,
+		wantOK: false,
+	}, {
+		res: &filtering.Result{
+			Rules:      blockedRules,
+			Reason:     filtering.FilteredSafeBrowsing,
+			IsFiltered: true,
+		},
+		name:   "safe_browsing",
+		host:   "malware.example",
+		qtype:  dns.TypeA,
+		wantOK: false,
+	}, {
+		res: &filtering.Result{
+			DNSRewriteResult: &filtering.DNSRewriteResult{
+				RCode: dns.RcodeNameError,
+			},
+			Rules:      blockedRules,
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		name:   "dnsrewrite",
+		host:   "rewrite.example",
+		qtype:  dns.TypeA,
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: (&dns.Msg{}).SetQuestion(dns.Fqdn(tc.host), tc.qtype),
+					Addr: &net.UDPAddr{
+						IP:   client.AsSlice(),
+						Port: 12345,
+					},
+				},
+				setts: &filtering.Settings{
+					ClientName: "laptop",
+				},
+			}
+
+			s.attachBlockPageToken(dctx, tc.res)
+
+			token, ok := tokens.Token(client, tc.host)
+			require.Equal(t, tc.wantOK, ok)
+
+			if !ok {
+				return
+			}
+
+			info, err := tokens.Verify(token)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.host, info.Host)
+			assert.Equal(t, tc.res.Reason.String(), info.Reason)
+			assert.Equal(t, rule, info.Rule)
+			assert.Equal(t, "laptop", info.ClientName)
+			assert.Equal(t, int64(1), info.FilterListID)
+		})
+	}
+}
@@ -0,0 +1,535 @@
+package dnsforward
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghrenameio"
+	"github.com/miekg/dns"
+)
+
+// cacheSnapshotVersion is the version of the cache snapshot file format.
+const cacheSnapshotVersion = 1
+
+// optimisticTTL is the TTL of the expired responses served from the cache
+// snapshot, in seconds.  It's the same as the one of the optimistic cache of
+// dnsproxy.
+const optimisticTTL = 10
+
+// cacheKey is the key of a response within the cache snapshot.
+type cacheKey struct {
+	// name is the lowercased question name.
+	name string
+
+	// qtype is the question type.
+	qtype uint16
+
+	// qclass is the question class.
+	qclass uint16
+
+	// do is true if the request had the DNSSEC OK bit set.
+	do bool
+}
+
+// newCacheKey returns the key of the response to req.  req must have exactly
+// one question.
+func newCacheKey(req *dns.Msg, do bool) (k cacheKey) {
+	q := req.Question[0]
+
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		do:     do,
+	}
+}
+
+// cachedItem is a single response within the cache snapshot.
+type cachedItem struct {
+	// Msg is the packed response.
+	Msg []byte `json:"msg"`
+
+	// Upstream is the address of the upstream which resolved the response.
+	Upstream string `json:"upstream"`
+
+	// Expire is the time when the response expires, as a Unix time in
+	// seconds.
+	Expire int64 `json:"expire"`
+
+	// DO is true if the request had the DNSSEC OK bit set.
+	DO bool `json:"do"`
+
+	// key is the key of the response.
+	key cacheKey
+}
+
+// cacheSnapshotFile is the structure of the cache snapshot file.
+type cacheSnapshotFile struct {
+	// Items are the responses from the most recently used one to the least
+	// recently used one.
+	Items []*cachedItem `json:"items"`
+
+	// Version is the version of the file format.
+	Version int `json:"version"`
+}
+
+// cacheSnapshot mirrors the responses cached by dnsproxy, which doesn't allow
+// accessing its cache, so that they survive restarts and reconfigurations.
+// The restored responses are served until they expire or until dnsproxy caches
+// new ones.
+type cacheSnapshot struct {
+	// mu protects items, recent, restored, and size.
+	mu *sync.Mutex
+
+	// items maps the keys to the elements of recent.
+	items map[cacheKey]*list.Element
+
+	// recent are the recorded responses of type *cachedItem from the most
+	// recently used one to the least recently used one.
+	recent *list.List
+
+	// restored are the responses restored from the file, which haven't been
+	// served yet.
+	restored map[cacheKey]*cachedItem
+
+	// done is closed to stop saving the snapshot periodically.  It's nil if
+	// the saving isn't running.
+	done chan struct{}
+
+	// now returns the current time.
+	now func() (now time.Time)
+
+	// filePath is the path to the snapshot file.
+	filePath string
+
+	// ivl is the interval between the periodic saves.  If it's zero, the
+	// snapshot is only saved when the server stops.
+	ivl time.Duration
+
+	// size is the total size of the recorded packed responses.
+	size int
+
+	// maxSize is the maximum total size of the packed responses within the
+	// snapshot.
+	maxSize int
+
+	// minTTL and maxTTL are the overrides of the TTLs of the responses.
+	minTTL uint32
+	maxTTL uint32
+
+	// optimistic is true if the expired responses should be served.
+	optimistic bool
+}
+
+// newCacheSnapshot returns a new properly initialized *cacheSnapshot for conf.
+// It returns nil if the cache isn't persistent.
+func newCacheSnapshot(conf *ServerConfig) (cs *cacheSnapshot) {
+	if !conf.CachePersistent || conf.CacheSize == 0 || conf.CacheSnapshotFile == "" {
+		return nil
+	} else if conf.EDNSClientSubnet != nil && conf.EDNSClientSubnet.Enabled {
+		log.Info("dnsforward: cache snapshot is not supported with edns client subnet")
+
+		return nil
+	}
+
+	return &cacheSnapshot{
+		mu:         &sync.Mutex{},
+		items:      map[cacheKey]*list.Element{},
+		recent:     list.New(),
+		restored:   map[cacheKey]*cachedItem{},
+		now:        time.Now,
+		filePath:   conf.CacheSnapshotFile,
+		ivl:        conf.CachePersistentInterval.Duration,
+		maxSize:    int(conf.CacheSize),
+		minTTL:     conf.CacheMinTTL,
+		maxTTL:     conf.CacheMaxTTL,
+		optimistic: conf.CacheOptimistic,
+	}
+}
+
+// responseTTL returns the TTL the response is cached with, the same way as
+// dnsproxy does.  ttl is zero if m shouldn't be cached.
+func (cs *cacheSnapshot) responseTTL(m *dns.Msg) (ttl uint32) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+
+	found := false
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); !found || hdr.Ttl < ttl {
+				ttl, found = hdr.Ttl, true
+			}
+		}
+	}
+
+	if !found {
+		return 0
+	}
+
+	if ttl < cs.minTTL {
+		ttl = cs.minTTL
+	} else if cs.maxTTL != 0 && ttl > cs.maxTTL {
+		ttl = cs.maxTTL
+	}
+
+	return ttl
+}
+
+// record stores the response from pctx with the given key.  It's safe for
+// concurrent use.
+func (cs *cacheSnapshot) record(key cacheKey, pctx *proxy.DNSContext) {
+	resp := pctx.Res
+	if resp == nil || len(resp.Question) != 1 {
+		return
+	}
+
+	ttl := cs.responseTTL(resp)
+	if ttl == 0 {
+		return
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		log.Debug("dnsforward: cache snapshot: packing response: %s", err)
+
+		return
+	}
+
+	item := &cachedItem{
+		Msg:      packed,
+		Upstream: pctx.CachedUpstreamAddr,
+		Expire:   cs.now().Unix() + int64(ttl),
+		DO:       key.do,
+		key:      key,
+	}
+	if pctx.Upstream != nil {
+		item.Upstream = pctx.Upstream.Address()
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	// The response is now cached by dnsproxy as well.
+	delete(cs.restored, key)
+
+	if e, ok := cs.items[key]; ok {
+		cs.size -= len(e.Value.(*cachedItem).Msg)
+		cs.recent.Remove(e)
+	}
+
+	cs.items[key] = cs.recent.PushFront(item)
+	cs.size += len(packed)
+
+	for cs.size > cs.maxSize {
+		e := cs.recent.Back()
+		evicted := cs.recent.Remove(e).(*cachedItem)
+		delete(cs.items, evicted.key)
+		cs.size -= len(evicted.Msg)
+	}
+}
+
+// get returns the restored response to req with the given key.  resp is nil if
+// there is none.  expired is true if the response has expired and is served
+// optimistically.  It's safe for concurrent use.
+func (cs *cacheSnapshot) get(key cacheKey, req *dns.Msg) (resp *dns.Msg, ups string, expired bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	item, ok := cs.restored[key]
+	if !ok {
+		return nil, "", false
+	}
+
+	ttl := item.Expire - cs.now().Unix()
+	if expired = ttl <= 0; expired {
+		// Serve the expired response only once, since it's refreshed in the
+		// background.
+		delete(cs.restored, key)
+		if !cs.optimistic {
+			return nil, "", false
+		}
+
+		ttl = optimisticTTL
+	}
+
+	m := &dns.Msg{}
+	if err := m.Unpack(item.Msg); err != nil {
+		// Shouldn't happen, since the items are validated on loading.
+		delete(cs.restored, key)
+
+		return nil, "", false
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, m.Rcode)
+	resp.AuthenticatedData = m.AuthenticatedData
+	resp.RecursionAvailable = m.RecursionAvailable
+	resp.Answer = withTTL(m.Answer, uint32(ttl))
+	resp.Ns = withTTL(m.Ns, uint32(ttl))
+	resp.Extra = withTTL(m.Extra, uint32(ttl))
+
+	return resp, item.Upstream, expired
+}
+
+// withTTL returns the records of rrs except the OPT ones with the TTLs set to
+// ttl.
+func withTTL(rrs []dns.RR, ttl uint32) (res []dns.RR) {
+	for _, rr := range rrs {
+		if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+			hdr.Ttl = ttl
+			res = append(res, rr)
+		}
+	}
+
+	return res
+}
+
+// snapshotItems returns the items to save, which are the recorded responses
+// and the restored ones, within the size limit.
+func (cs *cacheSnapshot) snapshotItems() (items []*cachedItem) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := cs.now().Unix()
+	size := 0
+	add := func(item *cachedItem) (ok bool) {
+		if !cs.optimistic && item.Expire <= now {
+			return true
+		}
+
+		size += len(item.Msg)
+		if size > cs.maxSize {
+			return false
+		}
+
+		items = append(items, item)
+
+		return true
+	}
+
+	for e := cs.recent.Front(); e != nil; e = e.Next() {
+		if !add(e.Value.(*cachedItem)) {
+			return items
+		}
+	}
+
+	for key, item := range cs.restored {
+		if _, ok := cs.items[key]; !ok && !add(item) {
+			return items
+		}
+	}
+
+	return items
+}
+
+// save writes the snapshot into the file atomically.
+func (cs *cacheSnapshot) save() (err error) {
+	snap := &cacheSnapshotFile{
+		Items:   cs.snapshotItems(),
+		Version: cacheSnapshotVersion,
+	}
+
+	f, err := aghrenameio.NewPendingFile(cs.filePath, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer func() { err = aghrenameio.WithDeferredCleanup(err, f) }()
+
+	err = json.NewEncoder(f).Encode(snap)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	log.Debug("dnsforward: cache snapshot: saved %d responses", len(snap.Items))
+
+	return nil
+}
+
+// maxFileSize returns the maximum size of the snapshot file to read.  It
+// accounts for the base64 encoding of the responses and the overhead of the
+// JSON structure.
+func (cs *cacheSnapshot) maxFileSize() (n int64) {
+	const (
+		minFileSize     = 1024 * 1024
+		perItemOverhead = 128
+	)
+
+	n = int64(cs.maxSize)*2 + perItemOverhead*int64(cs.maxSize/dns.MinMsgSize+1)
+
+	return max(n, minFileSize)
+}
+
+// load restores the responses from the file.  The file which is corrupted or
+// too large is ignored.
+func (cs *cacheSnapshot) load() (err error) {
+	f, err := os.Open(cs.filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	snap := &cacheSnapshotFile{}
+	err = json.NewDecoder(io.LimitReader(f, cs.maxFileSize())).Decode(snap)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	} else if snap.Version != cacheSnapshotVersion {
+		return fmt.Errorf("unsupported version %d", snap.Version)
+	}
+
+	now := cs.now().Unix()
+	size := 0
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, item := range snap.Items {
+		if item == nil || (!cs.optimistic && item.Expire <= now) {
+			continue
+		}
+
+		size += len(item.Msg)
+		if size > cs.maxSize {
+			break
+		}
+
+		m := &dns.Msg{}
+		if m.Unpack(item.Msg) != nil || len(m.Question) != 1 {
+			continue
+		}
+
+		item.key = newCacheKey(m, item.DO)
+		if _, ok := cs.restored[item.key]; !ok {
+			cs.restored[item.key] = item
+		}
+	}
+
+	log.Debug("dnsforward: cache snapshot: restored %d responses", len(cs.restored))
+
+	return nil
+}
+
+// start starts saving the snapshot periodically, if configured.
+func (cs *cacheSnapshot) start() {
+	if cs == nil || cs.ivl == 0 || cs.done != nil {
+		return
+	}
+
+	cs.done = make(chan struct{})
+
+	go cs.savePeriodically(cs.done)
+}
+
+// stop stops saving the snapshot periodically and saves it.
+func (cs *cacheSnapshot) stop() {
+	if cs == nil {
+		return
+	}
+
+	if cs.done != nil {
+		close(cs.done)
+		cs.done = nil
+	}
+
+	err := cs.save()
+	if err != nil {
+		log.Error("dnsforward: saving cache snapshot: %s", err)
+	}
+}
+
+// savePeriodically saves the snapshot each cs.ivl until done is closed.
+func (cs *cacheSnapshot) savePeriodically(done <-chan struct{}) {
+	defer log.OnPanic("dnsforward: saving cache snapshot")
+
+	ticker := time.NewTicker(cs.ivl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := cs.save()
+			if err != nil {
+				log.Error("dnsforward: saving cache snapshot: %s", err)
+			}
+		}
+	}
+}
+
+// snapshotKey returns the key of the request from pctx within the cache
+// snapshot.  ok is false if the snapshot isn't used for the request, the same
+// way as the cache of dnsproxy isn't.
+func (s *Server) snapshotKey(pctx *proxy.DNSContext) (key cacheKey, ok bool) {
+	req := pctx.Req
+	if s.cacheSnapshot == nil ||
+		pctx.CustomUpstreamConfig != nil ||
+		req.CheckingDisabled ||
+		len(req.Question) != 1 {
+		return cacheKey{}, false
+	}
+
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	return newCacheKey(req, do), true
+}
+
+// serveFromSnapshot sets the response restored from the cache snapshot into
+// pctx, if there is one.  The expired response is refreshed in the background.
+func (s *Server) serveFromSnapshot(key cacheKey, pctx *proxy.DNSContext) (ok bool) {
+	resp, ups, expired := s.cacheSnapshot.get(key, pctx.Req)
+	if resp == nil {
+		return false
+	}
+
+	log.Debug("dnsforward: cache snapshot: serving response for %s", pctx.Req.Question[0].Name)
+
+	pctx.Res = resp
+	pctx.CachedUpstreamAddr = ups
+
+	if expired {
+		go s.refreshFromUpstream(s.cacheSnapshot, key, pctx.Req.Copy())
+	}
+
+	return true
+}
+
+// refreshFromUpstream resolves req to replace the expired response restored
+// from cs.
+func (s *Server) refreshFromUpstream(cs *cacheSnapshot, key cacheKey, req *dns.Msg) {
+	defer log.OnPanic("dnsforward: refreshing cached response")
+
+	prx := s.proxy()
+	if prx == nil {
+		return
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		StartTime: time.Now(),
+	}
+
+	err := prx.Resolve(pctx)
+	if err != nil {
+		log.Debug("dnsforward: cache snapshot: refreshing %s: %s", req.Question[0].Name, err)
+
+		return
+	}
+
+	cs.record(key, pctx)
+}
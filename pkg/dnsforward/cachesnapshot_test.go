@@ -0,0 +1,195 @@
+package dnsforward
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCacheSnapshot returns a new *cacheSnapshot saved into filePath with
+// the given settings and the current time returned by now.
+func newTestCacheSnapshot(
+	t *testing.T,
+	filePath string,
+	size uint32,
+	optimistic bool,
+	now *time.Time,
+) (cs *cacheSnapshot) {
+	t.Helper()
+
+	cs = newCacheSnapshot(&ServerConfig{
+		Config: Config{
+			CacheSize:               size,
+			CacheOptimistic:         optimistic,
+			CachePersistent:         true,
+			CachePersistentInterval: timeutil.Duration{},
+			EDNSClientSubnet:        &EDNSClientSubnet{},
+		},
+		CacheSnapshotFile: filePath,
+	})
+	require.NotNil(t, cs)
+
+	cs.now = func() (n time.Time) { return *now }
+
+	return cs
+}
+
+// newTestResolved returns a context of the resolved request for name with the
+// answer of the given TTL.
+func newTestResolved(name string, ttl uint32) (pctx *proxy.DNSContext) {
+	req := createTestMessage(name)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		A: net.IP{192, 0, 2, 1},
+	}}
+
+	return &proxy.DNSContext{
+		Req:                req,
+		Res:                resp,
+		CachedUpstreamAddr: "1.1.1.1:53",
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	const (
+		shortName = "short.example."
+		longName  = "long.example."
+	)
+
+	filePath := filepath.Join(t.TempDir(), "dnscache.json")
+	now := time.Unix(1_000_000, 0)
+
+	cs := newTestCacheSnapshot(t, filePath, 64*1024, false, &now)
+
+	short := newTestResolved(shortName, 10)
+	cs.record(newCacheKey(short.Req, false), short)
+
+	long := newTestResolved(longName, 100)
+	cs.record(newCacheKey(long.Req, false), long)
+
+	// Responses without records aren't cached.
+	empty := newTestResolved("empty.example.", 10)
+	empty.Res.Answer = nil
+	cs.record(newCacheKey(empty.Req, false), empty)
+
+	require.NoError(t, cs.save())
+
+	now = now.Add(20 * time.Second)
+
+	t.Run("restored", func(t *testing.T) {
+		restored := newTestCacheSnapshot(t, filePath, 64*1024, false, &now)
+		require.NoError(t, restored.load())
+
+		assert.Len(t, restored.restored, 1)
+
+		req := createTestMessage(longName)
+		resp, ups, expired := restored.get(newCacheKey(req, false), req)
+		require.NotNil(t, resp)
+
+		assert.False(t, expired)
+		assert.Equal(t, "1.1.1.1:53", ups)
+		assert.Equal(t, req.Id, resp.Id)
+
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, uint32(80), resp.Answer[0].Header().Ttl)
+
+		req = createTestMessage(shortName)
+		resp, _, _ = restored.get(newCacheKey(req, false), req)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("optimistic", func(t *testing.T) {
+		restored := newTestCacheSnapshot(t, filePath, 64*1024, true, &now)
+		require.NoError(t, restored.load())
+
+		assert.Len(t, restored.restored, 2)
+
+		req := createTestMessage(shortName)
+		key := newCacheKey(req, false)
+		resp, _, expired := restored.get(key, req)
+		require.NotNil(t, resp)
+
+		assert.True(t, expired)
+
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, uint32(optimisticTTL), resp.Answer[0].Header().Ttl)
+
+		// The expired response is only served once.
+		resp, _, _ = restored.get(key, req)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("other_do", func(t *testing.T) {
+		restored := newTestCacheSnapshot(t, filePath, 64*1024, false, &now)
+		require.NoError(t, restored.load())
+
+		req := createTestMessage(longName)
+		resp, _, _ := restored.get(newCacheKey(req, true), req)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("size_limit", func(t *testing.T) {
+		packed, err := long.Res.Pack()
+		require.NoError(t, err)
+
+		limited := newTestCacheSnapshot(t, filePath, uint32(len(packed)), true, &now)
+		require.NoError(t, limited.load())
+
+		// Only the most recently used response fits.
+		assert.Len(t, limited.restored, 1)
+		assert.Contains(t, limited.restored, newCacheKey(long.Req, false))
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		corruptedPath := filepath.Join(t.TempDir(), "dnscache.json")
+		err := os.WriteFile(corruptedPath, []byte(`{"items":[{"msg":`), 0o600)
+		require.NoError(t, err)
+
+		corrupted := newTestCacheSnapshot(t, corruptedPath, 64*1024, false, &now)
+		require.Error(t, corrupted.load())
+
+		assert.Empty(t, corrupted.restored)
+	})
+
+	t.Run("no_file", func(t *testing.T) {
+		missing := newTestCacheSnapshot(t, filepath.Join(t.TempDir(), "none"), 64*1024, false, &now)
+		require.NoError(t, missing.load())
+
+		assert.Empty(t, missing.restored)
+	})
+}
+
+func TestCacheSnapshot_record_evict(t *testing.T) {
+	now := time.Now()
+
+	first := newTestResolved("first.example.", 100)
+	packed, err := first.Res.Pack()
+	require.NoError(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "dnscache.json")
+	cs := newTestCacheSnapshot(t, filePath, uint32(len(packed)), false, &now)
+	cs.record(newCacheKey(first.Req, false), first)
+
+	second := newTestResolved("other.example.", 100)
+	cs.record(newCacheKey(second.Req, false), second)
+
+	assert.Equal(t, 1, cs.recent.Len())
+	assert.NotContains(t, cs.items, newCacheKey(first.Req, false))
+	assert.Contains(t, cs.items, newCacheKey(second.Req, false))
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/jynychen/AdGuardHome/pkg/aghnet"
 	"github.com/jynychen/AdGuardHome/pkg/aghtls"
 	"github.com/jynychen/AdGuardHome/pkg/client"
+	"github.com/jynychen/AdGuardHome/pkg/dnstap"
 	"github.com/jynychen/AdGuardHome/pkg/filtering"
 	"golang.org/x/exp/slices"
 )
@@ -40,6 +41,11 @@ type Config struct {
 	// nil if there are no custom upstreams for the client.
 	GetCustomUpstreamByClient func(id string) (conf *proxy.UpstreamConfig, err error) `yaml:"-"`
 
+	// GetRatelimitPolicyByClient is a callback that returns the name of the
+	// ratelimit policy attached to the persistent client with the given IP
+	// address.  It returns an empty string if there is none.
+	GetRatelimitPolicyByClient func(id string) (name string) `yaml:"-"`
+
 	// Anti-DNS amplification
 
 	// Ratelimit is the maximum number of requests per second from a given IP
@@ -49,16 +55,23 @@ type Config struct {
 	// RatelimitWhitelist is the list of whitelisted client IP addresses.
 	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`
 
+	// RatelimitPolicies are the rate limit policies attached to persistent
+	// clients and subnets.  They take precedence over Ratelimit and
+	// RatelimitWhitelist.
+	RatelimitPolicies []*RatelimitPolicy `yaml:"ratelimit_policies"`
+
 	// RefuseAny, if true, refuse ANY requests.
 	RefuseAny bool `yaml:"refuse_any"`
 
 	// Upstream DNS servers configuration
 
-	// UpstreamDNS is the list of upstream DNS servers.
+	// UpstreamDNS is the list of upstream DNS servers.  It's ignored if
+	// UpstreamDNSFileName is set.
 	UpstreamDNS []string `yaml:"upstream_dns"`
 
 	// UpstreamDNSFileName, if set, points to the file which contains upstream
-	// DNS servers.
+	// DNS servers.  It takes precedence over UpstreamDNS, but not over
+	// ForwardingRules.
 	UpstreamDNSFileName string `yaml:"upstream_dns_file"`
 
 	// BootstrapDNS is the list of bootstrap DNS servers for DoH and DoT
@@ -69,6 +82,23 @@ type Config struct {
 	// servers are not responding.
 	FallbackDNS []string `yaml:"fallback_dns"`
 
+	// ForwardingRules are the conditional forwarding rules routing the
+	// requests for the specific domains to the specific upstream servers.  The
+	// enabled rules are always applied, regardless of whether the upstreams
+	// are loaded from UpstreamDNS or from UpstreamDNSFileName.  Their upstreams
+	// are combined with the ones specified for the same domains there.
+	ForwardingRules []*ForwardingRule `yaml:"forwarding_rules"`
+
+	// UpstreamHealthCheckInterval is the interval between the health checks of
+	// the upstream DNS servers.  If it's zero, the health checking is
+	// disabled.
+	UpstreamHealthCheckInterval timeutil.Duration `yaml:"upstream_health_check_interval"`
+
+	// UpstreamHealthCheckFailures is the number of consecutive failed exchanges
+	// after which an upstream DNS server is excluded from resolving until it
+	// passes a health check.  If it's zero, the default value is used.
+	UpstreamHealthCheckFailures uint `yaml:"upstream_health_check_failures"`
+
 	// AllServers, if true, parallel queries to all configured upstream servers
 	// are enabled.
 	AllServers bool `yaml:"all_servers"`
@@ -116,6 +146,15 @@ type Config struct {
 	// CacheOptimistic defines if optimistic cache mechanism should be used.
 	CacheOptimistic bool `yaml:"cache_optimistic"`
 
+	// CachePersistent defines if the cache should be saved into the data
+	// directory and restored on startup and after reconfiguration.
+	CachePersistent bool `yaml:"cache_persistent"`
+
+	// CachePersistentInterval is the interval between the periodic saves of
+	// the persistent cache.  If it's zero, the cache is only saved when the
+	// server stops.
+	CachePersistentInterval timeutil.Duration `yaml:"cache_persistent_interval"`
+
 	// Other settings
 
 	// BogusNXDomain is the list of IP addresses, responses with them will be
@@ -129,9 +168,23 @@ type Config struct {
 	// EnableDNSSEC, if true, set AD flag in outcoming DNS request.
 	EnableDNSSEC bool `yaml:"enable_dnssec"`
 
+	// DNSSECValidation, if true, makes the server validate the DNSSEC
+	// signatures of the upstream responses itself instead of trusting the AD
+	// flag set by the upstreams.  Bogus responses are replaced with SERVFAIL.
+	DNSSECValidation bool `yaml:"dnssec_validation"`
+
+	// DNSSECTrustAnchors are the DS or DNSKEY records in presentation format
+	// used as the trust anchors for DNSSEC validation.  If empty, the root
+	// zone's key signing keys are used.
+	DNSSECTrustAnchors []string `yaml:"dnssec_trust_anchors"`
+
 	// EDNSClientSubnet is the settings list for EDNS Client Subnet.
 	EDNSClientSubnet *EDNSClientSubnet `yaml:"edns_client_subnet"`
 
+	// DNSTap is the configuration of the dnstap output.  If it's nil, the
+	// dnstap messages aren't emitted.
+	DNSTap *dnstap.Config `yaml:"dnstap"`
+
 	// MaxGoroutines is the max number of parallel goroutines for processing
 	// incoming requests.
 	MaxGoroutines uint32 `yaml:"max_goroutines"`
@@ -151,6 +204,10 @@ type Config struct {
 	// The format is the same as in [IpsetList].
 	IpsetListFileName string `yaml:"ipset_file"`
 
+	// LocalZoneFiles are the paths to the RFC 1035 zone files.  AdGuard Home
+	// answers the requests for the names within these zones authoritatively.
+	LocalZoneFiles []string `yaml:"local_zone_files"`
+
 	// BootstrapPreferIPv6, if true, instructs the bootstrapper to prefer IPv6
 	// addresses to IPv4 ones for DoH, DoQ, and DoT.
 	BootstrapPreferIPv6 bool `yaml:"bootstrap_prefer_ipv6"`
@@ -269,6 +326,10 @@ type ServerConfig struct {
 	// UseHTTP3Upstreams defines if HTTP/3 is be allowed for DNS-over-HTTPS
 	// upstreams.
 	UseHTTP3Upstreams bool
+
+	// CacheSnapshotFile is the path to the file the persistent cache is saved
+	// into.  If it's empty, the cache isn't persistent.
+	CacheSnapshotFile string
 }
 
 // createProxyConfig creates and validates configuration for the main proxy.
@@ -278,8 +339,6 @@ func (s *Server) createProxyConfig() (conf proxy.Config, err error) {
 		UDPListenAddr:          srvConf.UDPListenAddrs,
 		TCPListenAddr:          srvConf.TCPListenAddrs,
 		HTTP3:                  srvConf.ServeHTTP3,
-		Ratelimit:              int(srvConf.Ratelimit),
-		RatelimitWhitelist:     srvConf.RatelimitWhitelist,
 		RefuseAny:              srvConf.RefuseAny,
 		TrustedProxies:         srvConf.TrustedProxies,
 		CacheMinTTL:            srvConf.CacheMinTTL,
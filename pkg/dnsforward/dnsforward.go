@@ -21,8 +21,13 @@ import (
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/jynychen/AdGuardHome/pkg/aghalg"
 	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/jynychen/AdGuardHome/pkg/aghos"
+	"github.com/jynychen/AdGuardHome/pkg/alerting"
+	"github.com/jynychen/AdGuardHome/pkg/blockpage"
 	"github.com/jynychen/AdGuardHome/pkg/client"
+	"github.com/jynychen/AdGuardHome/pkg/dnstap"
 	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/jynychen/AdGuardHome/pkg/metrics"
 	"github.com/jynychen/AdGuardHome/pkg/querylog"
 	"github.com/jynychen/AdGuardHome/pkg/rdns"
 	"github.com/jynychen/AdGuardHome/pkg/stats"
@@ -142,6 +147,51 @@ type Server struct {
 	// anonymizer masks the client's IP addresses if needed.
 	anonymizer *aghnet.IPMut
 
+	// localZones answers the requests for the names within the configured
+	// local zones.  It is nil if there are no zone files configured.
+	localZones *localZones
+
+	// upsHealth checks the health of the upstream DNS servers.  It is nil if
+	// the health checking is disabled.
+	upsHealth *upstreamHealth
+
+	// dnssec validates the DNSSEC signatures of the upstream responses.  It is
+	// nil if the local validation is disabled.
+	dnssec *dnssecValidator
+
+	// customUpstreams keeps the custom upstream configurations of the clients
+	// wrapped the same way as the main one.  It is nil if there is nothing to
+	// wrap those with.
+	customUpstreams *customUpstreamConfigs
+
+	// ratelimit limits the rate of plain DNS requests from clients.  It is nil
+	// if there are no limits configured.
+	ratelimit *ratelimiter
+
+	// cacheSnapshot keeps the cached responses across restarts.  It is nil if
+	// the cache isn't persistent.
+	cacheSnapshot *cacheSnapshot
+
+	// dnstap emits the dnstap messages about the processed requests.  It is
+	// nil if the dnstap output is disabled.
+	dnstap *dnstap.Emitter
+
+	// pipeline is the request processing pipeline including the stages added
+	// by the embedders.
+	pipeline stagePipeline
+
+	// blockPageTokens keeps the block page tokens of the blocked requests.  It
+	// is nil if the block page is disabled.
+	blockPageTokens *blockpage.Tokens
+
+	// metrics are the metrics of the server.  It is nil if the metrics are
+	// not collected.
+	metrics *serverMetrics
+
+	// alerter evaluates the alerting rules over the requests counted in the
+	// statistics.  It is nil if the alerting is disabled.
+	alerter *alerting.Alerter
+
 	// clientIDCache is a temporary storage for ClientIDs that were extracted
 	// during the BeforeRequestHandler stage.
 	clientIDCache cache.Cache
@@ -179,6 +229,22 @@ type DNSCreateParams struct {
 	PrivateNets netutil.SubnetSet
 	Anonymizer  *aghnet.IPMut
 	LocalDomain string
+
+	// Metrics is the registry to register the DNS server metrics in.  If it's
+	// nil, the metrics are not collected.
+	Metrics *metrics.Registry
+
+	// Alerter evaluates the alerting rules over the requests counted in the
+	// statistics.  If it's nil, the alerting is disabled.
+	Alerter *alerting.Alerter
+
+	// Stages are the custom request processing stages.  See
+	// [Server.AddStage].
+	Stages []*CustomStage
+
+	// BlockPageTokens keeps the block page tokens of the requests blocked in
+	// the custom IP blocking mode.  If it's nil, the tokens aren't issued.
+	BlockPageTokens *blockpage.Tokens
 }
 
 const (
@@ -223,6 +289,10 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 			MaxCount:  defaultClientIDCacheCount,
 		}),
 		anonymizer: p.Anonymizer,
+		metrics:    newServerMetrics(p.Metrics),
+		alerter:    p.Alerter,
+
+		blockPageTokens: p.BlockPageTokens,
 	}
 
 	// TODO(e.burkov): Enable the refresher after the actual implementation
@@ -234,6 +304,17 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 
 	s.dhcpServer = p.DHCPServer
 
+	for _, cs := range p.Stages {
+		err = s.AddStage(cs)
+		if err != nil {
+			// Don't wrap the error, because it's informative enough as is.
+			return nil, err
+		}
+	}
+
+	// Build the pipeline of the built-in stages if there are no custom ones.
+	s.initStages()
+
 	if runtime.GOARCH == "mips" || runtime.GOARCH == "mipsle" {
 		// Use plain DNS on MIPS, encryption is too slow
 		defaultDNS = defaultBootstrap
@@ -260,6 +341,14 @@ func (s *Server) Close() {
 	if err := s.ipset.close(); err != nil {
 		log.Error("dnsforward: closing ipset: %s", err)
 	}
+
+	if s.localZones != nil {
+		if err := s.localZones.Close(); err != nil {
+			log.Error("dnsforward: %s", err)
+		}
+
+		s.localZones = nil
+	}
 }
 
 // WriteDiskConfig - write configuration
@@ -277,6 +366,18 @@ func (s *Server) WriteDiskConfig(c *Config) {
 	c.BlockedHosts = stringutil.CloneSlice(sc.BlockedHosts)
 	c.TrustedProxies = stringutil.CloneSlice(sc.TrustedProxies)
 	c.UpstreamDNS = stringutil.CloneSlice(sc.UpstreamDNS)
+	c.LocalZoneFiles = stringutil.CloneSlice(sc.LocalZoneFiles)
+	c.DNSSECTrustAnchors = stringutil.CloneSlice(sc.DNSSECTrustAnchors)
+
+	c.ForwardingRules = make([]*ForwardingRule, 0, len(sc.ForwardingRules))
+	for _, r := range sc.ForwardingRules {
+		c.ForwardingRules = append(c.ForwardingRules, r.clone())
+	}
+
+	c.RatelimitPolicies = make([]*RatelimitPolicy, 0, len(sc.RatelimitPolicies))
+	for _, p := range sc.RatelimitPolicies {
+		c.RatelimitPolicies = append(c.RatelimitPolicies, p.clone())
+	}
 }
 
 // LocalPTRResolvers returns the current local PTR resolver configuration.
@@ -430,6 +531,16 @@ func (s *Server) startLocked() error {
 	err := s.dnsProxy.Start()
 	if err == nil {
 		s.isRunning = true
+
+		if s.upsHealth != nil {
+			s.upsHealth.start()
+		}
+
+		s.cacheSnapshot.start()
+
+		if s.dnstap != nil {
+			s.dnstap.Start()
+		}
 	}
 	return err
 }
@@ -474,6 +585,10 @@ func (s *Server) setupLocalResolvers() (err error) {
 		// Only set the upstream config if there are any upstreams.  It's safe
 		// to put nil into [proxy.Config.PrivateRDNSUpstreamConfig].
 		len(uc.Upstreams)+len(uc.DomainReservedUpstreams)+len(uc.SpecifiedDomainUpstreams) > 0 {
+		if s.dnssec != nil {
+			s.dnssec.wrapUpstreams(uc)
+		}
+
 		s.dnsProxy.PrivateRDNSUpstreamConfig = uc
 	}
 
@@ -508,6 +623,30 @@ func (s *Server) Prepare(conf *ServerConfig) (err error) {
 		return err
 	}
 
+	err = s.setupLocalZones()
+	if err != nil {
+		return fmt.Errorf("preparing local zones: %w", err)
+	}
+
+	s.ratelimit, err = newRatelimiter(&s.conf.Config)
+	if err != nil {
+		return fmt.Errorf("preparing ratelimit: %w", err)
+	}
+
+	s.cacheSnapshot = newCacheSnapshot(&s.conf)
+	if s.cacheSnapshot != nil {
+		err = s.cacheSnapshot.load()
+		if err != nil {
+			// Don't fail the startup because of a broken snapshot.
+			log.Error("dnsforward: loading cache snapshot: %s", err)
+		}
+	}
+
+	s.dnstap, err = newDNSTap(s.conf.DNSTap)
+	if err != nil {
+		return fmt.Errorf("preparing dnstap: %w", err)
+	}
+
 	var proxyConfig proxy.Config
 	proxyConfig, err = s.createProxyConfig()
 	if err != nil {
@@ -554,6 +693,36 @@ func (s *Server) Prepare(conf *ServerConfig) (err error) {
 	return nil
 }
 
+// setupLocalZones loads the configured local zones replacing the previous
+// ones.  For internal use only.
+func (s *Server) setupLocalZones() (err error) {
+	if s.localZones != nil {
+		err = s.localZones.Close()
+		if err != nil {
+			log.Error("dnsforward: %s", err)
+		}
+
+		s.localZones = nil
+	}
+
+	files := stringutil.FilterOut(s.conf.LocalZoneFiles, IsCommentOrEmpty)
+	if len(files) == 0 {
+		return nil
+	}
+
+	w, err := aghos.NewOSWritesWatcher()
+	if err != nil {
+		return fmt.Errorf("initializing watcher: %w", err)
+	}
+
+	s.localZones, err = newLocalZones(w, files)
+	if err != nil {
+		return errors.WithDeferred(err, w.Close())
+	}
+
+	return nil
+}
+
 // setupFallbackDNS initializes the fallback DNS servers.
 func (s *Server) setupFallbackDNS() (err error) {
 	fallbacks := s.conf.FallbackDNS
@@ -572,6 +741,10 @@ func (s *Server) setupFallbackDNS() (err error) {
 		return err
 	}
 
+	if s.dnssec != nil {
+		s.dnssec.wrapUpstreams(uc)
+	}
+
 	s.dnsProxy.Fallbacks = uc
 
 	return nil
@@ -672,6 +845,10 @@ func (s *Server) stopLocked() (err error) {
 	// This will require filtering all the non-critical errors in
 	// [upstream.Upstream] implementations.
 
+	if s.upsHealth != nil {
+		s.upsHealth.stop()
+	}
+
 	if s.dnsProxy != nil {
 		err = s.dnsProxy.Stop()
 		if err != nil {
@@ -679,6 +856,15 @@ func (s *Server) stopLocked() (err error) {
 		}
 	}
 
+	// Save the cache snapshot after the proxy has stopped, so that it contains
+	// the latest responses.
+	s.cacheSnapshot.stop()
+
+	if s.dnstap != nil {
+		s.dnstap.Close()
+		s.dnstap = nil
+	}
+
 	if upsConf := s.internalProxy.UpstreamConfig; upsConf != nil {
 		err = upsConf.Close()
 		if err != nil {
@@ -0,0 +1,989 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/jynychen/AdGuardHome/pkg/querylog"
+	"github.com/miekg/dns"
+)
+
+// dnssecMaxCacheSize is the maximum number of zone cuts kept in the cache of
+// the DNSSEC validator.  The cache is cleared once the size is exceeded.
+const dnssecMaxCacheSize = 10_000
+
+// dnssecMaxCacheTTL is the maximum duration for which the validated DNSKEY and
+// DS results are cached regardless of the TTLs of the records.
+const dnssecMaxCacheTTL = 1 * time.Hour
+
+// dnssecUDPSize is the UDP payload size advertised in the requests sent by the
+// DNSSEC validator.
+const dnssecUDPSize = 4096
+
+// defaultTrustAnchors are the DS records of the key signing keys of the root
+// zone.
+//
+// See https://data.iana.org/root-anchors/root-anchors.xml.
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// zoneCutKind is the kind of a name on the way from a trust anchor down to
+// the validated name.
+type zoneCutKind uint8
+
+const (
+	// zoneCutNone means that the name isn't a zone cut.
+	zoneCutNone zoneCutKind = iota
+
+	// zoneCutSecure means that the name is the apex of a signed zone with a
+	// validated DNSKEY RRset.
+	zoneCutSecure
+
+	// zoneCutInsecure means that the name is proven to be the apex of an
+	// unsigned zone or of a zone signed with unsupported algorithms only.
+	zoneCutInsecure
+)
+
+// zoneCut is the cached validation result for a single name.
+type zoneCut struct {
+	// expire is the time when the result should be validated again.
+	expire time.Time
+
+	// keys are the validated keys of the zone if kind is [zoneCutSecure].
+	keys []*dns.DNSKEY
+
+	// kind is the kind of the name.
+	kind zoneCutKind
+}
+
+// dnssecValidator validates the DNSSEC signatures of the responses by building
+// the chain of trust from the configured trust anchors.  The DNSKEY and DS
+// records are requested from the same upstream which sent the response.
+type dnssecValidator struct {
+	// mu protects cache.
+	mu *sync.Mutex
+
+	// cache maps lowercased names to the validation results for them.
+	cache map[string]*zoneCut
+
+	// anchors maps lowercased zone names to their trusted DS records.
+	anchors map[string][]*dns.DS
+
+	// now returns the current time.  It's used to check the validity periods
+	// of the signatures and the cache entries.
+	now func() (now time.Time)
+}
+
+// newDNSSECValidator returns a new properly initialized *dnssecValidator.
+// anchors are the DS or DNSKEY records in presentation format, if anchors are
+// empty, [defaultTrustAnchors] are used.
+func newDNSSECValidator(anchors []string) (v *dnssecValidator, err error) {
+	anchors = stringutil.FilterOut(anchors, IsCommentOrEmpty)
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors
+	}
+
+	v = &dnssecValidator{
+		mu:      &sync.Mutex{},
+		cache:   map[string]*zoneCut{},
+		anchors: map[string][]*dns.DS{},
+		now:     time.Now,
+	}
+
+	for i, a := range anchors {
+		var ds *dns.DS
+		ds, err = parseTrustAnchor(a)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor at index %d: %w", i, err)
+		}
+
+		name := strings.ToLower(ds.Hdr.Name)
+		v.anchors[name] = append(v.anchors[name], ds)
+	}
+
+	return v, nil
+}
+
+// parseTrustAnchor parses the DS or DNSKEY record from s.  DNSKEY records are
+// converted to DS records using the SHA-256 digest.
+func parseTrustAnchor(s string) (ds *dns.DS, err error) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	switch rr := rr.(type) {
+	case *dns.DS:
+		return rr, nil
+	case *dns.DNSKEY:
+		ds = rr.ToDS(dns.SHA256)
+		if ds == nil {
+			return nil, errors.Error("cannot compute digest of dnskey")
+		}
+
+		return ds, nil
+	case nil:
+		return nil, errors.Error("no record")
+	default:
+		return nil, fmt.Errorf("bad record type %s, want DS or DNSKEY", dns.Type(rr.Header().Rrtype))
+	}
+}
+
+// wrapUpstreams replaces each upstream within conf with the one validating its
+// responses.  conf must not be nil.
+func (v *dnssecValidator) wrapUpstreams(conf *proxy.UpstreamConfig) {
+	v.wrapUpstreamList(conf.Upstreams)
+
+	for _, ups := range conf.DomainReservedUpstreams {
+		v.wrapUpstreamList(ups)
+	}
+
+	for _, ups := range conf.SpecifiedDomainUpstreams {
+		v.wrapUpstreamList(ups)
+	}
+}
+
+// wrapUpstreamList replaces each upstream within upstreams with the one
+// validating its responses.
+func (v *dnssecValidator) wrapUpstreamList(upstreams []upstream.Upstream) {
+	for i, u := range upstreams {
+		if _, ok := u.(*validatingUpstream); ok {
+			continue
+		}
+
+		upstreams[i] = &validatingUpstream{
+			Upstream:  u,
+			validator: v,
+		}
+	}
+}
+
+// validate validates the DNSSEC signatures of resp requesting the necessary
+// records from u.  err describes the reason why the response is bogus.
+func (v *dnssecValidator) validate(
+	u upstream.Upstream,
+	resp *dns.Msg,
+) (status querylog.DNSSECStatus, err error) {
+	if len(resp.Question) == 0 ||
+		(resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		// There is nothing to validate.
+		return querylog.DNSSECStatusInsecure, nil
+	}
+
+	now := v.now()
+
+	ansSets, nsSets := splitRRsets(resp.Answer), splitRRsets(resp.Ns)
+
+	ansSecure, err := v.validateSection(u, ansSets, true, now)
+	if err != nil {
+		return querylog.DNSSECStatusBogus, fmt.Errorf("answer: %w", err)
+	}
+
+	nsSecure, err := v.validateSection(u, nsSets, false, now)
+	if err != nil {
+		return querylog.DNSSECStatusBogus, fmt.Errorf("authority: %w", err)
+	} else if !ansSecure {
+		return querylog.DNSSECStatusInsecure, nil
+	}
+
+	secure, err := checkExpansions(ansSets, nsSets)
+	if err != nil {
+		return querylog.DNSSECStatusBogus, fmt.Errorf("answer: %w", err)
+	}
+
+	secure = secure && nsSecure
+
+	q := resp.Question[0]
+	target, answered := answerTarget(ansSets, strings.ToLower(q.Name), q.Qtype)
+	if answered {
+		return statusFromBool(secure), nil
+	}
+
+	return v.validateDenial(u, nsSets, target, q.Qtype, resp.Rcode == dns.RcodeNameError, secure, now)
+}
+
+// validateDenial validates the denial of existence of the records of qtype for
+// the lowercased target name using the validated RRsets of the authority
+// section.  secure is the status of the rest of the response.
+func (v *dnssecValidator) validateDenial(
+	u upstream.Upstream,
+	nsSets []*rrset,
+	target string,
+	qtype uint16,
+	nxDomain bool,
+	secure bool,
+	now time.Time,
+) (status querylog.DNSSECStatus, err error) {
+	proof := newDenialProof(nsSets, target)
+	if !proof.isEmpty() {
+		var proven bool
+		proven, err = proof.denial(target, qtype, nxDomain)
+		if err != nil {
+			return querylog.DNSSECStatusBogus, fmt.Errorf("denial of %q: %w", target, err)
+		}
+
+		return statusFromBool(secure && proven), nil
+	}
+
+	// The negative response isn't signed, so make sure it's expected to be.
+	keys, _, err := v.chain(u, target, now)
+	if err != nil {
+		return querylog.DNSSECStatusBogus, err
+	} else if keys != nil {
+		return querylog.DNSSECStatusBogus, fmt.Errorf("no proof of denial of %q", target)
+	}
+
+	return querylog.DNSSECStatusInsecure, nil
+}
+
+// checkExpansions checks that the validated RRsets of the answer section
+// synthesized from the wildcards are proven to be synthesized correctly by the
+// validated RRsets of the authority section.  secure is false if some of the
+// proofs rely on the unsupported records.
+func checkExpansions(ansSets, nsSets []*rrset) (secure bool, err error) {
+	secure = true
+	for _, set := range ansSets {
+		ce, ok := wildcardEncloser(set)
+		if !ok {
+			continue
+		}
+
+		ok, err = newDenialProof(nsSets, set.name).expansion(set.name, ce)
+		if err != nil {
+			return false, fmt.Errorf("%s %s: wildcard expansion: %w", set.name, dns.Type(set.rrType), err)
+		}
+
+		secure = secure && ok
+	}
+
+	return secure, nil
+}
+
+// answerTarget follows the chain of CNAME RRsets starting from the lowercased
+// qname and returns the lowercased name it ends with.  answered is true if
+// sets contain the records of qtype for target.
+func answerTarget(sets []*rrset, qname string, qtype uint16) (target string, answered bool) {
+	target = qname
+
+	// Limit the number of steps to break the loops.
+	for range sets {
+		var cname *rrset
+		for _, set := range sets {
+			if set.name != target {
+				continue
+			} else if set.rrType == qtype || qtype == dns.TypeANY {
+				return target, true
+			} else if set.rrType == dns.TypeCNAME {
+				cname = set
+			}
+		}
+
+		if cname == nil {
+			break
+		}
+
+		target = strings.ToLower(cname.rrs[0].(*dns.CNAME).Target)
+	}
+
+	return target, false
+}
+
+// statusFromBool returns the secure status if secure is true and the insecure
+// one otherwise.
+func statusFromBool(secure bool) (status querylog.DNSSECStatus) {
+	if secure {
+		return querylog.DNSSECStatusSecure
+	}
+
+	return querylog.DNSSECStatusInsecure
+}
+
+// validateSection validates the RRsets within a section of a response.
+// secure is true if all the RRsets of the section are secure.  If strict is
+// true, the unsigned RRsets from the signed zones are considered bogus,
+// otherwise those are ignored.
+func (v *dnssecValidator) validateSection(
+	u upstream.Upstream,
+	sets []*rrset,
+	strict bool,
+	now time.Time,
+) (secure bool, err error) {
+	secure = true
+	for _, set := range sets {
+		var ok bool
+		if len(set.sigs) > 0 {
+			ok, err = v.verifyRRset(u, set, now)
+		} else if strict {
+			ok, err = v.checkUnsigned(u, set.name, now)
+		} else {
+			continue
+		}
+
+		if err != nil {
+			return false, fmt.Errorf("%s %s: %w", set.name, dns.Type(set.rrType), err)
+		}
+
+		secure = secure && ok
+	}
+
+	return secure, nil
+}
+
+// checkUnsigned returns an error if name belongs to a signed zone, since the
+// records for it must be signed.
+func (v *dnssecValidator) checkUnsigned(u upstream.Upstream, name string, now time.Time) (ok bool, err error) {
+	keys, _, err := v.chain(u, name, now)
+	if err != nil {
+		return false, err
+	} else if keys != nil {
+		return false, errors.Error("no signatures")
+	}
+
+	return false, nil
+}
+
+// rrset is a set of records with the same owner name, type, and class along
+// with the signatures covering them.
+type rrset struct {
+	// name is the lowercased owner name of the RRset.
+	name string
+
+	// rrs are the records of the RRset.
+	rrs []dns.RR
+
+	// sigs are the signatures covering the RRset.
+	sigs []*dns.RRSIG
+
+	// signer is the lowercased name of the zone, which signature of the RRset
+	// has been verified.  It's empty if the RRset isn't verified.
+	signer string
+
+	// rrType is the type of the records.
+	rrType uint16
+
+	// class is the class of the records.
+	class uint16
+
+	// labels is the number of labels of the original owner name from the
+	// verified signature.  It's less than the number of labels of name, if the
+	// RRset has been synthesized from a wildcard.
+	labels uint8
+}
+
+// splitRRsets groups the records of the section into RRsets keeping their
+// order.
+func splitRRsets(section []dns.RR) (sets []*rrset) {
+	find := func(name string, rrType, class uint16) (set *rrset) {
+		for _, set = range sets {
+			if set.name == name && set.rrType == rrType && set.class == class {
+				return set
+			}
+		}
+
+		set = &rrset{name: name, rrType: rrType, class: class}
+		sets = append(sets, set)
+
+		return set
+	}
+
+	for _, rr := range section {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			set := find(name, sig.TypeCovered, hdr.Class)
+			set.sigs = append(set.sigs, sig)
+		} else if hdr.Rrtype != dns.TypeOPT {
+			set := find(name, hdr.Rrtype, hdr.Class)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+
+	// Drop the signatures without the covered records.
+	filtered := sets[:0]
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			filtered = append(filtered, set)
+		}
+	}
+
+	return filtered
+}
+
+// verifyRRset verifies the signatures of set using the keys of the signer
+// zones and remembers the verified signer within set.  secure is false if the
+// signer zone is proven to be insecure.
+func (v *dnssecValidator) verifyRRset(u upstream.Upstream, set *rrset, now time.Time) (secure bool, err error) {
+	err = errors.Error("no valid signatures")
+	for _, sig := range set.sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dns.IsSubDomain(signer, set.name) {
+			err = fmt.Errorf("signer %q is not a parent of owner", signer)
+
+			continue
+		}
+
+		keys, zone, chainErr := v.chain(u, signer, now)
+		if chainErr != nil {
+			return false, chainErr
+		} else if keys == nil {
+			return false, nil
+		} else if zone != signer {
+			err = fmt.Errorf("signer %q is not a zone apex", signer)
+
+			continue
+		}
+
+		err = verifySig(sig, keys, set.rrs, now)
+		if err == nil {
+			set.signer, set.labels = signer, sig.Labels
+
+			return true, nil
+		}
+	}
+
+	return false, err
+}
+
+// verifySig returns nil if sig is a valid signature of rrs made with one of
+// keys.
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR, now time.Time) (err error) {
+	if !sig.ValidityPeriod(now) {
+		return fmt.Errorf("signature with key tag %d is expired or not yet valid", sig.KeyTag)
+	}
+
+	err = fmt.Errorf("no key with tag %d", sig.KeyTag)
+	for _, k := range keys {
+		if k.Flags&dns.ZONE == 0 || k.Algorithm != sig.Algorithm || k.KeyTag() != sig.KeyTag {
+			continue
+		}
+
+		err = sig.Verify(k, rrs)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("verifying signature: %w", err)
+}
+
+// chain builds the chain of trust from the closest trust anchor down to the
+// lowercased name.  keys are the validated keys of the closest secure zone
+// enclosing name, which apex is zone.  keys are nil if there is an insecure
+// delegation between the anchor and name or if there is no anchor for name.
+func (v *dnssecValidator) chain(
+	u upstream.Upstream,
+	name string,
+	now time.Time,
+) (keys []*dns.DNSKEY, zone string, err error) {
+	zone = v.closestAnchor(name)
+	if zone == "" {
+		return nil, "", nil
+	}
+
+	cut, err := v.anchorCut(u, zone, now)
+	if err != nil {
+		return nil, "", fmt.Errorf("trust anchor %q: %w", zone, err)
+	} else if cut.kind != zoneCutSecure {
+		return nil, zone, nil
+	}
+
+	keys = cut.keys
+
+	var names []string
+	for n := name; n != zone; n = parentName(n) {
+		names = append(names, n)
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		child := names[i]
+		cut, err = v.delegation(u, child, zone, keys, now)
+		if err != nil {
+			return nil, "", fmt.Errorf("delegation to %q: %w", child, err)
+		}
+
+		switch cut.kind {
+		case zoneCutSecure:
+			keys, zone = cut.keys, child
+		case zoneCutInsecure:
+			return nil, child, nil
+		default:
+			// Go on.
+		}
+	}
+
+	return keys, zone, nil
+}
+
+// closestAnchor returns the name of the closest trust anchor enclosing the
+// lowercased name or an empty string if there is none.
+func (v *dnssecValidator) closestAnchor(name string) (zone string) {
+	for n := name; n != ""; n = parentName(n) {
+		if _, ok := v.anchors[n]; ok {
+			return n
+		}
+	}
+
+	return ""
+}
+
+// anchorCut returns the validation result for the zone of a trust anchor.
+func (v *dnssecValidator) anchorCut(u upstream.Upstream, zone string, now time.Time) (cut *zoneCut, err error) {
+	if cut = v.cached(zone, now); cut != nil {
+		return cut, nil
+	}
+
+	keys, ttl, err := v.zoneKeys(u, zone, v.anchors[zone], now)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return v.store(zone, keys, zoneCutInsecure, ttl, now), nil
+}
+
+// delegation returns the validation result for the lowercased child name
+// using the validated keys of the enclosing parent zone.
+func (v *dnssecValidator) delegation(
+	u upstream.Upstream,
+	child string,
+	parent string,
+	parentKeys []*dns.DNSKEY,
+	now time.Time,
+) (cut *zoneCut, err error) {
+	if cut = v.cached(child, now); cut != nil {
+		return cut, nil
+	}
+
+	resp, err := v.query(u, child, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, set := range splitRRsets(resp.Answer) {
+		if set.name != child {
+			continue
+		} else if set.rrType == dns.TypeCNAME {
+			// An alias can't be a zone cut.
+			return v.store(child, nil, zoneCutNone, minTTL(set.rrs), now), nil
+		} else if set.rrType != dns.TypeDS {
+			continue
+		}
+
+		err = verifyWithParent(set, parent, parentKeys, now)
+		if err != nil {
+			return nil, fmt.Errorf("ds: %w", err)
+		}
+
+		dss := make([]*dns.DS, 0, len(set.rrs))
+		for _, rr := range set.rrs {
+			dss = append(dss, rr.(*dns.DS))
+		}
+
+		keys, ttl, keysErr := v.zoneKeys(u, child, dss, now)
+		if keysErr != nil {
+			return nil, keysErr
+		}
+
+		return v.store(child, keys, zoneCutInsecure, min(ttl, minTTL(set.rrs)), now), nil
+	}
+
+	// There are no DS records, so the denial must be signed by the parent.
+	var denial []dns.RR
+	for _, set := range splitRRsets(resp.Ns) {
+		if len(set.sigs) == 0 {
+			continue
+		}
+
+		err = verifyWithParent(set, parent, parentKeys, now)
+		if err != nil {
+			return nil, fmt.Errorf("denial of ds: %w", err)
+		}
+
+		denial = append(denial, set.rrs...)
+	}
+
+	if len(denial) == 0 {
+		return nil, errors.Error("no signatures for denial of ds")
+	}
+
+	return v.store(child, nil, delegationKind(denial, child), minTTL(denial), now), nil
+}
+
+// verifyWithParent verifies the signatures of set made by the parent zone.
+func verifyWithParent(set *rrset, parent string, parentKeys []*dns.DNSKEY, now time.Time) (err error) {
+	err = errors.Error("no signatures by parent zone")
+	for _, sig := range set.sigs {
+		if strings.ToLower(sig.SignerName) != parent {
+			continue
+		}
+
+		err = verifySig(sig, parentKeys, set.rrs, now)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// delegationKind returns the kind of the lowercased name according to the
+// validated NSEC and NSEC3 records from the denial of its DS records.  The name
+// is an insecure delegation if the type bitmap for it contains NS but not SOA,
+// or if it's covered by an opt-out NSEC3 record.
+func delegationKind(denial []dns.RR, name string) (kind zoneCutKind) {
+	optOut := false
+	for _, rr := range denial {
+		var types []uint16
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.ToLower(rr.Hdr.Name) != name {
+				continue
+			}
+
+			types = rr.TypeBitMap
+		case *dns.NSEC3:
+			if !rr.Match(name) {
+				optOut = optOut || (rr.Flags&1 == 1 && rr.Cover(name))
+
+				continue
+			}
+
+			types = rr.TypeBitMap
+		default:
+			continue
+		}
+
+		if hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA) {
+			return zoneCutInsecure
+		}
+
+		return zoneCutNone
+	}
+
+	if optOut {
+		return zoneCutInsecure
+	}
+
+	return zoneCutNone
+}
+
+// hasType returns true if types contain t.
+func hasType(types []uint16, t uint16) (ok bool) {
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// zoneKeys requests the DNSKEY records of the lowercased zone and validates
+// them against dss.  keys are nil if none of dss is supported.  ttl is the
+// minimum TTL of the keys.
+func (v *dnssecValidator) zoneKeys(
+	u upstream.Upstream,
+	zone string,
+	dss []*dns.DS,
+	now time.Time,
+) (keys []*dns.DNSKEY, ttl uint32, err error) {
+	supported := dss[:0:0]
+	for _, ds := range dss {
+		if isSupportedDS(ds) {
+			supported = append(supported, ds)
+		}
+	}
+
+	if len(supported) == 0 {
+		log.Debug("dnsforward: dnssec: no supported ds for %q, treating as insecure", zone)
+
+		return nil, uint32(dnssecMaxCacheTTL.Seconds()), nil
+	}
+
+	resp, err := v.query(u, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var set *rrset
+	for _, s := range splitRRsets(resp.Answer) {
+		if s.name == zone && s.rrType == dns.TypeDNSKEY {
+			set = s
+
+			break
+		}
+	}
+
+	if set == nil {
+		return nil, 0, fmt.Errorf("no dnskey records for %q", zone)
+	}
+
+	keys = make([]*dns.DNSKEY, 0, len(set.rrs))
+	for _, rr := range set.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	trusted := trustedKeys(keys, supported)
+	if len(trusted) == 0 {
+		return nil, 0, fmt.Errorf("no dnskey of %q matches ds", zone)
+	}
+
+	err = errors.Error("no valid signatures by trusted keys")
+	for _, sig := range set.sigs {
+		err = verifySig(sig, trusted, set.rrs, now)
+		if err == nil {
+			return keys, minTTL(set.rrs), nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("dnskey of %q: %w", zone, err)
+}
+
+// isSupportedDS returns true if both the algorithm and the digest type of ds
+// are supported by the validator.
+func isSupportedDS(ds *dns.DS) (ok bool) {
+	switch ds.Algorithm {
+	case
+		dns.RSASHA1,
+		dns.RSASHA1NSEC3SHA1,
+		dns.RSASHA256,
+		dns.RSASHA512,
+		dns.ECDSAP256SHA256,
+		dns.ECDSAP384SHA384,
+		dns.ED25519:
+		// Go on.
+	default:
+		return false
+	}
+
+	switch ds.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	default:
+		return false
+	}
+}
+
+// trustedKeys returns the keys matching any of dss.
+func trustedKeys(keys []*dns.DNSKEY, dss []*dns.DS) (trusted []*dns.DNSKEY) {
+	for _, k := range keys {
+		tag := k.KeyTag()
+		for _, ds := range dss {
+			if tag != ds.KeyTag || k.Algorithm != ds.Algorithm {
+				continue
+			}
+
+			if kds := k.ToDS(ds.DigestType); kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+				trusted = append(trusted, k)
+
+				break
+			}
+		}
+	}
+
+	return trusted
+}
+
+// minTTL returns the minimum TTL of rrs.
+func minTTL(rrs []dns.RR) (ttl uint32) {
+	ttl = uint32(dnssecMaxCacheTTL.Seconds())
+	for _, rr := range rrs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	return ttl
+}
+
+// query sends the DNSSEC-enabled request for name and qtype to u.  The
+// checking is disabled, since the response is validated locally.
+func (v *dnssecValidator) query(u upstream.Upstream, name string, qtype uint16) (resp *dns.Msg, err error) {
+	req := (&dns.Msg{}).SetQuestion(name, qtype)
+	req.CheckingDisabled = true
+	req.SetEdns0(dnssecUDPSize, true)
+
+	resp, err = u.Exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("querying %s %q: %w", dns.Type(qtype), name, err)
+	} else if rc := resp.Rcode; rc != dns.RcodeSuccess && rc != dns.RcodeNameError {
+		return nil, fmt.Errorf("querying %s %q: unexpected rcode %s", dns.Type(qtype), name, dns.RcodeToString[rc])
+	}
+
+	return resp, nil
+}
+
+// cached returns the unexpired cached result for the lowercased name, if any.
+func (v *dnssecValidator) cached(name string, now time.Time) (cut *zoneCut) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	cut = v.cache[name]
+	if cut == nil || now.After(cut.expire) {
+		return nil
+	}
+
+	return cut
+}
+
+// store caches the result for the lowercased name and returns it.  The kind
+// is [zoneCutSecure] if keys aren't empty and noKeysKind otherwise.
+func (v *dnssecValidator) store(
+	name string,
+	keys []*dns.DNSKEY,
+	noKeysKind zoneCutKind,
+	ttl uint32,
+	now time.Time,
+) (cut *zoneCut) {
+	cut = &zoneCut{
+		expire: now.Add(time.Duration(ttl) * time.Second),
+		keys:   keys,
+		kind:   noKeysKind,
+	}
+
+	if len(keys) > 0 {
+		cut.kind = zoneCutSecure
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.cache) >= dnssecMaxCacheSize {
+		v.cache = map[string]*zoneCut{}
+	}
+
+	v.cache[name] = cut
+
+	return cut
+}
+
+// validatingUpstream is an [upstream.Upstream] which validates the DNSSEC
+// signatures of the responses.  The secure responses have the AD flag set and
+// the bogus ones are replaced with SERVFAIL containing an Extended DNS Error.
+type validatingUpstream struct {
+	upstream.Upstream
+
+	// validator validates the responses.
+	validator *dnssecValidator
+}
+
+// type check
+var _ upstream.Upstream = (*validatingUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for
+// *validatingUpstream.  The requests with the CD flag set are passed as is.
+func (u *validatingUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if req.CheckingDisabled {
+		return u.Upstream.Exchange(req)
+	}
+
+	r := req.Copy()
+	r.CheckingDisabled = true
+	if o := r.IsEdns0(); o != nil {
+		o.SetDo()
+	} else {
+		r.SetEdns0(dnssecUDPSize, true)
+	}
+
+	resp, err = u.Upstream.Exchange(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.CheckingDisabled = false
+
+	status, err := u.validator.validate(u.Upstream, resp)
+	switch status {
+	case querylog.DNSSECStatusSecure:
+		resp.AuthenticatedData = true
+	case querylog.DNSSECStatusBogus:
+		log.Debug("dnsforward: dnssec: bogus response for %q: %s", req.Question[0].Name, err)
+
+		return newBogusResponse(req, err), nil
+	default:
+		resp.AuthenticatedData = false
+	}
+
+	return resp, nil
+}
+
+// newBogusResponse returns a SERVFAIL response to req with the Extended DNS
+// Error describing the validation failure.  The OPT record is always added and
+// should be removed if the client hasn't sent one.
+func newBogusResponse(req *dns.Msg, validationErr error) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure)
+	resp.RecursionAvailable = true
+
+	resp.SetEdns0(dnssecUDPSize, true)
+	o := resp.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeDNSBogus,
+		ExtraText: validationErr.Error(),
+	})
+
+	return resp
+}
+
+// isBogusResponse returns true if resp contains the Extended DNS Error added
+// by [newBogusResponse].
+func isBogusResponse(resp *dns.Msg) (ok bool) {
+	if resp.Rcode != dns.RcodeServerFailure {
+		return false
+	}
+
+	o := resp.IsEdns0()
+	if o == nil {
+		return false
+	}
+
+	for _, opt := range o.Option {
+		if ede, isEDE := opt.(*dns.EDNS0_EDE); isEDE && ede.InfoCode == dns.ExtendedErrorCodeDNSBogus {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setDNSSECStatus sets the status of the local DNSSEC validation of the
+// upstream response within dctx.  The AD bit of the response is trusted, since
+// all the upstreams, including the fallback, private, and custom ones, are
+// wrapped with [validatingUpstream], which sets it according to the validation
+// result.  hadEDNS is true if the original request contained the OPT record,
+// otherwise the one added for validation is removed.
+func (s *Server) setDNSSECStatus(dctx *dnsContext, hadEDNS bool) {
+	pctx := dctx.proxyCtx
+	if s.dnssec == nil || pctx.Req.CheckingDisabled {
+		return
+	}
+
+	switch resp := pctx.Res; {
+	case isBogusResponse(resp):
+		dctx.dnssecStatus = querylog.DNSSECStatusBogus
+	case resp.AuthenticatedData:
+		dctx.dnssecStatus = querylog.DNSSECStatusSecure
+	default:
+		dctx.dnssecStatus = querylog.DNSSECStatusInsecure
+	}
+
+	if hadEDNS {
+		return
+	}
+
+	extra := pctx.Res.Extra[:0]
+	for _, rr := range pctx.Res.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+
+	pctx.Res.Extra = extra
+}
@@ -0,0 +1,464 @@
+package dnsforward
+
+import (
+	"crypto"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/jynychen/AdGuardHome/pkg/aghtest"
+	"github.com/jynychen/AdGuardHome/pkg/querylog"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZoneSigner signs the records of a test zone.
+type testZoneSigner struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	zone string
+}
+
+// newTestZoneSigner generates a new key for zone.
+func newTestZoneSigner(t *testing.T, zone string) (zs *testZoneSigner) {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	return &testZoneSigner{
+		key:  key,
+		priv: priv.(crypto.Signer),
+		zone: zone,
+	}
+}
+
+// sign returns rrs followed by their signature.  rrs must be an RRset.
+func (zs *testZoneSigner) sign(t *testing.T, rrs ...dns.RR) (signed []dns.RR) {
+	t.Helper()
+
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrs[0].Header().Ttl,
+		},
+		Algorithm:  zs.key.Algorithm,
+		SignerName: zs.zone,
+		KeyTag:     zs.key.KeyTag(),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+
+	err := sig.Sign(zs.priv, rrs)
+	require.NoError(t, err)
+
+	return append(rrs, sig)
+}
+
+// ds returns the DS record for the key of zs.
+func (zs *testZoneSigner) ds() (ds *dns.DS) {
+	ds = zs.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	return ds
+}
+
+// newTestRR parses s into a resource record.
+func newTestRR(t *testing.T, s string) (rr dns.RR) {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+
+	return rr
+}
+
+// concatRRs returns the concatenation of rrss.
+func concatRRs(rrss ...[]dns.RR) (rrs []dns.RR) {
+	for _, r := range rrss {
+		rrs = append(rrs, r...)
+	}
+
+	return rrs
+}
+
+// testSignedResponse is a response of the test upstream serving the signed
+// zones.
+type testSignedResponse struct {
+	ans   []dns.RR
+	ns    []dns.RR
+	rcode int
+}
+
+// newTestSignedUpstream returns an upstream serving resps, which are keyed by
+// the question name and type.  numQueries counts the queries per key.
+func newTestSignedUpstream(
+	resps map[string]*testSignedResponse,
+) (u *aghtest.UpstreamMock, numQueries map[string]int) {
+	numQueries = map[string]int{}
+
+	return &aghtest.UpstreamMock{
+		OnAddress: func() (addr string) { return "signed.upstream.example" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			key := q.Name + " " + dns.Type(q.Qtype).String()
+			numQueries[key]++
+
+			r, ok := resps[key]
+			if !ok {
+				return nil, fmt.Errorf("unexpected query %q", key)
+			}
+
+			resp = (&dns.Msg{}).SetRcode(req, r.rcode)
+			resp.Answer = append(resp.Answer, r.ans...)
+			resp.Ns = append(resp.Ns, r.ns...)
+
+			return resp, nil
+		},
+	}, numQueries
+}
+
+func TestDNSSECValidator_validate(t *testing.T) {
+	root := newTestZoneSigner(t, "test.")
+	child := newTestZoneSigner(t, "secure.test.")
+
+	rootSOA := newTestRR(t, "test. 300 IN SOA ns.test. hostmaster.test. 1 7200 3600 1209600 300")
+	childSOA := newTestRR(t, "secure.test. 300 IN SOA ns.secure.test. hostmaster.secure.test. 1 7200 3600 1209600 300")
+
+	// childNODATA returns the signed denial of DS records for the name within
+	// the child zone.
+	childNODATA := func(name string) (r *testSignedResponse) {
+		nsec := newTestRR(t, name+" 300 IN NSEC z.secure.test. A RRSIG NSEC")
+
+		return &testSignedResponse{
+			ns:    append(child.sign(t, childSOA), child.sign(t, nsec)...),
+			rcode: dns.RcodeSuccess,
+		}
+	}
+
+	ups, numQueries := newTestSignedUpstream(map[string]*testSignedResponse{
+		"test. DNSKEY": {
+			ans:   root.sign(t, root.key),
+			rcode: dns.RcodeSuccess,
+		},
+		"secure.test. DNSKEY": {
+			ans:   child.sign(t, child.key),
+			rcode: dns.RcodeSuccess,
+		},
+		"secure.test. DS": {
+			ans:   root.sign(t, child.ds()),
+			rcode: dns.RcodeSuccess,
+		},
+		"insecure.test. DS": {
+			ns: append(
+				root.sign(t, rootSOA),
+				root.sign(t, newTestRR(t, "insecure.test. 300 IN NSEC z.test. NS RRSIG NSEC"))...,
+			),
+			rcode: dns.RcodeSuccess,
+		},
+		"www.secure.test. DS":      childNODATA("www.secure.test."),
+		"unsigned.secure.test. DS": childNODATA("unsigned.secure.test."),
+		"none.secure.test. DS":     childNODATA("none.secure.test."),
+	})
+
+	v, err := newDNSSECValidator([]string{root.ds().String()})
+	require.NoError(t, err)
+
+	childA := newTestRR(t, "www.secure.test. 300 IN A 192.0.2.1")
+	forgedA := child.sign(t, newTestRR(t, "www.secure.test. 300 IN A 192.0.2.1"))
+	forgedA[0].(*dns.A).A = []byte{192, 0, 2, 2}
+
+	apexNSEC := newTestRR(t, "secure.test. 300 IN NSEC a.secure.test. SOA NS RRSIG NSEC DNSKEY")
+	coverNSEC := newTestRR(t, "m.secure.test. 300 IN NSEC z.secure.test. A RRSIG NSEC")
+	wwwNSEC := newTestRR(t, "www.secure.test. 300 IN NSEC z.secure.test. A RRSIG NSEC")
+
+	// wildA is the record synthesized from the wildcard.
+	wildA := child.sign(t, newTestRR(t, "*.secure.test. 300 IN A 192.0.2.6"))
+	for _, rr := range wildA {
+		rr.Header().Name = "wild.secure.test."
+	}
+
+	testCases := []struct {
+		name       string
+		qname      string
+		ans        []dns.RR
+		ns         []dns.RR
+		rcode      int
+		qtype      uint16
+		wantStatus querylog.DNSSECStatus
+	}{{
+		name:       "secure",
+		qname:      "www.secure.test.",
+		ans:        child.sign(t, childA),
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusSecure,
+	}, {
+		name:  "secure_nxdomain",
+		qname: "none.secure.test.",
+		ns: concatRRs(
+			child.sign(t, childSOA),
+			child.sign(t, coverNSEC),
+			child.sign(t, apexNSEC),
+		),
+		rcode:      dns.RcodeNameError,
+		wantStatus: querylog.DNSSECStatusSecure,
+	}, {
+		name:       "secure_nodata",
+		qname:      "www.secure.test.",
+		qtype:      dns.TypeAAAA,
+		ns:         concatRRs(child.sign(t, childSOA), child.sign(t, wwwNSEC)),
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusSecure,
+	}, {
+		name:       "secure_wildcard",
+		qname:      "wild.secure.test.",
+		ans:        wildA,
+		ns:         child.sign(t, coverNSEC),
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusSecure,
+	}, {
+		name:       "insecure_delegation",
+		qname:      "www.insecure.test.",
+		ans:        []dns.RR{newTestRR(t, "www.insecure.test. 300 IN A 192.0.2.3")},
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusInsecure,
+	}, {
+		name:       "no_anchor",
+		qname:      "www.example.org.",
+		ans:        []dns.RR{newTestRR(t, "www.example.org. 300 IN A 192.0.2.4")},
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusInsecure,
+	}, {
+		name:       "bogus_signature",
+		qname:      "www.secure.test.",
+		ans:        forgedA,
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusBogus,
+	}, {
+		name:       "bogus_unsigned",
+		qname:      "unsigned.secure.test.",
+		ans:        []dns.RR{newTestRR(t, "unsigned.secure.test. 300 IN A 192.0.2.5")},
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusBogus,
+	}, {
+		name:       "bogus_unsigned_denial",
+		qname:      "none.secure.test.",
+		ns:         []dns.RR{childSOA},
+		rcode:      dns.RcodeNameError,
+		wantStatus: querylog.DNSSECStatusBogus,
+	}, {
+		name:       "bogus_nxdomain_existing",
+		qname:      "www.secure.test.",
+		ns:         concatRRs(child.sign(t, childSOA), child.sign(t, wwwNSEC)),
+		rcode:      dns.RcodeNameError,
+		wantStatus: querylog.DNSSECStatusBogus,
+	}, {
+		name:       "bogus_nxdomain_no_wildcard_proof",
+		qname:      "none.secure.test.",
+		ns:         concatRRs(child.sign(t, childSOA), child.sign(t, coverNSEC)),
+		rcode:      dns.RcodeNameError,
+		wantStatus: querylog.DNSSECStatusBogus,
+	}, {
+		name:       "bogus_nodata_existing_type",
+		qname:      "www.secure.test.",
+		ns:         concatRRs(child.sign(t, childSOA), child.sign(t, wwwNSEC)),
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusBogus,
+	}, {
+		name:       "bogus_wildcard_no_proof",
+		qname:      "wild.secure.test.",
+		ans:        wildA,
+		rcode:      dns.RcodeSuccess,
+		wantStatus: querylog.DNSSECStatusBogus,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			qtype := tc.qtype
+			if qtype == 0 {
+				qtype = dns.TypeA
+			}
+
+			req := (&dns.Msg{}).SetQuestion(tc.qname, qtype)
+			resp := (&dns.Msg{}).SetRcode(req, tc.rcode)
+			resp.Answer, resp.Ns = tc.ans, tc.ns
+
+			status, valErr := v.validate(ups, resp)
+			assert.Equal(t, tc.wantStatus, status)
+
+			if tc.wantStatus == querylog.DNSSECStatusBogus {
+				assert.Error(t, valErr)
+			} else {
+				assert.NoError(t, valErr)
+			}
+		})
+	}
+
+	// The keys must be requested only once.
+	assert.Equal(t, 1, numQueries["test. DNSKEY"])
+	assert.Equal(t, 1, numQueries["secure.test. DNSKEY"])
+
+	t.Run("wrong_anchor", func(t *testing.T) {
+		other := newTestZoneSigner(t, "test.")
+
+		wrongV, wrongErr := newDNSSECValidator([]string{other.ds().String()})
+		require.NoError(t, wrongErr)
+
+		req := (&dns.Msg{}).SetQuestion("www.secure.test.", dns.TypeA)
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = child.sign(t, childA)
+
+		status, valErr := wrongV.validate(ups, resp)
+		assert.Equal(t, querylog.DNSSECStatusBogus, status)
+		assert.ErrorContains(t, valErr, `no dnskey of "test." matches ds`)
+	})
+}
+
+func TestValidatingUpstream_Exchange(t *testing.T) {
+	zone := newTestZoneSigner(t, "test.")
+
+	ups, _ := newTestSignedUpstream(map[string]*testSignedResponse{
+		"test. DNSKEY": {
+			ans:   zone.sign(t, zone.key),
+			rcode: dns.RcodeSuccess,
+		},
+		"www.test. A": {
+			ans:   zone.sign(t, newTestRR(t, "www.test. 300 IN A 192.0.2.1")),
+			rcode: dns.RcodeSuccess,
+		},
+		"bogus.test. A": {
+			ans:   []dns.RR{newTestRR(t, "bogus.test. 300 IN A 192.0.2.2")},
+			rcode: dns.RcodeSuccess,
+		},
+		"bogus.test. DS": {
+			ns: zone.sign(
+				t,
+				newTestRR(t, "bogus.test. 300 IN NSEC z.test. A RRSIG NSEC"),
+			),
+			rcode: dns.RcodeSuccess,
+		},
+	})
+
+	v, err := newDNSSECValidator([]string{zone.ds().String()})
+	require.NoError(t, err)
+
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{ups},
+	}
+	v.wrapUpstreams(conf)
+
+	// Wrapping must be idempotent.
+	v.wrapUpstreams(conf)
+
+	require.Len(t, conf.Upstreams, 1)
+
+	wrapped := conf.Upstreams[0]
+
+	t.Run("secure", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("www.test.", dns.TypeA)
+
+		resp, exchErr := wrapped.Exchange(req)
+		require.NoError(t, exchErr)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.True(t, resp.AuthenticatedData)
+		assert.False(t, resp.CheckingDisabled)
+
+		// The original request must not be modified.
+		assert.Nil(t, req.IsEdns0())
+	})
+
+	t.Run("bogus", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("bogus.test.", dns.TypeA)
+
+		resp, exchErr := wrapped.Exchange(req)
+		require.NoError(t, exchErr)
+
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+		assert.Empty(t, resp.Answer)
+		assert.True(t, isBogusResponse(resp))
+	})
+
+	t.Run("checking_disabled", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("bogus.test.", dns.TypeA)
+		req.CheckingDisabled = true
+
+		resp, exchErr := wrapped.Exchange(req)
+		require.NoError(t, exchErr)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+	})
+}
+
+func TestServer_SetDNSSECStatus(t *testing.T) {
+	v, err := newDNSSECValidator(nil)
+	require.NoError(t, err)
+
+	s := &Server{dnssec: v}
+
+	req := (&dns.Msg{}).SetQuestion("bogus.test.", dns.TypeA)
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Req: req,
+			Res: newBogusResponse(req, assert.AnError),
+		},
+	}
+
+	s.setDNSSECStatus(dctx, false)
+	assert.Equal(t, querylog.DNSSECStatusBogus, dctx.dnssecStatus)
+
+	// The OPT record must be removed, since the request had none.
+	assert.Nil(t, dctx.proxyCtx.Res.IsEdns0())
+}
+
+func TestCustomUpstreamConfigs_get(t *testing.T) {
+	v, err := newDNSSECValidator(nil)
+	require.NoError(t, err)
+
+	ups := &aghtest.UpstreamMock{}
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{ups},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.": {ups},
+		},
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		var c *customUpstreamConfigs
+		assert.Same(t, conf, c.get(conf))
+	})
+
+	c := newCustomUpstreamConfigs(v.wrapUpstreams)
+
+	wrapped := c.get(conf)
+	require.NotSame(t, conf, wrapped)
+
+	require.Len(t, wrapped.Upstreams, 1)
+	assert.IsType(t, (*validatingUpstream)(nil), wrapped.Upstreams[0])
+
+	require.Len(t, wrapped.DomainReservedUpstreams["example.org."], 1)
+	assert.IsType(t, (*validatingUpstream)(nil), wrapped.DomainReservedUpstreams["example.org."][0])
+
+	// The original configuration must not be modified.
+	assert.Same(t, ups, conf.Upstreams[0])
+	assert.Same(t, ups, conf.DomainReservedUpstreams["example.org."][0])
+
+	// The wrapped copy must be reused.
+	assert.Same(t, wrapped, c.get(conf))
+}
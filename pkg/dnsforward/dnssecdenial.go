@@ -0,0 +1,369 @@
+package dnsforward
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// maxNSEC3Iterations is the maximum number of additional hash iterations of
+// the NSEC3 records considered by the validator.  The responses with the
+// records using more iterations are insecure.
+//
+// See RFC 9276, Section 3.2.
+const maxNSEC3Iterations = 150
+
+// nsec3FlagOptOut is the Opt-Out flag of the NSEC3 records.
+//
+// See RFC 5155, Section 3.1.2.1.
+const nsec3FlagOptOut = 1
+
+// denialProof contains the validated NSEC and NSEC3 records proving the
+// denial of existence.
+type denialProof struct {
+	// nsecs are the validated NSEC records.
+	nsecs []*dns.NSEC
+
+	// nsec3s are the validated NSEC3 records with the supported parameters.
+	nsec3s []*dns.NSEC3
+
+	// unsupported is true if some of the validated NSEC3 records have been
+	// skipped because of the unsupported hash algorithm or too many
+	// iterations.
+	unsupported bool
+}
+
+// newDenialProof returns the proof consisting of the NSEC and NSEC3 records
+// from the validated sets signed by the zones enclosing the lowercased name.
+func newDenialProof(sets []*rrset, name string) (p *denialProof) {
+	p = &denialProof{}
+	for _, set := range sets {
+		if set.signer == "" || !dns.IsSubDomain(set.signer, name) {
+			continue
+		}
+
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				p.nsecs = append(p.nsecs, rr)
+			case *dns.NSEC3:
+				if rr.Hash != dns.SHA1 || rr.Iterations > maxNSEC3Iterations {
+					p.unsupported = true
+				} else {
+					p.nsec3s = append(p.nsec3s, rr)
+				}
+			}
+		}
+	}
+
+	return p
+}
+
+// isEmpty returns true if p contains no records.
+func (p *denialProof) isEmpty() (ok bool) {
+	return len(p.nsecs) == 0 && len(p.nsec3s) == 0 && !p.unsupported
+}
+
+// denial checks that p proves that there are no records of qtype for the
+// lowercased name or, if nxDomain is true, that there is no such name at all.
+// secure is false if the proof relies on the Opt-Out NSEC3 records or on the
+// unsupported ones.  err describes the reason why the proof is bogus.
+//
+// See RFC 4035, Section 5.4 and RFC 5155, Section 8.
+func (p *denialProof) denial(name string, qtype uint16, nxDomain bool) (secure bool, err error) {
+	switch {
+	case p.unsupported:
+		return false, nil
+	case len(p.nsec3s) > 0:
+		return p.nsec3Denial(name, qtype, nxDomain)
+	case len(p.nsecs) > 0:
+		return true, p.nsecDenial(name, qtype, nxDomain)
+	default:
+		return false, errors.Error("no nsec or nsec3 records")
+	}
+}
+
+// expansion checks that p proves that the lowercased name doesn't exist, so
+// the records for it have been correctly synthesized from the wildcard at the
+// closest encloser ce.  secure is false if the proof relies on the unsupported
+// NSEC3 records.
+//
+// See RFC 4035, Section 5.3.4 and RFC 5155, Section 8.8.
+func (p *denialProof) expansion(name, ce string) (secure bool, err error) {
+	if p.unsupported {
+		return false, nil
+	}
+
+	if p.coveringNSEC(name) != nil {
+		return true, nil
+	}
+
+	nextCloser := ancestorName(name, dns.CountLabel(ce)+1)
+	if p.coveringNSEC3(nextCloser) != nil {
+		return true, nil
+	}
+
+	return false, fmt.Errorf("no nsec or nsec3 covering %q", name)
+}
+
+// nsecDenial checks that the NSEC records of p prove the denial of existence
+// of the records of qtype for the lowercased name.
+func (p *denialProof) nsecDenial(name string, qtype uint16, nxDomain bool) (err error) {
+	if n := p.matchingNSEC(name); n != nil {
+		if nxDomain {
+			return errors.Error("nsec proves that name exists")
+		}
+
+		return checkNoData(n.TypeBitMap, qtype)
+	}
+
+	cover := p.coveringNSEC(name)
+	if cover == nil {
+		return errors.Error("no nsec matching or covering name")
+	}
+
+	next := strings.ToLower(cover.NextDomain)
+	if next != name && dns.IsSubDomain(name, next) {
+		// The name is an empty non-terminal.
+		if nxDomain {
+			return errors.Error("nsec proves that name is empty non-terminal")
+		}
+
+		return nil
+	}
+
+	owner := strings.ToLower(cover.Hdr.Name)
+	ce := ancestorName(name, max(dns.CompareDomainName(name, owner), dns.CompareDomainName(name, next)))
+	wildcard := wildcardName(ce)
+
+	if w := p.matchingNSEC(wildcard); w != nil {
+		if nxDomain {
+			return fmt.Errorf("nsec proves that wildcard %q exists", wildcard)
+		}
+
+		return checkNoData(w.TypeBitMap, qtype)
+	} else if !nxDomain {
+		return fmt.Errorf("no nsec matching name or wildcard %q", wildcard)
+	}
+
+	if p.coveringNSEC(wildcard) == nil {
+		return fmt.Errorf("no nsec covering wildcard %q", wildcard)
+	}
+
+	return nil
+}
+
+// matchingNSEC returns the NSEC record owned by the lowercased name, if any.
+func (p *denialProof) matchingNSEC(name string) (n *dns.NSEC) {
+	for _, n = range p.nsecs {
+		if strings.ToLower(n.Hdr.Name) == name {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// coveringNSEC returns the NSEC record covering the lowercased name, if any.
+func (p *denialProof) coveringNSEC(name string) (n *dns.NSEC) {
+	for _, n = range p.nsecs {
+		if nsecCovers(n, name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsecCovers returns true if the lowercased name is between the owner name and
+// the next domain name of n in the canonical order.  The NSEC records of the
+// delegation points and of the DNAME owners don't cover the names below them,
+// since those belong to the other zones.
+func nsecCovers(n *dns.NSEC, name string) (ok bool) {
+	owner, next := strings.ToLower(n.Hdr.Name), strings.ToLower(n.NextDomain)
+	if canonicalCompare(owner, name) >= 0 {
+		return false
+	}
+
+	if dns.IsSubDomain(owner, name) && isCut(n.TypeBitMap) {
+		return false
+	}
+
+	// The next domain name of the last NSEC record in the zone is the apex.
+	return canonicalCompare(owner, next) >= 0 || canonicalCompare(name, next) < 0
+}
+
+// nsec3Denial checks that the NSEC3 records of p prove the denial of existence
+// of the records of qtype for the lowercased name.
+func (p *denialProof) nsec3Denial(name string, qtype uint16, nxDomain bool) (secure bool, err error) {
+	if n := p.matchingNSEC3(name); n != nil {
+		if nxDomain {
+			return false, errors.Error("nsec3 proves that name exists")
+		}
+
+		return true, checkNoData(n.TypeBitMap, qtype)
+	}
+
+	ce, cover, err := p.closestEncloser(name)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	}
+
+	optOut := cover.Flags&nsec3FlagOptOut != 0
+	wildcard := wildcardName(ce)
+
+	if w := p.matchingNSEC3(wildcard); w != nil {
+		if nxDomain {
+			return false, fmt.Errorf("nsec3 proves that wildcard %q exists", wildcard)
+		}
+
+		return true, checkNoData(w.TypeBitMap, qtype)
+	} else if !nxDomain {
+		if qtype == dns.TypeDS && optOut {
+			// An unsigned delegation within the Opt-Out span.
+			return false, nil
+		}
+
+		return false, fmt.Errorf("no nsec3 matching name or wildcard %q", wildcard)
+	}
+
+	if p.coveringNSEC3(wildcard) == nil {
+		return false, fmt.Errorf("no nsec3 covering wildcard %q", wildcard)
+	}
+
+	return !optOut, nil
+}
+
+// closestEncloser finds the closest existing ancestor of the lowercased name
+// and the NSEC3 record covering the next closer name, which proves that there
+// is no closer one.
+//
+// See RFC 5155, Section 8.3.
+func (p *denialProof) closestEncloser(name string) (ce string, cover *dns.NSEC3, err error) {
+	nextCloser := name
+	for ce = parentName(name); ce != ""; nextCloser, ce = ce, parentName(ce) {
+		n := p.matchingNSEC3(ce)
+		if n == nil {
+			continue
+		} else if isCut(n.TypeBitMap) {
+			return "", nil, fmt.Errorf("closest encloser %q is not authoritative", ce)
+		}
+
+		cover = p.coveringNSEC3(nextCloser)
+		if cover == nil {
+			return "", nil, fmt.Errorf("no nsec3 covering next closer name %q", nextCloser)
+		}
+
+		return ce, cover, nil
+	}
+
+	return "", nil, errors.Error("no nsec3 matching closest encloser")
+}
+
+// matchingNSEC3 returns the NSEC3 record matching the lowercased name, if any.
+func (p *denialProof) matchingNSEC3(name string) (n *dns.NSEC3) {
+	for _, n = range p.nsec3s {
+		if n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// coveringNSEC3 returns the NSEC3 record covering the lowercased name, if any.
+// Unlike [dns.NSEC3.Cover], the matching record doesn't cover the name.
+func (p *denialProof) coveringNSEC3(name string) (n *dns.NSEC3) {
+	for _, n = range p.nsec3s {
+		if n.Cover(name) && !n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// checkNoData returns an error if the type bitmap types of the existing name
+// doesn't prove that there are no records of qtype for it.
+func checkNoData(types []uint16, qtype uint16) (err error) {
+	switch {
+	case hasType(types, qtype):
+		return fmt.Errorf("type bitmap contains %s", dns.Type(qtype))
+	case hasType(types, dns.TypeCNAME):
+		return errors.Error("type bitmap contains CNAME")
+	case qtype != dns.TypeDS && hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA):
+		return errors.Error("denial is from parent side of delegation")
+	default:
+		return nil
+	}
+}
+
+// isCut returns true if the type bitmap types belongs to the owner of the
+// records, which the zone isn't authoritative for the names below, i.e. a
+// delegation point or a DNAME owner.
+func isCut(types []uint16) (ok bool) {
+	return (hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA)) || hasType(types, dns.TypeDNAME)
+}
+
+// wildcardEncloser returns the closest encloser of the wildcard, from which
+// the validated set has been synthesized.  ok is false if set hasn't been
+// synthesized.
+func wildcardEncloser(set *rrset) (ce string, ok bool) {
+	if set.signer == "" {
+		return "", false
+	}
+
+	n := dns.CountLabel(set.name)
+	if strings.HasPrefix(set.name, "*.") {
+		n--
+	}
+
+	if int(set.labels) >= n {
+		return "", false
+	}
+
+	return ancestorName(set.name, int(set.labels)), true
+}
+
+// ancestorName returns the ancestor of name consisting of the specified number
+// of the last labels of it.
+func ancestorName(name string, labels int) (ancestor string) {
+	if labels <= 0 {
+		return "."
+	}
+
+	idx := dns.Split(name)
+	if labels >= len(idx) {
+		return name
+	}
+
+	return name[idx[len(idx)-labels]:]
+}
+
+// wildcardName returns the name of the wildcard at the closest encloser ce.
+func wildcardName(ce string) (wildcard string) {
+	if ce == "." {
+		return "*."
+	}
+
+	return "*." + ce
+}
+
+// canonicalCompare compares the lowercased domain names a and b according to
+// the canonical DNS name order.
+//
+// See RFC 4034, Section 6.1.
+func canonicalCompare(a, b string) (res int) {
+	al, bl := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if res = strings.Compare(al[i], bl[j]); res != 0 {
+			return res
+		}
+	}
+
+	return cmp.Compare(len(al), len(bl))
+}
@@ -0,0 +1,290 @@
+package dnsforward
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNSECs returns the NSEC records of the test zone.
+func newTestNSECs(t *testing.T, rrs ...string) (nsecs []*dns.NSEC) {
+	t.Helper()
+
+	for _, s := range rrs {
+		nsec, ok := newTestRR(t, s).(*dns.NSEC)
+		require.True(t, ok)
+
+		nsecs = append(nsecs, nsec)
+	}
+
+	return nsecs
+}
+
+// newTestNSEC3Chain returns the chain of NSEC3 records for the zone containing
+// the names mapped to their types.
+func newTestNSEC3Chain(zone string, names map[string][]uint16, optOut bool) (chain []*dns.NSEC3) {
+	hashes := make([]string, 0, len(names))
+	types := make(map[string][]uint16, len(names))
+	for name, ts := range names {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, h)
+		types[h] = ts
+	}
+
+	sort.Strings(hashes)
+
+	flags := uint8(0)
+	if optOut {
+		flags = nsec3FlagOptOut
+	}
+
+	for i, h := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr: dns.RR_Header{
+				Name:   h + "." + zone,
+				Rrtype: dns.TypeNSEC3,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types[h],
+		})
+	}
+
+	return chain
+}
+
+func TestDenialProof_denial(t *testing.T) {
+	nsecProof := &denialProof{
+		nsecs: newTestNSECs(
+			t,
+			"example. 300 IN NSEC *.example. SOA NS RRSIG NSEC DNSKEY",
+			"*.example. 300 IN NSEC a.example. TXT RRSIG NSEC",
+			"a.example. 300 IN NSEC x.y.example. A RRSIG NSEC",
+			"x.y.example. 300 IN NSEC sub.z.example. A RRSIG NSEC",
+			"sub.z.example. 300 IN NSEC example. NS RRSIG NSEC",
+		),
+	}
+
+	nsec3Names := map[string][]uint16{
+		"example.":     {dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"a.example.":   {dns.TypeA, dns.TypeRRSIG},
+		"y.example.":   nil,
+		"x.y.example.": {dns.TypeA, dns.TypeRRSIG},
+	}
+
+	nsec3Proof := &denialProof{
+		nsec3s: newTestNSEC3Chain("example.", nsec3Names, false),
+	}
+
+	optOutProof := &denialProof{
+		nsec3s: newTestNSEC3Chain("example.", nsec3Names, true),
+	}
+
+	testCases := []struct {
+		proof      *denialProof
+		name       string
+		qname      string
+		wantErrMsg string
+		qtype      uint16
+		nxDomain   bool
+		wantSecure bool
+	}{{
+		proof:      nsecProof,
+		name:       "nsec_nodata",
+		qname:      "a.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeAAAA,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_nodata_existing_type",
+		qname:      "a.example.",
+		wantErrMsg: "type bitmap contains A",
+		qtype:      dns.TypeA,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_nodata_empty_non_terminal",
+		qname:      "y.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_nxdomain_empty_non_terminal",
+		qname:      "y.example.",
+		wantErrMsg: "nsec proves that name is empty non-terminal",
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_wildcard_nodata",
+		qname:      "b.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_wildcard_nodata_existing_type",
+		qname:      "b.example.",
+		wantErrMsg: "type bitmap contains TXT",
+		qtype:      dns.TypeTXT,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_nxdomain_wildcard_exists",
+		qname:      "b.example.",
+		wantErrMsg: `nsec proves that wildcard "*.example." exists`,
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_delegation_ds",
+		qname:      "sub.z.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeDS,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsecProof,
+		name:       "nsec_below_delegation",
+		qname:      "www.sub.z.example.",
+		wantErrMsg: "no nsec matching or covering name",
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: true,
+	}, {
+		proof:      nsec3Proof,
+		name:       "nsec3_nxdomain",
+		qname:      "none.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: true,
+	}, {
+		proof:      nsec3Proof,
+		name:       "nsec3_nxdomain_deep",
+		qname:      "www.none.y.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: true,
+	}, {
+		proof:      nsec3Proof,
+		name:       "nsec3_nxdomain_existing",
+		qname:      "a.example.",
+		wantErrMsg: "nsec3 proves that name exists",
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: false,
+	}, {
+		proof:      nsec3Proof,
+		name:       "nsec3_nodata",
+		qname:      "a.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeAAAA,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsec3Proof,
+		name:       "nsec3_nodata_existing_type",
+		qname:      "a.example.",
+		wantErrMsg: "type bitmap contains A",
+		qtype:      dns.TypeA,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsec3Proof,
+		name:       "nsec3_nodata_empty_non_terminal",
+		qname:      "y.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		nxDomain:   false,
+		wantSecure: true,
+	}, {
+		proof:      nsec3Proof,
+		name:       "nsec3_nodata_nonexistent",
+		qname:      "none.example.",
+		wantErrMsg: `no nsec3 matching name or wildcard "*.example."`,
+		qtype:      dns.TypeA,
+		nxDomain:   false,
+		wantSecure: false,
+	}, {
+		proof:      optOutProof,
+		name:       "nsec3_opt_out_nxdomain",
+		qname:      "none.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: false,
+	}, {
+		proof:      optOutProof,
+		name:       "nsec3_opt_out_ds",
+		qname:      "unsigned.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeDS,
+		nxDomain:   false,
+		wantSecure: false,
+	}, {
+		proof:      &denialProof{unsupported: true},
+		name:       "unsupported",
+		qname:      "none.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		nxDomain:   true,
+		wantSecure: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			secure, err := tc.proof.denial(tc.qname, tc.qtype, tc.nxDomain)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			if err == nil {
+				assert.Equal(t, tc.wantSecure, secure)
+			}
+		})
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// The names are in the canonical order, see RFC 4034, Section 6.1.
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"z.a.example.",
+		"zabc.a.example.",
+		"z.example.",
+		"*.z.example.",
+	}
+
+	for i, a := range names {
+		for j, b := range names {
+			got := canonicalCompare(a, b)
+			switch {
+			case i < j:
+				assert.Negative(t, got, "%q < %q", a, b)
+			case i > j:
+				assert.Positive(t, got, "%q > %q", a, b)
+			default:
+				assert.Zero(t, got, "%q == %q", a, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/jynychen/AdGuardHome/pkg/dnstap"
+	"github.com/miekg/dns"
+)
+
+// newDNSTap returns a new dnstap emitter for conf.  e is nil if the output is
+// disabled.
+func newDNSTap(conf *dnstap.Config) (e *dnstap.Emitter, err error) {
+	err = conf.Validate()
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
+	if conf == nil || !conf.Enabled {
+		return nil, nil
+	}
+
+	return dnstap.New(conf), nil
+}
+
+// emitDNSTap sends the dnstap messages describing the request processed in
+// dctx.  ip is the client's IP address to put into the messages.
+// s.serverLock is expected to be locked.
+func (s *Server) emitDNSTap(dctx *dnsContext, ip net.IP) {
+	if s.dnstap == nil {
+		return
+	}
+
+	pctx := dctx.proxyCtx
+	query := packDNSTap(pctx.Req)
+	resp := packDNSTap(pctx.Res)
+
+	var clientAddr netip.AddrPort
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		_, port := netutil.IPAndPortFromAddr(pctx.Addr)
+		clientAddr = netip.AddrPortFrom(addr.Unmap(), uint16(port))
+	}
+
+	queryTime := pctx.StartTime
+	if queryTime.IsZero() {
+		queryTime = dctx.startTime
+	}
+
+	var extra []byte
+	if dctx.clientID != "" {
+		extra = []byte(dctx.clientID)
+	}
+
+	proto := dnstapClientProto(pctx.Proto)
+
+	s.dnstap.Emit(&dnstap.Message{
+		QueryTime:      queryTime,
+		Extra:          extra,
+		QueryMessage:   query,
+		QueryAddr:      clientAddr,
+		Type:           dnstap.MessageTypeClientQuery,
+		SocketProtocol: proto,
+	})
+
+	if dctx.upstreamQueryTime.IsZero() || pctx.Upstream == nil {
+		// The response isn't received from an upstream.
+		s.emitDNSTapClientResponse(query, resp, extra, clientAddr, queryTime, proto)
+
+		return
+	}
+
+	upsResp := resp
+	if dctx.origResp != nil {
+		upsResp = packDNSTap(dctx.origResp)
+	}
+
+	upsAddr, upsProto := dnstapUpstream(pctx.Upstream.Address())
+
+	s.dnstap.Emit(&dnstap.Message{
+		QueryTime:      dctx.upstreamQueryTime,
+		Extra:          extra,
+		QueryMessage:   query,
+		ResponseAddr:   upsAddr,
+		Type:           dnstap.MessageTypeForwarderQuery,
+		SocketProtocol: upsProto,
+	})
+	s.dnstap.Emit(&dnstap.Message{
+		QueryTime:       dctx.upstreamQueryTime,
+		ResponseTime:    dctx.upstreamResponseTime,
+		Extra:           extra,
+		QueryMessage:    query,
+		ResponseMessage: upsResp,
+		ResponseAddr:    upsAddr,
+		Type:            dnstap.MessageTypeForwarderResponse,
+		SocketProtocol:  upsProto,
+	})
+
+	s.emitDNSTapClientResponse(query, resp, extra, clientAddr, queryTime, proto)
+}
+
+// emitDNSTapClientResponse sends the CLIENT_RESPONSE dnstap message.
+// s.serverLock is expected to be locked.
+func (s *Server) emitDNSTapClientResponse(
+	query []byte,
+	resp []byte,
+	extra []byte,
+	clientAddr netip.AddrPort,
+	queryTime time.Time,
+	proto dnstap.SocketProtocol,
+) {
+	s.dnstap.Emit(&dnstap.Message{
+		QueryTime:       queryTime,
+		ResponseTime:    time.Now(),
+		Extra:           extra,
+		QueryMessage:    query,
+		ResponseMessage: resp,
+		QueryAddr:       clientAddr,
+		Type:            dnstap.MessageTypeClientResponse,
+		SocketProtocol:  proto,
+	})
+}
+
+// packDNSTap returns the wire format of msg.  b is nil if msg is nil or can't
+// be packed.
+func packDNSTap(msg *dns.Msg) (b []byte) {
+	if msg == nil {
+		return nil
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		log.Debug("dnsforward: dnstap: packing message: %s", err)
+
+		return nil
+	}
+
+	return b
+}
+
+// dnstapClientProto returns the dnstap socket protocol of the client's request
+// received over proto.
+func dnstapClientProto(proto proxy.Proto) (sp dnstap.SocketProtocol) {
+	switch proto {
+	case proxy.ProtoUDP:
+		return dnstap.SocketProtocolUDP
+	case proxy.ProtoTCP:
+		return dnstap.SocketProtocolTCP
+	case proxy.ProtoTLS:
+		return dnstap.SocketProtocolDOT
+	case proxy.ProtoHTTPS:
+		return dnstap.SocketProtocolDOH
+	case proxy.ProtoQUIC:
+		return dnstap.SocketProtocolDOQ
+	case proxy.ProtoDNSCrypt:
+		return dnstap.SocketProtocolDNSCryptUDP
+	default:
+		return 0
+	}
+}
+
+// dnstapUpstream returns the address and the dnstap socket protocol of the
+// upstream with the given address.  addr is empty if the upstream isn't
+// specified with an IP address.
+func dnstapUpstream(upsAddr string) (addr netip.AddrPort, sp dnstap.SocketProtocol) {
+	defaultPort := defaultPlainDNSPort
+	sp = dnstap.SocketProtocolUDP
+	if u, err := url.Parse(upsAddr); err == nil {
+		switch u.Scheme {
+		case "tcp":
+			sp = dnstap.SocketProtocolTCP
+		case "tls":
+			defaultPort, sp = 853, dnstap.SocketProtocolDOT
+		case "https", "h3":
+			defaultPort, sp = 443, dnstap.SocketProtocolDOH
+		case "quic":
+			defaultPort, sp = 853, dnstap.SocketProtocolDOQ
+		case "sdns":
+			return netip.AddrPort{}, dnstap.SocketProtocolDNSCryptUDP
+		default:
+			// Consider this a plain DNS-over-UDP upstream.
+		}
+	}
+
+	addr, err := aghnet.ParseAddrPort(upsAddr, defaultPort)
+	if err != nil {
+		return netip.AddrPort{}, sp
+	}
+
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), sp
+}
@@ -0,0 +1,56 @@
+package dnsforward
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/jynychen/AdGuardHome/pkg/dnstap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSTapUpstream(t *testing.T) {
+	testCases := []struct {
+		wantAddr  netip.AddrPort
+		name      string
+		upsAddr   string
+		wantProto dnstap.SocketProtocol
+	}{{
+		wantAddr:  netip.MustParseAddrPort("1.1.1.1:53"),
+		name:      "plain",
+		upsAddr:   "1.1.1.1:53",
+		wantProto: dnstap.SocketProtocolUDP,
+	}, {
+		wantAddr:  netip.MustParseAddrPort("[2001:db8::1]:5353"),
+		name:      "tcp",
+		upsAddr:   "tcp://[2001:db8::1]:5353",
+		wantProto: dnstap.SocketProtocolTCP,
+	}, {
+		wantAddr:  netip.MustParseAddrPort("1.1.1.1:853"),
+		name:      "tls_default_port",
+		upsAddr:   "tls://1.1.1.1",
+		wantProto: dnstap.SocketProtocolDOT,
+	}, {
+		wantAddr:  netip.AddrPort{},
+		name:      "https_hostname",
+		upsAddr:   "https://dns.example/dns-query",
+		wantProto: dnstap.SocketProtocolDOH,
+	}, {
+		wantAddr:  netip.MustParseAddrPort("1.1.1.1:784"),
+		name:      "quic",
+		upsAddr:   "quic://1.1.1.1:784",
+		wantProto: dnstap.SocketProtocolDOQ,
+	}, {
+		wantAddr:  netip.AddrPort{},
+		name:      "dnscrypt",
+		upsAddr:   "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQz",
+		wantProto: dnstap.SocketProtocolDNSCryptUDP,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, proto := dnstapUpstream(tc.upsAddr)
+			assert.Equal(t, tc.wantAddr, addr)
+			assert.Equal(t, tc.wantProto, proto)
+		})
+	}
+}
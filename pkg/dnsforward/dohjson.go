@@ -0,0 +1,320 @@
+package dnsforward
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/miekg/dns"
+)
+
+// dohJSONContentType is the content type of the JSON DNS-over-HTTPS responses.
+const dohJSONContentType = "application/dns-json"
+
+// dohJSONUDPSize is the UDP payload size set in the JSON DNS-over-HTTPS
+// requests with the DO bit.
+const dohJSONUDPSize = 4096
+
+// isDoHJSONRequest returns true if r is a request to the JSON DNS-over-HTTPS
+// API, that is a GET request with the name parameter and without the dns one.
+func isDoHJSONRequest(r *http.Request) (ok bool) {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	q := r.URL.Query()
+
+	return q.Has("name") && !q.Has("dns")
+}
+
+// dohJSONResultKey is the context key for the *dohJSONResult of the request.
+type dohJSONResultKey struct{}
+
+// dohJSONResult is the filtering result of a JSON DNS-over-HTTPS request.
+type dohJSONResult struct {
+	res *filtering.Result
+}
+
+// setDoHJSONResult saves the filtering result of dctx into the request's
+// context, if it's a JSON DNS-over-HTTPS request.
+func setDoHJSONResult(dctx *dnsContext) {
+	r := dctx.proxyCtx.HTTPRequest
+	if r == nil {
+		return
+	}
+
+	if holder, ok := r.Context().Value(dohJSONResultKey{}).(*dohJSONResult); ok {
+		holder.res = dctx.result
+	}
+}
+
+// handleDoHJSON is the JSON DNS-over-HTTPS handler.  The request is converted
+// into a wire-format DNS-over-HTTPS one, so that it is processed the same way,
+// including the ClientID from the path.
+func (s *Server) handleDoHJSON(w http.ResponseWriter, r *http.Request) {
+	req, err := newDoHJSONRequest(r.URL.Query())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	packed, err := req.Pack()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "packing request: %s", err)
+
+		return
+	}
+
+	holder := &dohJSONResult{}
+	wireReq := r.Clone(context.WithValue(r.Context(), dohJSONResultKey{}, holder))
+	wireReq.URL.RawQuery = url.Values{
+		"dns": []string{base64.RawURLEncoding.EncodeToString(packed)},
+	}.Encode()
+
+	rw := &dohJSONResponseWriter{
+		header: http.Header{},
+		code:   http.StatusOK,
+	}
+	s.ServeHTTP(rw, wireReq)
+
+	if rw.code != http.StatusOK || rw.body.Len() == 0 {
+		code := rw.code
+		if code == http.StatusOK {
+			code = http.StatusInternalServerError
+		}
+
+		http.Error(w, http.StatusText(code), code)
+
+		return
+	}
+
+	resp := &dns.Msg{}
+	err = resp.Unpack(rw.body.Bytes())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "unpacking response: %s", err)
+
+		return
+	}
+
+	h := w.Header()
+	h.Set(httphdr.ContentType, dohJSONContentType)
+	h.Set(httphdr.Server, aghhttp.UserAgent())
+
+	err = json.NewEncoder(w).Encode(newDoHJSONResponse(resp, holder.res))
+	if err != nil {
+		log.Debug("dnsforward: writing json doh response: %s", err)
+	}
+}
+
+// newDoHJSONRequest returns a DNS request built from the parameters of a JSON
+// DNS-over-HTTPS request.
+func newDoHJSONRequest(q url.Values) (req *dns.Msg, err error) {
+	name := q.Get("name")
+	if name == "" {
+		return nil, errors.Error("name: empty value")
+	} else if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("name: bad domain name %q", name)
+	}
+
+	qtype := dns.TypeA
+	if typeStr := q.Get("type"); typeStr != "" {
+		qtype, err = parseDoHJSONType(typeStr)
+		if err != nil {
+			return nil, fmt.Errorf("type: %w", err)
+		}
+	}
+
+	do, err := parseDoHJSONBool(q.Get("do"))
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+
+	cd, err := parseDoHJSONBool(q.Get("cd"))
+	if err != nil {
+		return nil, fmt.Errorf("cd: %w", err)
+	}
+
+	req = (&dns.Msg{}).SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = cd
+	if do {
+		req.SetEdns0(dohJSONUDPSize, true)
+	}
+
+	return req, nil
+}
+
+// parseDoHJSONType parses the numeric or textual DNS type.
+func parseDoHJSONType(s string) (qtype uint16, err error) {
+	if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+
+	t, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad dns type %q", s)
+	}
+
+	return uint16(t), nil
+}
+
+// parseDoHJSONBool parses the boolean parameter of a JSON DNS-over-HTTPS
+// request.  An empty string is false.
+func parseDoHJSONBool(s string) (ok bool, err error) {
+	switch s {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("bad boolean value %q", s)
+	}
+}
+
+// dohJSONResponse is the response of the JSON DNS-over-HTTPS API.
+type dohJSONResponse struct {
+	// Blocked describes why the name was blocked.  It's nil if the request
+	// wasn't blocked.
+	Blocked *dohJSONBlocked `json:"Blocked,omitempty"`
+
+	Question   []*dohJSONQuestion `json:"Question"`
+	Answer     []*dohJSONRR       `json:"Answer,omitempty"`
+	Authority  []*dohJSONRR       `json:"Authority,omitempty"`
+	Additional []*dohJSONRR       `json:"Additional,omitempty"`
+
+	Status int  `json:"Status"`
+	TC     bool `json:"TC"`
+	RD     bool `json:"RD"`
+	RA     bool `json:"RA"`
+	AD     bool `json:"AD"`
+	CD     bool `json:"CD"`
+}
+
+// dohJSONQuestion is a question in the JSON DNS-over-HTTPS response.
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONRR is a resource record in the JSON DNS-over-HTTPS response.
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+}
+
+// dohJSONBlocked describes why the name was blocked.
+type dohJSONBlocked struct {
+	Reason      string         `json:"reason"`
+	ServiceName string         `json:"service_name,omitempty"`
+	Rules       []*dohJSONRule `json:"rules,omitempty"`
+}
+
+// dohJSONRule is a filtering rule that blocked the name.
+type dohJSONRule struct {
+	Text         string `json:"text"`
+	FilterListID int64  `json:"filter_list_id"`
+}
+
+// newDoHJSONResponse converts resp into the JSON DNS-over-HTTPS response.  res
+// is the filtering result of the request, it may be nil.
+func newDoHJSONResponse(resp *dns.Msg, res *filtering.Result) (jsonResp *dohJSONResponse) {
+	jsonResp = &dohJSONResponse{
+		Question:   make([]*dohJSONQuestion, 0, len(resp.Question)),
+		Answer:     newDoHJSONRRs(resp.Answer),
+		Authority:  newDoHJSONRRs(resp.Ns),
+		Additional: newDoHJSONRRs(resp.Extra),
+		Status:     resp.Rcode,
+		TC:         resp.Truncated,
+		RD:         resp.RecursionDesired,
+		RA:         resp.RecursionAvailable,
+		AD:         resp.AuthenticatedData,
+		CD:         resp.CheckingDisabled,
+	}
+
+	for _, q := range resp.Question {
+		jsonResp.Question = append(jsonResp.Question, &dohJSONQuestion{
+			Name: q.Name,
+			Type: q.Qtype,
+		})
+	}
+
+	if res == nil || !res.IsFiltered {
+		return jsonResp
+	}
+
+	jsonResp.Blocked = &dohJSONBlocked{
+		Reason:      res.Reason.String(),
+		ServiceName: res.ServiceName,
+	}
+
+	for _, r := range res.Rules {
+		jsonResp.Blocked.Rules = append(jsonResp.Blocked.Rules, &dohJSONRule{
+			Text:         r.Text,
+			FilterListID: r.FilterListID,
+		})
+	}
+
+	return jsonResp
+}
+
+// newDoHJSONRRs converts rrs into the JSON DNS-over-HTTPS resource records.
+// The OPT pseudo-records are skipped.
+func newDoHJSONRRs(rrs []dns.RR) (jsonRRs []*dohJSONRR) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		jsonRRs = append(jsonRRs, &dohJSONRR{
+			Name: hdr.Name,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+		})
+	}
+
+	return jsonRRs
+}
+
+// dohJSONResponseWriter is an [http.ResponseWriter] that keeps the wire-format
+// DNS-over-HTTPS response in memory.
+type dohJSONResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+// type check
+var _ http.ResponseWriter = (*dohJSONResponseWriter)(nil)
+
+// Header implements the [http.ResponseWriter] interface for
+// *dohJSONResponseWriter.
+func (w *dohJSONResponseWriter) Header() (h http.Header) {
+	return w.header
+}
+
+// Write implements the [http.ResponseWriter] interface for
+// *dohJSONResponseWriter.
+func (w *dohJSONResponseWriter) Write(b []byte) (n int, err error) {
+	return w.body.Write(b)
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface for
+// *dohJSONResponseWriter.
+func (w *dohJSONResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
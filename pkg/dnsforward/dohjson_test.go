@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/jynychen/AdGuardHome/pkg/aghalg"
+	"github.com/jynychen/AdGuardHome/pkg/aghtest"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_HandleDoH_json(t *testing.T) {
+	const blockedTTL = 10
+
+	s := createTestServer(t, &filtering.Config{
+		ProtectionEnabled:  true,
+		BlockingMode:       filtering.BlockingModeDefault,
+		BlockedResponseTTL: blockedTTL,
+	}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		Config: Config{
+			EDNSClientSubnet: &EDNSClientSubnet{Enabled: false},
+		},
+		TLSAllowUnencryptedDoH: true,
+	}, nil)
+
+	ups := aghtest.NewUpstreamMock(func(req *dns.Msg) (resp *dns.Msg, err error) {
+		return aghalg.Coalesce(
+			aghtest.MatchedResponse(req, dns.TypeAAAA, "example.org", "2001:db8::1"),
+			new(dns.Msg).SetRcode(req, dns.RcodeNameError),
+		), nil
+	})
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{ups}
+	startDeferStop(t, s)
+
+	testCases := []struct {
+		want     *dohJSONResponse
+		name     string
+		target   string
+		wantCode int
+	}{{
+		want: &dohJSONResponse{
+			Question: []*dohJSONQuestion{{Name: "example.org.", Type: dns.TypeAAAA}},
+			Answer: []*dohJSONRR{{
+				Name: "example.org.",
+				Data: "2001:db8::1",
+				Type: dns.TypeAAAA,
+				TTL:  60,
+			}},
+			Status: dns.RcodeSuccess,
+			RD:     true,
+		},
+		name:     "resolved",
+		target:   "/dns-query?name=example.org&type=AAAA",
+		wantCode: http.StatusOK,
+	}, {
+		want: &dohJSONResponse{
+			Blocked: &dohJSONBlocked{
+				Reason: filtering.FilteredBlockList.String(),
+				Rules: []*dohJSONRule{{
+					Text:         "||nxdomain.example.org",
+					FilterListID: 0,
+				}},
+			},
+			Question: []*dohJSONQuestion{{Name: "nxdomain.example.org.", Type: dns.TypeA}},
+			Answer: []*dohJSONRR{{
+				Name: "nxdomain.example.org.",
+				Data: "0.0.0.0",
+				Type: dns.TypeA,
+				TTL:  blockedTTL,
+			}},
+			Status: dns.RcodeSuccess,
+			RD:     true,
+			RA:     true,
+		},
+		name:     "blocked",
+		target:   "/dns-query/cli?name=nxdomain.example.org",
+		wantCode: http.StatusOK,
+	}, {
+		want:     nil,
+		name:     "bad_type",
+		target:   "/dns-query?name=example.org&type=BAD",
+		wantCode: http.StatusBadRequest,
+	}, {
+		want:     nil,
+		name:     "bad_do",
+		target:   "/dns-query?name=example.org&do=yes",
+		wantCode: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			w := httptest.NewRecorder()
+
+			s.handleDoH(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			if tc.want == nil {
+				return
+			}
+
+			assert.Equal(t, dohJSONContentType, w.Header().Get("Content-Type"))
+
+			resp := &dohJSONResponse{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, resp)
+		})
+	}
+}
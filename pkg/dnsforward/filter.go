@@ -90,6 +90,7 @@ func (s *Server) filterDNSRequest(dctx *dnsContext) (res *filtering.Result, err
 			res.Rules[0].Text,
 		)
 		pctx.Res = s.genDNSFilterMessage(pctx, res)
+		s.attachBlockPageToken(dctx, res)
 	case res.Reason.In(filtering.Rewritten, filtering.RewrittenRule) &&
 		res.CanonName != "" &&
 		len(res.IPList) == 0:
@@ -202,6 +203,7 @@ func (s *Server) filterDNSResponse(dctx *dnsContext) (err error) {
 			dctx.result = res
 			dctx.origResp = pctx.Res
 			pctx.Res = s.genDNSFilterMessage(pctx, res)
+			s.attachBlockPageToken(dctx, res)
 
 			log.Debug("dnsforward: matched %q by response: %q", pctx.Req.Question[0].Name, host)
 
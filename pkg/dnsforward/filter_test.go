@@ -374,3 +374,83 @@ func newSVCBHintsAnswer(target string, hints []dns.SVCBKeyValue) (rrs []dns.RR)
 		},
 	}}
 }
+
+func TestServer_genDNSFilterMessage(t *testing.T) {
+	const blockedTTL = 10
+
+	blockingIP := netip.MustParseAddr("192.0.2.100")
+
+	s := createTestServer(t, &filtering.Config{
+		BlockingMode:       filtering.BlockingModeCustomIP,
+		BlockingIPv4:       blockingIP,
+		BlockingIPv6:       netip.MustParseAddr("2001:db8::100"),
+		BlockedResponseTTL: blockedTTL,
+	}, ServerConfig{
+		Config: Config{
+			EDNSClientSubnet: &EDNSClientSubnet{Enabled: false},
+		},
+	}, nil)
+
+	blockedRules := []*filtering.ResultRule{{Text: "||blocked.example^"}}
+
+	testCases := []struct {
+		res       *filtering.Result
+		name      string
+		wantAns   []dns.RR
+		wantRCode int
+	}{{
+		res: &filtering.Result{
+			DNSRewriteResult: &filtering.DNSRewriteResult{RCode: dns.RcodeNameError},
+			Rules:            blockedRules,
+			Reason:           filtering.FilteredBlockList,
+			IsFiltered:       true,
+			IsRPZ:            true,
+		},
+		name:      "rpz_nxdomain",
+		wantAns:   nil,
+		wantRCode: dns.RcodeNameError,
+	}, {
+		res: &filtering.Result{
+			DNSRewriteResult: &filtering.DNSRewriteResult{RCode: dns.RcodeSuccess},
+			Rules:            blockedRules,
+			Reason:           filtering.FilteredBlockList,
+			IsFiltered:       true,
+			IsRPZ:            true,
+		},
+		name:      "rpz_nodata",
+		wantAns:   nil,
+		wantRCode: dns.RcodeSuccess,
+	}, {
+		res: &filtering.Result{
+			DNSRewriteResult: &filtering.DNSRewriteResult{RCode: dns.RcodeNameError},
+			Rules:            blockedRules,
+			Reason:           filtering.FilteredBlockList,
+			IsFiltered:       true,
+		},
+		name: "dnsrewrite",
+		wantAns: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   "blocked.example.",
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    blockedTTL,
+			},
+			A: blockingIP.AsSlice(),
+		}},
+		wantRCode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &proxy.DNSContext{
+				Req: createTestMessageWithType("blocked.example.", dns.TypeA),
+			}
+
+			resp := s.genDNSFilterMessage(dctx, tc.res)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRCode, resp.Rcode)
+			assert.Equal(t, tc.wantAns, resp.Answer)
+		})
+	}
+}
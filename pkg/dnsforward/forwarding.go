@@ -0,0 +1,361 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"golang.org/x/exp/slices"
+)
+
+// ForwardingRule is a conditional forwarding rule, which routes the requests
+// for the names within a domain to the specific upstream servers.
+type ForwardingRule struct {
+	// Domain is the domain name suffix the rule applies to.  The "*." prefix
+	// makes the rule only apply to the subdomains of the domain.
+	Domain string `yaml:"domain" json:"domain"`
+
+	// Comment is an optional human-readable description of the rule.
+	Comment string `yaml:"comment" json:"comment"`
+
+	// Upstreams are the addresses of the upstream servers for the domain.  The
+	// special "#" address means that the default upstream servers should be
+	// used, which excludes the domain from the less specific rules.
+	Upstreams []string `yaml:"upstreams" json:"upstreams"`
+
+	// Bootstrap are the addresses of the DNS servers used to resolve the
+	// hostnames of Upstreams.  If empty, the global bootstrap servers are used.
+	Bootstrap []string `yaml:"bootstrap_dns" json:"bootstrap_dns"`
+
+	// ExcludeSubdomains, if true, makes the rule only apply to the domain
+	// itself and not to its subdomains.
+	ExcludeSubdomains bool `yaml:"exclude_subdomains" json:"exclude_subdomains"`
+
+	// Enabled, if false, makes the rule be ignored.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+// clone returns a deep copy of r.
+func (r *ForwardingRule) clone() (c *ForwardingRule) {
+	c = &ForwardingRule{}
+	*c = *r
+	c.Upstreams = slices.Clone(r.Upstreams)
+	c.Bootstrap = slices.Clone(r.Bootstrap)
+
+	return c
+}
+
+// validate returns an error if r isn't a valid forwarding rule.
+func (r *ForwardingRule) validate() (err error) {
+	if r == nil {
+		return errors.Error("rule is nil")
+	}
+
+	defer func() { err = errors.Annotate(err, "rule for domain %q: %w", r.Domain) }()
+
+	domain, isWildcard := strings.CutPrefix(r.Domain, "*.")
+	err = netutil.ValidateDomainName(domain)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	} else if isWildcard && r.ExcludeSubdomains {
+		return errors.Error("wildcard domain can't exclude subdomains")
+	} else if len(r.Upstreams) == 0 {
+		return errors.Error("no upstreams")
+	}
+
+	for i, u := range r.Upstreams {
+		_, err = validateUpstream(u, []string{r.Domain})
+		if err != nil {
+			return fmt.Errorf("upstream at index %d: %w", i, err)
+		}
+	}
+
+	for i, b := range r.Bootstrap {
+		if _, err = upstream.NewResolver(b, nil); err != nil {
+			return fmt.Errorf("bootstrap at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// upstreamLines returns the rule in the "[/domain/]upstream" syntax accepted by
+// [proxy.ParseUpstreamsConfig].
+func (r *ForwardingRule) upstreamLines() (lines []string) {
+	for _, u := range r.Upstreams {
+		lines = append(lines, "[/"+r.Domain+"/]"+u)
+	}
+
+	if r.ExcludeSubdomains {
+		lines = append(lines, "[/*."+r.Domain+"/]#")
+	}
+
+	return lines
+}
+
+// validateForwardingRules returns an error if any of rules is invalid or if
+// there are several rules for the same domain.
+func validateForwardingRules(rules []*ForwardingRule) (err error) {
+	domains := map[string]struct{}{}
+	for i, r := range rules {
+		err = r.validate()
+		if err != nil {
+			return fmt.Errorf("forwarding rule at index %d: %w", i, err)
+		}
+
+		domain := strings.ToLower(r.Domain)
+		if _, ok := domains[domain]; ok {
+			return fmt.Errorf("forwarding rule at index %d: duplicate domain %q", i, r.Domain)
+		}
+
+		domains[domain] = struct{}{}
+	}
+
+	return nil
+}
+
+// forwardingRulesLines returns the upstream lines for the enabled rules which
+// use the global bootstrap servers.
+func forwardingRulesLines(rules []*ForwardingRule) (lines []string) {
+	for _, r := range rules {
+		if r.Enabled && len(r.Bootstrap) == 0 {
+			lines = append(lines, r.upstreamLines()...)
+		}
+	}
+
+	return lines
+}
+
+// addBootstrappedRules adds the upstreams of the enabled rules which use their
+// own bootstrap servers to uc.  opts are the global upstream options.
+func addBootstrappedRules(
+	uc *proxy.UpstreamConfig,
+	rules []*ForwardingRule,
+	opts *upstream.Options,
+) (err error) {
+	for _, r := range rules {
+		if !r.Enabled || len(r.Bootstrap) == 0 {
+			continue
+		}
+
+		ruleOpts := opts.Clone()
+		ruleOpts.Bootstrap = r.Bootstrap
+
+		var ruleConf *proxy.UpstreamConfig
+		ruleConf, err = proxy.ParseUpstreamsConfig(r.upstreamLines(), ruleOpts)
+		if err != nil {
+			return fmt.Errorf("forwarding rule for domain %q: %w", r.Domain, err)
+		}
+
+		mergeUpstreamConfig(uc, ruleConf)
+	}
+
+	return nil
+}
+
+// mergeUpstreamConfig adds the domain-specific upstreams of src to dst the
+// same way [proxy.ParseUpstreamsConfig] combines the lines of a single
+// configuration.  Both dst and src must be created by it.
+func mergeUpstreamConfig(dst, src *proxy.UpstreamConfig) {
+	for host, ups := range src.SpecifiedDomainUpstreams {
+		if ups == nil {
+			dst.SpecifiedDomainUpstreams[host] = nil
+		} else {
+			dst.SpecifiedDomainUpstreams[host] = append(dst.SpecifiedDomainUpstreams[host], ups...)
+		}
+	}
+
+	for host, ups := range src.DomainReservedUpstreams {
+		switch {
+		case src.SubdomainExclusions.Has(host):
+			// The subdomains-only upstreams override the others.
+			dst.SubdomainExclusions.Add(host)
+			dst.DomainReservedUpstreams[host] = ups
+		case dst.SubdomainExclusions.Has(host):
+			// Keep the subdomains-only upstreams of dst.
+		case ups == nil:
+			dst.DomainReservedUpstreams[host] = nil
+		default:
+			dst.DomainReservedUpstreams[host] = append(dst.DomainReservedUpstreams[host], ups...)
+		}
+	}
+}
+
+// forwardingRuleUpdateJSON is the request body of the PUT
+// /control/forwarding_rules/update HTTP API.
+type forwardingRuleUpdateJSON struct {
+	// Data is the new rule.
+	Data *ForwardingRule `json:"data"`
+
+	// Domain is the domain of the rule to update.
+	Domain string `json:"domain"`
+}
+
+// forwardingRuleDeleteJSON is the request body of the POST
+// /control/forwarding_rules/delete HTTP API.
+type forwardingRuleDeleteJSON struct {
+	// Domain is the domain of the rule to delete.
+	Domain string `json:"domain"`
+}
+
+// handleForwardingRulesList is the handler for the GET
+// /control/forwarding_rules/list HTTP API.
+func (s *Server) handleForwardingRulesList(w http.ResponseWriter, r *http.Request) {
+	rules := []*ForwardingRule{}
+
+	func() {
+		s.serverLock.RLock()
+		defer s.serverLock.RUnlock()
+
+		for _, rule := range s.conf.ForwardingRules {
+			rules = append(rules, rule.clone())
+		}
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, rules)
+}
+
+// handleForwardingRulesAdd is the handler for the POST
+// /control/forwarding_rules/add HTTP API.
+func (s *Server) handleForwardingRulesAdd(w http.ResponseWriter, r *http.Request) {
+	rule := &ForwardingRule{}
+	err := json.NewDecoder(r.Body).Decode(rule)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	s.updateForwardingRules(w, r, func(rules []*ForwardingRule) (upd []*ForwardingRule, err error) {
+		return append(rules, rule), nil
+	})
+}
+
+// handleForwardingRulesUpdate is the handler for the PUT
+// /control/forwarding_rules/update HTTP API.
+func (s *Server) handleForwardingRulesUpdate(w http.ResponseWriter, r *http.Request) {
+	req := &forwardingRuleUpdateJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	} else if req.Data == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no rule data")
+
+		return
+	}
+
+	s.updateForwardingRules(w, r, func(rules []*ForwardingRule) (upd []*ForwardingRule, err error) {
+		i := indexForwardingRule(rules, req.Domain)
+		if i < 0 {
+			return nil, fmt.Errorf("no rule for domain %q", req.Domain)
+		}
+
+		rules[i] = req.Data
+
+		return rules, nil
+	})
+}
+
+// handleForwardingRulesDelete is the handler for the POST
+// /control/forwarding_rules/delete HTTP API.
+func (s *Server) handleForwardingRulesDelete(w http.ResponseWriter, r *http.Request) {
+	req := &forwardingRuleDeleteJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	s.updateForwardingRules(w, r, func(rules []*ForwardingRule) (upd []*ForwardingRule, err error) {
+		i := indexForwardingRule(rules, req.Domain)
+		if i < 0 {
+			return nil, fmt.Errorf("no rule for domain %q", req.Domain)
+		}
+
+		return slices.Delete(rules, i, i+1), nil
+	})
+}
+
+// indexForwardingRule returns the index of the rule for domain within rules or
+// -1 if there is none.
+func indexForwardingRule(rules []*ForwardingRule, domain string) (i int) {
+	return slices.IndexFunc(rules, func(r *ForwardingRule) (ok bool) {
+		return strings.EqualFold(r.Domain, domain)
+	})
+}
+
+// updateForwardingRules applies modify to the copy of the current forwarding
+// rules, validates the result, and reconfigures the server to use it.  The
+// configuration is only saved if the server has been reconfigured
+// successfully, otherwise the previous rules are restored.  The errors are
+// written to w.
+func (s *Server) updateForwardingRules(
+	w http.ResponseWriter,
+	r *http.Request,
+	modify func(rules []*ForwardingRule) (upd []*ForwardingRule, err error),
+) {
+	var prev []*ForwardingRule
+	err := func() (err error) {
+		s.serverLock.Lock()
+		defer s.serverLock.Unlock()
+
+		prev = s.conf.ForwardingRules
+		rules, err := modify(slices.Clone(prev))
+		if err != nil {
+			return err
+		}
+
+		err = validateForwardingRules(rules)
+		if err != nil {
+			return err
+		}
+
+		s.conf.ForwardingRules = rules
+
+		return nil
+	}()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	err = s.Reconfigure(nil)
+	if err != nil {
+		s.restoreForwardingRules(prev)
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	log.Debug("dnsforward: forwarding rules updated")
+
+	s.conf.ConfigModified()
+}
+
+// restoreForwardingRules sets the forwarding rules back to prev and
+// reconfigures the server to use them.
+func (s *Server) restoreForwardingRules(prev []*ForwardingRule) {
+	func() {
+		s.serverLock.Lock()
+		defer s.serverLock.Unlock()
+
+		s.conf.ForwardingRules = prev
+	}()
+
+	err := s.Reconfigure(nil)
+	if err != nil {
+		log.Error("dnsforward: restoring forwarding rules: %s", err)
+	}
+}
@@ -0,0 +1,278 @@
+package dnsforward
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardingRule_validate(t *testing.T) {
+	testCases := []struct {
+		rule       *ForwardingRule
+		name       string
+		wantErrMsg string
+	}{{
+		rule: &ForwardingRule{
+			Domain:    "example.org",
+			Upstreams: []string{"1.1.1.1", "tls://dns.example", "#"},
+			Bootstrap: []string{"9.9.9.9"},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		rule: &ForwardingRule{
+			Domain:    "*.example.org",
+			Upstreams: []string{"1.1.1.1"},
+		},
+		name:       "valid_wildcard",
+		wantErrMsg: "",
+	}, {
+		rule:       nil,
+		name:       "nil",
+		wantErrMsg: "rule is nil",
+	}, {
+		rule: &ForwardingRule{
+			Domain:    "example.org",
+			Upstreams: nil,
+		},
+		name:       "no_upstreams",
+		wantErrMsg: `rule for domain "example.org": no upstreams`,
+	}, {
+		rule: &ForwardingRule{
+			Domain:    "",
+			Upstreams: []string{"1.1.1.1"},
+		},
+		name:       "empty_domain",
+		wantErrMsg: `rule for domain "": bad domain name "": domain name is empty`,
+	}, {
+		rule: &ForwardingRule{
+			Domain:            "*.example.org",
+			Upstreams:         []string{"1.1.1.1"},
+			ExcludeSubdomains: true,
+		},
+		name:       "wildcard_exclude",
+		wantErrMsg: `rule for domain "*.example.org": wildcard domain can't exclude subdomains`,
+	}, {
+		rule: &ForwardingRule{
+			Domain:    "example.org",
+			Upstreams: []string{"bad://1.1.1.1"},
+		},
+		name:       "bad_upstream",
+		wantErrMsg: `rule for domain "example.org": upstream at index 0: bad protocol "bad"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.rule.validate())
+		})
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		err := validateForwardingRules([]*ForwardingRule{{
+			Domain:    "example.org",
+			Upstreams: []string{"1.1.1.1"},
+		}, {
+			Domain:    "EXAMPLE.org",
+			Upstreams: []string{"8.8.8.8"},
+		}})
+		testutil.AssertErrorMsg(t, `forwarding rule at index 1: duplicate domain "EXAMPLE.org"`, err)
+	})
+}
+
+func TestForwardingRulesLines(t *testing.T) {
+	rules := []*ForwardingRule{{
+		Domain:    "example.org",
+		Upstreams: []string{"1.1.1.1", "8.8.8.8"},
+		Enabled:   true,
+	}, {
+		Domain:            "example.net",
+		Upstreams:         []string{"1.1.1.1"},
+		ExcludeSubdomains: true,
+		Enabled:           true,
+	}, {
+		Domain:    "disabled.example",
+		Upstreams: []string{"1.1.1.1"},
+		Enabled:   false,
+	}, {
+		Domain:    "bootstrapped.example",
+		Upstreams: []string{"tls://dns.example"},
+		Bootstrap: []string{"9.9.9.9"},
+		Enabled:   true,
+	}}
+
+	assert.Equal(t, []string{
+		"[/example.org/]1.1.1.1",
+		"[/example.org/]8.8.8.8",
+		"[/example.net/]1.1.1.1",
+		"[/*.example.net/]#",
+	}, forwardingRulesLines(rules))
+}
+
+// upstreamAddrs returns the addresses of ups.
+func upstreamAddrs(ups []upstream.Upstream) (addrs []string) {
+	for _, u := range ups {
+		addrs = append(addrs, u.Address())
+	}
+
+	return addrs
+}
+
+func TestAddBootstrappedRules(t *testing.T) {
+	uc, err := proxy.ParseUpstreamsConfig([]string{
+		"1.1.1.1",
+		"[/*.wild.example/]2.2.2.2",
+		"[/plain.example/]3.3.3.3",
+	}, nil)
+	require.NoError(t, err)
+
+	err = addBootstrappedRules(uc, []*ForwardingRule{{
+		Domain:    "wild.example",
+		Upstreams: []string{"4.4.4.4"},
+		Bootstrap: []string{"9.9.9.9"},
+		Enabled:   true,
+	}, {
+		Domain:            "plain.example",
+		Upstreams:         []string{"5.5.5.5"},
+		Bootstrap:         []string{"9.9.9.9"},
+		ExcludeSubdomains: true,
+		Enabled:           true,
+	}, {
+		Domain:    "disabled.example",
+		Upstreams: []string{"6.6.6.6"},
+		Bootstrap: []string{"9.9.9.9"},
+		Enabled:   false,
+	}}, &upstream.Options{})
+	require.NoError(t, err)
+
+	// The apex of wild.example is served by the new rule, while its
+	// subdomains are still served by the subdomains-only upstream.
+	assert.Equal(t, []string{"4.4.4.4:53"}, upstreamAddrs(uc.SpecifiedDomainUpstreams["wild.example."]))
+	assert.Equal(t, []string{"2.2.2.2:53"}, upstreamAddrs(uc.DomainReservedUpstreams["wild.example."]))
+
+	// The subdomains of plain.example are excluded by the new rule.
+	assert.True(t, uc.SubdomainExclusions.Has("plain.example."))
+	assert.Empty(t, uc.DomainReservedUpstreams["plain.example."])
+	assert.Equal(
+		t,
+		[]string{"3.3.3.3:53", "5.5.5.5:53"},
+		upstreamAddrs(uc.SpecifiedDomainUpstreams["plain.example."]),
+	)
+
+	assert.NotContains(t, uc.DomainReservedUpstreams, "disabled.example.")
+}
+
+func TestServer_handleForwardingRules(t *testing.T) {
+	// modified is the number of times the configuration has been saved.
+	modified := 0
+
+	forwardConf := ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{},
+		TCPListenAddrs: []*net.TCPAddr{},
+		Config: Config{
+			UpstreamDNS:      []string{"8.8.8.8:53"},
+			EDNSClientSubnet: &EDNSClientSubnet{Enabled: false},
+		},
+		ConfigModified: func() { modified++ },
+	}
+	s := createTestServer(t, &filtering.Config{BlockingMode: filtering.BlockingModeDefault}, forwardConf, nil)
+	s.sysResolvers = &fakeSystemResolvers{}
+
+	err := s.Start()
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Stop)
+
+	// do sends the request with the JSON-encoded body to the handler and
+	// returns the response code.
+	do := func(h http.HandlerFunc, method string, body any) (code int) {
+		b, jsonErr := json.Marshal(body)
+		require.NoError(t, jsonErr)
+
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, "/", bytes.NewReader(b)))
+
+		return w.Code
+	}
+
+	// list returns the current rules using the HTTP API.
+	list := func() (rules []*ForwardingRule) {
+		w := httptest.NewRecorder()
+		s.handleForwardingRulesList(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&rules))
+
+		return rules
+	}
+
+	rule := &ForwardingRule{
+		Domain:    "example.org",
+		Comment:   "test",
+		Upstreams: []string{"1.1.1.1"},
+		Enabled:   true,
+	}
+
+	code := do(s.handleForwardingRulesAdd, http.MethodPost, rule)
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Equal(t, 1, modified)
+	assert.Equal(t, []*ForwardingRule{rule}, list())
+	assert.Equal(
+		t,
+		[]string{"1.1.1.1:53"},
+		upstreamAddrs(s.conf.UpstreamConfig.DomainReservedUpstreams["example.org."]),
+	)
+
+	t.Run("add_duplicate", func(t *testing.T) {
+		code = do(s.handleForwardingRulesAdd, http.MethodPost, rule)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		// The configuration isn't saved when the update fails.
+		assert.Equal(t, 1, modified)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		upd := rule.clone()
+		upd.Upstreams = []string{"8.8.4.4"}
+
+		code = do(s.handleForwardingRulesUpdate, http.MethodPut, &forwardingRuleUpdateJSON{
+			Data:   upd,
+			Domain: "EXAMPLE.org",
+		})
+		require.Equal(t, http.StatusOK, code)
+
+		assert.Equal(t, []*ForwardingRule{upd}, list())
+		assert.Equal(
+			t,
+			[]string{"8.8.4.4:53"},
+			upstreamAddrs(s.conf.UpstreamConfig.DomainReservedUpstreams["example.org."]),
+		)
+	})
+
+	t.Run("update_missing", func(t *testing.T) {
+		code = do(s.handleForwardingRulesUpdate, http.MethodPut, &forwardingRuleUpdateJSON{
+			Data:   rule,
+			Domain: "missing.example",
+		})
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		code = do(s.handleForwardingRulesDelete, http.MethodPost, &forwardingRuleDeleteJSON{
+			Domain: "example.org",
+		})
+		require.Equal(t, http.StatusOK, code)
+
+		assert.Empty(t, list())
+		assert.NotContains(t, s.conf.UpstreamConfig.DomainReservedUpstreams, "example.org.")
+	})
+}
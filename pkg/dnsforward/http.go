@@ -829,6 +829,34 @@ func (s *Server) handleCacheClear(w http.ResponseWriter, _ *http.Request) {
 	_, _ = io.WriteString(w, "OK")
 }
 
+// upstreamsHealthJSON is the response for the GET /control/upstreams/health
+// HTTP API.
+type upstreamsHealthJSON struct {
+	// Upstreams are the health states of the upstream DNS servers.
+	Upstreams []*upstreamHealthJSON `json:"upstreams"`
+
+	// Enabled is true if the health checking is enabled.
+	Enabled bool `json:"enabled"`
+}
+
+// handleUpstreamsHealth is the handler for the GET /control/upstreams/health
+// HTTP API.
+func (s *Server) handleUpstreamsHealth(w http.ResponseWriter, r *http.Request) {
+	resp := &upstreamsHealthJSON{
+		Upstreams: []*upstreamHealthJSON{},
+	}
+
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if s.upsHealth != nil {
+		resp.Upstreams = s.upsHealth.toJSON()
+		resp.Enabled = true
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
 // protectionJSON is an object for /control/protection endpoint.
 type protectionJSON struct {
 	Enabled  bool `json:"enabled"`
@@ -874,7 +902,8 @@ func (s *Server) handleSetProtection(w http.ResponseWriter, r *http.Request) {
 	aghhttp.OK(w)
 }
 
-// handleDoH is the DNS-over-HTTPs handler.
+// handleDoH is the DNS-over-HTTPs handler.  The GET requests with the name
+// parameter are handled by the JSON API, see [Server.handleDoHJSON].
 //
 // Control flow:
 //
@@ -897,6 +926,12 @@ func (s *Server) handleDoH(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isDoHJSONRequest(r) {
+		s.handleDoHJSON(w, r)
+
+		return
+	}
+
 	s.ServeHTTP(w, r)
 }
 
@@ -908,6 +943,13 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream_dns", s.handleTestUpstreamDNS)
+	s.conf.HTTPRegister(http.MethodGet, "/control/upstreams/health", s.handleUpstreamsHealth)
+
+	s.conf.HTTPRegister(http.MethodGet, "/control/forwarding_rules/list", s.handleForwardingRulesList)
+	s.conf.HTTPRegister(http.MethodPost, "/control/forwarding_rules/add", s.handleForwardingRulesAdd)
+	s.conf.HTTPRegister(http.MethodPut, "/control/forwarding_rules/update", s.handleForwardingRulesUpdate)
+	s.conf.HTTPRegister(http.MethodPost, "/control/forwarding_rules/delete", s.handleForwardingRulesDelete)
+
 	s.conf.HTTPRegister(http.MethodPost, "/control/protection", s.handleSetProtection)
 
 	s.conf.HTTPRegister(http.MethodGet, "/control/access/list", s.handleAccessList)
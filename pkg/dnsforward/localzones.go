@@ -0,0 +1,418 @@
+package dnsforward
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghos"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// localZonesPrefix is a prefix for logging and wrapping errors in localZones's
+// methods.
+const localZonesPrefix = "dnsforward: local zones"
+
+// maxCNAMEChain is the maximum number of CNAME records followed within a local
+// zone while answering a single request.
+const maxCNAMEChain = 8
+
+// localZones answers the requests for the names within the zones loaded from
+// RFC 1035 zone files.  The files are reloaded when they change.
+type localZones struct {
+	// zones are the currently loaded zones sorted by the number of labels of
+	// their origins in descending order, so that the most specific zone is
+	// found first.
+	zones atomic.Pointer[[]*localZone]
+
+	// watcher tracks the changes in the zone files.
+	watcher aghos.FSWatcher
+
+	// done is closed to stop handling the watcher's events.
+	done chan struct{}
+
+	// files are the paths to the zone files.
+	files []string
+}
+
+// newLocalZones loads the zones from files and starts watching them for
+// changes using w.  files must not be empty and w must not be nil.
+func newLocalZones(w aghos.FSWatcher, files []string) (lz *localZones, err error) {
+	defer func() { err = errors.Annotate(err, "%s: %w", localZonesPrefix) }()
+
+	lz = &localZones{
+		watcher: w,
+		done:    make(chan struct{}),
+		files:   slices.Clone(files),
+	}
+
+	err = lz.refresh()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	for _, f := range files {
+		err = w.Add(f)
+		if err != nil {
+			return nil, fmt.Errorf("watching %q: %w", f, err)
+		}
+	}
+
+	go lz.handleEvents()
+
+	return lz, nil
+}
+
+// Close implements the [io.Closer] interface for *localZones.  It closes both
+// itself and its watcher.  Close must only be called once.
+func (lz *localZones) Close() (err error) {
+	err = lz.watcher.Close()
+	close(lz.done)
+
+	if err != nil {
+		return fmt.Errorf("%s: closing watcher: %w", localZonesPrefix, err)
+	}
+
+	return nil
+}
+
+// handleEvents reloads the zones on each event of the watcher.  It's used to be
+// called within a separate goroutine.
+func (lz *localZones) handleEvents() {
+	defer log.OnPanic(localZonesPrefix + ": handling events")
+
+	ok, eventsCh := true, lz.watcher.Events()
+	for ok {
+		select {
+		case _, ok = <-eventsCh:
+			if !ok {
+				log.Debug("%s: watcher closed the events channel", localZonesPrefix)
+
+				continue
+			}
+
+			if err := lz.refresh(); err != nil {
+				log.Error("%s: warning: reloading, keeping previous zones: %s", localZonesPrefix, err)
+			}
+		case _, ok = <-lz.done:
+			// Go on.
+		}
+	}
+}
+
+// refresh loads the zones from the files and replaces the current ones.  The
+// current zones are kept if any of the files fails to load.
+func (lz *localZones) refresh() (err error) {
+	zones := make([]*localZone, 0, len(lz.files))
+	for _, f := range lz.files {
+		var z *localZone
+		z, err = loadZoneFile(f)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+
+		for _, other := range zones {
+			if other.origin == z.origin {
+				return fmt.Errorf("zone %q in %q: duplicate zone", z.origin, f)
+			}
+		}
+
+		zones = append(zones, z)
+	}
+
+	slices.SortStableFunc(zones, func(a, b *localZone) (res int) {
+		return dns.CountLabel(b.origin) - dns.CountLabel(a.origin)
+	})
+
+	lz.zones.Store(&zones)
+
+	log.Debug("%s: loaded %d zones", localZonesPrefix, len(zones))
+
+	return nil
+}
+
+// resolve fills resp with the authoritative answer to q if q.Name belongs to
+// one of the zones.  ok is false if there is no such zone, in which case resp
+// isn't modified.
+func (lz *localZones) resolve(resp *dns.Msg, q dns.Question) (ok bool) {
+	if q.Qclass != dns.ClassINET {
+		return false
+	}
+
+	name := strings.ToLower(q.Name)
+	for _, z := range *lz.zones.Load() {
+		if dns.IsSubDomain(z.origin, name) {
+			z.answer(resp, name, q.Qtype)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// localZone is a single authoritative zone.
+type localZone struct {
+	// soa is the start of authority record of the zone.
+	soa *dns.SOA
+
+	// records maps the lowercased owner names to their resource records.  The
+	// empty non-terminals are also present with nil values.
+	records map[string][]dns.RR
+
+	// origin is the lowercased fully-qualified name of the zone apex.
+	origin string
+}
+
+// loadZoneFile parses the zone from the file with the given name.
+func loadZoneFile(fileName string) (z *localZone, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("opening zone file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	z, err = parseZone(f, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("parsing zone file %q: %w", fileName, err)
+	}
+
+	return z, nil
+}
+
+// parseZone parses the zone from r.  fileName is only used in error messages.
+// The zone must contain exactly one SOA record, which owner is the zone apex,
+// and all the records must be within the zone.
+func parseZone(r io.Reader, fileName string) (z *localZone, err error) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, "", fileName)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if z != nil {
+				return nil, fmt.Errorf("zone %q: more than one soa record", z.origin)
+			}
+
+			z = &localZone{
+				soa:     soa,
+				records: map[string][]dns.RR{},
+				origin:  strings.ToLower(soa.Hdr.Name),
+			}
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	if err = zp.Err(); err != nil {
+		return nil, err
+	} else if z == nil {
+		return nil, errors.Error("no soa record")
+	}
+
+	for _, rr := range rrs {
+		err = z.add(rr)
+		if err != nil {
+			return nil, fmt.Errorf("zone %q: %w", z.origin, err)
+		}
+	}
+
+	return z, nil
+}
+
+// add adds rr to the zone along with the empty non-terminals between its owner
+// name and the zone apex.
+func (z *localZone) add(rr dns.RR) (err error) {
+	name := strings.ToLower(rr.Header().Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return fmt.Errorf("record %q is out of zone", rr.Header().Name)
+	}
+
+	z.records[name] = append(z.records[name], rr)
+
+	for parent := parentName(name); parent != "" && dns.IsSubDomain(z.origin, parent); {
+		if _, ok := z.records[parent]; ok {
+			break
+		}
+
+		z.records[parent] = nil
+		parent = parentName(parent)
+	}
+
+	return nil
+}
+
+// parentName returns the name of the parent domain of the fully-qualified name
+// or an empty string if name is the root domain.
+func parentName(name string) (parent string) {
+	if name == "." {
+		return ""
+	}
+
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+
+	return name[off:]
+}
+
+// answer fills resp with the answer for the lowercased name and qtype.  name
+// must be within the zone.
+func (z *localZone) answer(resp *dns.Msg, name string, qtype uint16) {
+	resp.Authoritative = true
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		if z.refer(resp, name, qtype) {
+			return
+		}
+
+		rrs, exists := z.lookup(name)
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = append(resp.Ns, z.negativeSOA())
+
+			return
+		}
+
+		var cname dns.RR
+		found := false
+		for _, rr := range rrs {
+			rrType := rr.Header().Rrtype
+			if rrType == qtype || qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, rr)
+				found = true
+			} else if rrType == dns.TypeCNAME {
+				cname = rr
+			}
+		}
+
+		if found {
+			return
+		} else if cname == nil {
+			// NODATA.
+			resp.Ns = append(resp.Ns, z.negativeSOA())
+
+			return
+		}
+
+		resp.Answer = append(resp.Answer, cname)
+
+		name = strings.ToLower(cname.(*dns.CNAME).Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			// Let the client resolve the target outside of the zone.
+			return
+		}
+	}
+
+	log.Debug("%s: cname chain in zone %q is too long", localZonesPrefix, z.origin)
+}
+
+// lookup returns the records for the lowercased name, synthesizing them from a
+// wildcard if necessary.  exists is false if there is no such name in the zone.
+func (z *localZone) lookup(name string) (rrs []dns.RR, exists bool) {
+	rrs, exists = z.records[name]
+	if exists {
+		return copyRRs(rrs), true
+	}
+
+	// Find the closest encloser, which always exists since the apex is within
+	// the zone, and look for the wildcard at it.
+	encloser := parentName(name)
+	for ; encloser != z.origin; encloser = parentName(encloser) {
+		if _, ok := z.records[encloser]; ok {
+			break
+		}
+	}
+
+	wildRRs, ok := z.records["*."+encloser]
+	if !ok {
+		return nil, false
+	}
+
+	rrs = copyRRs(wildRRs)
+	for _, rr := range rrs {
+		rr.Header().Name = name
+	}
+
+	return rrs, true
+}
+
+// refer adds a referral to resp if name is at or below a delegation point of
+// the zone.  ok is true if the referral has been added.
+func (z *localZone) refer(resp *dns.Msg, name string, qtype uint16) (ok bool) {
+	// Collect the names from the one right below the apex down to name.
+	var names []string
+	for n := name; n != z.origin; n = parentName(n) {
+		names = append(names, n)
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		cut := names[i]
+		if cut == name && qtype == dns.TypeDS {
+			// DS records at the delegation point belong to the parent zone.
+			return false
+		}
+
+		ns := filterRRs(z.records[cut], dns.TypeNS)
+		if len(ns) == 0 {
+			continue
+		}
+
+		if len(resp.Answer) == 0 {
+			resp.Authoritative = false
+		}
+
+		resp.Ns = append(resp.Ns, ns...)
+		for _, rr := range ns {
+			target := strings.ToLower(rr.(*dns.NS).Ns)
+			resp.Extra = append(resp.Extra, filterRRs(z.records[target], dns.TypeA)...)
+			resp.Extra = append(resp.Extra, filterRRs(z.records[target], dns.TypeAAAA)...)
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// negativeSOA returns the SOA record to put into the authority section of a
+// negative response.  Its TTL is set according to RFC 2308.
+func (z *localZone) negativeSOA() (soa *dns.SOA) {
+	soa = dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+
+	return soa
+}
+
+// filterRRs returns the copies of the records of rrType from rrs.
+func filterRRs(rrs []dns.RR, rrType uint16) (filtered []dns.RR) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrType {
+			filtered = append(filtered, dns.Copy(rr))
+		}
+	}
+
+	return filtered
+}
+
+// copyRRs returns the deep copies of rrs.
+func copyRRs(rrs []dns.RR) (copies []dns.RR) {
+	if rrs == nil {
+		return nil
+	}
+
+	copies = make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		copies = append(copies, dns.Copy(rr))
+	}
+
+	return copies
+}
@@ -0,0 +1,244 @@
+package dnsforward
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghtest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLocalZones returns a *localZones which loads the zone files and
+// reloads them on each event sent into the returned channel.
+func newTestLocalZones(t *testing.T, files ...string) (lz *localZones, events chan struct{}) {
+	t.Helper()
+
+	events = make(chan struct{})
+	w := &aghtest.FSWatcher{
+		OnEvents: func() (e <-chan struct{}) { return events },
+		OnAdd:    func(_ string) (err error) { return nil },
+		OnClose:  func() (err error) { return nil },
+	}
+
+	lz, err := newLocalZones(w, files)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, lz.Close)
+
+	return lz, events
+}
+
+func TestLocalZones_resolve(t *testing.T) {
+	lz, _ := newTestLocalZones(t, filepath.Join("testdata", "local.zone"))
+
+	testCases := []struct {
+		name       string
+		qname      string
+		wantAns    []string
+		wantNs     []string
+		wantExtra  []string
+		qtype      uint16
+		wantRcode  int
+		wantAuth   bool
+		wantServed bool
+	}{{
+		name:       "a",
+		qname:      "www.example.internal.",
+		qtype:      dns.TypeA,
+		wantAns:    []string{"www.example.internal.\t3600\tIN\tA\t192.0.2.1"},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:       "case_insensitive",
+		qname:      "WWW.Example.Internal.",
+		qtype:      dns.TypeAAAA,
+		wantAns:    []string{"www.example.internal.\t3600\tIN\tAAAA\t2001:db8::1"},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:  "cname_chain",
+		qname: "chain.example.internal.",
+		qtype: dns.TypeA,
+		wantAns: []string{
+			"chain.example.internal.\t3600\tIN\tCNAME\talias.example.internal.",
+			"alias.example.internal.\t3600\tIN\tCNAME\twww.example.internal.",
+			"www.example.internal.\t3600\tIN\tA\t192.0.2.1",
+		},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:       "cname_outside",
+		qname:      "outside.example.internal.",
+		qtype:      dns.TypeA,
+		wantAns:    []string{"outside.example.internal.\t3600\tIN\tCNAME\twww.example.org."},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:       "wildcard",
+		qname:      "any.wild.example.internal.",
+		qtype:      dns.TypeA,
+		wantAns:    []string{"any.wild.example.internal.\t3600\tIN\tA\t192.0.2.2"},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:  "nodata",
+		qname: "www.example.internal.",
+		qtype: dns.TypeMX,
+		wantNs: []string{
+			"example.internal.\t300\tIN\tSOA\tns1.example.internal. " +
+				"hostmaster.example.internal. 2023100101 7200 3600 1209600 300",
+		},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:  "empty_non_terminal",
+		qname: "b.deep.example.internal.",
+		qtype: dns.TypeTXT,
+		wantNs: []string{
+			"example.internal.\t300\tIN\tSOA\tns1.example.internal. " +
+				"hostmaster.example.internal. 2023100101 7200 3600 1209600 300",
+		},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:  "nxdomain",
+		qname: "none.example.internal.",
+		qtype: dns.TypeA,
+		wantNs: []string{
+			"example.internal.\t300\tIN\tSOA\tns1.example.internal. " +
+				"hostmaster.example.internal. 2023100101 7200 3600 1209600 300",
+		},
+		wantRcode:  dns.RcodeNameError,
+		wantAuth:   true,
+		wantServed: true,
+	}, {
+		name:       "delegation",
+		qname:      "host.sub.example.internal.",
+		qtype:      dns.TypeA,
+		wantNs:     []string{"sub.example.internal.\t3600\tIN\tNS\tns.sub.example.internal."},
+		wantExtra:  []string{"ns.sub.example.internal.\t3600\tIN\tA\t192.0.2.54"},
+		wantRcode:  dns.RcodeSuccess,
+		wantAuth:   false,
+		wantServed: true,
+	}, {
+		name:       "outside_zone",
+		qname:      "www.example.org.",
+		qtype:      dns.TypeA,
+		wantServed: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			resp := (&dns.Msg{}).SetReply(req)
+
+			served := lz.resolve(resp, req.Question[0])
+			require.Equal(t, tc.wantServed, served)
+
+			if !served {
+				return
+			}
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, tc.wantAuth, resp.Authoritative)
+			assert.Equal(t, tc.wantAns, rrsToStrings(resp.Answer))
+			assert.Equal(t, tc.wantNs, rrsToStrings(resp.Ns))
+			assert.Equal(t, tc.wantExtra, rrsToStrings(resp.Extra))
+		})
+	}
+}
+
+// rrsToStrings returns the presentation format of rrs.
+func rrsToStrings(rrs []dns.RR) (strs []string) {
+	for _, rr := range rrs {
+		strs = append(strs, rr.String())
+	}
+
+	return strs
+}
+
+func TestLocalZones_refresh(t *testing.T) {
+	const zoneData = `$ORIGIN test.internal.
+@	3600	IN	SOA	ns hostmaster 1 7200 3600 1209600 300
+host	3600	IN	A	192.0.2.%d
+`
+
+	zoneFile := filepath.Join(t.TempDir(), "test.zone")
+	err := os.WriteFile(zoneFile, []byte(strings.Replace(zoneData, "%d", "1", 1)), 0o644)
+	require.NoError(t, err)
+
+	lz, events := newTestLocalZones(t, zoneFile)
+
+	resolveA := func() (ans []string) {
+		req := (&dns.Msg{}).SetQuestion("host.test.internal.", dns.TypeA)
+		resp := (&dns.Msg{}).SetReply(req)
+		require.True(t, lz.resolve(resp, req.Question[0]))
+
+		return rrsToStrings(resp.Answer)
+	}
+
+	assert.Equal(t, []string{"host.test.internal.\t3600\tIN\tA\t192.0.2.1"}, resolveA())
+
+	err = os.WriteFile(zoneFile, []byte(strings.Replace(zoneData, "%d", "2", 1)), 0o644)
+	require.NoError(t, err)
+
+	testutil.RequireSend(t, events, struct{}{}, time.Second)
+
+	assert.Eventually(t, func() (ok bool) {
+		ans := resolveA()
+
+		return len(ans) == 1 && ans[0] == "host.test.internal.\t3600\tIN\tA\t192.0.2.2"
+	}, time.Second, 10*time.Millisecond)
+
+	// A broken file must not replace the loaded zone.
+	err = os.WriteFile(zoneFile, []byte("broken"), 0o644)
+	require.NoError(t, err)
+
+	testutil.RequireSend(t, events, struct{}{}, time.Second)
+
+	// Make sure the event has been handled.
+	testutil.RequireSend(t, events, struct{}{}, time.Second)
+
+	assert.Equal(t, []string{"host.test.internal.\t3600\tIN\tA\t192.0.2.2"}, resolveA())
+}
+
+func TestParseZone_errors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		name:       "no_soa",
+		in:         "www.test.internal. 3600 IN A 192.0.2.1\n",
+		wantErrMsg: "no soa record",
+	}, {
+		name: "out_of_zone",
+		in: "test.internal. 3600 IN SOA ns.test.internal. hostmaster.test.internal. 1 2 3 4 5\n" +
+			"www.example.org. 3600 IN A 192.0.2.1\n",
+		wantErrMsg: `zone "test.internal.": record "www.example.org." is out of zone`,
+	}, {
+		name: "two_soa",
+		in: "test.internal. 3600 IN SOA ns.test.internal. hostmaster.test.internal. 1 2 3 4 5\n" +
+			"test.internal. 3600 IN SOA ns.test.internal. hostmaster.test.internal. 1 2 3 4 5\n",
+		wantErrMsg: `zone "test.internal.": more than one soa record`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseZone(strings.NewReader(tc.in), "test.zone")
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package dnsforward
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/jynychen/AdGuardHome/pkg/metrics"
+	"github.com/miekg/dns"
+)
+
+// serverMetrics are the metrics collected by the DNS server.  A nil
+// *serverMetrics is valid and collects nothing.
+type serverMetrics struct {
+	// queries counts the processed requests by the protocol, the question
+	// type, the response code, and the filtering reason.
+	queries *metrics.CounterVec
+
+	// upstreamDuration measures the latency of the exchanges with each
+	// upstream server.
+	upstreamDuration *metrics.HistogramVec
+
+	// upstreamErrors counts the failed exchanges with each upstream server.
+	upstreamErrors *metrics.CounterVec
+
+	// cacheHits counts the requests answered from the cache.
+	cacheHits *metrics.Counter
+
+	// cacheMisses counts the requests which were not found in the cache.
+	cacheMisses *metrics.Counter
+}
+
+// newServerMetrics registers the DNS server metrics in reg.  If reg is nil, m
+// is nil.
+func newServerMetrics(reg *metrics.Registry) (m *serverMetrics) {
+	if reg == nil {
+		return nil
+	}
+
+	return &serverMetrics{
+		queries: reg.NewCounterVec(
+			"adguardhome_dns_queries_total",
+			"Total number of processed DNS queries.",
+			"proto",
+			"qtype",
+			"rcode",
+			"reason",
+		),
+		upstreamDuration: reg.NewHistogramVec(
+			"adguardhome_dns_upstream_duration_seconds",
+			"Duration of exchanges with the upstream DNS servers.",
+			metrics.DefaultBuckets,
+			"upstream",
+		),
+		upstreamErrors: reg.NewCounterVec(
+			"adguardhome_dns_upstream_errors_total",
+			"Total number of failed exchanges with the upstream DNS servers.",
+			"upstream",
+		),
+		cacheHits: reg.NewCounterVec(
+			"adguardhome_dns_cache_hits_total",
+			"Total number of DNS queries answered from the cache.",
+		).With(),
+		cacheMisses: reg.NewCounterVec(
+			"adguardhome_dns_cache_misses_total",
+			"Total number of DNS queries not found in the cache.",
+		).With(),
+	}
+}
+
+// countQuery accounts the processed request in the metrics.
+func (m *serverMetrics) countQuery(dctx *dnsContext) {
+	if m == nil {
+		return
+	}
+
+	pctx := dctx.proxyCtx
+
+	qtype := dns.Type(pctx.Req.Question[0].Qtype).String()
+
+	rcode := ""
+	if pctx.Res != nil {
+		rcode = dns.RcodeToString[pctx.Res.Rcode]
+	}
+
+	reason := filtering.NotFilteredNotFound
+	if dctx.result != nil {
+		reason = dctx.result.Reason
+	}
+
+	m.queries.With(string(pctx.Proto), qtype, rcode, reason.String()).Inc()
+}
+
+// countCache accounts the cache usage by the request resolved by the proxy.
+// cacheEnabled is true if the cache is enabled in the server configuration.
+func (m *serverMetrics) countCache(pctx *proxy.DNSContext, cacheEnabled bool) {
+	if m == nil {
+		return
+	}
+
+	if pctx.CachedUpstreamAddr != "" {
+		m.cacheHits.Inc()
+	} else if cacheEnabled {
+		m.cacheMisses.Inc()
+	}
+}
+
+// wrapUpstreams replaces each upstream within conf with the one that records
+// the metrics of the exchanges.  conf must not be nil.
+func (m *serverMetrics) wrapUpstreams(conf *proxy.UpstreamConfig) {
+	if m == nil {
+		return
+	}
+
+	m.wrapUpstreamList(conf.Upstreams)
+
+	for _, ups := range conf.DomainReservedUpstreams {
+		m.wrapUpstreamList(ups)
+	}
+
+	for _, ups := range conf.SpecifiedDomainUpstreams {
+		m.wrapUpstreamList(ups)
+	}
+}
+
+// wrapUpstreamList replaces each upstream within upstreams with the one that
+// records the metrics of the exchanges.
+func (m *serverMetrics) wrapUpstreamList(upstreams []upstream.Upstream) {
+	for i, u := range upstreams {
+		if _, ok := u.(*meteredUpstream); ok {
+			continue
+		}
+
+		addr := u.Address()
+		upstreams[i] = &meteredUpstream{
+			Upstream: u,
+			duration: m.upstreamDuration.With(addr),
+			errors:   m.upstreamErrors.With(addr),
+		}
+	}
+}
+
+// meteredUpstream is an [upstream.Upstream] which records the latency and the
+// errors of its exchanges.
+type meteredUpstream struct {
+	upstream.Upstream
+
+	// duration measures the latency of the exchanges.
+	duration *metrics.Histogram
+
+	// errors counts the failed exchanges.
+	errors *metrics.Counter
+}
+
+// type check
+var _ upstream.Upstream = (*meteredUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *meteredUpstream.
+func (u *meteredUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	start := time.Now()
+	resp, err = u.Upstream.Exchange(req)
+	u.duration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		u.errors.Inc()
+	}
+
+	return resp, err
+}
@@ -0,0 +1,84 @@
+package dnsforward
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/jynychen/AdGuardHome/pkg/aghtest"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/jynychen/AdGuardHome/pkg/metrics"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMetrics(t *testing.T) {
+	const (
+		upsAddr              = "udp://1.2.3.4:53"
+		testErr errors.Error = "test error"
+	)
+
+	reg := metrics.NewRegistry()
+	m := newServerMetrics(reg)
+
+	failUps := &aghtest.UpstreamMock{
+		OnAddress:  func() (addr string) { return upsAddr },
+		OnExchange: func(_ *dns.Msg) (_ *dns.Msg, err error) { return nil, testErr },
+	}
+
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{failUps},
+	}
+	m.wrapUpstreams(conf)
+
+	// Wrapping must be idempotent.
+	m.wrapUpstreams(conf)
+
+	require.Len(t, conf.Upstreams, 1)
+
+	ups := conf.Upstreams[0]
+	assert.Equal(t, upsAddr, ups.Address())
+
+	_, err := ups.Exchange(&dns.Msg{})
+	assert.ErrorIs(t, err, testErr)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeAAAA)
+	resp := (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	pctx := &proxy.DNSContext{
+		Proto:              proxy.ProtoUDP,
+		Req:                req,
+		Res:                resp,
+		CachedUpstreamAddr: upsAddr,
+	}
+
+	m.countCache(pctx, true)
+	m.countQuery(&dnsContext{
+		proxyCtx: pctx,
+		result:   &filtering.Result{Reason: filtering.FilteredBlockList},
+	})
+
+	b := &strings.Builder{}
+	_, err = reg.WriteTo(b)
+	require.NoError(t, err)
+
+	out := b.String()
+	assert.Contains(t, out, "adguardhome_dns_cache_hits_total 1\n")
+	assert.Contains(t, out, "adguardhome_dns_cache_misses_total 0\n")
+	assert.Contains(t, out, `adguardhome_dns_upstream_errors_total{upstream="`+upsAddr+`"} 1`)
+	assert.Contains(t, out, `adguardhome_dns_upstream_duration_seconds_count{upstream="`+upsAddr+`"} 1`)
+	assert.Contains(t, out, `adguardhome_dns_queries_total{`+
+		`proto="udp",qtype="AAAA",rcode="NXDOMAIN",reason="FilteredBlackList"} 1`)
+
+	t.Run("nil", func(t *testing.T) {
+		var nilMetrics *serverMetrics
+
+		assert.NotPanics(t, func() {
+			nilMetrics.countCache(pctx, true)
+			nilMetrics.countQuery(&dnsContext{proxyCtx: pctx})
+			nilMetrics.wrapUpstreams(conf)
+		})
+	})
+}
@@ -48,6 +48,16 @@ func (s *Server) genDNSFilterMessage(
 	res *filtering.Result,
 ) (resp *dns.Msg) {
 	req := dctx.Req
+	if dnsrr := res.DNSRewriteResult; res.IsRPZ && dnsrr != nil {
+		// The rules of the response policy zones define the response code
+		// themselves.
+		if dnsrr.RCode == dns.RcodeNameError {
+			return s.genNXDomain(req)
+		}
+
+		return s.newMsgNODATA(req)
+	}
+
 	qt := req.Question[0].Qtype
 	if qt != dns.TypeA && qt != dns.TypeAAAA {
 		m, _, _ := s.dnsFilter.BlockingMode()
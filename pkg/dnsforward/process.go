@@ -15,6 +15,7 @@ import (
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/jynychen/AdGuardHome/pkg/querylog"
 	"github.com/miekg/dns"
 )
 
@@ -48,9 +49,21 @@ type dnsContext struct {
 	// clientID is the ClientID from DoH, DoQ, or DoT, if provided.
 	clientID string
 
+	// dnssecStatus is the result of the local DNSSEC validation of the
+	// upstream response.
+	dnssecStatus querylog.DNSSECStatus
+
 	// startTime is the time at which the processing of the request has started.
 	startTime time.Time
 
+	// upstreamQueryTime is the time at which the request has been sent to the
+	// upstream.  It is zero if the request hasn't been resolved by upstreams.
+	upstreamQueryTime time.Time
+
+	// upstreamResponseTime is the time at which the upstream response has
+	// been received.
+	upstreamResponseTime time.Time
+
 	// origQuestion is the question received from the client.  It is set
 	// when the request is modified by rewrites.
 	origQuestion dns.Question
@@ -66,6 +79,9 @@ type dnsContext struct {
 	// responseAD shows if the response had the AD bit set.
 	responseAD bool
 
+	// ratelimited shows if the request has exceeded the rate limit.
+	ratelimited bool
+
 	// isLocalClient shows if client's IP address is from locally served
 	// network.
 	isLocalClient bool
@@ -104,30 +120,11 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error
 		startTime: time.Now(),
 	}
 
-	type modProcessFunc func(ctx *dnsContext) (rc resultCode)
-
-	// Since (*dnsforward.Server).handleDNSRequest(...) is used as
-	// proxy.(Config).RequestHandler, there is no need for additional index
-	// out of range checking in any of the following functions, because the
-	// (*proxy.Proxy).handleDNSRequest method performs it before calling the
-	// appropriate handler.
-	mods := []modProcessFunc{
-		s.processRecursion,
-		s.processInitial,
-		s.processDDRQuery,
-		s.processDetermineLocal,
-		s.processDHCPHosts,
-		s.processRestrictLocal,
-		s.processDHCPAddrs,
-		s.processFilteringBeforeRequest,
-		s.processLocalPTR,
-		s.processUpstream,
-		s.processFilteringAfterResponse,
-		s.ipset.process,
-		s.processQueryLogsAndStats,
-	}
-	for _, process := range mods {
-		r := process(dctx)
+	// Let the JSON DNS-over-HTTPS handler know the filtering result.
+	defer setDoHJSONResult(dctx)
+
+	for _, st := range s.stages() {
+		r := st.process(dctx)
 		switch r {
 		case resultCodeSuccess:
 			// continue: call the next filter
@@ -693,6 +690,33 @@ func (s *Server) processFilteringBeforeRequest(dctx *dnsContext) (rc resultCode)
 	return resultCodeSuccess
 }
 
+// processLocalZones responds authoritatively to requests for names within the
+// configured local zones.
+func (s *Server) processLocalZones(dctx *dnsContext) (rc resultCode) {
+	log.Debug("dnsforward: started processing local zones")
+	defer log.Debug("dnsforward: finished processing local zones")
+
+	pctx := dctx.proxyCtx
+	if pctx.Res != nil {
+		return resultCodeSuccess
+	}
+
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if s.localZones == nil {
+		return resultCodeSuccess
+	}
+
+	req := pctx.Req
+	resp := s.makeResponse(req)
+	if s.localZones.resolve(resp, req.Question[0]) {
+		pctx.Res = resp
+	}
+
+	return resultCodeSuccess
+}
+
 // ipStringFromAddr extracts an IP address string from net.Addr.
 func ipStringFromAddr(addr net.Addr) (ipStr string) {
 	if ip, _ := netutil.IPAndPortFromAddr(addr); ip != nil {
@@ -729,6 +753,7 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 	s.setCustomUpstream(pctx, dctx.clientID)
 
 	reqWantsDNSSEC := s.setReqAD(req)
+	reqHasEDNS := req.IsEdns0() != nil
 
 	// Process the request further since it wasn't filtered.
 	prx := s.proxy()
@@ -738,26 +763,41 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		return resultCodeError
 	}
 
-	if err := prx.Resolve(pctx); err != nil {
-		if errors.Is(err, upstream.ErrNoUpstreams) {
-			// Do not even put into querylog.  Currently this happens either
-			// when the private resolvers enabled and the request is DNS64 PTR,
-			// or when the client isn't considered local by prx.
-			//
-			// TODO(e.burkov):  Make proxy detect local client the same way as
-			// AGH does.
-			pctx.Res = s.genNXDomain(req)
+	// Calculate the key before resolving, since dnsproxy changes the request.
+	key, useSnapshot := s.snapshotKey(pctx)
+	if !useSnapshot || !s.serveFromSnapshot(key, pctx) {
+		dctx.upstreamQueryTime = time.Now()
+		err := prx.Resolve(pctx)
+		dctx.upstreamResponseTime = time.Now()
+		if err != nil {
+			if errors.Is(err, upstream.ErrNoUpstreams) {
+				// Do not even put into querylog.  Currently this happens
+				// either when the private resolvers enabled and the request
+				// is DNS64 PTR, or when the client isn't considered local by
+				// prx.
+				//
+				// TODO(e.burkov):  Make proxy detect local client the same
+				// way as AGH does.
+				pctx.Res = s.genNXDomain(req)
 
-			return resultCodeFinish
-		}
+				return resultCodeFinish
+			}
 
-		dctx.err = err
+			dctx.err = err
 
-		return resultCodeError
+			return resultCodeError
+		}
+
+		if useSnapshot {
+			s.cacheSnapshot.record(key, pctx)
+		}
 	}
 
+	s.metrics.countCache(pctx, s.conf.CacheSize != 0)
+
 	dctx.responseFromUpstream = true
 	dctx.responseAD = pctx.Res.AuthenticatedData
+	s.setDNSSECStatus(dctx, reqHasEDNS)
 
 	s.setRespAD(pctx, reqWantsDNSSEC)
 
@@ -769,7 +809,7 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 //
 // TODO(a.garipov, e.burkov): This should probably be done in module dnsproxy.
 func (s *Server) setReqAD(req *dns.Msg) (wantsDNSSEC bool) {
-	if !s.conf.EnableDNSSEC {
+	if !s.conf.EnableDNSSEC && s.dnssec == nil {
 		return false
 	}
 
@@ -801,7 +841,7 @@ func hasDO(msg *dns.Msg) (do bool) {
 // setRespAD changes the request and response based on the server settings and
 // the original request data.
 func (s *Server) setRespAD(pctx *proxy.DNSContext, reqWantsDNSSEC bool) {
-	if s.conf.EnableDNSSEC && !reqWantsDNSSEC {
+	if (s.conf.EnableDNSSEC || s.dnssec != nil) && !reqWantsDNSSEC {
 		pctx.Req.AuthenticatedData = false
 		pctx.Res.AuthenticatedData = false
 	}
@@ -829,11 +869,32 @@ func (s *Server) dhcpHostFromRequest(q *dns.Question) (reqHost string) {
 	return reqHost[:len(reqHost)-len(s.localDomainSuffix)-1]
 }
 
-// setCustomUpstream sets custom upstream settings in pctx, if necessary.
+// setCustomUpstream sets custom upstream settings in pctx, if necessary.  The
+// ejected upstreams are excluded from those, see [upstreamHealth.activeConfig].
+//
+// Note that the main upstream configuration is never set here, since dnsproxy
+// doesn't use the cache for the requests with the custom upstream
+// configuration.  The ejected upstreams of the main configuration are skipped
+// by the upstream selection instead, see [checkedUpstream].
 func (s *Server) setCustomUpstream(pctx *proxy.DNSContext, clientID string) {
+	upsConf := s.clientUpstreams(pctx, clientID)
+	if upsConf == nil {
+		return
+	}
+
+	if active, ok := s.upsHealth.activeConfig(upsConf); ok {
+		upsConf = active
+	}
+
+	pctx.CustomUpstreamConfig = upsConf
+}
+
+// clientUpstreams returns the wrapped custom upstream configuration of the
+// client of pctx, if any.
+func (s *Server) clientUpstreams(pctx *proxy.DNSContext, clientID string) (upsConf *proxy.UpstreamConfig) {
 	customUpsByClient := s.conf.GetCustomUpstreamByClient
 	if pctx.Addr == nil || customUpsByClient == nil {
-		return
+		return nil
 	}
 
 	// Use the ClientID first, since it has a higher priority.
@@ -842,14 +903,16 @@ func (s *Server) setCustomUpstream(pctx *proxy.DNSContext, clientID string) {
 	if err != nil {
 		log.Error("dnsforward: getting custom upstreams for client %s: %s", id, err)
 
-		return
+		return nil
 	}
 
-	if upsConf != nil {
-		log.Debug("dnsforward: using custom upstreams for client %s", id)
+	if upsConf == nil {
+		return nil
 	}
 
-	pctx.CustomUpstreamConfig = upsConf
+	log.Debug("dnsforward: using custom upstreams for client %s", id)
+
+	return s.customUpstreams.get(upsConf)
 }
 
 // Apply filtering logic after we have received response from upstream servers
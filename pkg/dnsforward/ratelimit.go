@@ -0,0 +1,379 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/bluele/gcache"
+	"golang.org/x/exp/slices"
+)
+
+// RatelimitAction is the action taken on the requests exceeding the rate limit.
+type RatelimitAction string
+
+// Supported rate limit actions.
+const (
+	// RatelimitActionRefused means that the client receives a REFUSED
+	// response.  It's the default action.
+	RatelimitActionRefused RatelimitAction = "refused"
+
+	// RatelimitActionDrop means that the request is dropped without a
+	// response.
+	RatelimitActionDrop RatelimitAction = "drop"
+
+	// RatelimitActionTruncate means that the client receives an empty response
+	// with the TC flag set, which makes it retry the request over TCP.
+	RatelimitActionTruncate RatelimitAction = "truncate"
+)
+
+// RatelimitPolicy is a named rate limiting policy, which can be attached to
+// persistent clients and to subnets.  Rate limiting only applies to the plain
+// DNS requests over UDP, since the other protocols can't be used for
+// amplification attacks.
+type RatelimitPolicy struct {
+	// Name is the unique name of the policy used to attach it to persistent
+	// clients.
+	Name string `yaml:"name"`
+
+	// Action is the action taken on the requests exceeding the limit.  If
+	// empty, [RatelimitActionRefused] is used.
+	Action RatelimitAction `yaml:"action"`
+
+	// Subnets are the subnets the policy is attached to.  The most specific
+	// subnet containing the client's address wins.
+	Subnets []netip.Prefix `yaml:"subnets"`
+
+	// Ratelimit is the number of requests per second allowed for each group
+	// of addresses.  Zero means no limit.
+	Ratelimit uint32 `yaml:"ratelimit"`
+
+	// Burst is the maximum number of requests allowed at once.  If zero,
+	// Ratelimit is used.
+	Burst uint32 `yaml:"burst"`
+
+	// SubnetLenIPv4 is the length of the prefix which IPv4 addresses are
+	// grouped by to share a limit.  If zero, each address has its own limit.
+	SubnetLenIPv4 int `yaml:"subnet_len_ipv4"`
+
+	// SubnetLenIPv6 is the length of the prefix which IPv6 addresses are
+	// grouped by to share a limit.  If zero, each address has its own limit.
+	SubnetLenIPv6 int `yaml:"subnet_len_ipv6"`
+}
+
+// clone returns a deep copy of p.
+func (p *RatelimitPolicy) clone() (c *RatelimitPolicy) {
+	c = &RatelimitPolicy{}
+	*c = *p
+	c.Subnets = slices.Clone(p.Subnets)
+
+	return c
+}
+
+// validate returns an error if p isn't a valid rate limit policy.
+func (p *RatelimitPolicy) validate() (err error) {
+	if p == nil {
+		return errors.Error("policy is nil")
+	} else if p.Name == "" {
+		return errors.Error("empty policy name")
+	}
+
+	defer func() { err = errors.Annotate(err, "policy %q: %w", p.Name) }()
+
+	switch p.Action {
+	case "", RatelimitActionRefused, RatelimitActionDrop, RatelimitActionTruncate:
+		// Go on.
+	default:
+		return fmt.Errorf("bad action %q", p.Action)
+	}
+
+	if p.SubnetLenIPv4 < 0 || p.SubnetLenIPv4 > netutil.IPv4BitLen {
+		return fmt.Errorf("subnet_len_ipv4: %d is out of range", p.SubnetLenIPv4)
+	} else if p.SubnetLenIPv6 < 0 || p.SubnetLenIPv6 > netutil.IPv6BitLen {
+		return fmt.Errorf("subnet_len_ipv6: %d is out of range", p.SubnetLenIPv6)
+	}
+
+	for i, subnet := range p.Subnets {
+		if !subnet.IsValid() {
+			return fmt.Errorf("subnet at index %d is invalid", i)
+		}
+	}
+
+	return nil
+}
+
+// groupOf returns the prefix which addr shares the limit with.
+func (p *RatelimitPolicy) groupOf(addr netip.Addr) (group netip.Prefix) {
+	bits := addr.BitLen()
+	if addr.Is4() && p.SubnetLenIPv4 != 0 {
+		bits = p.SubnetLenIPv4
+	} else if addr.Is6() && p.SubnetLenIPv6 != 0 {
+		bits = p.SubnetLenIPv6
+	}
+
+	// Don't check the error, since bits is validated to be within the range.
+	group, _ = addr.Prefix(bits)
+
+	return group
+}
+
+// validateRatelimitPolicies returns an error if any of policies is invalid or
+// if there are several policies with the same name.
+func validateRatelimitPolicies(policies []*RatelimitPolicy) (err error) {
+	names := map[string]struct{}{}
+	for i, p := range policies {
+		err = p.validate()
+		if err != nil {
+			return fmt.Errorf("ratelimit policy at index %d: %w", i, err)
+		}
+
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("ratelimit policy at index %d: duplicate name %q", i, p.Name)
+		}
+
+		names[p.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// maxRatelimitBuckets is the maximum number of the token buckets kept by
+// [ratelimiter].  Evicting a bucket only resets the limit for the group.
+const maxRatelimitBuckets = 64 * 1024
+
+// bucketKey is the key of a token bucket within [ratelimiter].
+type bucketKey struct {
+	// policy is the name of the policy.  It's empty for the global limit.
+	policy string
+
+	// group is the prefix of the addresses sharing the bucket.
+	group netip.Prefix
+}
+
+// tokenBucket is a token bucket of a group of addresses.
+type tokenBucket struct {
+	// last is the time of the last update of tokens.
+	last time.Time
+
+	// tokens is the number of requests currently allowed.
+	tokens float64
+}
+
+// take refills b at the given rate up to burst tokens and takes a token, if
+// there is one.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) (ok bool) {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// subnetPolicy is a rate limit policy attached to a subnet.
+type subnetPolicy struct {
+	policy *RatelimitPolicy
+	subnet netip.Prefix
+}
+
+// ratelimiter limits the rate of requests from clients according to the
+// policies attached to them.
+type ratelimiter struct {
+	// mu protects buckets and the buckets stored in it.
+	mu *sync.Mutex
+
+	// buckets maps bucketKey to *tokenBucket.
+	buckets gcache.Cache
+
+	// clientPolicy returns the name of the policy attached to the persistent
+	// client with the given ID.  It may be nil.
+	clientPolicy func(id string) (name string)
+
+	// policies maps names to the policies.
+	policies map[string]*RatelimitPolicy
+
+	// global is the policy for the clients without an attached one.  It's
+	// nil if there is no global limit.
+	global *RatelimitPolicy
+
+	// allowlist are the addresses exempted from the global limit.
+	allowlist map[netip.Addr]struct{}
+
+	// now returns the current time.
+	now func() (now time.Time)
+
+	// subnets are the policies attached to subnets sorted from the most
+	// specific subnet to the least one.
+	subnets []*subnetPolicy
+}
+
+// newRatelimiter returns a new properly initialized *ratelimiter for conf.  It
+// returns nil if there are no limits configured.
+func newRatelimiter(conf *Config) (rl *ratelimiter, err error) {
+	err = validateRatelimitPolicies(conf.RatelimitPolicies)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if conf.Ratelimit == 0 && len(conf.RatelimitPolicies) == 0 {
+		return nil, nil
+	}
+
+	rl = &ratelimiter{
+		mu:           &sync.Mutex{},
+		buckets:      gcache.New(maxRatelimitBuckets).LRU().Build(),
+		clientPolicy: conf.GetRatelimitPolicyByClient,
+		policies:     make(map[string]*RatelimitPolicy, len(conf.RatelimitPolicies)),
+		allowlist:    make(map[netip.Addr]struct{}, len(conf.RatelimitWhitelist)),
+		now:          time.Now,
+	}
+
+	if conf.Ratelimit != 0 {
+		// Keep the behavior of the global limit the same as it used to be.
+		rl.global = &RatelimitPolicy{
+			Action:    RatelimitActionDrop,
+			Ratelimit: conf.Ratelimit,
+		}
+	}
+
+	for _, s := range conf.RatelimitWhitelist {
+		addr, parseErr := netip.ParseAddr(s)
+		if parseErr != nil {
+			log.Info("dnsforward: warning: bad ratelimit whitelist entry: %s", parseErr)
+
+			continue
+		}
+
+		rl.allowlist[addr] = struct{}{}
+	}
+
+	for _, p := range conf.RatelimitPolicies {
+		p = p.clone()
+		rl.policies[p.Name] = p
+		for _, subnet := range p.Subnets {
+			rl.subnets = append(rl.subnets, &subnetPolicy{
+				policy: p,
+				subnet: subnet.Masked(),
+			})
+		}
+	}
+
+	slices.SortStableFunc(rl.subnets, func(a, b *subnetPolicy) (res int) {
+		return b.subnet.Bits() - a.subnet.Bits()
+	})
+
+	return rl, nil
+}
+
+// policyFor returns the policy applied to the client with addr.  p is nil if
+// the client isn't limited.
+func (rl *ratelimiter) policyFor(addr netip.Addr) (p *RatelimitPolicy) {
+	if rl.clientPolicy != nil && len(rl.policies) > 0 {
+		name := rl.clientPolicy(addr.String())
+		if p = rl.policies[name]; p != nil {
+			return p
+		} else if name != "" {
+			log.Debug("dnsforward: ratelimit policy %q of client %s not found", name, addr)
+		}
+	}
+
+	for _, sp := range rl.subnets {
+		if sp.subnet.Contains(addr) {
+			return sp.policy
+		}
+	}
+
+	if _, ok := rl.allowlist[addr]; ok {
+		return nil
+	}
+
+	return rl.global
+}
+
+// check returns the policy which the request from addr exceeds, if any.
+func (rl *ratelimiter) check(addr netip.Addr) (exceeded *RatelimitPolicy) {
+	addr = addr.Unmap()
+
+	p := rl.policyFor(addr)
+	if p == nil || p.Ratelimit == 0 {
+		return nil
+	}
+
+	burst := p.Burst
+	if burst == 0 {
+		burst = p.Ratelimit
+	}
+
+	key := bucketKey{
+		policy: p.Name,
+		group:  p.groupOf(addr),
+	}
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var b *tokenBucket
+	v, err := rl.buckets.Get(key)
+	if err == nil {
+		b = v.(*tokenBucket)
+	} else {
+		b = &tokenBucket{
+			last:   now,
+			tokens: float64(burst),
+		}
+
+		// Don't check the error, since the cache doesn't have any loaders.
+		_ = rl.buckets.Set(key, b)
+	}
+
+	if b.take(now, float64(p.Ratelimit), float64(burst)) {
+		return nil
+	}
+
+	return p
+}
+
+// processRatelimit applies the rate limit policies to the plain DNS requests
+// over UDP.  The limited requests are still counted in the query log and
+// statistics.
+func (s *Server) processRatelimit(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if s.ratelimit == nil || pctx.Proto != proxy.ProtoUDP {
+		return resultCodeSuccess
+	}
+
+	addr := netutil.NetAddrToAddrPort(pctx.Addr).Addr()
+	p := s.ratelimit.check(addr)
+	if p == nil {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dnsforward: request from %s exceeds ratelimit policy %q", addr, p.Name)
+
+	dctx.ratelimited = true
+
+	switch p.Action {
+	case RatelimitActionDrop:
+		pctx.Res = nil
+	case RatelimitActionTruncate:
+		pctx.Res = s.makeResponse(pctx.Req)
+		pctx.Res.Truncated = true
+	default:
+		pctx.Res = s.makeResponseREFUSED(pctx.Req)
+	}
+
+	s.processQueryLogsAndStats(dctx)
+
+	return resultCodeFinish
+}
@@ -0,0 +1,299 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/jynychen/AdGuardHome/pkg/stats"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRatelimitPolicy_validate(t *testing.T) {
+	testCases := []struct {
+		policy     *RatelimitPolicy
+		name       string
+		wantErrMsg string
+	}{{
+		policy: &RatelimitPolicy{
+			Name:          "iot",
+			Action:        RatelimitActionTruncate,
+			Subnets:       []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+			Ratelimit:     5,
+			SubnetLenIPv6: 64,
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		policy:     nil,
+		name:       "nil",
+		wantErrMsg: "policy is nil",
+	}, {
+		policy:     &RatelimitPolicy{},
+		name:       "no_name",
+		wantErrMsg: "empty policy name",
+	}, {
+		policy: &RatelimitPolicy{
+			Name:   "bad",
+			Action: "ignore",
+		},
+		name:       "bad_action",
+		wantErrMsg: `policy "bad": bad action "ignore"`,
+	}, {
+		policy: &RatelimitPolicy{
+			Name:          "bad",
+			SubnetLenIPv4: 33,
+		},
+		name:       "bad_ipv4_len",
+		wantErrMsg: `policy "bad": subnet_len_ipv4: 33 is out of range`,
+	}, {
+		policy: &RatelimitPolicy{
+			Name:          "bad",
+			SubnetLenIPv6: -1,
+		},
+		name:       "bad_ipv6_len",
+		wantErrMsg: `policy "bad": subnet_len_ipv6: -1 is out of range`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.policy.validate())
+		})
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		err := validateRatelimitPolicies([]*RatelimitPolicy{{
+			Name: "iot",
+		}, {
+			Name: "iot",
+		}})
+		testutil.AssertErrorMsg(t, `ratelimit policy at index 1: duplicate name "iot"`, err)
+	})
+}
+
+func TestRatelimiter_check(t *testing.T) {
+	iot := &RatelimitPolicy{
+		Name:      "iot",
+		Subnets:   []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+		Ratelimit: 1,
+		Burst:     2,
+	}
+	lab := &RatelimitPolicy{
+		Name:      "lab",
+		Subnets:   []netip.Prefix{netip.MustParsePrefix("192.168.10.128/25")},
+		Ratelimit: 1,
+	}
+	v6 := &RatelimitPolicy{
+		Name:          "v6",
+		Subnets:       []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")},
+		Ratelimit:     1,
+		SubnetLenIPv6: 64,
+	}
+	unlimited := &RatelimitPolicy{
+		Name: "unlimited",
+	}
+
+	rl, err := newRatelimiter(&Config{
+		GetRatelimitPolicyByClient: func(id string) (name string) {
+			if id == "192.168.10.2" {
+				return unlimited.Name
+			}
+
+			return ""
+		},
+		Ratelimit:          1,
+		RatelimitWhitelist: []string{"10.0.0.2"},
+		RatelimitPolicies:  []*RatelimitPolicy{iot, lab, v6, unlimited},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, rl)
+
+	now := time.Now()
+	rl.now = func() (n time.Time) { return now }
+
+	// assertExceeds checks that the n-th request from addr exceeds the policy
+	// with the given name and the previous ones don't.
+	assertExceeds := func(t *testing.T, addr netip.Addr, n int, name string) {
+		t.Helper()
+
+		for i := 1; i < n; i++ {
+			require.Nil(t, rl.check(addr), "request %d", i)
+		}
+
+		p := rl.check(addr)
+		require.NotNil(t, p)
+
+		assert.Equal(t, name, p.Name)
+	}
+
+	t.Run("subnet_burst", func(t *testing.T) {
+		assertExceeds(t, netip.MustParseAddr("192.168.10.1"), 3, iot.Name)
+	})
+
+	t.Run("most_specific_subnet", func(t *testing.T) {
+		assertExceeds(t, netip.MustParseAddr("192.168.10.200"), 2, lab.Name)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			require.Nil(t, rl.check(netip.MustParseAddr("192.168.10.2")))
+		}
+	})
+
+	t.Run("ipv6_aggregation", func(t *testing.T) {
+		require.Nil(t, rl.check(netip.MustParseAddr("2001:db8::1")))
+
+		p := rl.check(netip.MustParseAddr("2001:db8::2"))
+		require.NotNil(t, p)
+
+		assert.Equal(t, v6.Name, p.Name)
+		assert.Nil(t, rl.check(netip.MustParseAddr("2001:db8:0:1::1")))
+	})
+
+	t.Run("global", func(t *testing.T) {
+		assertExceeds(t, netip.MustParseAddr("10.0.0.1"), 2, "")
+	})
+
+	t.Run("whitelist", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			require.Nil(t, rl.check(netip.MustParseAddr("10.0.0.2")))
+		}
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		addr := netip.MustParseAddr("10.0.0.3")
+		require.Nil(t, rl.check(addr))
+		require.NotNil(t, rl.check(addr))
+
+		now = now.Add(time.Second)
+
+		assert.Nil(t, rl.check(addr))
+	})
+}
+
+func TestServer_ProcessRatelimit(t *testing.T) {
+	const ip = "192.168.10.1"
+
+	testCases := []struct {
+		name      string
+		action    RatelimitAction
+		wantRcode int
+		wantTC    bool
+		wantRes   bool
+	}{{
+		name:      "refused",
+		action:    RatelimitActionRefused,
+		wantRcode: dns.RcodeRefused,
+		wantTC:    false,
+		wantRes:   true,
+	}, {
+		name:      "default",
+		action:    "",
+		wantRcode: dns.RcodeRefused,
+		wantTC:    false,
+		wantRes:   true,
+	}, {
+		name:      "truncate",
+		action:    RatelimitActionTruncate,
+		wantRcode: dns.RcodeSuccess,
+		wantTC:    true,
+		wantRes:   true,
+	}, {
+		name:    "drop",
+		action:  RatelimitActionDrop,
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rl, err := newRatelimiter(&Config{
+				RatelimitPolicies: []*RatelimitPolicy{{
+					Name:      "test",
+					Action:    tc.action,
+					Subnets:   []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+					Ratelimit: 1,
+				}},
+			})
+			require.NoError(t, err)
+
+			ql := &testQueryLog{}
+			st := &testStats{}
+			s := &Server{
+				queryLog:   ql,
+				stats:      st,
+				anonymizer: aghnet.NewIPMut(nil),
+				ratelimit:  rl,
+			}
+
+			// newCtx returns a new context of the request.
+			newCtx := func() (dctx *dnsContext) {
+				return &dnsContext{
+					proxyCtx: &proxy.DNSContext{
+						Proto: proxy.ProtoUDP,
+						Req:   createTestMessage("example.org."),
+						Addr:  &net.UDPAddr{IP: net.ParseIP(ip), Port: 53},
+					},
+					result: &filtering.Result{},
+				}
+			}
+
+			dctx := newCtx()
+			require.Equal(t, resultCodeSuccess, s.processRatelimit(dctx))
+
+			assert.False(t, dctx.ratelimited)
+
+			dctx = newCtx()
+			require.Equal(t, resultCodeFinish, s.processRatelimit(dctx))
+
+			assert.True(t, dctx.ratelimited)
+
+			require.NotNil(t, ql.lastParams)
+			require.NotNil(t, st.lastEntry)
+
+			assert.True(t, ql.lastParams.Ratelimited)
+			assert.Equal(t, stats.RRatelimited, st.lastEntry.Result)
+
+			res := dctx.proxyCtx.Res
+			if !tc.wantRes {
+				assert.Nil(t, res)
+
+				return
+			}
+
+			require.NotNil(t, res)
+
+			assert.Equal(t, tc.wantRcode, res.Rcode)
+			assert.Equal(t, tc.wantTC, res.Truncated)
+			assert.Empty(t, res.Answer)
+		})
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		rl, err := newRatelimiter(&Config{Ratelimit: 1})
+		require.NoError(t, err)
+
+		s := &Server{
+			ratelimit: rl,
+		}
+
+		for i := 0; i < 3; i++ {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Proto: proxy.ProtoTCP,
+					Req:   createTestMessage("example.org."),
+					Addr:  &net.TCPAddr{IP: net.ParseIP(ip), Port: 53},
+				},
+				result: &filtering.Result{},
+			}
+
+			assert.Equal(t, resultCodeSuccess, s.processRatelimit(dctx))
+		}
+	})
+}
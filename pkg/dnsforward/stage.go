@@ -0,0 +1,354 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// StageName is the name of a request processing stage.
+type StageName string
+
+// Built-in request processing stages in the order of their execution.
+const (
+	StageRatelimit              StageName = "ratelimit"
+	StageRecursion              StageName = "recursion"
+	StageInitial                StageName = "initial"
+	StageDDR                    StageName = "ddr"
+	StageDetermineLocal         StageName = "determine_local"
+	StageDHCPHosts              StageName = "dhcp_hosts"
+	StageRestrictLocal          StageName = "restrict_local"
+	StageDHCPAddrs              StageName = "dhcp_addrs"
+	StageFilteringBeforeRequest StageName = "filtering_before_request"
+	StageLocalPTR               StageName = "local_ptr"
+	StageLocalZones             StageName = "local_zones"
+	StageUpstream               StageName = "upstream"
+	StageFilteringAfterResponse StageName = "filtering_after_response"
+	StageIpset                  StageName = "ipset"
+	StageQueryLogsAndStats      StageName = "query_logs_and_stats"
+)
+
+// StageRequest is the view of the request passed to a [Stage].  All the
+// fields are copies or must not be modified.
+type StageRequest struct {
+	// Request is a copy of the DNS request.
+	Request *dns.Msg
+
+	// Response is a copy of the current DNS response.  It is nil if the
+	// response hasn't been set yet.
+	Response *dns.Msg
+
+	// Result is a shallow copy of the current filtering result.  It must not be
+	// modified.
+	Result *filtering.Result
+
+	// ClientID is the ClientID from DoH, DoQ, or DoT, if provided.
+	ClientID string
+
+	// ClientName is the name of the persistent client, if any.  It is only
+	// set after the [StageFilteringBeforeRequest] stage.
+	ClientName string
+
+	// Proto is the protocol of the request.
+	Proto proxy.Proto
+
+	// Addr is the address of the client.
+	Addr netip.AddrPort
+
+	// IsLocalClient is true if the client's address is from a locally served
+	// network.  It is only set after the [StageDetermineLocal] stage.
+	IsLocalClient bool
+}
+
+// Stage is a custom request processing stage.
+type Stage interface {
+	// Process processes the request.  If resp is not nil, the processing
+	// finishes and resp is sent to the client.  The request finished before
+	// the [StageQueryLogsAndStats] stage is still written into the query log
+	// and the statistics.  If err is not nil, the processing finishes with
+	// the error.  req is never nil.
+	Process(req *StageRequest) (resp *dns.Msg, err error)
+}
+
+// StageFunc is a function that implements the [Stage] interface.
+type StageFunc func(req *StageRequest) (resp *dns.Msg, err error)
+
+// type check
+var _ Stage = StageFunc(nil)
+
+// Process implements the [Stage] interface for StageFunc.
+func (f StageFunc) Process(req *StageRequest) (resp *dns.Msg, err error) {
+	return f(req)
+}
+
+// CustomStage is a custom request processing stage placed next to a built-in
+// one.
+type CustomStage struct {
+	// Stage processes the requests.  It must not be nil.
+	Stage Stage
+
+	// Name is the unique name of the stage used for logging.  It must not be
+	// empty or equal to the name of a built-in stage.
+	Name StageName
+
+	// Anchor is the built-in stage the stage is placed next to.
+	Anchor StageName
+
+	// After, if true, places the stage after Anchor.  Otherwise, the stage is
+	// placed before it.  The stages placed next to the same built-in stage
+	// are executed in the order of their registration.
+	After bool
+}
+
+// processStage is a named request processing stage.
+type processStage struct {
+	// process processes the request.
+	process func(dctx *dnsContext) (rc resultCode)
+
+	// name is the name of the stage.
+	name StageName
+}
+
+// builtinStages returns the built-in request processing stages in the order of
+// their execution.
+func (s *Server) builtinStages() (stages []processStage) {
+	// Since (*dnsforward.Server).handleDNSRequest(...) is used as
+	// proxy.(Config).RequestHandler, there is no need for additional index
+	// out of range checking in any of the following functions, because the
+	// (*proxy.Proxy).handleDNSRequest method performs it before calling the
+	// appropriate handler.
+	return []processStage{
+		{name: StageRatelimit, process: s.processRatelimit},
+		{name: StageRecursion, process: s.processRecursion},
+		{name: StageInitial, process: s.processInitial},
+		{name: StageDDR, process: s.processDDRQuery},
+		{name: StageDetermineLocal, process: s.processDetermineLocal},
+		{name: StageDHCPHosts, process: s.processDHCPHosts},
+		{name: StageRestrictLocal, process: s.processRestrictLocal},
+		{name: StageDHCPAddrs, process: s.processDHCPAddrs},
+		{name: StageFilteringBeforeRequest, process: s.processFilteringBeforeRequest},
+		{name: StageLocalPTR, process: s.processLocalPTR},
+		{name: StageLocalZones, process: s.processLocalZones},
+		{name: StageUpstream, process: s.processUpstream},
+		{name: StageFilteringAfterResponse, process: s.processFilteringAfterResponse},
+		{name: StageIpset, process: s.ipset.process},
+		{name: StageQueryLogsAndStats, process: s.processQueryLogsAndStats},
+	}
+}
+
+// isBuiltinStage returns true if name is the name of a built-in stage.
+func isBuiltinStage(name StageName) (ok bool) {
+	switch name {
+	case
+		StageRatelimit,
+		StageRecursion,
+		StageInitial,
+		StageDDR,
+		StageDetermineLocal,
+		StageDHCPHosts,
+		StageRestrictLocal,
+		StageDHCPAddrs,
+		StageFilteringBeforeRequest,
+		StageLocalPTR,
+		StageLocalZones,
+		StageUpstream,
+		StageFilteringAfterResponse,
+		StageIpset,
+		StageQueryLogsAndStats:
+		return true
+	default:
+		return false
+	}
+}
+
+// validate returns an error if cs isn't a valid custom stage.
+func (cs *CustomStage) validate() (err error) {
+	switch {
+	case cs == nil:
+		return errors.Error("stage is nil")
+	case cs.Name == "":
+		return errors.Error("empty stage name")
+	case isBuiltinStage(cs.Name):
+		return fmt.Errorf("stage %q: name of a built-in stage", cs.Name)
+	case cs.Stage == nil:
+		return fmt.Errorf("stage %q: no stage implementation", cs.Name)
+	case !isBuiltinStage(cs.Anchor):
+		return fmt.Errorf("stage %q: unknown anchor stage %q", cs.Name, cs.Anchor)
+	default:
+		return nil
+	}
+}
+
+// stagePipeline is the request processing pipeline including the custom
+// stages, which is safe for concurrent use.
+type stagePipeline struct {
+	// stages are the request processing stages in the order of their
+	// execution.  The slice it points to is never modified, only replaced.
+	stages atomic.Pointer[[]processStage]
+
+	// custom are the registered custom stages.  It's only accessed with mu
+	// locked.
+	custom []*CustomStage
+
+	// mu serializes the additions of the custom stages.
+	mu sync.Mutex
+}
+
+// AddStage registers a custom request processing stage.  It's applied to the
+// requests received after the registration.  It is safe for concurrent use.
+func (s *Server) AddStage(cs *CustomStage) (err error) {
+	err = s.addStage(cs)
+	if err != nil {
+		return fmt.Errorf("adding custom stage: %w", err)
+	}
+
+	log.Debug("dnsforward: added custom stage %q", cs.Name)
+
+	return nil
+}
+
+// addStage validates cs, adds it to the custom stages, and rebuilds the
+// pipeline.  It returns an error if cs is invalid or a stage with the same
+// name is already registered.
+func (s *Server) addStage(cs *CustomStage) (err error) {
+	err = cs.validate()
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return err
+	}
+
+	p := &s.pipeline
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if slices.ContainsFunc(p.custom, func(st *CustomStage) (ok bool) { return st.Name == cs.Name }) {
+		return fmt.Errorf("stage %q: duplicate name", cs.Name)
+	}
+
+	p.custom = append(p.custom, cs)
+	stages := s.buildStages(p.custom)
+	p.stages.Store(&stages)
+
+	return nil
+}
+
+// initStages builds the pipeline of the built-in stages, unless it has already
+// been built, and returns the current one.
+func (s *Server) initStages() (stages *[]processStage) {
+	builtin := s.builtinStages()
+	if s.pipeline.stages.CompareAndSwap(nil, &builtin) {
+		return &builtin
+	}
+
+	return s.pipeline.stages.Load()
+}
+
+// stages returns the request processing stages including the custom ones.
+// stages must not be modified.
+func (s *Server) stages() (stages []processStage) {
+	p := s.pipeline.stages.Load()
+	if p == nil {
+		p = s.initStages()
+	}
+
+	return *p
+}
+
+// buildStages returns the built-in request processing stages with the custom
+// ones placed next to them.
+func (s *Server) buildStages(custom []*CustomStage) (stages []processStage) {
+	builtin := s.builtinStages()
+
+	stages = make([]processStage, 0, len(builtin)+len(custom))
+	for _, st := range builtin {
+		stages = s.appendCustomStages(stages, custom, st.name, false)
+		stages = append(stages, st)
+		stages = s.appendCustomStages(stages, custom, st.name, true)
+	}
+
+	return stages
+}
+
+// appendCustomStages appends the stages from custom placed before or after the
+// anchor stage to stages.
+func (s *Server) appendCustomStages(
+	stages []processStage,
+	custom []*CustomStage,
+	anchor StageName,
+	after bool,
+) (res []processStage) {
+	for _, cs := range custom {
+		if cs.Anchor == anchor && cs.After == after {
+			stages = append(stages, processStage{
+				name:    cs.Name,
+				process: s.customProcess(cs),
+			})
+		}
+	}
+
+	return stages
+}
+
+// customProcess returns the function processing the requests with cs.
+func (s *Server) customProcess(cs *CustomStage) (process func(dctx *dnsContext) (rc resultCode)) {
+	// The query log and statistics stage is the last one, so only the stages
+	// placed after it run after the request is logged.
+	logOnFinish := cs.Anchor != StageQueryLogsAndStats || !cs.After
+
+	return func(dctx *dnsContext) (rc resultCode) {
+		log.Debug("dnsforward: started processing custom stage %q", cs.Name)
+		defer log.Debug("dnsforward: finished processing custom stage %q", cs.Name)
+
+		resp, err := cs.Stage.Process(newStageRequest(dctx))
+		if err != nil {
+			dctx.err = fmt.Errorf("custom stage %q: %w", cs.Name, err)
+
+			return resultCodeError
+		} else if resp == nil {
+			return resultCodeSuccess
+		}
+
+		dctx.proxyCtx.Res = resp
+		if logOnFinish {
+			s.processQueryLogsAndStats(dctx)
+		}
+
+		return resultCodeFinish
+	}
+}
+
+// newStageRequest returns the view of the request from dctx.
+func newStageRequest(dctx *dnsContext) (req *StageRequest) {
+	pctx := dctx.proxyCtx
+	req = &StageRequest{
+		Request:       pctx.Req.Copy(),
+		Result:        &filtering.Result{},
+		ClientID:      dctx.clientID,
+		Proto:         pctx.Proto,
+		Addr:          netutil.NetAddrToAddrPort(pctx.Addr),
+		IsLocalClient: dctx.isLocalClient,
+	}
+
+	if dctx.result != nil {
+		*req.Result = *dctx.result
+	}
+
+	if pctx.Res != nil {
+		req.Response = pctx.Res.Copy()
+	}
+
+	if dctx.setts != nil {
+		req.ClientName = dctx.setts.ClientName
+	}
+
+	return req
+}
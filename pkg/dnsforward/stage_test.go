@@ -0,0 +1,258 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nopStage is a [Stage] that does nothing.
+var nopStage = StageFunc(func(_ *StageRequest) (resp *dns.Msg, err error) {
+	return nil, nil
+})
+
+func TestServer_AddStage(t *testing.T) {
+	testCases := []struct {
+		stage      *CustomStage
+		name       string
+		wantErrMsg string
+	}{{
+		stage: &CustomStage{
+			Stage:  nopStage,
+			Name:   "tenant",
+			Anchor: StageUpstream,
+		},
+		name:       "success",
+		wantErrMsg: "",
+	}, {
+		stage:      nil,
+		name:       "nil",
+		wantErrMsg: "adding custom stage: stage is nil",
+	}, {
+		stage: &CustomStage{
+			Stage:  nopStage,
+			Anchor: StageUpstream,
+		},
+		name:       "empty_name",
+		wantErrMsg: "adding custom stage: empty stage name",
+	}, {
+		stage: &CustomStage{
+			Stage:  nopStage,
+			Name:   StageUpstream,
+			Anchor: StageUpstream,
+		},
+		name:       "builtin_name",
+		wantErrMsg: `adding custom stage: stage "upstream": name of a built-in stage`,
+	}, {
+		stage: &CustomStage{
+			Name:   "tenant",
+			Anchor: StageUpstream,
+		},
+		name:       "no_stage",
+		wantErrMsg: `adding custom stage: stage "tenant": no stage implementation`,
+	}, {
+		stage: &CustomStage{
+			Stage:  nopStage,
+			Name:   "tenant",
+			Anchor: "unknown",
+		},
+		name:       "bad_anchor",
+		wantErrMsg: `adding custom stage: stage "tenant": unknown anchor stage "unknown"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			err := s.AddStage(tc.stage)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		s := &Server{}
+		cs := &CustomStage{
+			Stage:  nopStage,
+			Name:   "tenant",
+			Anchor: StageUpstream,
+		}
+
+		require.NoError(t, s.AddStage(cs))
+
+		err := s.AddStage(cs)
+		testutil.AssertErrorMsg(t, `adding custom stage: stage "tenant": duplicate name`, err)
+	})
+}
+
+func TestServer_stages(t *testing.T) {
+	s := &Server{}
+
+	names := func() (res []StageName) {
+		for _, st := range s.stages() {
+			res = append(res, st.name)
+		}
+
+		return res
+	}
+
+	builtin := names()
+	require.Len(t, builtin, 15)
+
+	assert.Equal(t, StageRatelimit, builtin[0])
+	assert.Equal(t, StageQueryLogsAndStats, builtin[len(builtin)-1])
+
+	for _, cs := range []*CustomStage{{
+		Name:   "after_upstream",
+		Anchor: StageUpstream,
+		After:  true,
+	}, {
+		Name:   "before_upstream_1",
+		Anchor: StageUpstream,
+	}, {
+		Name:   "before_upstream_2",
+		Anchor: StageUpstream,
+	}, {
+		Name:   "first",
+		Anchor: StageRatelimit,
+	}, {
+		Name:   "last",
+		Anchor: StageQueryLogsAndStats,
+		After:  true,
+	}} {
+		cs.Stage = nopStage
+		require.NoError(t, s.AddStage(cs))
+	}
+
+	got := names()
+	require.Len(t, got, len(builtin)+5)
+
+	assert.Equal(t, StageName("first"), got[0])
+	assert.Equal(t, StageName("last"), got[len(got)-1])
+
+	assert.Equal(t, []StageName{
+		StageLocalZones,
+		"before_upstream_1",
+		"before_upstream_2",
+		StageUpstream,
+		"after_upstream",
+		StageFilteringAfterResponse,
+	}, got[11:17])
+
+	// The pipeline is only rebuilt when a custom stage is added.
+	assert.Same(t, &s.stages()[0], &s.stages()[0])
+}
+
+func TestServer_customProcess(t *testing.T) {
+	const (
+		clientID = "cli"
+		domain   = "example.com."
+	)
+
+	testErr := errors.Error("test error")
+
+	newCtx := func() (dctx *dnsContext) {
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Proto: proxy.ProtoHTTPS,
+				Req:   createTestMessage(domain),
+				Addr:  &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 1234},
+			},
+			result: &filtering.Result{
+				Reason: filtering.NotFilteredAllowList,
+			},
+			setts: &filtering.Settings{
+				ClientName: "client",
+			},
+			startTime:     time.Now(),
+			clientID:      clientID,
+			isLocalClient: true,
+		}
+	}
+
+	t.Run("view", func(t *testing.T) {
+		var got *StageRequest
+		s := &Server{}
+		process := s.customProcess(&CustomStage{
+			Stage: StageFunc(func(req *StageRequest) (resp *dns.Msg, err error) {
+				got = req
+
+				return nil, nil
+			}),
+			Name:   "view",
+			Anchor: StageUpstream,
+		})
+
+		dctx := newCtx()
+		rc := process(dctx)
+		assert.Equal(t, resultCodeSuccess, rc)
+
+		require.NotNil(t, got)
+
+		assert.Equal(t, dctx.proxyCtx.Req.Question, got.Request.Question)
+		assert.NotSame(t, dctx.proxyCtx.Req, got.Request)
+		assert.Nil(t, got.Response)
+		assert.Equal(t, dctx.result, got.Result)
+		assert.NotSame(t, dctx.result, got.Result)
+		assert.Equal(t, clientID, got.ClientID)
+		assert.Equal(t, "client", got.ClientName)
+		assert.Equal(t, proxy.ProtoHTTPS, got.Proto)
+		assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:1234"), got.Addr)
+		assert.True(t, got.IsLocalClient)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		s := &Server{}
+		process := s.customProcess(&CustomStage{
+			Stage: StageFunc(func(_ *StageRequest) (resp *dns.Msg, err error) {
+				return nil, testErr
+			}),
+			Name:   "failing",
+			Anchor: StageUpstream,
+		})
+
+		dctx := newCtx()
+		rc := process(dctx)
+		assert.Equal(t, resultCodeError, rc)
+
+		assert.ErrorIs(t, dctx.err, testErr)
+		testutil.AssertErrorMsg(t, `custom stage "failing": test error`, dctx.err)
+	})
+
+	t.Run("finish", func(t *testing.T) {
+		ql := &testQueryLog{}
+		s := &Server{
+			queryLog:   ql,
+			stats:      &testStats{},
+			anonymizer: aghnet.NewIPMut(nil),
+		}
+
+		process := s.customProcess(&CustomStage{
+			Stage: StageFunc(func(req *StageRequest) (resp *dns.Msg, err error) {
+				return (&dns.Msg{}).SetRcode(req.Request, dns.RcodeRefused), nil
+			}),
+			Name:   "refusing",
+			Anchor: StageUpstream,
+		})
+
+		dctx := newCtx()
+		rc := process(dctx)
+		assert.Equal(t, resultCodeFinish, rc)
+
+		require.NotNil(t, dctx.proxyCtx.Res)
+
+		assert.Equal(t, dns.RcodeRefused, dctx.proxyCtx.Res.Rcode)
+
+		require.NotNil(t, ql.lastParams)
+
+		assert.Equal(t, clientID, ql.lastParams.ClientID)
+	})
+}
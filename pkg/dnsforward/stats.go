@@ -32,6 +32,8 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 
 	log.Debug("dnsforward: client ip for stats and querylog: %s", ip)
 
+	s.metrics.countQuery(dctx)
+
 	ipStr := ip.String()
 	ids := []string{ipStr, dctx.clientID}
 	qt, cl := q.Qtype, q.Qclass
@@ -42,6 +44,8 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	s.serverLock.RLock()
 	defer s.serverLock.RUnlock()
 
+	s.emitDNSTap(dctx, ip)
+
 	if s.shouldLog(host, qt, cl, ids) {
 		s.logQuery(dctx, pctx, elapsed, ip)
 	} else {
@@ -106,19 +110,9 @@ func (s *Server) logQuery(
 		ClientIP:          ip,
 		Elapsed:           elapsed,
 		AuthenticatedData: dctx.responseAD,
-	}
-
-	switch pctx.Proto {
-	case proxy.ProtoHTTPS:
-		p.ClientProto = querylog.ClientProtoDoH
-	case proxy.ProtoQUIC:
-		p.ClientProto = querylog.ClientProtoDoQ
-	case proxy.ProtoTLS:
-		p.ClientProto = querylog.ClientProtoDoT
-	case proxy.ProtoDNSCrypt:
-		p.ClientProto = querylog.ClientProtoDNSCrypt
-	default:
-		// Consider this a plain DNS-over-UDP or DNS-over-TCP request.
+		DNSSECStatus:      dctx.dnssecStatus,
+		Ratelimited:       dctx.ratelimited,
+		ClientProto:       clientProto(pctx.Proto),
 	}
 
 	if pctx.Upstream != nil {
@@ -131,6 +125,23 @@ func (s *Server) logQuery(
 	s.queryLog.Add(p)
 }
 
+// clientProto returns the client protocol name for proto.
+func clientProto(proto proxy.Proto) (cp querylog.ClientProto) {
+	switch proto {
+	case proxy.ProtoHTTPS:
+		return querylog.ClientProtoDoH
+	case proxy.ProtoQUIC:
+		return querylog.ClientProtoDoQ
+	case proxy.ProtoTLS:
+		return querylog.ClientProtoDoT
+	case proxy.ProtoDNSCrypt:
+		return querylog.ClientProtoDNSCrypt
+	default:
+		// Consider this a plain DNS-over-UDP or DNS-over-TCP request.
+		return querylog.ClientProtoPlain
+	}
+}
+
 // updatesStats writes the request into statistics.
 func (s *Server) updateStats(
 	ctx *dnsContext,
@@ -139,10 +150,24 @@ func (s *Server) updateStats(
 	clientIP string,
 ) {
 	pctx := ctx.proxyCtx
+	q := pctx.Req.Question[0]
 	e := &stats.Entry{
-		Domain: aghnet.NormalizeDomain(pctx.Req.Question[0].Name),
-		Result: stats.RNotFiltered,
-		Time:   elapsed,
+		Domain:      aghnet.NormalizeDomain(q.Name),
+		QType:       dns.Type(q.Qtype).String(),
+		ClientProto: string(clientProto(pctx.Proto)),
+		Result:      stats.RNotFiltered,
+		Time:        elapsed,
+	}
+
+	if pctx.Res != nil {
+		e.RCode = dns.RcodeToString[pctx.Res.Rcode]
+	}
+
+	for _, r := range res.Rules {
+		e.Rules = append(e.Rules, stats.Rule{
+			Text:         r.Text,
+			FilterListID: r.FilterListID,
+		})
 	}
 
 	if pctx.Upstream != nil {
@@ -169,5 +194,10 @@ func (s *Server) updateStats(
 		e.Result = stats.RFiltered
 	}
 
+	if ctx.ratelimited {
+		e.Result = stats.RRatelimited
+	}
+
 	s.stats.Update(e)
+	s.alerter.Observe(e)
 }
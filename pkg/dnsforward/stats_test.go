@@ -233,6 +233,8 @@ func TestServer_ProcessQueryLogsAndStats(t *testing.T) {
 			assert.Equal(t, tc.wantLogProto, ql.lastParams.ClientProto)
 			assert.Equal(t, tc.wantStatClient, st.lastEntry.Client)
 			assert.Equal(t, tc.wantStatResult, st.lastEntry.Result)
+			assert.Equal(t, string(tc.wantLogProto), st.lastEntry.ClientProto)
+			assert.Equal(t, "NOERROR", st.lastEntry.RCode)
 		})
 	}
 }
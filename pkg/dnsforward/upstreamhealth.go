@@ -0,0 +1,477 @@
+package dnsforward
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// defaultUpstreamHealthFailures is the default number of consecutive failed
+// exchanges after which an upstream is ejected.
+const defaultUpstreamHealthFailures = 3
+
+// errUpstreamEjected is returned by the upstreams which are temporarily
+// excluded from resolving due to failing health checks.
+const errUpstreamEjected errors.Error = "upstream is ejected due to failed health checks"
+
+// upstreamHealth periodically checks the health of the upstream DNS servers
+// and temporarily ejects the unhealthy ones, so that the requests are resolved
+// by the remaining upstreams or by the fallback ones.
+type upstreamHealth struct {
+	// mu protects states, active, and numEjected.
+	mu *sync.RWMutex
+
+	// states maps the addresses of the upstreams to their health states.
+	states map[string]*upstreamState
+
+	// active maps the upstream configurations to their copies without the
+	// ejected upstreams.  It's cleared each time an upstream is ejected or
+	// re-admitted.
+	active map[*proxy.UpstreamConfig]*proxy.UpstreamConfig
+
+	// check is the function used to probe the upstreams.
+	check healthCheckFunc
+
+	// done is closed to stop the periodic checking.  It's nil if the checking
+	// isn't running.  It's protected by the server's lock.
+	done chan struct{}
+
+	// ivl is the interval between the health checks.
+	ivl time.Duration
+
+	// maxFails is the number of consecutive failures after which an upstream
+	// is ejected.
+	maxFails uint
+
+	// numEjected is the number of the currently ejected upstreams.
+	numEjected uint
+}
+
+// upstreamState is the health state of a single upstream.
+type upstreamState struct {
+	// ups is the original upstream used for probing.
+	ups upstream.Upstream
+
+	// lastCheck is the time of the last health check.
+	lastCheck time.Time
+
+	// ejectedAt is the time when the upstream was ejected.  It's zero if the
+	// upstream is healthy.
+	ejectedAt time.Time
+
+	// lastErr is the last error of exchanging with the upstream, if any.
+	lastErr error
+
+	// latency is the round-trip time of the last successful health check.
+	latency time.Duration
+
+	// fails is the number of consecutive failed exchanges.
+	fails uint
+}
+
+// newUpstreamHealth returns a new properly initialized *upstreamHealth.  If
+// maxFails is zero, [defaultUpstreamHealthFailures] is used.
+func newUpstreamHealth(ivl time.Duration, maxFails uint, check healthCheckFunc) (h *upstreamHealth) {
+	if maxFails == 0 {
+		maxFails = defaultUpstreamHealthFailures
+	}
+
+	return &upstreamHealth{
+		mu:       &sync.RWMutex{},
+		states:   map[string]*upstreamState{},
+		active:   map[*proxy.UpstreamConfig]*proxy.UpstreamConfig{},
+		check:    check,
+		ivl:      ivl,
+		maxFails: maxFails,
+	}
+}
+
+// wrapUpstreams replaces each upstream within conf with the one that fails
+// fast while it's ejected.  conf must not be nil.
+func (h *upstreamHealth) wrapUpstreams(conf *proxy.UpstreamConfig) {
+	h.wrapUpstreamList(conf.Upstreams)
+
+	for _, ups := range conf.DomainReservedUpstreams {
+		h.wrapUpstreamList(ups)
+	}
+
+	for _, ups := range conf.SpecifiedDomainUpstreams {
+		h.wrapUpstreamList(ups)
+	}
+}
+
+// wrapUpstreamList replaces each upstream within upstreams with the one that
+// fails fast while it's ejected.
+func (h *upstreamHealth) wrapUpstreamList(upstreams []upstream.Upstream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, u := range upstreams {
+		if _, ok := u.(*checkedUpstream); ok {
+			continue
+		}
+
+		addr := u.Address()
+		if _, ok := h.states[addr]; !ok {
+			h.states[addr] = &upstreamState{ups: u}
+		}
+
+		upstreams[i] = &checkedUpstream{
+			Upstream: u,
+			health:   h,
+			addr:     addr,
+		}
+	}
+}
+
+// activeConfig returns the copy of conf without the ejected upstreams.  ok is
+// false if none of the upstreams of conf are ejected, so conf should be used
+// as is.  The lists consisting of the ejected upstreams only are kept, so that
+// the fallback upstreams are used for those.  h may be nil.
+func (h *upstreamHealth) activeConfig(conf *proxy.UpstreamConfig) (active *proxy.UpstreamConfig, ok bool) {
+	if h == nil || conf == nil {
+		return nil, false
+	}
+
+	h.mu.RLock()
+	active, ok = h.active[conf]
+	numEjected := h.numEjected
+	h.mu.RUnlock()
+
+	if numEjected == 0 {
+		return nil, false
+	} else if ok {
+		return active, active != nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.active) >= maxCustomUpstreamConfigs {
+		clear(h.active)
+	}
+
+	active = &proxy.UpstreamConfig{
+		Upstreams:                h.filterLocked(conf.Upstreams),
+		DomainReservedUpstreams:  h.filterMapLocked(conf.DomainReservedUpstreams),
+		SpecifiedDomainUpstreams: h.filterMapLocked(conf.SpecifiedDomainUpstreams),
+		SubdomainExclusions:      conf.SubdomainExclusions,
+	}
+
+	if !h.anyEjectedLocked(conf) {
+		// Remember that there is nothing to filter.
+		active = nil
+	}
+
+	h.active[conf] = active
+
+	return active, active != nil
+}
+
+// anyEjectedLocked returns true if any of the upstreams of conf is ejected.
+// h.mu is expected to be locked.
+func (h *upstreamHealth) anyEjectedLocked(conf *proxy.UpstreamConfig) (ok bool) {
+	if slices.ContainsFunc(conf.Upstreams, h.isEjectedLocked) {
+		return true
+	}
+
+	for _, m := range []map[string][]upstream.Upstream{
+		conf.DomainReservedUpstreams,
+		conf.SpecifiedDomainUpstreams,
+	} {
+		for _, ups := range m {
+			if slices.ContainsFunc(ups, h.isEjectedLocked) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// filterMapLocked returns the copy of m with the ejected upstreams removed from
+// each list, see [upstreamHealth.filterLocked].  h.mu is expected to be
+// locked.
+func (h *upstreamHealth) filterMapLocked(
+	m map[string][]upstream.Upstream,
+) (filtered map[string][]upstream.Upstream) {
+	if m == nil {
+		return nil
+	}
+
+	filtered = make(map[string][]upstream.Upstream, len(m))
+	for domain, ups := range m {
+		filtered[domain] = h.filterLocked(ups)
+	}
+
+	return filtered
+}
+
+// filterLocked returns the copy of upstreams without the ejected ones.  It
+// returns upstreams as is if all of those are ejected, since an empty list
+// means the default upstreams for the domain-specific ones.  h.mu is expected
+// to be locked.
+func (h *upstreamHealth) filterLocked(upstreams []upstream.Upstream) (filtered []upstream.Upstream) {
+	filtered = slices.DeleteFunc(slices.Clone(upstreams), h.isEjectedLocked)
+	if len(filtered) == 0 {
+		return upstreams
+	}
+
+	return filtered
+}
+
+// isEjectedLocked returns true if u is ejected.  h.mu is expected to be locked.
+func (h *upstreamHealth) isEjectedLocked(u upstream.Upstream) (ok bool) {
+	st, ok := h.states[u.Address()]
+
+	return ok && !st.ejectedAt.IsZero()
+}
+
+// start starts checking the upstreams periodically in a separate goroutine.  It
+// does nothing if the checking is already running.
+func (h *upstreamHealth) start() {
+	if h.done != nil {
+		return
+	}
+
+	h.done = make(chan struct{})
+
+	go h.checkPeriodically(h.done)
+}
+
+// stop stops checking the upstreams.  It does nothing if the checking isn't
+// running.
+func (h *upstreamHealth) stop() {
+	if h.done == nil {
+		return
+	}
+
+	close(h.done)
+	h.done = nil
+}
+
+// checkPeriodically checks the upstreams each h.ivl until done is closed.
+func (h *upstreamHealth) checkPeriodically(done <-chan struct{}) {
+	defer log.OnPanic("dnsforward: checking upstreams health")
+
+	ticker := time.NewTicker(h.ivl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			h.checkAll()
+		}
+	}
+}
+
+// checkAll probes all the upstreams concurrently and waits for the results.
+func (h *upstreamHealth) checkAll() {
+	h.mu.RLock()
+	states := maps.Clone(h.states)
+	h.mu.RUnlock()
+
+	wg := &sync.WaitGroup{}
+	for addr, st := range states {
+		wg.Add(1)
+		go func(addr string, u upstream.Upstream) {
+			defer log.OnPanic("dnsforward: checking upstream health")
+			defer wg.Done()
+
+			h.checkOne(addr, u)
+		}(addr, st.ups)
+	}
+
+	wg.Wait()
+}
+
+// checkOne probes the upstream with the given address and updates its state.
+func (h *upstreamHealth) checkOne(addr string, u upstream.Upstream) {
+	start := time.Now()
+	err := h.check(u)
+	rtt := time.Since(start)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[addr]
+	if !ok {
+		return
+	}
+
+	st.lastCheck = start
+	if err != nil {
+		h.failLocked(addr, st, err)
+
+		return
+	}
+
+	st.latency = rtt
+	h.recoverLocked(addr, st)
+}
+
+// isEjected returns true if the upstream with the given address is ejected.
+func (h *upstreamHealth) isEjected(addr string) (ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	st, ok := h.states[addr]
+
+	return ok && !st.ejectedAt.IsZero()
+}
+
+// report updates the state of the upstream with the given address according
+// to the result of an ordinary exchange.  Successful exchanges only reset the
+// failures counter, since only the health checks re-admit ejected upstreams.
+func (h *upstreamHealth) report(addr string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[addr]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		h.failLocked(addr, st, err)
+	} else if st.ejectedAt.IsZero() {
+		st.fails = 0
+		st.lastErr = nil
+	}
+}
+
+// failLocked accounts the failed exchange with the upstream and ejects it, if
+// necessary.  h.mu is expected to be locked.
+func (h *upstreamHealth) failLocked(addr string, st *upstreamState, err error) {
+	st.fails++
+	st.lastErr = err
+
+	if st.ejectedAt.IsZero() && st.fails >= h.maxFails {
+		st.ejectedAt = time.Now()
+		h.numEjected++
+		clear(h.active)
+
+		log.Info("dnsforward: upstream %s is ejected after %d failures: %s", addr, st.fails, err)
+	}
+}
+
+// recoverLocked marks the upstream as healthy and re-admits it, if necessary.
+// h.mu is expected to be locked.
+func (h *upstreamHealth) recoverLocked(addr string, st *upstreamState) {
+	if !st.ejectedAt.IsZero() {
+		log.Info("dnsforward: upstream %s is healthy again", addr)
+
+		h.numEjected--
+		clear(h.active)
+	}
+
+	st.fails = 0
+	st.lastErr = nil
+	st.ejectedAt = time.Time{}
+}
+
+// upstreamHealthJSON is the health state of a single upstream for the HTTP
+// API.
+type upstreamHealthJSON struct {
+	// LastCheck is the time of the last health check in RFC 3339 format.  It's
+	// empty if the upstream hasn't been checked yet.
+	LastCheck string `json:"last_check,omitempty"`
+
+	// EjectedAt is the time when the upstream was ejected in RFC 3339 format.
+	// It's empty if the upstream is healthy.
+	EjectedAt string `json:"ejected_at,omitempty"`
+
+	// Address is the address of the upstream.
+	Address string `json:"address"`
+
+	// LastError is the message of the last error, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// LatencyMs is the round-trip time of the last successful health check in
+	// milliseconds.
+	LatencyMs float64 `json:"latency_ms"`
+
+	// ConsecutiveFailures is the number of consecutive failed exchanges.
+	ConsecutiveFailures uint `json:"consecutive_failures"`
+
+	// Healthy is true if the upstream is used for resolving.
+	Healthy bool `json:"healthy"`
+}
+
+// toJSON returns the health states of the upstreams sorted by address.
+func (h *upstreamHealth) toJSON() (states []*upstreamHealthJSON) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	addrs := maps.Keys(h.states)
+	slices.Sort(addrs)
+
+	states = make([]*upstreamHealthJSON, 0, len(addrs))
+	for _, addr := range addrs {
+		st := h.states[addr]
+		sj := &upstreamHealthJSON{
+			Address:             addr,
+			LatencyMs:           float64(st.latency) / float64(time.Millisecond),
+			ConsecutiveFailures: st.fails,
+			Healthy:             st.ejectedAt.IsZero(),
+		}
+
+		if !st.lastCheck.IsZero() {
+			sj.LastCheck = st.lastCheck.Format(time.RFC3339)
+		}
+
+		if !st.ejectedAt.IsZero() {
+			sj.EjectedAt = st.ejectedAt.Format(time.RFC3339)
+		}
+
+		if st.lastErr != nil {
+			sj.LastError = st.lastErr.Error()
+		}
+
+		states = append(states, sj)
+	}
+
+	return states
+}
+
+// checkedUpstream is an [upstream.Upstream] which fails fast while it's
+// ejected by the health checker and reports the results of the exchanges to
+// it otherwise.  The ejected upstreams of the clients' configurations are
+// excluded from resolving by [upstreamHealth.activeConfig].  The ones of the
+// main configuration are skipped by the upstream selection of dnsproxy, which
+// moves on to the remaining upstreams once the ejected one fails, so that the
+// cache keeps working.  If all the upstreams of a list are ejected, the
+// fallback ones are used.
+type checkedUpstream struct {
+	upstream.Upstream
+
+	// health is the health checker of the upstream.
+	health *upstreamHealth
+
+	// addr is the cached address of the upstream.
+	addr string
+}
+
+// type check
+var _ upstream.Upstream = (*checkedUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *checkedUpstream.
+func (u *checkedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if u.health.isEjected(u.addr) {
+		return nil, errUpstreamEjected
+	}
+
+	resp, err = u.Upstream.Exchange(req)
+	u.health.report(u.addr, err)
+
+	return resp, err
+}
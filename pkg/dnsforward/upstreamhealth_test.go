@@ -0,0 +1,294 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghtest"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	const (
+		upsAddr               = "udp://1.2.3.4:53"
+		testErr  errors.Error = "test error"
+		maxFails              = 2
+	)
+
+	var exchErr error
+	numExch := 0
+	ups := &aghtest.UpstreamMock{
+		OnAddress: func() (addr string) { return upsAddr },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			numExch++
+
+			if exchErr != nil {
+				return nil, exchErr
+			}
+
+			return (&dns.Msg{}).SetRcode(req, dns.RcodeNameError), nil
+		},
+	}
+
+	h := newUpstreamHealth(time.Hour, maxFails, checkDNSUpstreamExc)
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{ups},
+	}
+	h.wrapUpstreams(conf)
+
+	require.Len(t, conf.Upstreams, 1)
+
+	wrapped := conf.Upstreams[0]
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	exchErr = testErr
+	for i := 0; i < maxFails; i++ {
+		_, err := wrapped.Exchange(req)
+		require.ErrorIs(t, err, testErr)
+	}
+
+	require.Equal(t, maxFails, numExch)
+
+	t.Run("ejected", func(t *testing.T) {
+		_, err := wrapped.Exchange(req)
+		assert.ErrorIs(t, err, errUpstreamEjected)
+
+		// The ejected upstream must not be queried.
+		assert.Equal(t, maxFails, numExch)
+
+		states := h.toJSON()
+		require.Len(t, states, 1)
+
+		assert.False(t, states[0].Healthy)
+		assert.NotEmpty(t, states[0].EjectedAt)
+		assert.Equal(t, uint(maxFails), states[0].ConsecutiveFailures)
+	})
+
+	t.Run("still_failing", func(t *testing.T) {
+		h.checkAll()
+
+		assert.True(t, h.isEjected(upsAddr))
+		assert.Equal(t, maxFails+1, numExch)
+	})
+
+	t.Run("recovered", func(t *testing.T) {
+		exchErr = nil
+		h.checkAll()
+
+		require.False(t, h.isEjected(upsAddr))
+
+		resp, err := wrapped.Exchange(req)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		states := h.toJSON()
+		require.Len(t, states, 1)
+
+		assert.True(t, states[0].Healthy)
+		assert.Empty(t, states[0].EjectedAt)
+		assert.Empty(t, states[0].LastError)
+		assert.NotEmpty(t, states[0].LastCheck)
+	})
+}
+
+func TestUpstreamHealth_activeConfig(t *testing.T) {
+	const (
+		addrA                = "udp://1.2.3.4:53"
+		addrB                = "udp://5.6.7.8:53"
+		testErr errors.Error = "test error"
+	)
+
+	newUps := func(addr string) (u upstream.Upstream) {
+		return &aghtest.UpstreamMock{OnAddress: func() (a string) { return addr }}
+	}
+
+	// checkErr is the error of the health checks of the upstream with addrB.
+	var checkErr error
+	h := newUpstreamHealth(time.Hour, 1, func(u upstream.Upstream) (err error) {
+		if u.Address() == addrB {
+			return checkErr
+		}
+
+		return nil
+	})
+
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{newUps(addrA), newUps(addrB)},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.": {newUps(addrB)},
+		},
+	}
+	h.wrapUpstreams(conf)
+
+	custom := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{newUps(addrA)},
+	}
+	h.wrapUpstreams(custom)
+
+	s := &Server{
+		conf: ServerConfig{
+			UpstreamConfig: conf,
+		},
+		upsHealth: h,
+	}
+
+	pctx := &proxy.DNSContext{}
+	s.setCustomUpstream(pctx, "")
+	assert.Nil(t, pctx.CustomUpstreamConfig)
+
+	checkErr = testErr
+	h.checkAll()
+
+	require.True(t, h.isEjected(addrB))
+
+	active, ok := h.activeConfig(conf)
+	require.True(t, ok)
+
+	require.Len(t, active.Upstreams, 1)
+	assert.Equal(t, addrA, active.Upstreams[0].Address())
+
+	// The list consisting of the ejected upstreams only is kept.
+	assert.Equal(t, conf.DomainReservedUpstreams, active.DomainReservedUpstreams)
+
+	// The original configuration must not be modified.
+	assert.Len(t, conf.Upstreams, 2)
+
+	again, _ := h.activeConfig(conf)
+	assert.Same(t, active, again)
+
+	// The main configuration is never set as the custom one, since that turns
+	// off the cache.
+	s.setCustomUpstream(pctx, "")
+	assert.Nil(t, pctx.CustomUpstreamConfig)
+
+	// The configurations without the ejected upstreams are used as is.
+	_, ok = h.activeConfig(custom)
+	assert.False(t, ok)
+
+	checkErr = nil
+	h.checkAll()
+
+	_, ok = h.activeConfig(conf)
+	assert.False(t, ok)
+
+	s.setCustomUpstream(pctx, "")
+	assert.Nil(t, pctx.CustomUpstreamConfig)
+}
+
+func TestServer_upstreamHealthCache(t *testing.T) {
+	const (
+		addrA = "udp://192.0.2.1:53"
+		addrB = "udp://192.0.2.2:53"
+	)
+
+	numExchA, numExchB := 0, 0
+	newUps := func(addr string, numExch *int) (u upstream.Upstream) {
+		return &aghtest.UpstreamMock{
+			OnAddress: func() (a string) { return addr },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				*numExch++
+
+				resp = (&dns.Msg{}).SetReply(req)
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   req.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: net.IP{192, 0, 2, 100},
+				}}
+
+				return resp, nil
+			},
+			OnClose: func() (err error) { return nil },
+		}
+	}
+
+	s := createTestServer(t, &filtering.Config{
+		BlockingMode: filtering.BlockingModeDefault,
+	}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		Config: Config{
+			CacheSize:                   64 * 1024,
+			EDNSClientSubnet:            &EDNSClientSubnet{Enabled: false},
+			UpstreamHealthCheckInterval: timeutil.Duration{Duration: time.Hour},
+		},
+	}, nil)
+
+	require.NotNil(t, s.upsHealth)
+
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		newUps(addrA, &numExchA),
+		newUps(addrB, &numExchB),
+	}
+	s.upsHealth.wrapUpstreams(s.conf.UpstreamConfig)
+
+	for i := uint(0); i < defaultUpstreamHealthFailures; i++ {
+		s.upsHealth.report(addrB, errors.Error("test error"))
+	}
+
+	require.True(t, s.upsHealth.isEjected(addrB))
+
+	startDeferStop(t, s)
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	req := createTestMessage("example.org.")
+	for i := 0; i < 2; i++ {
+		resp, err := dns.Exchange(req, addr)
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+	}
+
+	// The second response is served from the cache, and the ejected upstream
+	// isn't queried at all.
+	assert.Equal(t, 1, numExchA)
+	assert.Zero(t, numExchB)
+}
+
+func TestServer_HandleUpstreamsHealth(t *testing.T) {
+	s := &Server{}
+
+	w := httptest.NewRecorder()
+	s.handleUpstreamsHealth(w, httptest.NewRequest(http.MethodGet, "/control/upstreams/health", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &upstreamsHealthJSON{}
+	err := json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	assert.False(t, resp.Enabled)
+	assert.Empty(t, resp.Upstreams)
+
+	s.upsHealth = newUpstreamHealth(time.Hour, 0, checkDNSUpstreamExc)
+	s.upsHealth.wrapUpstreams(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&aghtest.UpstreamMock{
+			OnAddress: func() (addr string) { return "1.1.1.1:53" },
+		}},
+	})
+
+	w = httptest.NewRecorder()
+	s.handleUpstreamsHealth(w, httptest.NewRequest(http.MethodGet, "/control/upstreams/health", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	assert.True(t, resp.Enabled)
+	require.Len(t, resp.Upstreams, 1)
+
+	assert.Equal(t, "1.1.1.1:53", resp.Upstreams[0].Address)
+	assert.True(t, resp.Upstreams[0].Healthy)
+}
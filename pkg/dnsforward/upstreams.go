@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
@@ -38,7 +39,9 @@ func (s *Server) loadUpstreams() (upstreams []string, err error) {
 	return stringutil.FilterOut(upstreams, IsCommentOrEmpty), nil
 }
 
-// prepareUpstreamSettings sets upstream DNS server settings.
+// prepareUpstreamSettings sets upstream DNS server settings.  The forwarding
+// rules are added to the upstreams loaded either from the file or from the
+// settings, see [Config.ForwardingRules].
 func (s *Server) prepareUpstreamSettings() (err error) {
 	// Load upstreams either from the file, or from the settings
 	var upstreams []string
@@ -47,7 +50,9 @@ func (s *Server) prepareUpstreamSettings() (err error) {
 		return fmt.Errorf("loading upstreams: %w", err)
 	}
 
-	s.conf.UpstreamConfig, err = s.prepareUpstreamConfig(upstreams, defaultDNS, &upstream.Options{
+	upstreams = append(upstreams, forwardingRulesLines(s.conf.ForwardingRules)...)
+
+	opts := &upstream.Options{
 		Bootstrap:    s.conf.BootstrapDNS,
 		Timeout:      s.conf.UpstreamTimeout,
 		HTTPVersions: UpstreamHTTPVersions(s.conf.UseHTTP3Upstreams),
@@ -61,14 +66,131 @@ func (s *Server) prepareUpstreamSettings() (err error) {
 		// TODO(a.garipov): Investigate if that's true.
 		RootCAs:      s.conf.TLSv12Roots,
 		CipherSuites: s.conf.TLSCiphers,
-	})
+	}
+
+	s.conf.UpstreamConfig, err = s.prepareUpstreamConfig(upstreams, defaultDNS, opts)
 	if err != nil {
 		return fmt.Errorf("preparing upstream config: %w", err)
 	}
 
+	err = addBootstrappedRules(s.conf.UpstreamConfig, s.conf.ForwardingRules, opts)
+	if err != nil {
+		return fmt.Errorf("preparing forwarding rules: %w", err)
+	}
+
+	var wrappers []func(conf *proxy.UpstreamConfig)
+
+	s.dnssec = nil
+	if s.conf.DNSSECValidation {
+		s.dnssec, err = newDNSSECValidator(s.conf.DNSSECTrustAnchors)
+		if err != nil {
+			return fmt.Errorf("preparing dnssec validation: %w", err)
+		}
+
+		wrappers = append(wrappers, s.dnssec.wrapUpstreams)
+	}
+
+	s.upsHealth = nil
+	if ivl := s.conf.UpstreamHealthCheckInterval.Duration; ivl > 0 {
+		s.upsHealth = newUpstreamHealth(ivl, s.conf.UpstreamHealthCheckFailures, checkDNSUpstreamExc)
+		wrappers = append(wrappers, s.upsHealth.wrapUpstreams)
+	}
+
+	s.customUpstreams = nil
+	if len(wrappers) > 0 {
+		wrap := func(conf *proxy.UpstreamConfig) {
+			for _, w := range wrappers {
+				w(conf)
+			}
+		}
+
+		wrap(s.conf.UpstreamConfig)
+		s.customUpstreams = newCustomUpstreamConfigs(wrap)
+	}
+
+	s.metrics.wrapUpstreams(s.conf.UpstreamConfig)
+
 	return nil
 }
 
+// maxCustomUpstreamConfigs is the maximum number of the wrapped custom
+// upstream configurations kept by [customUpstreamConfigs].  The cache is
+// cleared once the size is exceeded.
+const maxCustomUpstreamConfigs = 1000
+
+// customUpstreamConfigs keeps the copies of the custom upstream configurations
+// of the clients with the wrapped upstreams.  The configurations are shared
+// between the requests of a client, so those can't be wrapped in place.
+type customUpstreamConfigs struct {
+	// mu protects wrapped.
+	mu *sync.Mutex
+
+	// wrapped maps the original configurations to their wrapped copies.
+	wrapped map[*proxy.UpstreamConfig]*proxy.UpstreamConfig
+
+	// wrap replaces the upstreams within the copy of a configuration.
+	wrap func(conf *proxy.UpstreamConfig)
+}
+
+// newCustomUpstreamConfigs returns a new properly initialized
+// *customUpstreamConfigs.
+func newCustomUpstreamConfigs(wrap func(conf *proxy.UpstreamConfig)) (c *customUpstreamConfigs) {
+	return &customUpstreamConfigs{
+		mu:      &sync.Mutex{},
+		wrapped: map[*proxy.UpstreamConfig]*proxy.UpstreamConfig{},
+		wrap:    wrap,
+	}
+}
+
+// get returns the wrapped copy of conf.  It returns conf as is if c is nil.
+func (c *customUpstreamConfigs) get(conf *proxy.UpstreamConfig) (wrapped *proxy.UpstreamConfig) {
+	if c == nil {
+		return conf
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wrapped = c.wrapped[conf]; wrapped != nil {
+		return wrapped
+	}
+
+	if len(c.wrapped) >= maxCustomUpstreamConfigs {
+		c.wrapped = map[*proxy.UpstreamConfig]*proxy.UpstreamConfig{}
+	}
+
+	wrapped = cloneUpstreamConfig(conf)
+	c.wrap(wrapped)
+	c.wrapped[conf] = wrapped
+
+	return wrapped
+}
+
+// cloneUpstreamConfig returns a copy of conf with the lists of upstreams
+// copied, so that those can be modified independently.
+func cloneUpstreamConfig(conf *proxy.UpstreamConfig) (clone *proxy.UpstreamConfig) {
+	return &proxy.UpstreamConfig{
+		Upstreams:                slices.Clone(conf.Upstreams),
+		DomainReservedUpstreams:  cloneUpstreamsMap(conf.DomainReservedUpstreams),
+		SpecifiedDomainUpstreams: cloneUpstreamsMap(conf.SpecifiedDomainUpstreams),
+		SubdomainExclusions:      conf.SubdomainExclusions,
+	}
+}
+
+// cloneUpstreamsMap returns a copy of m with the lists of upstreams copied.
+func cloneUpstreamsMap(m map[string][]upstream.Upstream) (clone map[string][]upstream.Upstream) {
+	if m == nil {
+		return nil
+	}
+
+	clone = make(map[string][]upstream.Upstream, len(m))
+	for domain, ups := range m {
+		clone[domain] = slices.Clone(ups)
+	}
+
+	return clone
+}
+
 // prepareUpstreamConfig returns the upstream configuration based on upstreams
 // and configuration of s.
 func (s *Server) prepareUpstreamConfig(
@@ -0,0 +1,218 @@
+// Package dnstap contains an emitter of the dnstap messages describing DNS
+// queries and responses.
+//
+// See https://dnstap.info.
+package dnstap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// MessageType is the type of a dnstap message.
+type MessageType uint8
+
+// Message types used by AdGuard Home.  See the Message.Type enumeration in
+// dnstap.proto.
+const (
+	MessageTypeClientQuery       MessageType = 5
+	MessageTypeClientResponse    MessageType = 6
+	MessageTypeForwarderQuery    MessageType = 7
+	MessageTypeForwarderResponse MessageType = 8
+)
+
+// SocketProtocol is the transport protocol of a DNS message.
+type SocketProtocol uint8
+
+// Socket protocols.  See the SocketProtocol enumeration in dnstap.proto.
+const (
+	SocketProtocolUDP         SocketProtocol = 1
+	SocketProtocolTCP         SocketProtocol = 2
+	SocketProtocolDOT         SocketProtocol = 3
+	SocketProtocolDOH         SocketProtocol = 4
+	SocketProtocolDNSCryptUDP SocketProtocol = 5
+	SocketProtocolDNSCryptTCP SocketProtocol = 6
+	SocketProtocolDOQ         SocketProtocol = 7
+)
+
+// Socket families.  See the SocketFamily enumeration in dnstap.proto.
+const (
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+)
+
+// Message is a single dnstap message.
+type Message struct {
+	// QueryTime is the time the query was sent or received.  It isn't encoded
+	// if it's zero.
+	QueryTime time.Time
+
+	// ResponseTime is the time the response was sent or received.  It isn't
+	// encoded if it's zero.
+	ResponseTime time.Time
+
+	// Extra is the additional data attached to the message, for example, the
+	// ClientID.
+	Extra []byte
+
+	// QueryMessage is the wire-format query, if any.
+	QueryMessage []byte
+
+	// ResponseMessage is the wire-format response, if any.
+	ResponseMessage []byte
+
+	// QueryAddr is the address of the party that sent the query.
+	QueryAddr netip.AddrPort
+
+	// ResponseAddr is the address of the party that sent the response.
+	ResponseAddr netip.AddrPort
+
+	// Type is the type of the message.  It must be set.
+	Type MessageType
+
+	// SocketProtocol is the transport protocol of the messages.  It isn't
+	// encoded if it's zero.
+	SocketProtocol SocketProtocol
+}
+
+// Protobuf field numbers of the Dnstap message.
+const (
+	fieldDnstapIdentity = 1
+	fieldDnstapVersion  = 2
+	fieldDnstapExtra    = 3
+	fieldDnstapMessage  = 14
+	fieldDnstapType     = 15
+)
+
+// dnstapTypeMessage is the only value of the Dnstap.Type enumeration.
+const dnstapTypeMessage = 1
+
+// Protobuf field numbers of the Message message.
+const (
+	fieldMessageType             = 1
+	fieldMessageSocketFamily     = 2
+	fieldMessageSocketProtocol   = 3
+	fieldMessageQueryAddress     = 4
+	fieldMessageResponseAddress  = 5
+	fieldMessageQueryPort        = 6
+	fieldMessageResponsePort     = 7
+	fieldMessageQueryTimeSec     = 8
+	fieldMessageQueryTimeNsec    = 9
+	fieldMessageQueryMessage     = 10
+	fieldMessageResponseTimeSec  = 12
+	fieldMessageResponseTimeNsec = 13
+	fieldMessageResponseMessage  = 14
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// marshal appends the protobuf encoding of the Dnstap message wrapping m with
+// the given identity and version to b.
+func marshal(b []byte, identity, version []byte, m *Message) (res []byte) {
+	b = appendBytesField(b, fieldDnstapIdentity, identity)
+	b = appendBytesField(b, fieldDnstapVersion, version)
+	b = appendBytesField(b, fieldDnstapExtra, m.Extra)
+
+	msg := m.marshal(nil)
+	b = appendTag(b, fieldDnstapMessage, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	b = append(b, msg...)
+
+	return appendVarintField(b, fieldDnstapType, dnstapTypeMessage)
+}
+
+// marshal appends the protobuf encoding of m to b.
+func (m *Message) marshal(b []byte) (res []byte) {
+	b = appendVarintField(b, fieldMessageType, uint64(m.Type))
+
+	if fam := m.socketFamily(); fam != 0 {
+		b = appendVarintField(b, fieldMessageSocketFamily, fam)
+	}
+
+	if m.SocketProtocol != 0 {
+		b = appendVarintField(b, fieldMessageSocketProtocol, uint64(m.SocketProtocol))
+	}
+
+	b = appendAddr(b, fieldMessageQueryAddress, fieldMessageQueryPort, m.QueryAddr)
+	b = appendAddr(b, fieldMessageResponseAddress, fieldMessageResponsePort, m.ResponseAddr)
+	b = appendTime(b, fieldMessageQueryTimeSec, fieldMessageQueryTimeNsec, m.QueryTime)
+	b = appendBytesField(b, fieldMessageQueryMessage, m.QueryMessage)
+	b = appendTime(b, fieldMessageResponseTimeSec, fieldMessageResponseTimeNsec, m.ResponseTime)
+
+	return appendBytesField(b, fieldMessageResponseMessage, m.ResponseMessage)
+}
+
+// socketFamily returns the socket family of the addresses of m or zero if
+// there are none.
+func (m *Message) socketFamily() (fam uint64) {
+	addr := m.QueryAddr.Addr()
+	if !addr.IsValid() {
+		addr = m.ResponseAddr.Addr()
+	}
+
+	switch {
+	case !addr.IsValid():
+		return 0
+	case addr.Unmap().Is4():
+		return socketFamilyINET
+	default:
+		return socketFamilyINET6
+	}
+}
+
+// appendAddr appends the address and the port fields of addrPort to b, if it's
+// valid.
+func appendAddr(b []byte, addrField, portField int, addrPort netip.AddrPort) (res []byte) {
+	addr := addrPort.Addr().Unmap()
+	if !addr.IsValid() {
+		return b
+	}
+
+	b = appendBytesField(b, addrField, addr.AsSlice())
+
+	return appendVarintField(b, portField, uint64(addrPort.Port()))
+}
+
+// appendTime appends the seconds and the nanoseconds fields of t to b, if it's
+// not zero.
+func appendTime(b []byte, secField, nsecField int, t time.Time) (res []byte) {
+	if t.IsZero() {
+		return b
+	}
+
+	b = appendVarintField(b, secField, uint64(t.Unix()))
+	b = appendTag(b, nsecField, wireFixed32)
+
+	return binary.LittleEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
+
+// appendTag appends the key of the field with the given number and wire type to
+// b.
+func appendTag(b []byte, field, wireType int) (res []byte) {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+// appendVarintField appends the varint field to b.
+func appendVarintField(b []byte, field int, v uint64) (res []byte) {
+	b = appendTag(b, field, wireVarint)
+
+	return binary.AppendUvarint(b, v)
+}
+
+// appendBytesField appends the length-delimited field to b, if v isn't empty.
+func appendBytesField(b []byte, field int, v []byte) (res []byte) {
+	if len(v) == 0 {
+		return b
+	}
+
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
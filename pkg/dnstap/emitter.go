@@ -0,0 +1,355 @@
+package dnstap
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/version"
+)
+
+// Supported networks of the dnstap output.
+const (
+	NetworkUnix = "unix"
+	NetworkTCP  = "tcp"
+	NetworkFile = "file"
+)
+
+// DefaultQueueSize is the default number of the messages waiting to be sent.
+const DefaultQueueSize = 10_000
+
+const (
+	// writeTimeout is the timeout for writing a frame or performing the
+	// handshake with the collector.
+	writeTimeout = 5 * time.Second
+
+	// reconnectInterval is the minimum time between two attempts to connect
+	// to the collector.  The messages emitted meanwhile are dropped.
+	reconnectInterval = 5 * time.Second
+
+	// rotatedFileTimeFormat is the format of the time appended to the name of
+	// the previous output file.
+	rotatedFileTimeFormat = "20060102T150405.000000000"
+)
+
+// Config is the configuration of the dnstap output.
+type Config struct {
+	// Network is the type of the output, either [NetworkUnix], [NetworkTCP],
+	// or [NetworkFile].
+	Network string `yaml:"network"`
+
+	// Address is the path to the Unix socket, the address of the TCP
+	// collector, or the path to the file.  Each time the output is opened, a
+	// new file is created with a new frame stream, and the existing non-empty
+	// file is renamed by appending the current time to its name.
+	Address string `yaml:"address"`
+
+	// Identity is the identity of the server sent in every message.
+	Identity string `yaml:"identity"`
+
+	// QueueSize is the maximum number of the messages waiting to be sent.
+	// When the queue is full, the new messages are dropped.  If it's zero,
+	// [DefaultQueueSize] is used.
+	QueueSize uint32 `yaml:"queue_size"`
+
+	// Enabled defines if the dnstap messages are emitted.
+	Enabled bool `yaml:"enabled"`
+}
+
+// Validate returns an error if c is enabled but contains invalid values.  c
+// may be nil.
+func (c *Config) Validate() (err error) {
+	if c == nil || !c.Enabled {
+		return nil
+	}
+
+	switch c.Network {
+	case NetworkUnix, NetworkTCP, NetworkFile:
+		// Go on.
+	default:
+		return fmt.Errorf("network: unsupported value %q", c.Network)
+	}
+
+	if c.Address == "" {
+		return errors.Error("address: empty value")
+	}
+
+	return nil
+}
+
+// Emitter sends the dnstap messages to the collector.  A slow or unavailable
+// collector never blocks the callers of [Emitter.Emit], the messages are
+// dropped instead.
+type Emitter struct {
+	// queue contains the messages waiting to be sent.
+	queue chan *Message
+
+	// done is closed when the emitter is closed.
+	done chan struct{}
+
+	// finished is closed when the sending goroutine exits.
+	finished chan struct{}
+
+	// dropped is the number of the messages dropped since the last report.
+	dropped atomic.Uint64
+
+	// started is true if the sending goroutine has been started.
+	started atomic.Bool
+
+	// identity is the encoded identity of the server.
+	identity []byte
+
+	// version is the encoded version of the server.
+	version []byte
+
+	// network is the type of the output.
+	network string
+
+	// address is the address of the output.
+	address string
+}
+
+// New returns a new properly initialized *Emitter.  conf must be valid and
+// enabled.
+func New(conf *Config) (e *Emitter) {
+	queueSize := int(conf.QueueSize)
+	if queueSize == 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	return &Emitter{
+		queue:    make(chan *Message, queueSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+		identity: []byte(conf.Identity),
+		version:  []byte("AdGuard Home " + version.Version()),
+		network:  conf.Network,
+		address:  conf.Address,
+	}
+}
+
+// Start starts sending the messages in a separate goroutine.
+func (e *Emitter) Start() {
+	e.started.Store(true)
+
+	go e.run()
+}
+
+// Emit queues m for sending.  It never blocks, and m is dropped if the queue
+// is full.  m must not be modified after calling Emit.  It is safe for
+// concurrent use.
+func (e *Emitter) Emit(m *Message) {
+	select {
+	case e.queue <- m:
+		// Go on.
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Close sends the queued messages, if possible, and closes the output.  It
+// must only be called once.
+func (e *Emitter) Close() {
+	close(e.done)
+
+	if e.started.Load() {
+		<-e.finished
+	}
+}
+
+// output is an opened dnstap output.
+type output struct {
+	// conn is the underlying connection or file.
+	conn io.ReadWriteCloser
+
+	// fw writes the frames into conn.
+	fw *frameWriter
+}
+
+// run sends the queued messages until e is closed.  It's intended to be used
+// as a goroutine.
+func (e *Emitter) run() {
+	defer log.OnPanic("dnstap")
+	defer close(e.finished)
+
+	var out *output
+	var nextConnect time.Time
+	var buf []byte
+
+	for {
+		var m *Message
+		select {
+		case m = <-e.queue:
+			// Go on.
+		case <-e.done:
+			e.drain(out, buf)
+
+			return
+		}
+
+		if out == nil {
+			if time.Now().Before(nextConnect) {
+				e.dropped.Add(1)
+
+				continue
+			}
+
+			var err error
+			out, err = e.open()
+			if err != nil {
+				log.Error("dnstap: opening %s %q: %s", e.network, e.address, err)
+				nextConnect = time.Now().Add(reconnectInterval)
+				e.dropped.Add(1)
+
+				continue
+			}
+
+			log.Debug("dnstap: opened %s %q", e.network, e.address)
+		}
+
+		buf = marshal(buf[:0], e.identity, e.version, m)
+		err := out.write(buf)
+		if err != nil {
+			log.Error("dnstap: writing to %s %q: %s", e.network, e.address, err)
+			out.abort()
+			out, nextConnect = nil, time.Now().Add(reconnectInterval)
+			e.dropped.Add(1)
+
+			continue
+		}
+
+		if n := e.dropped.Swap(0); n > 0 {
+			log.Info("dnstap: dropped %d messages", n)
+		}
+	}
+}
+
+// drain sends the messages left in the queue into out and closes it.  If out
+// is nil, the output is opened when there are messages left.
+func (e *Emitter) drain(out *output, buf []byte) {
+	if out == nil {
+		if len(e.queue) == 0 {
+			return
+		}
+
+		var err error
+		out, err = e.open()
+		if err != nil {
+			log.Error("dnstap: opening %s %q: %s", e.network, e.address, err)
+
+			return
+		}
+	}
+
+	for {
+		select {
+		case m := <-e.queue:
+			buf = marshal(buf[:0], e.identity, e.version, m)
+			err := out.write(buf)
+			if err != nil {
+				log.Error("dnstap: writing to %s %q: %s", e.network, e.address, err)
+				out.abort()
+
+				return
+			}
+		default:
+			err := out.close()
+			if err != nil {
+				log.Error("dnstap: closing %s %q: %s", e.network, e.address, err)
+			}
+
+			return
+		}
+	}
+}
+
+// open opens the output and performs the Frame Streams handshake.
+func (e *Emitter) open() (out *output, err error) {
+	var conn io.ReadWriteCloser
+	bidirectional := e.network != NetworkFile
+	if bidirectional {
+		conn, err = net.DialTimeout(e.network, e.address, writeTimeout)
+	} else {
+		conn, err = createFile(e.address)
+	}
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	out = &output{conn: conn}
+	out.setDeadline()
+
+	out.fw, err = newFrameWriter(conn, bidirectional)
+	if err != nil {
+		return nil, errors.WithDeferred(err, conn.Close())
+	}
+
+	return out, nil
+}
+
+// createFile creates a new file for a frame stream at path.  The existing
+// non-empty file is renamed first, so that the previously captured messages
+// aren't lost when the output is reopened.
+func createFile(path string) (f *os.File, err error) {
+	fi, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Go on.
+	case err != nil:
+		return nil, fmt.Errorf("checking file: %w", err)
+	case fi.Mode().IsRegular() && fi.Size() > 0:
+		rotated := path + "." + time.Now().Format(rotatedFileTimeFormat)
+		err = os.Rename(path, rotated)
+		if err != nil {
+			return nil, fmt.Errorf("renaming previous file: %w", err)
+		}
+
+		log.Info("dnstap: renamed previous file to %q", rotated)
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+}
+
+// write writes a data frame with payload.
+func (o *output) write(payload []byte) (err error) {
+	o.setDeadline()
+
+	return o.fw.writeFrame(payload)
+}
+
+// close finishes the stream and closes the output.
+func (o *output) close() (err error) {
+	o.setDeadline()
+
+	err = o.fw.close()
+
+	return errors.WithDeferred(err, o.conn.Close())
+}
+
+// abort closes the output without finishing the stream.
+func (o *output) abort() {
+	err := o.conn.Close()
+	if err != nil {
+		log.Debug("dnstap: closing output: %s", err)
+	}
+}
+
+// setDeadline sets the deadline of the next I/O operation, if the output is a
+// connection.
+func (o *output) setDeadline() {
+	c, ok := o.conn.(net.Conn)
+	if !ok {
+		return
+	}
+
+	err := c.SetDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		log.Debug("dnstap: setting deadline: %s", err)
+	}
+}
@@ -0,0 +1,320 @@
+package dnstap_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/jynychen/AdGuardHome/pkg/dnstap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Frame Streams control frame types.
+const (
+	controlAccept uint32 = 0x01
+	controlStart  uint32 = 0x02
+	controlStop   uint32 = 0x03
+	controlReady  uint32 = 0x04
+)
+
+// readFrame reads a single frame from r.  If the frame is a control one,
+// control is its type and payload contains its fields.
+func readFrame(t testing.TB, r io.Reader) (payload []byte, control uint32) {
+	t.Helper()
+
+	var lenBuf [4]byte
+	_, err := io.ReadFull(r, lenBuf[:])
+	require.NoError(t, err)
+
+	l := binary.BigEndian.Uint32(lenBuf[:])
+	isControl := l == 0
+	if isControl {
+		_, err = io.ReadFull(r, lenBuf[:])
+		require.NoError(t, err)
+
+		l = binary.BigEndian.Uint32(lenBuf[:])
+	}
+
+	payload = make([]byte, l)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+
+	if isControl {
+		return payload[4:], binary.BigEndian.Uint32(payload[:4])
+	}
+
+	return payload, 0
+}
+
+// field is a decoded protobuf field.
+type field struct {
+	bytes  []byte
+	varint uint64
+}
+
+// decodeFields decodes the protobuf message b into its fields by numbers.
+func decodeFields(t testing.TB, b []byte) (fields map[uint64]field) {
+	t.Helper()
+
+	fields = map[uint64]field{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.Positive(t, n)
+
+		b = b[n:]
+
+		var f field
+		switch wireType := key & 0x7; wireType {
+		case 0:
+			f.varint, n = binary.Uvarint(b)
+			require.Positive(t, n)
+
+			b = b[n:]
+		case 2:
+			var l uint64
+			l, n = binary.Uvarint(b)
+			require.Positive(t, n)
+
+			f.bytes, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			f.varint, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", wireType)
+		}
+
+		fields[key>>3] = f
+	}
+
+	return fields
+}
+
+// newTestMessage returns a new client response message for tests.
+func newTestMessage() (m *dnstap.Message) {
+	return &dnstap.Message{
+		QueryTime:       time.Unix(1_000, 123),
+		ResponseTime:    time.Unix(1_001, 0),
+		Extra:           []byte("cli"),
+		QueryMessage:    []byte{1, 2, 3},
+		ResponseMessage: []byte{4, 5, 6},
+		QueryAddr:       netip.MustParseAddrPort("[::ffff:192.0.2.1]:1234"),
+		Type:            dnstap.MessageTypeClientResponse,
+		SocketProtocol:  dnstap.SocketProtocolDOH,
+	}
+}
+
+// assertTestMessage checks that the payload of the data frame is the encoded
+// message returned by [newTestMessage].
+func assertTestMessage(t *testing.T, payload []byte) {
+	t.Helper()
+
+	frame := decodeFields(t, payload)
+
+	assert.Equal(t, []byte("test"), frame[1].bytes)
+	assert.Equal(t, []byte("cli"), frame[3].bytes)
+	assert.Equal(t, uint64(1), frame[15].varint)
+
+	msg := decodeFields(t, frame[14].bytes)
+
+	assert.Equal(t, uint64(dnstap.MessageTypeClientResponse), msg[1].varint)
+	assert.Equal(t, uint64(1), msg[2].varint)
+	assert.Equal(t, uint64(dnstap.SocketProtocolDOH), msg[3].varint)
+	assert.Equal(t, []byte{192, 0, 2, 1}, msg[4].bytes)
+	assert.Equal(t, uint64(1234), msg[6].varint)
+	assert.Equal(t, uint64(1_000), msg[8].varint)
+	assert.Equal(t, uint64(123), msg[9].varint)
+	assert.Equal(t, []byte{1, 2, 3}, msg[10].bytes)
+	assert.Equal(t, uint64(1_001), msg[12].varint)
+	assert.Equal(t, uint64(0), msg[13].varint)
+	assert.Equal(t, []byte{4, 5, 6}, msg[14].bytes)
+
+	assert.NotContains(t, msg, uint64(5))
+	assert.NotContains(t, msg, uint64(7))
+}
+
+func TestEmitter_unix(t *testing.T) {
+	// Use a short path, since the length of a Unix socket path is limited.
+	dir, err := os.MkdirTemp("", "dnstap")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return os.RemoveAll(dir) })
+
+	sockPath := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	payloads := make(chan []byte, 1)
+	go func() {
+		conn, acceptErr := l.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		fields, typ := readFrame(t, conn)
+		assert.Equal(t, controlReady, typ)
+		assert.Contains(t, string(fields), "protobuf:dnstap.Dnstap")
+
+		accept := binary.BigEndian.AppendUint32(nil, 0)
+		accept = binary.BigEndian.AppendUint32(accept, 4)
+		accept = binary.BigEndian.AppendUint32(accept, controlAccept)
+		_, writeErr := conn.Write(accept)
+		assert.NoError(t, writeErr)
+
+		_, typ = readFrame(t, conn)
+		assert.Equal(t, controlStart, typ)
+
+		payload, _ := readFrame(t, conn)
+		payloads <- payload
+	}()
+
+	e := dnstap.New(&dnstap.Config{
+		Network:  dnstap.NetworkUnix,
+		Address:  sockPath,
+		Identity: "test",
+		Enabled:  true,
+	})
+	e.Start()
+	t.Cleanup(e.Close)
+
+	e.Emit(newTestMessage())
+
+	select {
+	case payload := <-payloads:
+		assertTestMessage(t, payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+// emitToFile emits num test messages into the file at filePath using a new
+// emitter.
+func emitToFile(t *testing.T, filePath string, num int) {
+	t.Helper()
+
+	e := dnstap.New(&dnstap.Config{
+		Network:  dnstap.NetworkFile,
+		Address:  filePath,
+		Identity: "test",
+		Enabled:  true,
+	})
+	e.Start()
+
+	for i := 0; i < num; i++ {
+		e.Emit(newTestMessage())
+	}
+
+	// Close sends the queued messages.
+	e.Close()
+}
+
+// assertFileStream checks that the file at filePath contains a single frame
+// stream with num test messages.
+func assertFileStream(t *testing.T, filePath string, num int) {
+	t.Helper()
+
+	f, err := os.Open(filePath)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, f.Close)
+
+	_, typ := readFrame(t, f)
+	require.Equal(t, controlStart, typ)
+
+	for i := 0; i < num; i++ {
+		payload, dataTyp := readFrame(t, f)
+		require.Zero(t, dataTyp)
+
+		assertTestMessage(t, payload)
+	}
+
+	_, typ = readFrame(t, f)
+	assert.Equal(t, controlStop, typ)
+}
+
+func TestEmitter_file(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "dnstap.fstrm")
+
+	emitToFile(t, filePath, 2)
+	assertFileStream(t, filePath, 2)
+
+	// The previous file is kept when the output is opened again.
+	emitToFile(t, filePath, 1)
+	assertFileStream(t, filePath, 1)
+
+	rotated, err := filepath.Glob(filePath + ".*")
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+
+	assertFileStream(t, rotated[0], 2)
+}
+
+func TestEmitter_Emit_full(t *testing.T) {
+	e := dnstap.New(&dnstap.Config{
+		Network:   dnstap.NetworkTCP,
+		Address:   "127.0.0.1:1",
+		QueueSize: 1,
+		Enabled:   true,
+	})
+
+	// The emitter isn't started, so the queue is never drained, but Emit must
+	// not block.
+	for i := 0; i < 10; i++ {
+		e.Emit(newTestMessage())
+	}
+
+	e.Close()
+}
+
+func TestConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		conf       *dnstap.Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf: &dnstap.Config{
+			Enabled: false,
+		},
+		name:       "disabled",
+		wantErrMsg: "",
+	}, {
+		conf: &dnstap.Config{
+			Network: dnstap.NetworkTCP,
+			Address: "127.0.0.1:6000",
+			Enabled: true,
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf: &dnstap.Config{
+			Network: "udp",
+			Address: "127.0.0.1:6000",
+			Enabled: true,
+		},
+		name:       "bad_network",
+		wantErrMsg: `network: unsupported value "udp"`,
+	}, {
+		conf: &dnstap.Config{
+			Network: dnstap.NetworkFile,
+			Enabled: true,
+		},
+		name:       "no_address",
+		wantErrMsg: "address: empty value",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.Validate())
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// contentType is the content type of the dnstap Frame Streams.
+const contentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types.
+//
+// See https://farsightsec.github.io/fstrm/.
+const (
+	controlAccept uint32 = 0x01
+	controlStart  uint32 = 0x02
+	controlStop   uint32 = 0x03
+	controlReady  uint32 = 0x04
+	controlFinish uint32 = 0x05
+)
+
+// controlFieldContentType is the type of the content type control frame field.
+const controlFieldContentType uint32 = 0x01
+
+// maxControlFrameSize is the maximum size of a control frame accepted from the
+// collector.
+const maxControlFrameSize = 512
+
+// frameWriter writes the Frame Streams data frames.
+type frameWriter struct {
+	// rw is the underlying stream.
+	rw io.ReadWriter
+
+	// buf is reused for encoding the frames.
+	buf []byte
+
+	// bidirectional, if true, means that the collector acknowledges the
+	// stream with the control frames.
+	bidirectional bool
+}
+
+// newFrameWriter performs the Frame Streams handshake over rw and returns a
+// writer for the data frames.  If bidirectional is true, the collector is
+// expected to answer the READY frame with an ACCEPT frame.
+func newFrameWriter(rw io.ReadWriter, bidirectional bool) (fw *frameWriter, err error) {
+	fw = &frameWriter{
+		rw:            rw,
+		bidirectional: bidirectional,
+	}
+
+	if bidirectional {
+		err = fw.writeControl(controlReady, true)
+		if err != nil {
+			return nil, fmt.Errorf("writing ready: %w", err)
+		}
+
+		err = fw.readControl(controlAccept)
+		if err != nil {
+			return nil, fmt.Errorf("reading accept: %w", err)
+		}
+	}
+
+	err = fw.writeControl(controlStart, true)
+	if err != nil {
+		return nil, fmt.Errorf("writing start: %w", err)
+	}
+
+	return fw, nil
+}
+
+// writeFrame writes a data frame with payload.
+func (fw *frameWriter) writeFrame(payload []byte) (err error) {
+	fw.buf = binary.BigEndian.AppendUint32(fw.buf[:0], uint32(len(payload)))
+	fw.buf = append(fw.buf, payload...)
+
+	_, err = fw.rw.Write(fw.buf)
+
+	return err
+}
+
+// close writes the STOP frame and, if the stream is bidirectional, waits for
+// the FINISH frame.  It doesn't close the underlying stream.
+func (fw *frameWriter) close() (err error) {
+	err = fw.writeControl(controlStop, false)
+	if err != nil {
+		return fmt.Errorf("writing stop: %w", err)
+	}
+
+	if fw.bidirectional {
+		err = fw.readControl(controlFinish)
+		if err != nil {
+			return fmt.Errorf("reading finish: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeControl writes a control frame of the given type, optionally with the
+// content type field.
+func (fw *frameWriter) writeControl(typ uint32, withContentType bool) (err error) {
+	frameLen := 4
+	if withContentType {
+		frameLen += 8 + len(contentType)
+	}
+
+	b := fw.buf[:0]
+
+	// The escape sequence, which is the zero length of a data frame.
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(frameLen))
+	b = binary.BigEndian.AppendUint32(b, typ)
+	if withContentType {
+		b = binary.BigEndian.AppendUint32(b, controlFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+
+	fw.buf = b
+
+	_, err = fw.rw.Write(b)
+
+	return err
+}
+
+// readControl reads a control frame and returns an error if its type isn't
+// want.
+func (fw *frameWriter) readControl(want uint32) (err error) {
+	var hdr [12]byte
+	_, err = io.ReadFull(fw.rw, hdr[:])
+	if err != nil {
+		return err
+	}
+
+	escape := binary.BigEndian.Uint32(hdr[0:4])
+	frameLen := binary.BigEndian.Uint32(hdr[4:8])
+	typ := binary.BigEndian.Uint32(hdr[8:12])
+	switch {
+	case escape != 0:
+		return errors.Error("not a control frame")
+	case frameLen < 4 || frameLen > maxControlFrameSize:
+		return fmt.Errorf("bad control frame length %d", frameLen)
+	case typ != want:
+		return fmt.Errorf("control frame type %d, want %d", typ, want)
+	}
+
+	// Skip the fields, since only one content type is supported.
+	_, err = io.CopyN(io.Discard, fw.rw, int64(frameLen-4))
+
+	return err
+}
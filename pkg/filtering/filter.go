@@ -188,6 +188,39 @@ func (d *DNSFilter) filterExistsLocked(url string) (ok bool) {
 	return false
 }
 
+// FilterListName returns the human-readable name of the filter list with the
+// given ID.  name is empty if there is no such list.  It's safe for concurrent
+// use.
+func (d *DNSFilter) FilterListName(id int64) (name string) {
+	switch id {
+	case CustomListID:
+		return "Custom filtering rules"
+	case SysHostsListID:
+		return "System hosts file"
+	case BlockedSvcsListID:
+		return "Blocked services"
+	case ParentalListID:
+		return "Parental control"
+	case SafeBrowsingListID:
+		return "Safe browsing"
+	case SafeSearchListID:
+		return "Safe search"
+	}
+
+	d.conf.filtersMu.RLock()
+	defer d.conf.filtersMu.RUnlock()
+
+	for _, fltList := range [][]FilterYAML{d.conf.Filters, d.conf.WhitelistFilters} {
+		for _, flt := range fltList {
+			if flt.ID == id {
+				return flt.Name
+			}
+		}
+	}
+
+	return ""
+}
+
 // Add a filter
 // Return FALSE if a filter with this URL exists
 func (d *DNSFilter) filterAdd(flt FilterYAML) (err error) {
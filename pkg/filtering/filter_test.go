@@ -173,3 +173,43 @@ func TestFilterYAML_EnsureName(t *testing.T) {
 		assert.Equal(t, "List 0", f.Name)
 	})
 }
+
+func TestDNSFilter_FilterListName(t *testing.T) {
+	dnsFilter := newDNSFilter(t)
+	dnsFilter.conf.Filters = []FilterYAML{{
+		Name:   "Blocklist",
+		Filter: Filter{ID: 1},
+	}}
+	dnsFilter.conf.WhitelistFilters = []FilterYAML{{
+		Name:   "Allowlist",
+		Filter: Filter{ID: 2},
+	}}
+
+	testCases := []struct {
+		name string
+		want string
+		id   int64
+	}{{
+		name: "custom",
+		want: "Custom filtering rules",
+		id:   CustomListID,
+	}, {
+		name: "blocklist",
+		want: "Blocklist",
+		id:   1,
+	}, {
+		name: "allowlist",
+		want: "Allowlist",
+		id:   2,
+	}, {
+		name: "unknown",
+		want: "",
+		id:   3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, dnsFilter.FilterListName(tc.id))
+		})
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
 	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/jynychen/AdGuardHome/pkg/filtering/rpz"
 	"github.com/jynychen/AdGuardHome/pkg/filtering/rulelist"
 	"github.com/miekg/dns"
 	"golang.org/x/exp/slices"
@@ -105,6 +106,12 @@ type Config struct {
 	// Register an HTTP handler
 	HTTPRegister aghhttp.RegisterFunc `yaml:"-"`
 
+	// RuleHits returns the numbers of requests matched by the rules of each
+	// filter list and by each rule, grouped by the filter list ID, within the
+	// statistics interval.  It returns nil maps if the statistics are
+	// disabled.  It may be nil.
+	RuleHits func() (lists map[int64]uint64, rules map[int64]map[string]uint64) `yaml:"-"`
+
 	// HTTPClient is the client to use for updating the remote filters.
 	HTTPClient *http.Client `yaml:"-"`
 
@@ -240,6 +247,10 @@ type DNSFilter struct {
 	rulesStorageAllow    *filterlist.RuleStorage
 	filteringEngineAllow *urlfilter.DNSEngine
 
+	// rpzZones are the blocklists in the Response Policy Zone format.  They
+	// are protected by engineLock.
+	rpzZones []*rpz.Zone
+
 	safeSearch SafeSearch
 
 	// safeBrowsingChecker is the safe browsing hash-prefix checker.
@@ -456,6 +467,8 @@ func (d *DNSFilter) reset() {
 			log.Error("filtering: rulesStorageAllow.Close: %s", err)
 		}
 	}
+
+	d.rpzZones = nil
 }
 
 // ProtectionStatus returns the status of protection and time until it's
@@ -485,6 +498,27 @@ func (d *DNSFilter) SetProtectionEnabled(status bool) {
 	d.conf.ProtectionEnabled = status
 }
 
+// RulesCount returns the numbers of rules currently loaded into the blocking
+// and the allowlist filtering engines.
+func (d *DNSFilter) RulesCount() (block, allow int) {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	for _, z := range d.rpzZones {
+		block += z.RulesCount
+	}
+
+	if d.filteringEngine != nil {
+		block += d.filteringEngine.RulesCount
+	}
+
+	if d.filteringEngineAllow != nil {
+		allow = d.filteringEngineAllow.RulesCount
+	}
+
+	return block, allow
+}
+
 // EtcHostsRecords returns the hosts records for the hostname.
 func (d *DNSFilter) EtcHostsRecords(hostname string) (recs []*hostsfile.Record) {
 	if d.conf.EtcHosts != nil {
@@ -582,6 +616,10 @@ type Result struct {
 
 	// IsFiltered is true if the request is filtered.
 	IsFiltered bool `json:",omitempty"`
+
+	// IsRPZ is true if the result comes from a rule of a response policy
+	// zone.
+	IsRPZ bool `json:",omitempty"`
 }
 
 // Matched returns true if any match at all was found regardless of
@@ -845,6 +883,7 @@ func newRuleStorage(filters []Filter) (rs *filterlist.RuleStorage, err error) {
 
 // Initialize urlfilter objects.
 func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) (err error) {
+	rpzZones, blockFilters := newRPZones(blockFilters)
 	rulesStorage, err := newRuleStorage(blockFilters)
 	if err != nil {
 		return err
@@ -867,6 +906,7 @@ func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) (err erro
 		d.filteringEngine = filteringEngine
 		d.rulesStorageAllow = rulesStorageAllow
 		d.filteringEngineAllow = filteringEngineAllow
+		d.rpzZones = rpzZones
 	}()
 
 	// Make sure that the OS reclaims memory as soon as possible.
@@ -1013,16 +1053,23 @@ func (d *DNSFilter) matchHost(
 	dnsRWRes := d.processDNSResultRewrites(dnsres, host)
 	if dnsRWRes.Reason != NotFilteredNotFound {
 		return dnsRWRes, nil
-	} else if !matchedEngine {
+	} else if !setts.ProtectionEnabled {
+		// Don't check non-dnsrewrite filtering results.
 		return Result{}, nil
 	}
 
-	if !setts.ProtectionEnabled {
-		// Don't check non-dnsrewrite filtering results.
-		return Result{}, nil
+	if matchedEngine {
+		res = d.matchHostProcessDNSResult(rrtype, dnsres)
+	}
+
+	// Only the exception rules take precedence over the response policy
+	// zones.
+	if res.Reason != NotFilteredAllowList {
+		if rpzRes, ok := d.matchRPZ(host); ok {
+			res = rpzRes
+		}
 	}
 
-	res = d.matchHostProcessDNSResult(rrtype, dnsres)
 	for _, r := range res.Rules {
 		log.Debug(
 			"filtering: found rule %q for host %q, filter list id: %d",
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -69,6 +70,21 @@ type Config struct {
 	CacheSize uint
 }
 
+// Stats are the statistics of the lookups performed by a [Checker].
+type Stats struct {
+	// Lookups is the total number of checked hostnames.
+	Lookups uint64
+
+	// CacheHits is the number of lookups answered from the cache.
+	CacheHits uint64
+
+	// Errors is the number of lookups failed due to upstream errors.
+	Errors uint64
+
+	// Blocked is the number of lookups which resulted in blocking.
+	Blocked uint64
+}
+
 type Checker struct {
 	// upstream is the upstream DNS server.
 	upstream upstream.Upstream
@@ -84,6 +100,13 @@ type Checker struct {
 
 	// cacheTime is the time period to store hash.
 	cacheTime time.Duration
+
+	// lookups, cacheHits, errors, and blocked are the lookup counters, see
+	// [Stats].
+	lookups   atomic.Uint64
+	cacheHits atomic.Uint64
+	errors    atomic.Uint64
+	blocked   atomic.Uint64
 }
 
 // New returns Checker.
@@ -102,11 +125,19 @@ func New(conf *Config) (c *Checker) {
 
 // Check returns true if request for the host should be blocked.
 func (c *Checker) Check(host string) (ok bool, err error) {
+	c.lookups.Add(1)
+	defer func() {
+		if ok {
+			c.blocked.Add(1)
+		}
+	}()
+
 	hashes := hostnameToHashes(host)
 
 	found, blocked, hashesToRequest := c.findInCache(hashes)
 	if found {
 		log.Debug("%s: found %q in cache, blocked: %t", c.svc, host, blocked)
+		c.cacheHits.Add(1)
 
 		return blocked, nil
 	}
@@ -118,6 +149,8 @@ func (c *Checker) Check(host string) (ok bool, err error) {
 
 	resp, err := c.upstream.Exchange(req)
 	if err != nil {
+		c.errors.Add(1)
+
 		return false, fmt.Errorf("getting hashes: %w", err)
 	}
 
@@ -128,6 +161,16 @@ func (c *Checker) Check(host string) (ok bool, err error) {
 	return matched, nil
 }
 
+// Stats returns the current statistics of the lookups performed by c.
+func (c *Checker) Stats() (s Stats) {
+	return Stats{
+		Lookups:   c.lookups.Load(),
+		CacheHits: c.cacheHits.Load(),
+		Errors:    c.errors.Load(),
+		Blocked:   c.blocked.Load(),
+	}
+}
+
 // hostnameToHashes returns hashes that should be checked by the hash prefix
 // filter.
 func hostnameToHashes(host string) (hashes []hostnameHash) {
@@ -243,6 +243,18 @@ func TestChecker_Check(t *testing.T) {
 
 			// Check that there were no additional requests.
 			assert.Equal(t, 1, numReq)
+
+			wantBlocked := uint64(0)
+			if tc.wantBlock {
+				wantBlocked = 2
+			}
+
+			assert.Equal(t, Stats{
+				Lookups:   2,
+				CacheHits: 1,
+				Errors:    0,
+				Blocked:   wantBlocked,
+			}, c.Stats())
 		})
 	}
 }
@@ -310,6 +310,7 @@ type filterJSON struct {
 	LastUpdated string `json:"last_updated,omitempty"`
 	ID          int64  `json:"id"`
 	RulesCount  uint32 `json:"rules_count"`
+	Hits        uint64 `json:"hits"`
 	Enabled     bool   `json:"enabled"`
 }
 
@@ -321,13 +322,14 @@ type filteringConfig struct {
 	Enabled          bool         `json:"enabled"`
 }
 
-func filterToJSON(f FilterYAML) filterJSON {
+func filterToJSON(f FilterYAML, hits map[int64]uint64) filterJSON {
 	fj := filterJSON{
 		ID:         f.ID,
 		Enabled:    f.Enabled,
 		URL:        f.URL,
 		Name:       f.Name,
 		RulesCount: uint32(f.RulesCount),
+		Hits:       hits[f.ID],
 	}
 
 	if !f.LastUpdated.IsZero() {
@@ -339,16 +341,18 @@ func filterToJSON(f FilterYAML) filterJSON {
 
 // Get filtering configuration
 func (d *DNSFilter) handleFilteringStatus(w http.ResponseWriter, r *http.Request) {
+	hits, _ := d.ruleHits()
+
 	resp := filteringConfig{}
 	d.conf.filtersMu.RLock()
 	resp.Enabled = d.conf.FilteringEnabled
 	resp.Interval = d.conf.FiltersUpdateIntervalHours
 	for _, f := range d.conf.Filters {
-		fj := filterToJSON(f)
+		fj := filterToJSON(f, hits)
 		resp.Filters = append(resp.Filters, fj)
 	}
 	for _, f := range d.conf.WhitelistFilters {
-		fj := filterToJSON(f)
+		fj := filterToJSON(f, hits)
 		resp.WhitelistFilters = append(resp.WhitelistFilters, fj)
 	}
 	resp.UserRules = d.conf.UserRules
@@ -576,6 +580,7 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodPost, "/control/filtering/refresh", d.handleFilteringRefresh)
 	registerHTTP(http.MethodPost, "/control/filtering/set_rules", d.handleFilteringSetRules)
 	registerHTTP(http.MethodGet, "/control/filtering/check_host", d.handleCheckHost)
+	registerHTTP(http.MethodGet, "/control/filtering/rule_hits", d.handleRuleHits)
 }
 
 // ValidateUpdateIvl returns false if i is not a valid filters update interval.
@@ -0,0 +1,127 @@
+package filtering
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/filtering/rpz"
+	"github.com/miekg/dns"
+)
+
+// newRPZones parses the filters in the Response Policy Zone format.  rest are
+// the other filters.  The errors are logged, since a broken list shouldn't
+// disable filtering.
+func newRPZones(filters []Filter) (zones []*rpz.Zone, rest []Filter) {
+	for _, f := range filters {
+		z, err := parseRPZ(f)
+		if err != nil {
+			log.Error("filtering: rpz list %d: %s", f.ID, err)
+		}
+
+		if z != nil {
+			zones = append(zones, z)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+
+	return zones, rest
+}
+
+// parseRPZ returns the zone of f, if f is a Response Policy Zone.  Otherwise,
+// z is nil.  If err is not nil, z may contain the rules parsed before the
+// error.
+func parseRPZ(f Filter) (z *rpz.Zone, err error) {
+	var r io.ReadSeeker
+	switch {
+	case len(f.Data) != 0:
+		r = bytes.NewReader(f.Data)
+	case f.FilePath == "":
+		return nil, nil
+	default:
+		var file *os.File
+		file, err = os.Open(f.FilePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		defer func() { err = errors.WithDeferred(err, file.Close()) }()
+
+		r = file
+	}
+
+	isZone, err := rpz.IsZone(r)
+	if err != nil {
+		return nil, fmt.Errorf("detecting zone: %w", err)
+	} else if !isZone {
+		return nil, nil
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("rewinding: %w", err)
+	}
+
+	z, err = rpz.Parse(r, int(f.ID))
+	if err != nil {
+		return z, fmt.Errorf("parsing zone: %w", err)
+	}
+
+	log.Debug("filtering: rpz list %d: %d rules", f.ID, z.RulesCount)
+
+	return z, nil
+}
+
+// matchRPZ returns the result of the first response policy zone matching host.
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) matchRPZ(host string) (res Result, ok bool) {
+	for _, z := range d.rpzZones {
+		r := z.Match(host)
+		if r != nil {
+			return rpzResult(z.ListID, r), true
+		}
+	}
+
+	return Result{}, false
+}
+
+// rpzResult returns the filtering result of the rule of the response policy
+// zone with the given list ID.
+func rpzResult(listID int, r *rpz.Rule) (res Result) {
+	res.IsRPZ = true
+	for _, text := range r.Texts {
+		res.Rules = append(res.Rules, &ResultRule{
+			FilterListID: int64(listID),
+			Text:         text,
+		})
+	}
+
+	switch r.Action {
+	case rpz.ActionNXDOMAIN:
+		res.Reason, res.IsFiltered = FilteredBlockList, true
+		res.DNSRewriteResult = &DNSRewriteResult{RCode: dns.RcodeNameError}
+	case rpz.ActionNODATA:
+		res.Reason, res.IsFiltered = FilteredBlockList, true
+		res.DNSRewriteResult = &DNSRewriteResult{RCode: dns.RcodeSuccess}
+	case rpz.ActionPassthru:
+		res.Reason = NotFilteredAllowList
+	default:
+		res.Reason = RewrittenRule
+		if r.CNAME != "" {
+			res.CanonName = r.CNAME
+		} else {
+			res.DNSRewriteResult = &DNSRewriteResult{
+				Response: DNSRewriteResultResponse(r.Response),
+				RCode:    dns.RcodeSuccess,
+			}
+		}
+	}
+
+	return res
+}
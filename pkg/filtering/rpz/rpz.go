@@ -0,0 +1,410 @@
+// Package rpz contains the implementation of the filtering-rule lists in the
+// Response Policy Zone format.
+//
+// See https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz.
+package rpz
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// Action is the policy action of a rule.
+type Action uint8
+
+// Supported policy actions.
+const (
+	// ActionNXDOMAIN means that the response is NXDOMAIN.  It's defined by
+	// the "CNAME ." record.
+	ActionNXDOMAIN Action = iota + 1
+
+	// ActionNODATA means that the response is NODATA.  It's defined by the
+	// "CNAME *." record.
+	ActionNODATA
+
+	// ActionPassthru means that the request is exempted from filtering.  It's
+	// defined by the "CNAME rpz-passthru." record.
+	ActionPassthru
+
+	// ActionLocalData means that the response is made of the records of the
+	// rule.
+	ActionLocalData
+)
+
+// Special CNAME targets of the policy actions.
+const (
+	targetNXDOMAIN = "."
+	targetNODATA   = "*."
+	targetPassthru = "rpz-passthru."
+	targetDrop     = "rpz-drop."
+	targetTCPOnly  = "rpz-tcp-only."
+)
+
+// Trigger suffixes.
+const (
+	suffixIP       = ".rpz-ip"
+	suffixClientIP = ".rpz-client-ip"
+	suffixNSDName  = ".rpz-nsdname"
+	suffixNSIP     = ".rpz-nsip"
+)
+
+// defaultOrigin is the origin used for the zones which don't set one.
+const defaultOrigin = "rpz."
+
+// Rule is a policy rule of a trigger.
+type Rule struct {
+	// Response are the local data records of an [ActionLocalData] rule by
+	// their types.  The values have the types expected by the $dnsrewrite
+	// rules of urlfilter.
+	Response map[rules.RRType][]rules.RRValue
+
+	// CNAME is the target of the local data CNAME record of an
+	// [ActionLocalData] rule.  If set, Response is empty.
+	CNAME string
+
+	// Texts are the texts of the records defining the rule.
+	Texts []string
+
+	// Action is the policy action of the rule.
+	Action Action
+}
+
+// ipRule is a rule of an rpz-ip trigger.
+type ipRule struct {
+	rule   *Rule
+	subnet netip.Prefix
+}
+
+// Zone is a parsed Response Policy Zone.  It supports the QNAME triggers, the
+// wildcard QNAME triggers, and the rpz-ip triggers, which are matched against
+// the addresses in the responses.  The rpz-nsdname, rpz-nsip, and
+// rpz-client-ip triggers require the data unavailable to the filtering, so
+// they are skipped.
+type Zone struct {
+	// names maps the lowercased names without the trailing dot to their rules.
+	names map[string]*Rule
+
+	// wildcards maps the lowercased names without the trailing dot to the
+	// rules for their subdomains.
+	wildcards map[string]*Rule
+
+	// origin is the apex of the zone with the trailing dot.
+	origin string
+
+	// ips are the rules of the rpz-ip triggers sorted from the most specific
+	// subnet to the least one.
+	ips []*ipRule
+
+	// ListID is the ID of the filtering-rule list.
+	ListID int
+
+	// RulesCount is the number of triggers in the zone.
+	RulesCount int
+}
+
+// IsZoneStart returns true if line is likely the first meaningful line of a
+// DNS zone.  line is assumed to be trimmed of whitespace characters.
+func IsZoneStart(line []byte) (ok bool) {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	if d := fields[0]; bytes.EqualFold(d, []byte("$TTL")) || bytes.EqualFold(d, []byte("$ORIGIN")) {
+		return true
+	}
+
+	// The SOA type may be preceded by the owner name, the TTL, and the class.
+	for i := 1; i < len(fields) && i < 4; i++ {
+		if bytes.EqualFold(fields[i], []byte("SOA")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsZone returns true if the first meaningful line read from r is the start of
+// a DNS zone.
+func IsZone(r io.Reader) (ok bool, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == ';' || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		return IsZoneStart(line), nil
+	}
+
+	return false, s.Err()
+}
+
+// Parse parses the zone from r.  z is never nil and contains the rules parsed
+// before the error, if any.
+func Parse(r io.Reader, listID int) (z *Zone, err error) {
+	z = &Zone{
+		names:     map[string]*Rule{},
+		wildcards: map[string]*Rule{},
+		origin:    defaultOrigin,
+		ListID:    listID,
+	}
+
+	zp := dns.NewZoneParser(r, defaultOrigin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			z.origin = strings.ToLower(soa.Hdr.Name)
+
+			continue
+		}
+
+		z.add(rr)
+	}
+
+	slices.SortStableFunc(z.ips, func(a, b *ipRule) (res int) {
+		return b.subnet.Bits() - a.subnet.Bits()
+	})
+
+	return z, zp.Err()
+}
+
+// add adds the rule defined by rr to z.
+func (z *Zone) add(rr dns.RR) {
+	hdr := rr.Header()
+	if hdr.Rrtype == dns.TypeNS {
+		return
+	}
+
+	trigger, ok := strings.CutSuffix(strings.ToLower(hdr.Name), "."+z.origin)
+	if !ok {
+		log.Debug("rpz: list %d: record %q is out of zone %q", z.ListID, hdr.Name, z.origin)
+
+		return
+	}
+
+	switch {
+	case
+		strings.HasSuffix(trigger, suffixClientIP),
+		strings.HasSuffix(trigger, suffixNSDName),
+		strings.HasSuffix(trigger, suffixNSIP):
+		log.Debug("rpz: list %d: trigger %q is not supported", z.ListID, trigger)
+	case strings.HasSuffix(trigger, suffixIP):
+		z.addIP(strings.TrimSuffix(trigger, suffixIP), rr)
+	default:
+		var rules map[string]*Rule
+		if name, isWildcard := strings.CutPrefix(trigger, "*."); isWildcard {
+			trigger, rules = name, z.wildcards
+		} else {
+			rules = z.names
+		}
+
+		r, isNew := addRecord(rules[trigger], rr)
+		if r == nil {
+			log.Debug("rpz: list %d: record %q is not supported", z.ListID, rr)
+		} else if isNew {
+			rules[trigger] = r
+			z.RulesCount++
+		}
+	}
+}
+
+// addIP adds the rule of the rpz-ip trigger defined by rr to z.  trigger is the
+// trigger name without the rpz-ip suffix.
+func (z *Zone) addIP(trigger string, rr dns.RR) {
+	subnet, err := parseIPTrigger(trigger)
+	if err != nil {
+		log.Debug("rpz: list %d: bad ip trigger %q: %s", z.ListID, trigger, err)
+
+		return
+	}
+
+	i := slices.IndexFunc(z.ips, func(ir *ipRule) (ok bool) { return ir.subnet == subnet })
+
+	var prev *Rule
+	if i >= 0 {
+		prev = z.ips[i].rule
+	}
+
+	r, isNew := addRecord(prev, rr)
+	if r == nil || r.Action == ActionLocalData {
+		// The local data can't replace the addresses in the responses.
+		log.Debug("rpz: list %d: record %q is not supported", z.ListID, rr)
+
+		return
+	} else if isNew {
+		z.ips = append(z.ips, &ipRule{
+			rule:   r,
+			subnet: subnet,
+		})
+		z.RulesCount++
+	}
+}
+
+// parseIPTrigger parses the name of the rpz-ip trigger without the suffix,
+// e.g. "24.0.2.0.192" or "48.zz.db8.2001".
+func parseIPTrigger(trigger string) (subnet netip.Prefix, err error) {
+	labels := strings.Split(trigger, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, fmt.Errorf("bad number of labels %d", len(labels))
+	}
+
+	bits, addrLabels := labels[0], labels[1:]
+	slices.Reverse(addrLabels)
+
+	var addr string
+	if len(addrLabels) == 4 && !slices.Contains(addrLabels, "zz") {
+		addr = strings.Join(addrLabels, ".")
+	} else {
+		for i, l := range addrLabels {
+			if l == "zz" {
+				addrLabels[i] = ""
+			}
+		}
+
+		// Complete the "::" at the start or at the end of the address.
+		addr = strings.Join(addrLabels, ":")
+		if strings.HasPrefix(addr, ":") {
+			addr = ":" + addr
+		} else if strings.HasSuffix(addr, ":") {
+			addr += ":"
+		}
+	}
+
+	subnet, err = netip.ParsePrefix(addr + "/" + bits)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return netip.Prefix{}, err
+	}
+
+	return subnet.Masked(), nil
+}
+
+// addRecord adds rr to r.  If r is nil, a new rule is returned with isNew set
+// to true.  res is nil if rr isn't supported.
+func addRecord(r *Rule, rr dns.RR) (res *Rule, isNew bool) {
+	action, cname, rrType, val := parseRecord(rr)
+	if action == 0 {
+		return nil, false
+	}
+
+	if r == nil {
+		r = &Rule{
+			CNAME:  cname,
+			Action: action,
+		}
+		isNew = true
+	} else if r.Action != ActionLocalData || r.CNAME != "" || action != ActionLocalData || cname != "" {
+		// The policy actions and the local data CNAME records can't be
+		// combined with other records.  Keep the first one.
+		return r, false
+	}
+
+	r.Texts = append(r.Texts, strings.ReplaceAll(rr.String(), "\t", " "))
+	if val != nil {
+		if r.Response == nil {
+			r.Response = map[rules.RRType][]rules.RRValue{}
+		}
+
+		r.Response[rrType] = append(r.Response[rrType], val)
+	}
+
+	return r, isNew
+}
+
+// parseRecord returns the policy action defined by rr.  For the local data, it
+// also returns either the CNAME target or the type and the value of the record.
+// action is zero if rr isn't supported.
+func parseRecord(rr dns.RR) (action Action, cname string, rrType rules.RRType, val rules.RRValue) {
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		return parseCNAME(strings.ToLower(rr.Target))
+	case *dns.A:
+		addr, ok := netip.AddrFromSlice(rr.A.To4())
+		if ok {
+			return ActionLocalData, "", dns.TypeA, addr
+		}
+	case *dns.AAAA:
+		addr, ok := netip.AddrFromSlice(rr.AAAA)
+		if ok {
+			return ActionLocalData, "", dns.TypeAAAA, addr
+		}
+	case *dns.TXT:
+		return ActionLocalData, "", dns.TypeTXT, strings.Join(rr.Txt, "")
+	case *dns.PTR:
+		return ActionLocalData, "", dns.TypePTR, rr.Ptr
+	case *dns.MX:
+		return ActionLocalData, "", dns.TypeMX, &rules.DNSMX{
+			Exchange:   strings.TrimSuffix(rr.Mx, "."),
+			Preference: rr.Preference,
+		}
+	}
+
+	return 0, "", 0, nil
+}
+
+// parseCNAME returns the policy action defined by the CNAME record with the
+// lowercased target.
+func parseCNAME(target string) (action Action, cname string, rrType rules.RRType, val rules.RRValue) {
+	switch {
+	case target == targetNXDOMAIN:
+		return ActionNXDOMAIN, "", 0, nil
+	case target == targetNODATA:
+		return ActionNODATA, "", 0, nil
+	case target == targetPassthru:
+		return ActionPassthru, "", 0, nil
+	case
+		target == targetDrop,
+		target == targetTCPOnly,
+		strings.HasPrefix(target, "*."):
+		// Dropping requests, forcing TCP, and synthesizing the CNAME targets
+		// from the requested names aren't supported.
+		return 0, "", 0, nil
+	default:
+		return ActionLocalData, strings.TrimSuffix(target, "."), 0, nil
+	}
+}
+
+// Match returns the rule matching host, which is either a domain name or an IP
+// address, or nil if there is none.  The exact QNAME triggers take precedence
+// over the wildcard ones, and the more specific wildcard triggers take
+// precedence over the less specific ones.
+func (z *Zone) Match(host string) (r *Rule) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return z.matchIP(addr)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if r = z.names[host]; r != nil {
+		return r
+	}
+
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if r = z.wildcards[host]; r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// matchIP returns the rule of the most specific rpz-ip trigger containing addr.
+func (z *Zone) matchIP(addr netip.Addr) (r *Rule) {
+	addr = addr.Unmap()
+	for _, ir := range z.ips {
+		if ir.subnet.Contains(addr) {
+			return ir.rule
+		}
+	}
+
+	return nil
+}
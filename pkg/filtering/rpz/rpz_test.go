@@ -0,0 +1,217 @@
+package rpz_test
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/jynychen/AdGuardHome/pkg/filtering/rpz"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is the zone for tests.
+const testZone = `; Threat intelligence feed.
+$TTL 300
+@ SOA localhost. root.localhost. (
+	1 3600 600 86400 300 )
+  NS localhost.
+
+nxdomain.example        CNAME .
+*.nxdomain.example      CNAME .
+nodata.example          CNAME *.
+*.wild.example          CNAME .
+pass.wild.example       CNAME rpz-passthru.
+*.deep.wild.example     CNAME *.
+local.example           A 192.0.2.1
+                        AAAA 2001:db8::1
+                        TXT "local" "data"
+cname.example           CNAME walled.garden.example.
+drop.example            CNAME rpz-drop.
+32.1.2.0.192.rpz-ip     CNAME .
+24.0.2.0.192.rpz-ip     CNAME rpz-passthru.
+48.zz.db8.2001.rpz-ip   CNAME *.
+ns.example.rpz-nsdname  CNAME .
+out.of.zone.example.    CNAME .
+`
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	z, err := rpz.Parse(strings.NewReader(testZone), 1)
+	require.NoError(t, err)
+	require.NotNil(t, z)
+
+	assert.Equal(t, 1, z.ListID)
+	assert.Equal(t, 11, z.RulesCount)
+
+	testCases := []struct {
+		want *rpz.Rule
+		name string
+		host string
+	}{{
+		want: &rpz.Rule{
+			Texts:  []string{"nxdomain.example.rpz. 300 IN CNAME ."},
+			Action: rpz.ActionNXDOMAIN,
+		},
+		name: "qname",
+		host: "nxdomain.example",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"*.nxdomain.example.rpz. 300 IN CNAME ."},
+			Action: rpz.ActionNXDOMAIN,
+		},
+		name: "qname_subdomain",
+		host: "sub.NXDOMAIN.example",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"nodata.example.rpz. 300 IN CNAME *."},
+			Action: rpz.ActionNODATA,
+		},
+		name: "nodata",
+		host: "nodata.example",
+	}, {
+		want: nil,
+		name: "wildcard_apex",
+		host: "wild.example",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"*.wild.example.rpz. 300 IN CNAME ."},
+			Action: rpz.ActionNXDOMAIN,
+		},
+		name: "wildcard",
+		host: "a.b.wild.example",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"pass.wild.example.rpz. 300 IN CNAME rpz-passthru."},
+			Action: rpz.ActionPassthru,
+		},
+		name: "passthru",
+		host: "pass.wild.example",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"*.deep.wild.example.rpz. 300 IN CNAME *."},
+			Action: rpz.ActionNODATA,
+		},
+		name: "closest_wildcard",
+		host: "a.deep.wild.example",
+	}, {
+		want: &rpz.Rule{
+			Response: map[rules.RRType][]rules.RRValue{
+				dns.TypeA:    {netip.MustParseAddr("192.0.2.1")},
+				dns.TypeAAAA: {netip.MustParseAddr("2001:db8::1")},
+				dns.TypeTXT:  {"localdata"},
+			},
+			Texts: []string{
+				"local.example.rpz. 300 IN A 192.0.2.1",
+				"local.example.rpz. 300 IN AAAA 2001:db8::1",
+				`local.example.rpz. 300 IN TXT "local" "data"`,
+			},
+			Action: rpz.ActionLocalData,
+		},
+		name: "local_data",
+		host: "local.example",
+	}, {
+		want: &rpz.Rule{
+			CNAME:  "walled.garden.example",
+			Texts:  []string{"cname.example.rpz. 300 IN CNAME walled.garden.example."},
+			Action: rpz.ActionLocalData,
+		},
+		name: "local_cname",
+		host: "cname.example",
+	}, {
+		want: nil,
+		name: "unsupported_action",
+		host: "drop.example",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"32.1.2.0.192.rpz-ip.rpz. 300 IN CNAME ."},
+			Action: rpz.ActionNXDOMAIN,
+		},
+		name: "ip",
+		host: "192.0.2.1",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"24.0.2.0.192.rpz-ip.rpz. 300 IN CNAME rpz-passthru."},
+			Action: rpz.ActionPassthru,
+		},
+		name: "ip_subnet",
+		host: "192.0.2.2",
+	}, {
+		want: &rpz.Rule{
+			Texts:  []string{"48.zz.db8.2001.rpz-ip.rpz. 300 IN CNAME *."},
+			Action: rpz.ActionNODATA,
+		},
+		name: "ipv6_subnet",
+		host: "2001:db8::2",
+	}, {
+		want: nil,
+		name: "nsdname",
+		host: "ns.example",
+	}, {
+		want: nil,
+		name: "out_of_zone",
+		host: "out.of.zone.example",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, z.Match(tc.host))
+		})
+	}
+}
+
+func TestParse_error(t *testing.T) {
+	t.Parallel()
+
+	z, err := rpz.Parse(strings.NewReader(testZone+"bad.example BAD .\n"), 1)
+	require.Error(t, err)
+	require.NotNil(t, z)
+
+	assert.Equal(t, 11, z.RulesCount)
+}
+
+func TestIsZone(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		in   string
+		want bool
+	}{{
+		name: "zone",
+		in:   testZone,
+		want: true,
+	}, {
+		name: "origin",
+		in:   "$ORIGIN rpz.example.\n",
+		want: true,
+	}, {
+		name: "soa",
+		in:   "# Comment\n\nrpz.example. 300 IN SOA localhost. root.localhost. 1 2 3 4 5\n",
+		want: true,
+	}, {
+		name: "adblock",
+		in:   "! Title: List\n||example.org^\n",
+		want: false,
+	}, {
+		name: "hosts",
+		in:   "0.0.0.0 example.org\n",
+		want: false,
+	}, {
+		name: "empty",
+		in:   "",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := rpz.IsZone(strings.NewReader(tc.in))
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, ok)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package filtering
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_CheckHostRules_rpz(t *testing.T) {
+	const (
+		rpzListID   = 1
+		rulesListID = 2
+	)
+
+	const zoneText = `$TTL 300
+@ SOA localhost. root.localhost. 1 3600 600 86400 300
+blocked.example     CNAME .
+*.nodata.example    CNAME *.
+allowed.example     CNAME rpz-passthru.
+excepted.example    CNAME .
+local.example       A 192.0.2.1
+cname.example       CNAME target.example.
+32.1.2.0.192.rpz-ip CNAME .
+`
+
+	d, setts := newForTest(t, nil, []Filter{{
+		ID:   rpzListID,
+		Data: []byte(zoneText),
+	}, {
+		ID:   rulesListID,
+		Data: []byte("||allowed.example^\n@@||excepted.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	block, _ := d.RulesCount()
+	assert.Equal(t, 7+2, block)
+
+	testCases := []struct {
+		want Result
+		name string
+		host string
+	}{{
+		want: Result{
+			Rules: []*ResultRule{{
+				Text:         "blocked.example.rpz. 300 IN CNAME .",
+				FilterListID: rpzListID,
+			}},
+			DNSRewriteResult: &DNSRewriteResult{RCode: dns.RcodeNameError},
+			Reason:           FilteredBlockList,
+			IsFiltered:       true,
+			IsRPZ:            true,
+		},
+		name: "nxdomain",
+		host: "blocked.example",
+	}, {
+		want: Result{
+			Rules: []*ResultRule{{
+				Text:         "*.nodata.example.rpz. 300 IN CNAME *.",
+				FilterListID: rpzListID,
+			}},
+			DNSRewriteResult: &DNSRewriteResult{RCode: dns.RcodeSuccess},
+			Reason:           FilteredBlockList,
+			IsFiltered:       true,
+			IsRPZ:            true,
+		},
+		name: "nodata",
+		host: "sub.nodata.example",
+	}, {
+		want: Result{
+			Rules: []*ResultRule{{
+				Text:         "allowed.example.rpz. 300 IN CNAME rpz-passthru.",
+				FilterListID: rpzListID,
+			}},
+			Reason: NotFilteredAllowList,
+			IsRPZ:  true,
+		},
+		name: "passthru",
+		host: "allowed.example",
+	}, {
+		want: Result{
+			Rules: []*ResultRule{{
+				Text:         "@@||excepted.example^",
+				FilterListID: rulesListID,
+			}},
+			Reason: NotFilteredAllowList,
+		},
+		name: "exception",
+		host: "excepted.example",
+	}, {
+		want: Result{
+			Rules: []*ResultRule{{
+				Text:         "local.example.rpz. 300 IN A 192.0.2.1",
+				FilterListID: rpzListID,
+			}},
+			DNSRewriteResult: &DNSRewriteResult{
+				Response: DNSRewriteResultResponse{
+					dns.TypeA: []rules.RRValue{netip.MustParseAddr("192.0.2.1")},
+				},
+				RCode: dns.RcodeSuccess,
+			},
+			Reason: RewrittenRule,
+			IsRPZ:  true,
+		},
+		name: "local_data",
+		host: "local.example",
+	}, {
+		want: Result{
+			Rules: []*ResultRule{{
+				Text:         "cname.example.rpz. 300 IN CNAME target.example.",
+				FilterListID: rpzListID,
+			}},
+			Reason:    RewrittenRule,
+			CanonName: "target.example",
+			IsRPZ:     true,
+		},
+		name: "local_cname",
+		host: "cname.example",
+	}, {
+		want: Result{
+			Rules: []*ResultRule{{
+				Text:         "32.1.2.0.192.rpz-ip.rpz. 300 IN CNAME .",
+				FilterListID: rpzListID,
+			}},
+			DNSRewriteResult: &DNSRewriteResult{RCode: dns.RcodeNameError},
+			Reason:           FilteredBlockList,
+			IsFiltered:       true,
+			IsRPZ:            true,
+		},
+		name: "ip",
+		host: "192.0.2.1",
+	}, {
+		want: Result{},
+		name: "not_found",
+		host: "example.org",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHostRules(tc.host, dns.TypeA, setts)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, res)
+		})
+	}
+}
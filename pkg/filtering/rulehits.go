@@ -0,0 +1,179 @@
+package filtering
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// defaultTopRulesLimit is the default number of the most matched rules
+	// returned by the GET /control/filtering/rule_hits HTTP API.
+	defaultTopRulesLimit = 100
+
+	// maxTopRulesLimit is the maximum number of the most matched rules
+	// returned by the GET /control/filtering/rule_hits HTTP API.
+	maxTopRulesLimit = 1000
+)
+
+// ruleHitJSON is the number of requests matched by a rule.
+type ruleHitJSON struct {
+	// Text is the text of the rule.
+	Text string `json:"text"`
+
+	// FilterListID is the ID of the rule's filter list.
+	FilterListID int64 `json:"filter_list_id"`
+
+	// Hits is the number of requests matched by the rule.
+	Hits uint64 `json:"hits"`
+}
+
+// ruleHitsResp is the response to the GET /control/filtering/rule_hits HTTP
+// API.
+type ruleHitsResp struct {
+	// TopRules are the rules with the most matched requests, from more to
+	// less.
+	TopRules []*ruleHitJSON `json:"top_rules"`
+
+	// UnusedUserRules are the user rules, which haven't matched any request.
+	UnusedUserRules []string `json:"unused_user_rules"`
+
+	// UnusedFilters are the IDs of the enabled filter lists, which rules
+	// haven't matched any request.
+	UnusedFilters []int64 `json:"unused_filters"`
+}
+
+// ruleHits returns the numbers of requests matched by the rules of each filter
+// list and by each rule.  It returns nil maps if those aren't available.
+func (d *DNSFilter) ruleHits() (lists map[int64]uint64, rules map[int64]map[string]uint64) {
+	if d.conf.RuleHits == nil {
+		return nil, nil
+	}
+
+	return d.conf.RuleHits()
+}
+
+// handleRuleHits is the handler for the GET /control/filtering/rule_hits HTTP
+// API.
+func (d *DNSFilter) handleRuleHits(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseTopRulesLimit(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "limit: %s", err)
+
+		return
+	}
+
+	lists, rules := d.ruleHits()
+	if lists == nil {
+		aghhttp.Error(r, w, http.StatusServiceUnavailable, "statistics are disabled")
+
+		return
+	}
+
+	resp := &ruleHitsResp{
+		TopRules: topRules(rules, limit),
+	}
+
+	func() {
+		d.conf.filtersMu.RLock()
+		defer d.conf.filtersMu.RUnlock()
+
+		resp.UnusedUserRules = unusedUserRules(d.conf.UserRules, rules[CustomListID])
+		resp.UnusedFilters = unusedFilters(lists, d.conf.Filters, d.conf.WhitelistFilters)
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// parseTopRulesLimit returns the number of the most matched rules requested by
+// r.
+func parseTopRulesLimit(r *http.Request) (limit int, err error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return defaultTopRulesLimit, nil
+	}
+
+	limit, err = strconv.Atoi(s)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return 0, err
+	} else if limit <= 0 || limit > maxTopRulesLimit {
+		return 0, fmt.Errorf("must be from 1 to %d, got %d", maxTopRulesLimit, limit)
+	}
+
+	return limit, nil
+}
+
+// topRules returns at most limit rules with the most matched requests, sorted
+// by the number of requests from more to less, then by the filter list ID, and
+// then by the text.
+func topRules(rules map[int64]map[string]uint64, limit int) (top []*ruleHitJSON) {
+	top = []*ruleHitJSON{}
+	for id, listRules := range rules {
+		for text, n := range listRules {
+			top = append(top, &ruleHitJSON{
+				Text:         text,
+				FilterListID: id,
+				Hits:         n,
+			})
+		}
+	}
+
+	slices.SortFunc(top, func(a, b *ruleHitJSON) (res int) {
+		switch {
+		case a.Hits > b.Hits:
+			return -1
+		case a.Hits < b.Hits:
+			return +1
+		case a.FilterListID < b.FilterListID:
+			return -1
+		case a.FilterListID > b.FilterListID:
+			return +1
+		default:
+			return strings.Compare(a.Text, b.Text)
+		}
+	})
+
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	return top
+}
+
+// unusedUserRules returns the rules from userRules, which aren't in hits.  The
+// empty lines and the comments are skipped.
+func unusedUserRules(userRules []string, hits map[string]uint64) (unused []string) {
+	unused = []string{}
+	for _, rule := range userRules {
+		text := strings.TrimSpace(rule)
+		if text == "" || text[0] == '!' || text[0] == '#' {
+			continue
+		}
+
+		if hits[text] == 0 {
+			unused = append(unused, text)
+		}
+	}
+
+	return unused
+}
+
+// unusedFilters returns the IDs of the enabled filter lists from filters, which
+// rules haven't matched any request according to hits.
+func unusedFilters(hits map[int64]uint64, filters ...[]FilterYAML) (unused []int64) {
+	unused = []int64{}
+	for _, fs := range filters {
+		for _, f := range fs {
+			if f.Enabled && hits[f.ID] == 0 {
+				unused = append(unused, f.ID)
+			}
+		}
+	}
+
+	return unused
+}
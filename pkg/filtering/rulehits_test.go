@@ -0,0 +1,146 @@
+package filtering
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_handleRuleHits(t *testing.T) {
+	const (
+		blockRule  = "||blocked.example^"
+		unusedRule = "||unused.example^"
+		listRule   = "||list.example^"
+	)
+
+	lists := map[int64]uint64{
+		CustomListID: 3,
+		1:            5,
+	}
+	rules := map[int64]map[string]uint64{
+		CustomListID: {blockRule: 3},
+		1:            {listRule: 5},
+	}
+
+	var statsEnabled bool
+	d, err := New(&Config{
+		DataDir: t.TempDir(),
+		Filters: []FilterYAML{{
+			Enabled: true,
+			Name:    "used",
+			URL:     "https://filters.example/used.txt",
+			Filter:  Filter{ID: 1},
+		}, {
+			Enabled: true,
+			Name:    "unused",
+			URL:     "https://filters.example/unused.txt",
+			Filter:  Filter{ID: 2},
+		}, {
+			Enabled: false,
+			Name:    "disabled",
+			URL:     "https://filters.example/disabled.txt",
+			Filter:  Filter{ID: 3},
+		}},
+		UserRules: []string{
+			"! A comment.",
+			"",
+			blockRule,
+			unusedRule,
+		},
+		RuleHits: func() (l map[int64]uint64, r map[int64]map[string]uint64) {
+			if !statsEnabled {
+				return nil, nil
+			}
+
+			return lists, rules
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+
+	t.Run("disabled", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		d.handleRuleHits(w, httptest.NewRequest(http.MethodGet, "/control/filtering/rule_hits", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	statsEnabled = true
+
+	testCases := []struct {
+		want     *ruleHitsResp
+		name     string
+		query    string
+		wantCode int
+	}{{
+		want: &ruleHitsResp{
+			TopRules: []*ruleHitJSON{{
+				Text:         listRule,
+				FilterListID: 1,
+				Hits:         5,
+			}, {
+				Text:         blockRule,
+				FilterListID: CustomListID,
+				Hits:         3,
+			}},
+			UnusedUserRules: []string{unusedRule},
+			UnusedFilters:   []int64{2},
+		},
+		name:     "all",
+		query:    "",
+		wantCode: http.StatusOK,
+	}, {
+		want: &ruleHitsResp{
+			TopRules: []*ruleHitJSON{{
+				Text:         listRule,
+				FilterListID: 1,
+				Hits:         5,
+			}},
+			UnusedUserRules: []string{unusedRule},
+			UnusedFilters:   []int64{2},
+		},
+		name:     "limit",
+		query:    "?limit=1",
+		wantCode: http.StatusOK,
+	}, {
+		want:     nil,
+		name:     "bad_limit",
+		query:    "?limit=0",
+		wantCode: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/control/filtering/rule_hits"+tc.query, nil)
+			d.handleRuleHits(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			if tc.want == nil {
+				return
+			}
+
+			resp := &ruleHitsResp{}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+			assert.Equal(t, tc.want, resp)
+		})
+	}
+
+	t.Run("status", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		d.handleFilteringStatus(w, httptest.NewRequest(http.MethodGet, "/control/filtering/status", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &filteringConfig{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+		require.Len(t, resp.Filters, 3)
+
+		assert.Equal(t, uint64(5), resp.Filters[0].Hits)
+		assert.Equal(t, uint64(0), resp.Filters[1].Hits)
+	})
+}
@@ -8,17 +8,34 @@ import (
 	"io"
 
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/jynychen/AdGuardHome/pkg/filtering/rpz"
 	"golang.org/x/exp/slices"
 )
 
 // Parser is a filtering-rule parser that collects data, such as the checksum
 // and the title, as well as counts rules and removes comments.
+//
+// The lists in the Response Policy Zone format are detected by their first
+// meaningful line.  The lines of such lists are kept intact except for the
+// trailing whitespace, since the leading whitespace is significant in zone
+// files.
 type Parser struct {
 	title      string
 	rulesCount int
 	written    int
 	checksum   uint32
 	titleFound bool
+
+	// sawRule is true if a rule other than a zone-file comment has been
+	// parsed.
+	sawRule bool
+
+	// zone is true if the list is a DNS zone.
+	zone bool
+
+	// zoneParens is the depth of the parentheses in the zone, which are used
+	// to continue records on the following lines.
+	zoneParens int
 }
 
 // NewParser returns a new filtering-rule parser.
@@ -97,6 +114,16 @@ func (p *Parser) processLine(dst io.Writer, line []byte, lineNum int) (n int, er
 		return 0, ErrHTML
 	}
 
+	if !p.sawRule && rpz.IsZoneStart(trimmed) {
+		// The rules parsed before are zone-file comments.
+		p.zone = true
+		p.rulesCount = 0
+	}
+
+	if p.zone {
+		return p.processZoneLine(dst, line, lineNum)
+	}
+
 	badIdx, isRule := 0, false
 	if p.titleFound {
 		badIdx, isRule = parseLine(trimmed)
@@ -116,6 +143,7 @@ func (p *Parser) processLine(dst io.Writer, line []byte, lineNum int) (n int, er
 		return 0, nil
 	}
 
+	p.sawRule = p.sawRule || trimmed[0] != ';'
 	p.rulesCount++
 	p.checksum = crc32.Update(p.checksum, crc32.IEEETable, trimmed)
 
@@ -126,6 +154,41 @@ func (p *Parser) processLine(dst io.Writer, line []byte, lineNum int) (n int, er
 	return n, errors.Annotate(err, "writing rule line: %w")
 }
 
+// processZoneLine is like [Parser.processLine] but for the lines of a DNS
+// zone.  Only the lines starting the records are counted as rules.
+func (p *Parser) processZoneLine(dst io.Writer, line []byte, lineNum int) (n int, err error) {
+	line = bytes.TrimRight(line, " \t\r")
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] == ';' {
+		return 0, nil
+	}
+
+	if badIdx := slices.IndexFunc(line, likelyBinary); badIdx != -1 {
+		return 0, fmt.Errorf(
+			"line %d: character %d: likely binary character %q",
+			lineNum,
+			badIdx+1,
+			line[badIdx],
+		)
+	}
+
+	if p.zoneParens == 0 && trimmed[0] != '$' {
+		p.rulesCount++
+	}
+
+	// Don't count the parentheses within the comments.
+	data, _, _ := bytes.Cut(line, []byte(";"))
+	p.zoneParens += bytes.Count(data, []byte("(")) - bytes.Count(data, []byte(")"))
+
+	p.checksum = crc32.Update(p.checksum, crc32.IEEETable, line)
+
+	// Assume that there is generally enough space in the buffer to add a
+	// newline.
+	n, err = dst.Write(append(line, '\n'))
+
+	return n, errors.Annotate(err, "writing zone line: %w")
+}
+
 // isHTMLLine returns true if line is likely an HTML line.  line is assumed to
 // be trimmed of whitespace characters.
 func isHTMLLine(line []byte) (isHTML bool) {
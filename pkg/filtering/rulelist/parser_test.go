@@ -129,6 +129,25 @@ func TestParser_Parse(t *testing.T) {
 		wantTitle:    "",
 		wantRulesNum: 1,
 		wantWritten:  len(testRuleTextEtcHostsTab),
+	}, {
+		name: "zone",
+		in: "; Zone comment.\n" +
+			"$TTL 300\n" +
+			"@ SOA localhost. root.localhost. ( 1 3600\n" +
+			"  600 86400 300 )\n" +
+			"\n" +
+			"blocked.example CNAME . ; Inline comment.\n" +
+			"  TXT \"blocked\"  \n",
+		wantDst: "; Zone comment.\n" +
+			"$TTL 300\n" +
+			"@ SOA localhost. root.localhost. ( 1 3600\n" +
+			"  600 86400 300 )\n" +
+			"blocked.example CNAME . ; Inline comment.\n" +
+			"  TXT \"blocked\"\n",
+		wantErrMsg:   "",
+		wantTitle:    "",
+		wantRulesNum: 3,
+		wantWritten:  143,
 	}}
 
 	for _, tc := range testCases {
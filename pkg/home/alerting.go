@@ -0,0 +1,70 @@
+package home
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/alerting"
+)
+
+// alertingConfig is the configuration of the alerting on the anomalies in the
+// requests of the clients.
+type alertingConfig struct {
+	// Rules are the rules evaluated for each client at the end of each window.
+	Rules []*alerting.Rule `yaml:"rules"`
+
+	// Sinks are the sinks to deliver the alerts to.
+	Sinks []*alerting.SinkConfig `yaml:"sinks"`
+
+	// Window is the duration of the window, within which the requests are
+	// counted.
+	Window timeutil.Duration `yaml:"window"`
+
+	// DedupInterval is the interval, within which the repeated alerts of the
+	// same rule for the same client aren't delivered.
+	DedupInterval timeutil.Duration `yaml:"dedup_interval"`
+
+	// BaselineWindows is the number of windows, over which the usual number of
+	// requests of a client is averaged.
+	BaselineWindows uint32 `yaml:"baseline_windows"`
+
+	// HistorySize is the number of the last alerts returned by the HTTP API.
+	HistorySize uint32 `yaml:"history_size"`
+
+	// Enabled defines if the rules are evaluated.
+	Enabled bool `yaml:"enabled"`
+}
+
+// initAlerting initializes the alerter in [Context], if the alerting is
+// enabled.
+func initAlerting(conf *alertingConfig) (err error) {
+	if conf == nil || !conf.Enabled {
+		return nil
+	}
+
+	Context.alerter, err = alerting.New(&alerting.Config{
+		HTTPRegister:    httpRegister,
+		HTTPClient:      httpClient(),
+		Rules:           conf.Rules,
+		Sinks:           conf.Sinks,
+		Window:          conf.Window.Duration,
+		DedupInterval:   conf.DedupInterval.Duration,
+		BaselineWindows: conf.BaselineWindows,
+		HistorySize:     conf.HistorySize,
+	})
+	if err != nil {
+		return fmt.Errorf("alerting: %w", err)
+	}
+
+	return nil
+}
+
+// closeAlerting stops delivering the alerts, if the alerting is enabled.
+func closeAlerting() {
+	if Context.alerter == nil {
+		return
+	}
+
+	Context.alerter.Close()
+	Context.alerter = nil
+}
@@ -0,0 +1,111 @@
+package home
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/blockpage"
+)
+
+// blockPageConfig is the configuration of the built-in block page server.
+type blockPageConfig struct {
+	// Address is the address to serve the block page over HTTP on.  The HTTP
+	// listener is disabled if it's not set.
+	Address netip.AddrPort `yaml:"address"`
+
+	// TLSAddress is the address to serve the block page over HTTPS on.  The
+	// HTTPS listener is disabled if it's not set or if the encryption isn't
+	// configured.
+	TLSAddress netip.AddrPort `yaml:"tls_address"`
+
+	// Enabled defines if the block page should be served.  It only makes sense
+	// with the custom IP blocking mode and the blocking addresses pointing to
+	// the block page server.
+	Enabled bool `yaml:"enabled"`
+}
+
+const (
+	// blockPageTokenTTL is the lifetime of the block page tokens.
+	blockPageTokenTTL = 5 * time.Minute
+
+	// blockPageKeyLen is the length of the block page tokens' signing key.
+	blockPageKeyLen = 32
+
+	// blockPageTemplateFile is the name of the file in the data directory
+	// overriding the block page template.
+	blockPageTemplateFile = "blockpage.html"
+)
+
+// initBlockPage initializes the block page server and its tokens in [Context],
+// if the block page is enabled.  tlsConf must not be nil.
+func initBlockPage(conf *blockPageConfig, tlsConf *tlsConfigSettings) (err error) {
+	if conf == nil || !conf.Enabled {
+		return nil
+	}
+
+	key := make([]byte, blockPageKeyLen)
+	_, err = rand.Read(key)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+
+	tokens := blockpage.NewTokens(key, blockPageTokenTTL)
+
+	srvConf := &blockpage.Config{
+		Tokens:         tokens,
+		FilterListName: Context.filters.FilterListName,
+		TemplatePath:   filepath.Join(Context.getDataDir(), blockPageTemplateFile),
+		Addr:           conf.Address,
+	}
+
+	tlsEnabled := tlsConf.Enabled &&
+		len(tlsConf.CertificateChainData) != 0 &&
+		len(tlsConf.PrivateKeyData) != 0
+	if tlsEnabled && conf.TLSAddress.IsValid() {
+		var cert tls.Certificate
+		cert, err = tls.X509KeyPair(tlsConf.CertificateChainData, tlsConf.PrivateKeyData)
+		if err != nil {
+			return fmt.Errorf("loading certificate: %w", err)
+		}
+
+		srvConf.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		srvConf.TLSAddr = conf.TLSAddress
+	}
+
+	Context.blockPage, err = blockpage.New(srvConf)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return err
+	}
+
+	Context.blockPageTokens = tokens
+
+	return nil
+}
+
+// closeBlockPage stops the block page server, if any.
+func closeBlockPage() {
+	if Context.blockPage == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := Context.blockPage.Shutdown(ctx)
+	if err != nil {
+		log.Debug("closing block page: %s", err)
+	}
+
+	Context.blockPage = nil
+	Context.blockPageTokens = nil
+}
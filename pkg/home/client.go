@@ -28,6 +28,10 @@ type Client struct {
 
 	Name string
 
+	// RatelimitPolicy is the name of the ratelimit policy attached to the
+	// client.  If empty, the subnet and global limits are applied.
+	RatelimitPolicy string
+
 	IDs       []string
 	Tags      []string
 	Upstreams []string
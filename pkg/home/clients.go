@@ -55,6 +55,10 @@ type clientsContainer struct {
 
 	allTags *stringutil.Set
 
+	// ratelimitPolicies are the names of the ratelimit policies which can be
+	// attached to the persistent clients.
+	ratelimitPolicies *stringutil.Set
+
 	// dhcp is the DHCP service implementation.
 	dhcp DHCP
 
@@ -97,6 +101,7 @@ func (clients *clientsContainer) Init(
 	etcHosts *aghnet.HostsContainer,
 	arpDB arpdb.Interface,
 	filteringConf *filtering.Config,
+	ratelimitPolicies []*dnsforward.RatelimitPolicy,
 ) (err error) {
 	if clients.list != nil {
 		log.Fatal("clients.list != nil")
@@ -108,6 +113,11 @@ func (clients *clientsContainer) Init(
 
 	clients.allTags = stringutil.NewSet(clientTags...)
 
+	clients.ratelimitPolicies = stringutil.NewSet()
+	for _, p := range ratelimitPolicies {
+		clients.ratelimitPolicies.Add(p.Name)
+	}
+
 	// TODO(e.burkov):  Use [dhcpsvc] implementation when it's ready.
 	clients.dhcp = dhcpServer
 
@@ -175,6 +185,8 @@ type clientObject struct {
 
 	Name string `yaml:"name"`
 
+	RatelimitPolicy string `yaml:"ratelimit_policy"`
+
 	IDs       []string `yaml:"ids"`
 	Tags      []string `yaml:"tags"`
 	Upstreams []string `yaml:"upstreams"`
@@ -199,6 +211,8 @@ func (clients *clientsContainer) addFromConfig(
 		cli := &Client{
 			Name: o.Name,
 
+			RatelimitPolicy: o.RatelimitPolicy,
+
 			IDs:       o.IDs,
 			Upstreams: o.Upstreams,
 
@@ -232,6 +246,11 @@ func (clients *clientsContainer) addFromConfig(
 			return fmt.Errorf("clients: init client blocked services %q: %w", cli.Name, err)
 		}
 
+		err = clients.validateRatelimitPolicy(o.RatelimitPolicy)
+		if err != nil {
+			return fmt.Errorf("clients: init client %q: %w", cli.Name, err)
+		}
+
 		cli.BlockedServices = o.BlockedServices.Clone()
 
 		for _, t := range o.Tags {
@@ -264,6 +283,8 @@ func (clients *clientsContainer) forConfig() (objs []*clientObject) {
 		o := &clientObject{
 			Name: cli.Name,
 
+			RatelimitPolicy: cli.RatelimitPolicy,
+
 			BlockedServices: cli.BlockedServices.Clone(),
 
 			IDs:       stringutil.CloneSlice(cli.IDs),
@@ -461,6 +482,20 @@ func (clients *clientsContainer) findUpstreams(
 	return conf, nil
 }
 
+// findRatelimitPolicy returns the name of the ratelimit policy attached to the
+// client identified by id, if any.
+func (clients *clientsContainer) findRatelimitPolicy(id string) (name string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findLocked(id)
+	if !ok {
+		return ""
+	}
+
+	return c.RatelimitPolicy
+}
+
 // findLocked searches for a client by its ID.  clients.lock is expected to be
 // locked.
 func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
@@ -585,7 +620,18 @@ func (clients *clientsContainer) check(c *Client) (err error) {
 		return fmt.Errorf("invalid upstream servers: %w", err)
 	}
 
-	return nil
+	// Don't wrap the error, since it's informative enough as is.
+	return clients.validateRatelimitPolicy(c.RatelimitPolicy)
+}
+
+// validateRatelimitPolicy returns an error if name is neither empty nor the
+// name of a configured ratelimit policy.
+func (clients *clientsContainer) validateRatelimitPolicy(name string) (err error) {
+	if name == "" || clients.ratelimitPolicies.Has(name) {
+		return nil
+	}
+
+	return fmt.Errorf("unknown ratelimit policy: %q", name)
 }
 
 // normalizeClientIdentifier returns a normalized version of idStr.  If idStr
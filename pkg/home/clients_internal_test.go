@@ -7,6 +7,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/jynychen/AdGuardHome/pkg/client"
 	"github.com/jynychen/AdGuardHome/pkg/dhcpd"
 	"github.com/jynychen/AdGuardHome/pkg/dhcpsvc"
@@ -46,7 +48,7 @@ func newClientsContainer(t *testing.T) (c *clientsContainer) {
 		OnMACBy:  func(ip netip.Addr) (mac net.HardwareAddr) { return nil },
 	}
 
-	require.NoError(t, c.Init(nil, dhcp, nil, nil, &filtering.Config{}))
+	require.NoError(t, c.Init(nil, dhcp, nil, nil, &filtering.Config{}, nil))
 
 	return c
 }
@@ -365,3 +367,48 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Len(t, config.Upstreams, 1)
 	assert.Len(t, config.DomainReservedUpstreams, 1)
 }
+
+func TestClientsRatelimitPolicy(t *testing.T) {
+	const policy = "strict"
+
+	clients := newClientsContainer(t)
+	clients.ratelimitPolicies = stringutil.NewSet(policy)
+
+	t.Run("unknown", func(t *testing.T) {
+		ok, err := clients.Add(&Client{
+			IDs:             []string{"1.1.1.1"},
+			Name:            "client1",
+			RatelimitPolicy: "unknown",
+		})
+		testutil.AssertErrorMsg(t, `unknown ratelimit policy: "unknown"`, err)
+		assert.False(t, ok)
+	})
+
+	prev := &Client{
+		IDs:             []string{"2.2.2.2"},
+		Name:            "client2",
+		RatelimitPolicy: policy,
+	}
+	ok, err := clients.Add(prev)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	t.Run("kept", func(t *testing.T) {
+		c, jErr := clients.jsonToClient(clientJSON{Name: prev.Name, IDs: prev.IDs}, prev)
+		require.NoError(t, jErr)
+
+		assert.Equal(t, policy, c.RatelimitPolicy)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		empty := ""
+		c, jErr := clients.jsonToClient(clientJSON{
+			Name:            prev.Name,
+			IDs:             prev.IDs,
+			RatelimitPolicy: &empty,
+		}, prev)
+		require.NoError(t, jErr)
+
+		assert.Empty(t, c.RatelimitPolicy)
+	})
+}
@@ -40,6 +40,10 @@ type clientJSON struct {
 
 	Name string `json:"name"`
 
+	// RatelimitPolicy is the name of the ratelimit policy attached to the
+	// client.  If it's nil, the policy of the previous client is kept.
+	RatelimitPolicy *string `json:"ratelimit_policy"`
+
 	// BlockedServices is the names of blocked services.
 	BlockedServices []string `json:"blocked_services"`
 	IDs             []string `json:"ids"`
@@ -62,7 +66,7 @@ type clientJSON struct {
 // client.
 func (j *clientJSON) copySettings(
 	prev *Client,
-) (weekly *schedule.Weekly, ignoreQueryLog, ignoreStatistics bool) {
+) (weekly *schedule.Weekly, ratelimitPolicy string, ignoreQueryLog, ignoreStatistics bool) {
 	if j.Schedule != nil {
 		weekly = j.Schedule.Clone()
 	} else if prev != nil && prev.BlockedServices != nil {
@@ -71,6 +75,12 @@ func (j *clientJSON) copySettings(
 		weekly = schedule.EmptyWeekly()
 	}
 
+	if j.RatelimitPolicy != nil {
+		ratelimitPolicy = *j.RatelimitPolicy
+	} else if prev != nil {
+		ratelimitPolicy = prev.RatelimitPolicy
+	}
+
 	if j.IgnoreQueryLog != aghalg.NBNull {
 		ignoreQueryLog = j.IgnoreQueryLog == aghalg.NBTrue
 	} else if prev != nil {
@@ -83,7 +93,7 @@ func (j *clientJSON) copySettings(
 		ignoreStatistics = prev.IgnoreStatistics
 	}
 
-	return weekly, ignoreQueryLog, ignoreStatistics
+	return weekly, ratelimitPolicy, ignoreQueryLog, ignoreStatistics
 }
 
 type runtimeClientJSON struct {
@@ -163,7 +173,7 @@ func (clients *clientsContainer) jsonToClient(cj clientJSON, prev *Client) (c *C
 		}
 	}
 
-	weekly, ignoreQueryLog, ignoreStatistics := cj.copySettings(prev)
+	weekly, ratelimitPolicy, ignoreQueryLog, ignoreStatistics := cj.copySettings(prev)
 
 	bs := &filtering.BlockedServices{
 		Schedule: weekly,
@@ -179,6 +189,8 @@ func (clients *clientsContainer) jsonToClient(cj clientJSON, prev *Client) (c *C
 
 		Name: cj.Name,
 
+		RatelimitPolicy: ratelimitPolicy,
+
 		BlockedServices: bs,
 
 		IDs:       cj.IDs,
@@ -215,8 +227,11 @@ func clientToJSON(c *Client) (cj *clientJSON) {
 	cloneVal := c.safeSearchConf
 	safeSearchConf := &cloneVal
 
+	ratelimitPolicy := c.RatelimitPolicy
+
 	return &clientJSON{
 		Name:                c.Name,
+		RatelimitPolicy:     &ratelimitPolicy,
 		IDs:                 c.IDs,
 		Tags:                c.Tags,
 		UseGlobalSettings:   !c.UseOwnSettings,
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/fastip"
 	"github.com/AdguardTeam/golibs/errors"
@@ -15,9 +16,11 @@ import (
 	"github.com/google/renameio/v2/maybe"
 	"github.com/jynychen/AdGuardHome/pkg/aghalg"
 	"github.com/jynychen/AdGuardHome/pkg/aghtls"
+	"github.com/jynychen/AdGuardHome/pkg/alerting"
 	"github.com/jynychen/AdGuardHome/pkg/confmigrate"
 	"github.com/jynychen/AdGuardHome/pkg/dhcpd"
 	"github.com/jynychen/AdGuardHome/pkg/dnsforward"
+	"github.com/jynychen/AdGuardHome/pkg/dnstap"
 	"github.com/jynychen/AdGuardHome/pkg/filtering"
 	"github.com/jynychen/AdGuardHome/pkg/querylog"
 	"github.com/jynychen/AdGuardHome/pkg/schedule"
@@ -120,6 +123,10 @@ type configuration struct {
 	QueryLog queryLogConfig    `yaml:"querylog"`
 	Stats    statsConfig       `yaml:"statistics"`
 
+	// Alerting is the configuration of the alerting on the anomalies in the
+	// requests of the clients.
+	Alerting *alertingConfig `yaml:"alerting"`
+
 	// Filters reflects the filters from [filtering.Config].  It's cloned to the
 	// config used in the filtering module at the startup.  Afterwards it's
 	// cloned from the filtering module back here.
@@ -159,6 +166,9 @@ type httpConfig struct {
 	// Pprof defines the profiling HTTP handler.
 	Pprof *httpPprofConfig `yaml:"pprof"`
 
+	// Metrics defines the metrics HTTP handler.
+	Metrics *httpMetricsConfig `yaml:"metrics"`
+
 	// Address is the address to serve the web UI on.
 	Address netip.AddrPort
 
@@ -176,6 +186,13 @@ type httpPprofConfig struct {
 	Enabled bool `yaml:"enabled"`
 }
 
+// httpMetricsConfig is the block with metrics HTTP configuration.
+type httpMetricsConfig struct {
+	// Enabled defines if the metrics are collected and served on the /metrics
+	// path of the web interface.
+	Enabled bool `yaml:"enabled"`
+}
+
 // dnsConfig is a block with DNS configuration params.
 //
 // Field ordering is important, YAML fields better not to be reordered, if it's
@@ -226,6 +243,10 @@ type dnsConfig struct {
 	// TODO(a.garipov): Add to the UI when HTTP/3 support is no longer
 	// experimental.
 	UseHTTP3Upstreams bool `yaml:"use_http3_upstreams"`
+
+	// BlockPage is the configuration of the block page served for the
+	// requests blocked in the custom IP blocking mode.
+	BlockPage *blockPageConfig `yaml:"block_page"`
 }
 
 type tlsConfigSettings struct {
@@ -264,11 +285,25 @@ type queryLogConfig struct {
 	// to disk.
 	MemSize uint32 `yaml:"size_memory"`
 
+	// MaxSize is the maximum total size of the query log files in bytes.  If
+	// it's zero, the size isn't limited.
+	MaxSize uint64 `yaml:"max_size"`
+
+	// RotatedFiles is the number of the rotated query log files to keep.
+	RotatedFiles uint `yaml:"rotated_files"`
+
 	// Enabled defines if the query log is enabled.
 	Enabled bool `yaml:"enabled"`
 
 	// FileEnabled defines, if the query log is written to the file.
 	FileEnabled bool `yaml:"file_enabled"`
+
+	// Compress defines if the rotated query log files are compressed.
+	Compress bool `yaml:"compress"`
+
+	// Syslog is the configuration of sending the query log entries to a
+	// remote syslog server.
+	Syslog *querylog.SyslogConfig `yaml:"syslog"`
 }
 
 type statsConfig struct {
@@ -278,6 +313,14 @@ type statsConfig struct {
 	// Interval is the retention interval for statistics.
 	Interval timeutil.Duration `yaml:"interval"`
 
+	// MinuteInterval is the retention interval for the statistics with the
+	// one-minute resolution.  If it's zero, those aren't kept.
+	MinuteInterval timeutil.Duration `yaml:"minute_interval"`
+
+	// SeriesLimit is the maximum number of the clients and of the domains, for
+	// which the hourly series are kept.  If it's zero, the series aren't kept.
+	SeriesLimit uint32 `yaml:"series_limit"`
+
 	// Enabled defines if the statistics are enabled.
 	Enabled bool `yaml:"enabled"`
 }
@@ -301,6 +344,9 @@ var config = &configuration{
 			Enabled: false,
 			Port:    6060,
 		},
+		Metrics: &httpMetricsConfig{
+			Enabled: false,
+		},
 	},
 	DNS: dnsConfig{
 		BindHosts: []netip.Addr{netip.IPv4Unspecified()},
@@ -316,6 +362,9 @@ var config = &configuration{
 
 			TrustedProxies: []string{"127.0.0.0/8", "::1/128"},
 			CacheSize:      4 * 1024 * 1024,
+			CachePersistentInterval: timeutil.Duration{
+				Duration: 5 * time.Minute,
+			},
 
 			EDNSClientSubnet: &dnsforward.EDNSClientSubnet{
 				CustomIP:  netip.Addr{},
@@ -323,6 +372,12 @@ var config = &configuration{
 				UseCustom: false,
 			},
 
+			DNSTap: &dnstap.Config{
+				Network:   dnstap.NetworkUnix,
+				QueueSize: dnstap.DefaultQueueSize,
+				Enabled:   false,
+			},
+
 			// set default maximum concurrent queries to 300
 			// we introduced a default limit due to this:
 			// https://github.com/AdguardTeam/AdGuardHome/issues/2015#issuecomment-674041912
@@ -331,6 +386,10 @@ var config = &configuration{
 		},
 		UpstreamTimeout: timeutil.Duration{Duration: dnsforward.DefaultTimeout},
 		UsePrivateRDNS:  true,
+		BlockPage: &blockPageConfig{
+			Address: netip.AddrPortFrom(netip.IPv4Unspecified(), defaultPortBlockPage),
+			Enabled: false,
+		},
 	},
 	TLS: tlsConfigSettings{
 		PortHTTPS:       defaultPortHTTPS,
@@ -338,16 +397,44 @@ var config = &configuration{
 		PortDNSOverQUIC: defaultPortQUIC,
 	},
 	QueryLog: queryLogConfig{
-		Enabled:     true,
-		FileEnabled: true,
-		Interval:    timeutil.Duration{Duration: 90 * timeutil.Day},
-		MemSize:     1000,
-		Ignored:     []string{},
+		Enabled:      true,
+		FileEnabled:  true,
+		Interval:     timeutil.Duration{Duration: 90 * timeutil.Day},
+		MemSize:      1000,
+		RotatedFiles: 1,
+		Ignored:      []string{},
+		Syslog: &querylog.SyslogConfig{
+			Network:   querylog.SyslogNetworkUDP,
+			Format:    querylog.SyslogFormatRFC5424,
+			QueueSize: querylog.DefaultSyslogQueueSize,
+			Enabled:   false,
+		},
 	},
 	Stats: statsConfig{
-		Enabled:  true,
-		Interval: timeutil.Duration{Duration: 1 * timeutil.Day},
-		Ignored:  []string{},
+		Enabled:        true,
+		Interval:       timeutil.Duration{Duration: 1 * timeutil.Day},
+		MinuteInterval: timeutil.Duration{Duration: stats.DefaultMinuteLimit},
+		SeriesLimit:    stats.DefaultSeriesLimit,
+		Ignored:        []string{},
+	},
+	Alerting: &alertingConfig{
+		Rules: []*alerting.Rule{{
+			Name:       "client_rate",
+			Type:       alerting.RuleTypeClientRate,
+			Threshold:  50,
+			MinQueries: 100,
+		}, {
+			Name:       "nxdomain_ratio",
+			Type:       alerting.RuleTypeNXDomainRatio,
+			Threshold:  0.5,
+			MinQueries: 100,
+		}},
+		Sinks:           []*alerting.SinkConfig{},
+		Window:          timeutil.Duration{Duration: alerting.DefaultWindow},
+		DedupInterval:   timeutil.Duration{Duration: alerting.DefaultDedupInterval},
+		BaselineWindows: alerting.DefaultBaselineWindows,
+		HistorySize:     alerting.DefaultHistorySize,
+		Enabled:         false,
 	},
 	// NOTE: Keep these parameters in sync with the one put into
 	// client/src/helpers/filters/filters.js by scripts/vetted-filters.
@@ -540,6 +627,13 @@ func validateConfig() (err error) {
 		addPorts(udpPorts, udpPort(config.TLS.PortDNSOverQUIC))
 	}
 
+	if bp := config.DNS.BlockPage; bp != nil && bp.Enabled {
+		addPorts(tcpPorts, tcpPort(bp.Address.Port()))
+		if config.TLS.Enabled {
+			addPorts(tcpPorts, tcpPort(bp.TLSAddress.Port()))
+		}
+	}
+
 	if err = tcpPorts.Validate(); err != nil {
 		return fmt.Errorf("validating tcp ports: %w", err)
 	} else if err = udpPorts.Validate(); err != nil {
@@ -612,6 +706,9 @@ func (c *configuration) write() (err error) {
 		config.QueryLog.FileEnabled = dc.FileEnabled
 		config.QueryLog.Interval = timeutil.Duration{Duration: dc.RotationIvl}
 		config.QueryLog.MemSize = dc.MemSize
+		config.QueryLog.MaxSize = dc.MaxSize
+		config.QueryLog.RotatedFiles = dc.RotatedFiles
+		config.QueryLog.Compress = dc.Compress
 		config.QueryLog.Ignored = dc.Ignored.Values()
 	}
 
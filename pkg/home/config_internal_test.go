@@ -0,0 +1,87 @@
+package home
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+)
+
+func TestValidateConfig_blockPage(t *testing.T) {
+	prevConfig := config
+	t.Cleanup(func() { config = prevConfig })
+
+	webAddr := netip.AddrPortFrom(netip.IPv4Unspecified(), defaultPortHTTP)
+
+	testCases := []struct {
+		blockPage  *blockPageConfig
+		name       string
+		wantErrMsg string
+		tlsEnabled bool
+	}{{
+		blockPage: &blockPageConfig{
+			Address: netip.AddrPortFrom(netip.IPv4Unspecified(), defaultPortBlockPage),
+			Enabled: true,
+		},
+		name:       "default",
+		wantErrMsg: "",
+		tlsEnabled: false,
+	}, {
+		blockPage: &blockPageConfig{
+			Address: webAddr,
+			Enabled: true,
+		},
+		name:       "web_conflict",
+		wantErrMsg: "validating tcp ports: duplicated values: [80]",
+		tlsEnabled: false,
+	}, {
+		blockPage: &blockPageConfig{
+			Address: webAddr,
+			Enabled: false,
+		},
+		name:       "disabled",
+		wantErrMsg: "",
+		tlsEnabled: false,
+	}, {
+		blockPage: &blockPageConfig{
+			TLSAddress: netip.AddrPortFrom(netip.IPv4Unspecified(), defaultPortHTTPS),
+			Enabled:    true,
+		},
+		name:       "tls_conflict",
+		wantErrMsg: "validating tcp ports: duplicated values: [443]",
+		tlsEnabled: true,
+	}, {
+		blockPage: &blockPageConfig{
+			TLSAddress: netip.AddrPortFrom(netip.IPv4Unspecified(), defaultPortHTTPS),
+			Enabled:    true,
+		},
+		name:       "tls_disabled",
+		wantErrMsg: "",
+		tlsEnabled: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config = &configuration{
+				HTTPConfig: httpConfig{
+					Address: webAddr,
+				},
+				DNS: dnsConfig{
+					BindHosts: []netip.Addr{netip.IPv4Unspecified()},
+					Port:      defaultPortDNS,
+					BlockPage: tc.blockPage,
+				},
+				TLS: tlsConfigSettings{
+					Enabled:   tc.tlsEnabled,
+					PortHTTPS: defaultPortHTTPS,
+				},
+				Filtering: &filtering.Config{
+					FiltersUpdateIntervalHours: 24,
+				},
+			}
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, validateConfig())
+		})
+	}
+}
@@ -32,8 +32,17 @@ const (
 	defaultPortHTTPS = 443
 	defaultPortQUIC  = 853
 	defaultPortTLS   = 853
+
+	// defaultPortBlockPage is the default port of the block page server.  It
+	// differs from defaultPortHTTP, since the web interface usually listens
+	// on it.
+	defaultPortBlockPage = 8080
 )
 
+// cacheSnapshotBaseName is the base name of the file within the data directory
+// the persistent DNS cache is saved into.
+const cacheSnapshotBaseName = "dnscache.json"
+
 // Called by other modules when configuration is changed
 func onConfigModified() {
 	err := config.write()
@@ -42,6 +51,16 @@ func onConfigModified() {
 	}
 }
 
+// ruleHits returns the numbers of requests matched by the filtering rules from
+// the statistics, if those are initialized.
+func ruleHits() (lists map[int64]uint64, rules map[int64]map[string]uint64) {
+	if Context.stats == nil {
+		return nil, nil
+	}
+
+	return Context.stats.RuleHits()
+}
+
 // initDNS updates all the fields of the [Context] needed to initialize the DNS
 // server and initializes it at last.  It also must not be called unless
 // [config] and [Context] are initialized.
@@ -53,6 +72,8 @@ func initDNS() (err error) {
 	statsConf := stats.Config{
 		Filename:          filepath.Join(baseDir, "stats.db"),
 		Limit:             config.Stats.Interval.Duration,
+		MinuteLimit:       config.Stats.MinuteInterval.Duration,
+		SeriesLimit:       config.Stats.SeriesLimit,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
 		Enabled:           config.Stats.Enabled,
@@ -79,6 +100,11 @@ func initDNS() (err error) {
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
 		RotationIvl:       config.QueryLog.Interval.Duration,
 		MemSize:           config.QueryLog.MemSize,
+		RotatedFiles:      config.QueryLog.RotatedFiles,
+		MaxSize:           config.QueryLog.MaxSize,
+		Compress:          config.QueryLog.Compress,
+		Syslog:            config.QueryLog.Syslog,
+		SyslogRootCAs:     Context.tlsRoots,
 		Enabled:           config.QueryLog.Enabled,
 		FileEnabled:       config.QueryLog.FileEnabled,
 	}
@@ -100,9 +126,24 @@ func initDNS() (err error) {
 		return err
 	}
 
+	if config.HTTPConfig.Metrics.Enabled {
+		Context.metrics = newMetricsRegistry(Context.filters, httpRegister)
+	}
+
 	tlsConf := &tlsConfigSettings{}
 	Context.tls.WriteDiskConfig(tlsConf)
 
+	err = initBlockPage(config.DNS.BlockPage, tlsConf)
+	if err != nil {
+		return fmt.Errorf("init block page: %w", err)
+	}
+
+	err = initAlerting(config.Alerting)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
 	return initDNSServer(
 		Context.filters,
 		Context.stats,
@@ -140,6 +181,10 @@ func initDNSServer(
 		Anonymizer:  anonymizer,
 		LocalDomain: config.DHCP.LocalDomainName,
 		DHCPServer:  dhcpSrv,
+		Metrics:     Context.metrics,
+
+		BlockPageTokens: Context.blockPageTokens,
+		Alerter:         Context.alerter,
 	})
 	if err != nil {
 		closeDNSServer()
@@ -237,6 +282,8 @@ func newServerConfig(
 		HTTPRegister:   httpReg,
 		UseDNS64:       config.DNS.UseDNS64,
 		DNS64Prefixes:  config.DNS.DNS64Prefixes,
+
+		CacheSnapshotFile: filepath.Join(Context.getDataDir(), cacheSnapshotBaseName),
 	}
 
 	var initialAddresses []netip.Addr
@@ -289,6 +336,7 @@ func newServerConfig(
 
 	newConf.FilterHandler = applyAdditionalFiltering
 	newConf.GetCustomUpstreamByClient = Context.clients.findUpstreams
+	newConf.GetRatelimitPolicyByClient = Context.clients.findRatelimitPolicy
 
 	newConf.LocalPTRResolvers = dnsConf.LocalPTRResolvers
 	newConf.UpstreamTimeout = dnsConf.UpstreamTimeout.Duration
@@ -447,6 +495,17 @@ func startDNSServer() error {
 	Context.stats.Start()
 	Context.queryLog.Start()
 
+	if Context.alerter != nil {
+		Context.alerter.Start()
+	}
+
+	if Context.blockPage != nil {
+		err = Context.blockPage.Start()
+		if err != nil {
+			return fmt.Errorf("starting block page: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -494,6 +553,9 @@ func closeDNSServer() {
 		Context.dnsServer = nil
 	}
 
+	closeBlockPage()
+	closeAlerting()
+
 	if Context.filters != nil {
 		Context.filters.Close()
 	}
@@ -29,12 +29,15 @@ import (
 	"github.com/jynychen/AdGuardHome/pkg/aghnet"
 	"github.com/jynychen/AdGuardHome/pkg/aghos"
 	"github.com/jynychen/AdGuardHome/pkg/aghtls"
+	"github.com/jynychen/AdGuardHome/pkg/alerting"
 	"github.com/jynychen/AdGuardHome/pkg/arpdb"
+	"github.com/jynychen/AdGuardHome/pkg/blockpage"
 	"github.com/jynychen/AdGuardHome/pkg/dhcpd"
 	"github.com/jynychen/AdGuardHome/pkg/dnsforward"
 	"github.com/jynychen/AdGuardHome/pkg/filtering"
 	"github.com/jynychen/AdGuardHome/pkg/filtering/hashprefix"
 	"github.com/jynychen/AdGuardHome/pkg/filtering/safesearch"
+	"github.com/jynychen/AdGuardHome/pkg/metrics"
 	"github.com/jynychen/AdGuardHome/pkg/querylog"
 	"github.com/jynychen/AdGuardHome/pkg/stats"
 	"github.com/jynychen/AdGuardHome/pkg/updater"
@@ -57,6 +60,22 @@ type homeContext struct {
 	web        *webAPI              // Web (HTTP, HTTPS) module
 	tls        *tlsManager          // TLS module
 
+	// metrics is the registry of the metrics served by the web interface.  It
+	// is nil if the metrics are disabled.
+	metrics *metrics.Registry
+
+	// alerter evaluates the alerting rules over the requests.  It is nil if
+	// the alerting is disabled.
+	alerter *alerting.Alerter
+
+	// blockPage is the server of the block page.  It is nil if the block page
+	// is disabled.
+	blockPage *blockpage.Server
+
+	// blockPageTokens keeps the tokens of the requests blocked with the block
+	// page.  It is nil if the block page is disabled.
+	blockPageTokens *blockpage.Tokens
+
 	// etcHosts contains IP-hostname mappings taken from the OS-specific hosts
 	// configuration files, for example /etc/hosts.
 	etcHosts *aghnet.HostsContainer
@@ -300,6 +319,7 @@ func initContextClients() (err error) {
 		Context.etcHosts,
 		arpDB,
 		config.Filtering,
+		config.DNS.RatelimitPolicies,
 	)
 	if err != nil {
 		// Don't wrap the error, because it's informative enough as is.
@@ -366,6 +386,7 @@ func setupDNSFilteringConf(conf *filtering.Config) (err error) {
 	conf.EtcHosts = Context.etcHosts
 	conf.ConfigModified = onConfigModified
 	conf.HTTPRegister = httpRegister
+	conf.RuleHits = ruleHits
 	conf.DataDir = Context.getDataDir()
 	conf.Filters = slices.Clone(config.Filters)
 	conf.WhitelistFilters = slices.Clone(config.WhitelistFilters)
@@ -0,0 +1,93 @@
+package home
+
+import (
+	"net/http"
+
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/jynychen/AdGuardHome/pkg/filtering/hashprefix"
+	"github.com/jynychen/AdGuardHome/pkg/metrics"
+)
+
+// newMetricsRegistry returns a new metrics registry with the metrics of the
+// filtering module registered and registers the HTTP handler serving them.
+// filters must not be nil.
+func newMetricsRegistry(
+	filters *filtering.DNSFilter,
+	httpReg aghhttp.RegisterFunc,
+) (reg *metrics.Registry) {
+	reg = metrics.NewRegistry()
+
+	reg.NewGaugeFunc(
+		"adguardhome_filtering_rules",
+		"Number of rules loaded into the filtering engines.",
+		func() (samples []metrics.Sample) {
+			block, allow := filters.RulesCount()
+
+			return []metrics.Sample{{
+				LabelValues: []string{"block"},
+				Value:       float64(block),
+			}, {
+				LabelValues: []string{"allow"},
+				Value:       float64(allow),
+			}}
+		},
+		"engine",
+	)
+
+	checkers := []struct {
+		checker filtering.Checker
+		service string
+	}{{
+		checker: config.Filtering.SafeBrowsingChecker,
+		service: "safe_browsing",
+	}, {
+		checker: config.Filtering.ParentalControlChecker,
+		service: "parental",
+	}}
+
+	counters := []struct {
+		value func(s hashprefix.Stats) (n uint64)
+		name  string
+		help  string
+	}{{
+		value: func(s hashprefix.Stats) (n uint64) { return s.Lookups },
+		name:  "adguardhome_hashprefix_lookups_total",
+		help:  "Total number of hash-prefix lookups.",
+	}, {
+		value: func(s hashprefix.Stats) (n uint64) { return s.CacheHits },
+		name:  "adguardhome_hashprefix_cache_hits_total",
+		help:  "Total number of hash-prefix lookups answered from the cache.",
+	}, {
+		value: func(s hashprefix.Stats) (n uint64) { return s.Errors },
+		name:  "adguardhome_hashprefix_errors_total",
+		help:  "Total number of failed hash-prefix lookups.",
+	}, {
+		value: func(s hashprefix.Stats) (n uint64) { return s.Blocked },
+		name:  "adguardhome_hashprefix_blocked_total",
+		help:  "Total number of hash-prefix lookups resulted in blocking.",
+	}}
+
+	for _, cnt := range counters {
+		value := cnt.value
+		reg.NewCounterFunc(cnt.name, cnt.help, func() (samples []metrics.Sample) {
+			for _, c := range checkers {
+				hc, ok := c.checker.(*hashprefix.Checker)
+				if !ok {
+					continue
+				}
+
+				samples = append(samples, metrics.Sample{
+					LabelValues: []string{c.service},
+					Value:       float64(value(hc.Stats())),
+				})
+			}
+
+			return samples
+		}, "service")
+	}
+
+	httpReg(http.MethodGet, "/metrics", reg.ServeHTTP)
+
+	return reg
+}
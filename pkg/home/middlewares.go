@@ -48,10 +48,22 @@ func expectsLargerRequests(r *http.Request) (ok bool) {
 		p == "/control/filtering/set_rules"
 }
 
+// limitsRequestBody shows if the handler of this request limits the size of
+// the request body itself, since it expects the body to be streamed.
+func limitsRequestBody(r *http.Request) (ok bool) {
+	return r.Method == http.MethodPost && r.URL.Path == "/control/stats/import"
+}
+
 // limitRequestBody wraps underlying handler h, making it's request's body Read
 // method limited.
 func limitRequestBody(h http.Handler) (limited http.Handler) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limitsRequestBody(r) {
+			h.ServeHTTP(w, r)
+
+			return
+		}
+
 		var err error
 
 		var szLim int64 = defaultReqBodySzLim
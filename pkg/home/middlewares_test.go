@@ -19,24 +19,34 @@ func TestLimitRequestBody(t *testing.T) {
 
 	testCases := []struct {
 		name    string
+		path    string
 		body    string
 		want    []byte
 		wantErr error
 	}{{
 		name:    "not_so_big",
+		path:    "/",
 		body:    "somestr",
 		want:    []byte("somestr"),
 		wantErr: nil,
 	}, {
 		name:    "so_big",
+		path:    "/",
 		body:    string(make([]byte, defaultReqBodySzLim+1)),
 		want:    make([]byte, defaultReqBodySzLim),
 		wantErr: errReqLimitReached,
 	}, {
 		name:    "empty",
+		path:    "/",
 		body:    "",
 		want:    []byte(nil),
 		wantErr: nil,
+	}, {
+		name:    "own_limit",
+		path:    "/control/stats/import",
+		body:    string(make([]byte, largerReqBodySzLim+1)),
+		want:    make([]byte, largerReqBodySzLim+1),
+		wantErr: nil,
 	}}
 
 	makeHandler := func(t *testing.T, err *error) http.HandlerFunc {
@@ -56,7 +66,11 @@ func TestLimitRequestBody(t *testing.T) {
 			handler := makeHandler(t, &err)
 			lim := limitRequestBody(handler)
 
-			req := httptest.NewRequest(http.MethodPost, "https://www.example.com", strings.NewReader(tc.body))
+			req := httptest.NewRequest(
+				http.MethodPost,
+				"https://www.example.com"+tc.path,
+				strings.NewReader(tc.body),
+			)
 			res := httptest.NewRecorder()
 
 			lim.ServeHTTP(res, req)
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value.  It's safe for concurrent use.
+type Counter struct {
+	val atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.val.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	c.val.Add(n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() (n uint64) {
+	return c.val.Load()
+}
+
+// CounterVec is a set of counters distinguished by the label values.
+type CounterVec struct {
+	vec *vec[*Counter]
+}
+
+// type check
+var _ metric = (*CounterVec)(nil)
+
+// With returns the counter for the label values, creating it if necessary.  It
+// panics if the number of values doesn't match the number of label names.
+func (c *CounterVec) With(vals ...string) (cnt *Counter) {
+	return c.vec.with(vals)
+}
+
+// writeTo implements the [metric] interface for *CounterVec.
+func (c *CounterVec) writeTo(b *bytes.Buffer, name string) {
+	c.vec.each(func(cnt *Counter, vals []string) {
+		writeSample(b, name, c.vec.labels, vals, "", "", float64(cnt.Value()))
+	})
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"sync"
+)
+
+// DefaultBuckets are the default upper bounds of histogram buckets.  These
+// are suitable for measuring network latencies in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts the observed values in configurable buckets.  It's safe for
+// concurrent use.
+type Histogram struct {
+	// mu protects counts, count, and sum.
+	mu *sync.Mutex
+
+	// buckets are the upper bounds of the buckets sorted in ascending order.
+	buckets []float64
+
+	// counts are the non-cumulative numbers of observations per bucket.
+	counts []uint64
+
+	// count is the total number of observations.
+	count uint64
+
+	// sum is the sum of all observed values.
+	sum float64
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+
+			break
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+// snapshot returns the cumulative counts of the buckets, the total count, and
+// the sum of the observations.
+func (h *Histogram) snapshot() (cumulative []uint64, count uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cumulative = make([]uint64, len(h.counts))
+
+	var acc uint64
+	for i, c := range h.counts {
+		acc += c
+		cumulative[i] = acc
+	}
+
+	return cumulative, h.count, h.sum
+}
+
+// HistogramVec is a set of histograms distinguished by the label values.
+type HistogramVec struct {
+	vec *vec[*Histogram]
+}
+
+// type check
+var _ metric = (*HistogramVec)(nil)
+
+// With returns the histogram for the label values, creating it if necessary.
+// It panics if the number of values doesn't match the number of label names.
+func (h *HistogramVec) With(vals ...string) (hist *Histogram) {
+	return h.vec.with(vals)
+}
+
+// writeTo implements the [metric] interface for *HistogramVec.
+func (h *HistogramVec) writeTo(b *bytes.Buffer, name string) {
+	labels := h.vec.labels
+	bucketName, sumName, countName := name+"_bucket", name+"_sum", name+"_count"
+
+	h.vec.each(func(hist *Histogram, vals []string) {
+		cumulative, count, sum := hist.snapshot()
+		for i, upper := range hist.buckets {
+			le := formatFloat(upper)
+			writeSample(b, bucketName, labels, vals, "le", le, float64(cumulative[i]))
+		}
+
+		writeSample(b, bucketName, labels, vals, "le", formatFloat(math.Inf(1)), float64(count))
+		writeSample(b, sumName, labels, vals, "", "", sum)
+		writeSample(b, countName, labels, vals, "", "", float64(count))
+	})
+}
@@ -0,0 +1,343 @@
+// Package metrics contains a minimal registry of metrics which can be exposed
+// in the Prometheus text-based exposition format.
+//
+// See https://prometheus.io/docs/instrumenting/exposition_formats.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// ContentType is the value of the Content-Type HTTP header for the responses
+// containing metrics in the text-based exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metric types.
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// metric is a single named metric family.
+type metric interface {
+	// writeTo writes the samples of the metric family into b.  The header
+	// lines are written by the registry.
+	writeTo(b *bytes.Buffer, name string)
+}
+
+// family is a registered metric family along with its description.
+type family struct {
+	metric metric
+	name   string
+	help   string
+	typ    string
+}
+
+// Registry is a set of metric families.  A nil *Registry is not valid.
+// Registry is safe for concurrent use.
+type Registry struct {
+	// mu protects families.
+	mu *sync.Mutex
+
+	// families are the registered metric families sorted by name.
+	families []*family
+}
+
+// NewRegistry returns a new properly initialized *Registry.
+func NewRegistry() (r *Registry) {
+	return &Registry{
+		mu: &sync.Mutex{},
+	}
+}
+
+// register adds a new metric family.  It panics if a metric family with the
+// same name has already been registered, since that is a programmer error.
+func (r *Registry) register(name, help, typ string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, found := slices.BinarySearchFunc(r.families, name, func(f *family, n string) (res int) {
+		return strings.Compare(f.name, n)
+	})
+	if found {
+		panic(fmt.Errorf("metrics: metric %q is already registered", name))
+	}
+
+	r.families = slices.Insert(r.families, i, &family{
+		metric: m,
+		name:   name,
+		help:   help,
+		typ:    typ,
+	})
+}
+
+// NewCounterVec registers and returns a new counter vector with the given
+// label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) (c *CounterVec) {
+	c = &CounterVec{
+		vec: newVec(labels, func() (s *Counter) {
+			return &Counter{}
+		}),
+	}
+
+	r.register(name, help, typeCounter, c)
+
+	return c
+}
+
+// NewHistogramVec registers and returns a new histogram vector with the given
+// upper bounds of buckets and label names.  buckets must be sorted in
+// ascending order.
+func (r *Registry) NewHistogramVec(
+	name string,
+	help string,
+	buckets []float64,
+	labels ...string,
+) (h *HistogramVec) {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Errorf("metrics: buckets of %q are not sorted", name))
+	}
+
+	h = &HistogramVec{
+		vec: newVec(labels, func() (s *Histogram) {
+			return &Histogram{
+				mu:      &sync.Mutex{},
+				buckets: buckets,
+				counts:  make([]uint64, len(buckets)),
+			}
+		}),
+	}
+
+	r.register(name, help, typeHistogram, h)
+
+	return h
+}
+
+// Sample is a single value of a metric computed on collection.
+type Sample struct {
+	// LabelValues are the values of the labels in the same order as the label
+	// names of the metric.
+	LabelValues []string
+
+	// Value is the value of the sample.
+	Value float64
+}
+
+// CollectFunc returns the current samples of a metric.
+type CollectFunc func() (samples []Sample)
+
+// NewGaugeFunc registers a new gauge with the given label names, which values
+// are computed by f on each collection.
+func (r *Registry) NewGaugeFunc(name, help string, f CollectFunc, labels ...string) {
+	r.register(name, help, typeGauge, &funcMetric{labels: labels, collect: f})
+}
+
+// NewCounterFunc registers a new counter with the given label names, which
+// values are computed by f on each collection.  f must return monotonically
+// increasing values.
+func (r *Registry) NewCounterFunc(name, help string, f CollectFunc, labels ...string) {
+	r.register(name, help, typeCounter, &funcMetric{labels: labels, collect: f})
+}
+
+// WriteTo implements the [io.WriterTo] interface for *Registry.  It writes all
+// the registered metrics in the text-based exposition format.
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	b := &bytes.Buffer{}
+	for _, f := range families {
+		b.WriteString("# HELP ")
+		b.WriteString(f.name)
+		b.WriteByte(' ')
+		b.WriteString(escapeHelp(f.help))
+		b.WriteString("\n# TYPE ")
+		b.WriteString(f.name)
+		b.WriteByte(' ')
+		b.WriteString(f.typ)
+		b.WriteByte('\n')
+
+		f.metric.writeTo(b, f.name)
+	}
+
+	return b.WriteTo(w)
+}
+
+// ServeHTTP implements the [http.Handler] interface for *Registry.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set(httphdr.ContentType, ContentType)
+
+	_, err := r.WriteTo(w)
+	if err != nil {
+		log.Debug("metrics: writing response: %s", err)
+	}
+}
+
+// vec is a set of series of the same type distinguished by the label values.
+type vec[S any] struct {
+	// mu protects series.
+	mu *sync.RWMutex
+
+	// series maps the joined label values to the series.
+	series map[string]*series[S]
+
+	// newSeries creates a new series.
+	newSeries func() (s S)
+
+	// labels are the names of the labels.
+	labels []string
+}
+
+// series is a single series within a vector.
+type series[S any] struct {
+	value  S
+	labels []string
+}
+
+// newVec returns a new properly initialized vector.
+func newVec[S any](labels []string, newSeries func() (s S)) (v *vec[S]) {
+	return &vec[S]{
+		mu:        &sync.RWMutex{},
+		series:    map[string]*series[S]{},
+		newSeries: newSeries,
+		labels:    labels,
+	}
+}
+
+// labelsSep is used to join the label values into a key.  It's not a valid
+// UTF-8 sequence, so it can't appear in label values.
+const labelsSep = "\xff"
+
+// with returns the series for the label values creating it, if necessary.  It
+// panics if the number of values doesn't match the number of label names.
+func (v *vec[S]) with(vals []string) (s S) {
+	if len(vals) != len(v.labels) {
+		panic(fmt.Errorf("metrics: got %d label values, want %d", len(vals), len(v.labels)))
+	}
+
+	key := strings.Join(vals, labelsSep)
+
+	v.mu.RLock()
+	ser, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return ser.value
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	ser, ok = v.series[key]
+	if !ok {
+		ser = &series[S]{
+			value:  v.newSeries(),
+			labels: slices.Clone(vals),
+		}
+		v.series[key] = ser
+	}
+
+	return ser.value
+}
+
+// each calls f for each series sorted by their label values.
+func (v *vec[S]) each(f func(s S, labelVals []string)) {
+	v.mu.RLock()
+	keys := maps.Keys(v.series)
+	ser := maps.Clone(v.series)
+	v.mu.RUnlock()
+
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := ser[k]
+		f(s.value, s.labels)
+	}
+}
+
+// funcMetric is a metric which samples are collected by a function.
+type funcMetric struct {
+	collect CollectFunc
+	labels  []string
+}
+
+// type check
+var _ metric = (*funcMetric)(nil)
+
+// writeTo implements the [metric] interface for *funcMetric.
+func (m *funcMetric) writeTo(b *bytes.Buffer, name string) {
+	for _, s := range m.collect() {
+		writeSample(b, name, m.labels, s.LabelValues, "", "", s.Value)
+	}
+}
+
+// writeSample writes a single sample line.  extraLabel and extraVal are
+// appended to the labels, if extraLabel is not empty.
+func writeSample(
+	b *bytes.Buffer,
+	name string,
+	labels []string,
+	vals []string,
+	extraLabel string,
+	extraVal string,
+	v float64,
+) {
+	b.WriteString(name)
+
+	if len(labels) > 0 || extraLabel != "" {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+
+			writeLabel(b, l, vals[i])
+		}
+
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+
+			writeLabel(b, extraLabel, extraVal)
+		}
+
+		b.WriteByte('}')
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+}
+
+// writeLabel writes a single label pair.
+func writeLabel(b *bytes.Buffer, name, val string) {
+	b.WriteString(name)
+	b.WriteString(`="`)
+	b.WriteString(labelValueReplacer.Replace(val))
+	b.WriteByte('"')
+}
+
+// labelValueReplacer escapes the label values.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeHelp escapes the text of the HELP line.
+func escapeHelp(help string) (escaped string) {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// formatFloat formats v according to the exposition format.
+func formatFloat(v float64) (s string) {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
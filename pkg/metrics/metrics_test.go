@@ -0,0 +1,81 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/jynychen/AdGuardHome/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	c := r.NewCounterVec("test_requests_total", "Total requests.", "proto", "code")
+	c.With("udp", "NOERROR").Inc()
+	c.With("udp", "NOERROR").Add(2)
+	c.With("tcp", `quo"te`).Inc()
+
+	h := r.NewHistogramVec("test_duration_seconds", "Duration.", []float64{0.1, 1}, "upstream")
+	h.With("1.1.1.1").Observe(0.05)
+	h.With("1.1.1.1").Observe(0.5)
+	h.With("1.1.1.1").Observe(5)
+
+	r.NewGaugeFunc("test_rules", "Rules.", func() (samples []metrics.Sample) {
+		return []metrics.Sample{{
+			LabelValues: []string{"block"},
+			Value:       42,
+		}}
+	}, "type")
+
+	b := &strings.Builder{}
+	_, err := r.WriteTo(b)
+	require.NoError(t, err)
+
+	want := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{upstream="1.1.1.1",le="0.1"} 1
+test_duration_seconds_bucket{upstream="1.1.1.1",le="1"} 2
+test_duration_seconds_bucket{upstream="1.1.1.1",le="+Inf"} 3
+test_duration_seconds_sum{upstream="1.1.1.1"} 5.55
+test_duration_seconds_count{upstream="1.1.1.1"} 3
+# HELP test_requests_total Total requests.
+# TYPE test_requests_total counter
+test_requests_total{proto="tcp",code="quo\"te"} 1
+test_requests_total{proto="udp",code="NOERROR"} 3
+# HELP test_rules Rules.
+# TYPE test_rules gauge
+test_rules{type="block"} 42
+`
+	assert.Equal(t, want, b.String())
+}
+
+func TestRegistry_register(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounterVec("test_total", "Test.")
+
+	assert.Panics(t, func() {
+		r.NewCounterVec("test_total", "Test.")
+	})
+
+	c := r.NewCounterVec("test_labeled_total", "Test.", "label")
+	assert.Panics(t, func() {
+		c.With("a", "b")
+	})
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounterVec("test_total", "Test.").With().Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metrics.ContentType, w.Header().Get(httphdr.ContentType))
+	assert.Contains(t, w.Body.String(), "test_total 1\n")
+}
@@ -0,0 +1,326 @@
+package querylog
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"golang.org/x/exp/slices"
+)
+
+// aggregateGroupBy is the field by which the log entries are grouped.
+type aggregateGroupBy string
+
+// Supported grouping fields.
+const (
+	groupByDomain   aggregateGroupBy = "domain"
+	groupByClient   aggregateGroupBy = "client"
+	groupByUpstream aggregateGroupBy = "upstream"
+	groupByQType    aggregateGroupBy = "qtype"
+	groupByReason   aggregateGroupBy = "reason"
+)
+
+const (
+	// minAggregateBucket is the minimum duration of a time bucket.
+	minAggregateBucket = time.Minute
+
+	// maxAggregateBuckets is the maximum number of time buckets within the
+	// requested range.
+	maxAggregateBuckets = 1000
+)
+
+// aggregateParams are the parameters of a query log aggregation.
+type aggregateParams struct {
+	// search contains the search criteria and the aggregated range.  Its
+	// limit field is the maximum number of returned groups.
+	search *searchParams
+
+	// groupBy is the field by which the entries are grouped.
+	groupBy aggregateGroupBy
+
+	// bucket is the duration of a time bucket.  If it's zero, the entries
+	// aren't bucketed.
+	bucket time.Duration
+}
+
+// parseAggregateParams parses the aggregation parameters from the HTTP
+// request's query string.
+func parseAggregateParams(r *http.Request) (p *aggregateParams, err error) {
+	search, err := parseSearchParams(r)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
+	if search.limit <= 0 {
+		return nil, fmt.Errorf("limit: must be positive, got %d", search.limit)
+	}
+
+	p = &aggregateParams{
+		search:  search,
+		groupBy: groupByDomain,
+	}
+
+	q := r.URL.Query()
+
+	switch g := aggregateGroupBy(q.Get("group_by")); g {
+	case "":
+		// Go on.
+	case groupByDomain, groupByClient, groupByUpstream, groupByQType, groupByReason:
+		p.groupBy = g
+	default:
+		return nil, fmt.Errorf("group_by: unsupported value %q", g)
+	}
+
+	if s := q.Get("bucket"); s != "" {
+		p.bucket, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("bucket: %w", err)
+		}
+
+		err = p.validateBucket()
+		if err != nil {
+			return nil, fmt.Errorf("bucket: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// validateBucket returns an error if the bucket duration is invalid for the
+// requested range.
+func (p *aggregateParams) validateBucket() (err error) {
+	if p.bucket < minAggregateBucket {
+		return fmt.Errorf("must be at least %s, got %s", minAggregateBucket, p.bucket)
+	} else if p.search.newerThan.IsZero() {
+		return errors.Error("start must be set")
+	}
+
+	end := p.search.olderThan
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	if n := p.numBuckets(end); n > maxAggregateBuckets {
+		return fmt.Errorf("too many buckets in range: %d, max %d", n, maxAggregateBuckets)
+	}
+
+	return nil
+}
+
+// numBuckets returns the number of the time buckets from the start of the range
+// to end.
+func (p *aggregateParams) numBuckets(end time.Time) (n int) {
+	d := end.Sub(p.search.newerThan)
+	if d <= 0 {
+		return 0
+	}
+
+	return int((d + p.bucket - 1) / p.bucket)
+}
+
+// aggregateResp is the response of the GET /control/querylog/aggregate HTTP
+// API.
+type aggregateResp struct {
+	// GroupBy is the field by which the entries are grouped.
+	GroupBy aggregateGroupBy `json:"group_by"`
+
+	// Start is the start of the aggregated range, if set.
+	Start string `json:"start,omitempty"`
+
+	// End is the end of the aggregated range, if set.
+	End string `json:"end,omitempty"`
+
+	// Bucket is the duration of a time bucket, if the entries are bucketed.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Groups are the groups with the most entries, from larger to smaller.
+	Groups []*aggregateGroup `json:"groups"`
+
+	// Total is the total number of the matching entries, including the ones
+	// from the groups not in Groups.
+	Total uint64 `json:"total"`
+}
+
+// aggregateGroup is a single group of the aggregated entries.
+type aggregateGroup struct {
+	// Key is the value of the grouping field.
+	Key string `json:"key"`
+
+	// Buckets are the numbers of the entries in each time bucket, from older
+	// to newer, if the entries are bucketed.  The i-th bucket starts at
+	// start + i*bucket.
+	Buckets []uint64 `json:"buckets,omitempty"`
+
+	// Count is the number of the entries in the group.
+	Count uint64 `json:"count"`
+}
+
+// handleQueryLogAggregate is the handler for the GET
+// /control/querylog/aggregate HTTP API.
+func (l *queryLog) handleQueryLogAggregate(w http.ResponseWriter, r *http.Request) {
+	params, err := parseAggregateParams(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing params: %s", err)
+
+		return
+	}
+
+	resp, err := l.aggregate(params)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "aggregating: %s", err)
+
+		return
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// aggregate groups the entries matching params.  Only the numbers are kept in
+// memory, not the entries themselves.  The entries are read twice if those are
+// bucketed: first to count the groups and then to count the buckets of the
+// returned ones only.
+func (l *queryLog) aggregate(params *aggregateParams) (resp *aggregateResp, err error) {
+	if params.search.olderThan.IsZero() {
+		// Fix the end of the range, so that the newly added entries don't
+		// affect the result.
+		params.search.olderThan = time.Now()
+	}
+
+	start, end := params.search.newerThan, params.search.olderThan
+	anonFunc := l.anonymizer.Load()
+	counts := map[string]uint64{}
+
+	var total uint64
+	err = l.forEachEntry(params.search, func(e *logEntry) (fErr error) {
+		counts[aggregateKey(e, params.groupBy, anonFunc)]++
+		total++
+
+		return nil
+	})
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	resp = &aggregateResp{
+		GroupBy: params.groupBy,
+		End:     end.Format(time.RFC3339Nano),
+		Groups:  topGroups(counts, params.search.limit),
+		Total:   total,
+	}
+
+	if !start.IsZero() {
+		resp.Start = start.Format(time.RFC3339Nano)
+	}
+
+	if params.bucket > 0 {
+		resp.Bucket = params.bucket.String()
+
+		err = l.fillBuckets(params, resp.Groups, anonFunc)
+		if err != nil {
+			// Don't wrap the error, since it's informative enough as is.
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// fillBuckets sets the numbers of the entries matching params in each time
+// bucket of groups.  The entries of the other groups are skipped.
+func (l *queryLog) fillBuckets(
+	params *aggregateParams,
+	groups []*aggregateGroup,
+	anonFunc aghnet.IPMutFunc,
+) (err error) {
+	n := params.numBuckets(params.search.olderThan)
+	buckets := make(map[string][]uint64, len(groups))
+	for _, g := range groups {
+		g.Buckets = make([]uint64, n)
+		buckets[g.Key] = g.Buckets
+	}
+
+	start := params.search.newerThan
+
+	return l.forEachEntry(params.search, func(e *logEntry) (fErr error) {
+		b, ok := buckets[aggregateKey(e, params.groupBy, anonFunc)]
+		if !ok {
+			return nil
+		}
+
+		if i := int(e.Time.Sub(start) / params.bucket); i >= 0 && i < len(b) {
+			b[i]++
+		}
+
+		return nil
+	})
+}
+
+// aggregateKey returns the value of the groupBy field of e.  The clients are
+// identified by their ClientIDs, if any, and by their anonymized IP addresses
+// otherwise.
+func aggregateKey(
+	e *logEntry,
+	groupBy aggregateGroupBy,
+	anonFunc aghnet.IPMutFunc,
+) (key string) {
+	switch groupBy {
+	case groupByClient:
+		if e.ClientID != "" {
+			return e.ClientID
+		}
+
+		ip := slices.Clone(e.IP)
+		anonFunc(ip)
+
+		return ip.String()
+	case groupByUpstream:
+		return e.Upstream
+	case groupByQType:
+		return e.QType
+	case groupByReason:
+		return e.Result.Reason.String()
+	default:
+		return e.QHost
+	}
+}
+
+// topGroups returns at most limit groups with the largest counts, sorted by
+// the count from larger to smaller and then by the key.
+func topGroups(counts map[string]uint64, limit int) (groups []*aggregateGroup) {
+	groups = make([]*aggregateGroup, 0, len(counts))
+	for k, n := range counts {
+		groups = append(groups, &aggregateGroup{
+			Key:   k,
+			Count: n,
+		})
+	}
+
+	slices.SortFunc(groups, func(a, b *aggregateGroup) (res int) {
+		if a.Count != b.Count {
+			if a.Count > b.Count {
+				return -1
+			}
+
+			return 1
+		}
+
+		if a.Key < b.Key {
+			return -1
+		} else if a.Key > b.Key {
+			return 1
+		}
+
+		return 0
+	})
+
+	if len(groups) > limit {
+		groups = groups[:limit]
+	}
+
+	return groups
+}
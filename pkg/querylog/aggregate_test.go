@@ -0,0 +1,195 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_HandleQueryLogAggregate(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Anonymizer:  aghnet.NewIPMut(nil),
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	start := time.Now().Add(-10 * time.Minute)
+
+	ans := net.IPv4(1, 1, 1, 1)
+	clientA, clientB := net.IPv4(2, 2, 2, 1), net.IPv4(2, 2, 2, 2)
+
+	// Add file entries.
+	addEntry(l, "a.example.org", ans, clientA)
+	addEntry(l, "a.example.org", ans, clientA)
+	addEntry(l, "b.example.org", ans, clientB)
+	require.NoError(t, l.flushLogBuffer())
+
+	// Add memory entries.
+	addEntry(l, "a.example.org", ans, clientB)
+	addEntry(l, "c.example.com", ans, clientA)
+
+	end := time.Now()
+
+	testCases := []struct {
+		query      url.Values
+		want       *aggregateResp
+		name       string
+		wantGroups []*aggregateGroup
+	}{{
+		query: url.Values{},
+		name:  "domain",
+		wantGroups: []*aggregateGroup{{
+			Key:   "a.example.org",
+			Count: 3,
+		}, {
+			Key:   "b.example.org",
+			Count: 1,
+		}, {
+			Key:   "c.example.com",
+			Count: 1,
+		}},
+	}, {
+		query: url.Values{
+			"group_by": []string{"client"},
+			"search":   []string{"example.org"},
+		},
+		name: "client_search",
+		wantGroups: []*aggregateGroup{{
+			Key:   "2.2.2.1",
+			Count: 2,
+		}, {
+			Key:   "2.2.2.2",
+			Count: 2,
+		}},
+	}, {
+		query: url.Values{
+			"group_by": []string{"reason"},
+			"limit":    []string{"1"},
+		},
+		name: "reason_limit",
+		wantGroups: []*aggregateGroup{{
+			Key:   "Rewrite",
+			Count: 5,
+		}},
+	}, {
+		query: url.Values{
+			"group_by": []string{"upstream"},
+			"start":    []string{start.Format(time.RFC3339Nano)},
+			"end":      []string{end.Format(time.RFC3339Nano)},
+			"bucket":   []string{"5m"},
+		},
+		name: "upstream_bucket",
+		wantGroups: []*aggregateGroup{{
+			Key:     "upstream",
+			Buckets: []uint64{0, 0, 5},
+			Count:   5,
+		}},
+	}, {
+		query: url.Values{
+			"start":  []string{start.Format(time.RFC3339Nano)},
+			"end":    []string{end.Format(time.RFC3339Nano)},
+			"bucket": []string{"5m"},
+			"limit":  []string{"1"},
+		},
+		name: "domain_bucket_limit",
+		wantGroups: []*aggregateGroup{{
+			Key:     "a.example.org",
+			Buckets: []uint64{0, 0, 3},
+			Count:   3,
+		}},
+	}, {
+		query: url.Values{
+			"group_by": []string{"qtype"},
+			"end":      []string{start.Format(time.RFC3339Nano)},
+		},
+		name:       "qtype_empty_range",
+		wantGroups: []*aggregateGroup{},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			l.handleQueryLogAggregate(w, newAggregateRequest(tc.query))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			resp := &aggregateResp{}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+			assert.Equal(t, tc.wantGroups, resp.Groups)
+		})
+	}
+
+	t.Run("anonymized", func(t *testing.T) {
+		l.anonymizer.Store(AnonymizeIP)
+		t.Cleanup(func() { l.anonymizer.Store(nil) })
+
+		w := httptest.NewRecorder()
+		l.handleQueryLogAggregate(w, newAggregateRequest(url.Values{
+			"group_by": []string{"client"},
+		}))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &aggregateResp{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		assert.Equal(t, []*aggregateGroup{{
+			Key:   "2.2.0.0",
+			Count: 5,
+		}}, resp.Groups)
+		assert.Equal(t, uint64(5), resp.Total)
+	})
+
+	badCases := []struct {
+		query url.Values
+		name  string
+	}{{
+		query: url.Values{"group_by": []string{"answer"}},
+		name:  "bad_group_by",
+	}, {
+		query: url.Values{"bucket": []string{"1h"}},
+		name:  "bucket_without_start",
+	}, {
+		query: url.Values{
+			"start":  []string{start.Format(time.RFC3339Nano)},
+			"bucket": []string{"1s"},
+		},
+		name: "bucket_too_small",
+	}, {
+		query: url.Values{
+			"start":  []string{start.Add(-timeutil.Day).Format(time.RFC3339Nano)},
+			"bucket": []string{"1m"},
+		},
+		name: "too_many_buckets",
+	}, {
+		query: url.Values{"limit": []string{"0"}},
+		name:  "zero_limit",
+	}}
+
+	for _, tc := range badCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			l.handleQueryLogAggregate(w, newAggregateRequest(tc.query))
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+// newAggregateRequest returns a new aggregation request with the parameters
+// from q.
+func newAggregateRequest(q url.Values) (r *http.Request) {
+	return httptest.NewRequest(http.MethodGet, "/control/querylog/aggregate?"+q.Encode(), nil)
+}
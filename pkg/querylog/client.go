@@ -23,3 +23,8 @@ type clientCacheKey struct {
 // make sure that changes in client data between two lookups don't create
 // discrepancies in our response.
 type clientCache map[clientCacheKey]*Client
+
+// maxClientCacheSize is the maximum number of clients in the caches that live
+// longer than a single request, for example the ones of the live stream and the
+// export.  Such caches are reset when they grow larger.
+const maxClientCacheSize = 1000
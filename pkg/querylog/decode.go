@@ -93,6 +93,17 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return err
 	},
+	"DNSSEC": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		var err error
+		ent.DNSSECStatus, err = NewDNSSECStatus(v)
+
+		return err
+	},
 	"Answer": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
@@ -135,6 +146,16 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return nil
 	},
+	"Ratelimited": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(bool)
+		if !ok {
+			return nil
+		}
+
+		ent.Ratelimited = v
+
+		return nil
+	},
 	"AD": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(bool)
 		if !ok {
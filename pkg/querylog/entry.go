@@ -39,6 +39,10 @@ type logEntry struct {
 
 	Cached            bool `json:",omitempty"`
 	AuthenticatedData bool `json:"AD,omitempty"`
+
+	DNSSECStatus DNSSECStatus `json:"DNSSEC,omitempty"`
+
+	Ratelimited bool `json:",omitempty"`
 }
 
 // shallowClone returns a shallow clone of e.
@@ -0,0 +1,349 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// exportFormat is the format of the exported query log.
+type exportFormat string
+
+// Supported export formats.
+const (
+	exportFormatCSV   exportFormat = "csv"
+	exportFormatJSONL exportFormat = "jsonl"
+)
+
+// exportCSVHeader is the header of the exported CSV query log.
+var exportCSVHeader = []string{
+	"time",
+	"client",
+	"client_id",
+	"client_name",
+	"client_proto",
+	"name",
+	"type",
+	"class",
+	"status",
+	"reason",
+	"rule",
+	"filter_list_id",
+	"service_name",
+	"upstream",
+	"elapsed_ms",
+	"cached",
+}
+
+// exportParams are the parameters of a query log export.
+type exportParams struct {
+	// search contains the search criteria and the exported range.
+	search *searchParams
+
+	// format is the format of the exported entries.
+	format exportFormat
+
+	// gzip, if true, means that the exported data should be compressed.
+	gzip bool
+}
+
+// parseExportParams parses the export parameters from the HTTP request's query
+// string.
+func parseExportParams(r *http.Request) (p *exportParams, err error) {
+	search, err := parseSearchParams(r)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
+	p = &exportParams{
+		search: search,
+		format: exportFormatCSV,
+	}
+
+	q := r.URL.Query()
+
+	switch f := exportFormat(q.Get("format")); f {
+	case "", exportFormatCSV:
+		// Go on.
+	case exportFormatJSONL:
+		p.format = f
+	default:
+		return nil, fmt.Errorf("format: unsupported value %q", f)
+	}
+
+	if s := q.Get("gzip"); s != "" {
+		p.gzip, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// handleQueryLogExport is the handler for the GET /control/querylog/export
+// HTTP API.  It writes the log entries from the requested range and matching
+// the search criteria from newer to older, without keeping them in memory.
+func (l *queryLog) handleQueryLogExport(w http.ResponseWriter, r *http.Request) {
+	params, err := parseExportParams(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing params: %s", err)
+
+		return
+	}
+
+	filename := "querylog." + string(params.format)
+	contentType := "text/csv"
+	if params.format == exportFormatJSONL {
+		contentType = "application/jsonl"
+	}
+
+	h := w.Header()
+	if params.gzip {
+		filename += ".gz"
+		contentType = "application/gzip"
+
+		// Prevent the compressing middlewares from compressing the data again.
+		h.Set("Content-Encoding", "identity")
+	}
+
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	var out io.Writer = w
+	if params.gzip {
+		gzw := gzip.NewWriter(w)
+		defer func() {
+			err = gzw.Close()
+			if err != nil {
+				log.Debug("querylog: export: closing gzip: %s", err)
+			}
+		}()
+
+		out = gzw
+	}
+
+	var ew entryWriter
+	if params.format == exportFormatJSONL {
+		ew = &jsonlEntryWriter{enc: json.NewEncoder(out)}
+	} else {
+		ew, err = newCSVEntryWriter(out)
+		if err != nil {
+			log.Debug("querylog: export: writing header: %s", err)
+
+			return
+		}
+	}
+
+	err = l.export(ew, params)
+	if err != nil {
+		log.Debug("querylog: export: %s", err)
+	}
+}
+
+// export writes the entries matching params to ew.
+func (l *queryLog) export(ew entryWriter, params *exportParams) (err error) {
+	anonFunc := l.anonymizer.Load()
+
+	err = l.forEachEntry(params.search, func(e *logEntry) (wErr error) {
+		return ew.write(e, anonFunc)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ew.flush()
+}
+
+// forEachEntry calls f for each entry matching params, from newer to older,
+// both from the memory buffer and from the files.  The entries are read from
+// the files one by one, so the whole range is never kept in memory.  It stops
+// and returns the error if f returns one.
+func (l *queryLog) forEachEntry(
+	params *searchParams,
+	f func(e *logEntry) (err error),
+) (err error) {
+	cache := clientCache{}
+
+	// The memory buffer contains the newest entries and it's limited in size,
+	// so it's fine to collect the matching ones first.
+	memEntries, _ := l.searchMemory(params, cache)
+	for _, e := range memEntries {
+		err = f(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := l.setQLogReader(params, cache)
+	if err != nil {
+		log.Error("querylog: reading entries: %s", err)
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	defer func() {
+		if closeErr := r.Close(); closeErr != nil {
+			log.Error("querylog: reading entries: closing file: %s", closeErr)
+		}
+	}()
+
+	startNano := params.newerThan.UnixNano()
+	for {
+		if len(cache) > maxClientCacheSize {
+			clear(cache)
+		}
+
+		e, ts, rErr := l.readNextEntryLocked(r, params, cache)
+		if rErr == io.EOF {
+			return nil
+		} else if rErr != nil {
+			log.Error("querylog: reading next entry: %s", rErr)
+		}
+
+		if !params.newerThan.IsZero() && ts != 0 && ts < startNano {
+			// The entries are read from newer to older, so the rest are out of
+			// range.
+			return nil
+		}
+
+		if e == nil {
+			continue
+		}
+
+		err = f(e)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readNextEntryLocked is a wrapper around [queryLog.readNextEntry] that locks
+// l.confMu for reading only for the duration of the call, so that long exports
+// don't block the configuration updates.
+func (l *queryLog) readNextEntryLocked(
+	r *qLogReader,
+	params *searchParams,
+	cache clientCache,
+) (e *logEntry, ts int64, err error) {
+	l.confMu.RLock()
+	defer l.confMu.RUnlock()
+
+	return l.readNextEntry(r, params, cache)
+}
+
+// entryWriter writes the exported log entries.
+type entryWriter interface {
+	// write writes e, anonymizing the client's IP address with anonFunc.
+	write(e *logEntry, anonFunc aghnet.IPMutFunc) (err error)
+
+	// flush writes any buffered data.
+	flush() (err error)
+}
+
+// jsonlEntryWriter is an entryWriter that writes the entries in the JSON Lines
+// format using the same objects as the JSON API.
+type jsonlEntryWriter struct {
+	enc *json.Encoder
+}
+
+// type check
+var _ entryWriter = (*jsonlEntryWriter)(nil)
+
+// write implements the [entryWriter] interface for *jsonlEntryWriter.
+func (w *jsonlEntryWriter) write(e *logEntry, anonFunc aghnet.IPMutFunc) (err error) {
+	return w.enc.Encode(entryToJSON(e, anonFunc))
+}
+
+// flush implements the [entryWriter] interface for *jsonlEntryWriter.
+func (w *jsonlEntryWriter) flush() (err error) {
+	return nil
+}
+
+// csvEntryWriter is an entryWriter that writes the entries in the CSV format.
+type csvEntryWriter struct {
+	w *csv.Writer
+}
+
+// newCSVEntryWriter returns a new *csvEntryWriter writing to w.  It writes the
+// header right away.
+func newCSVEntryWriter(w io.Writer) (ew *csvEntryWriter, err error) {
+	ew = &csvEntryWriter{
+		w: csv.NewWriter(w),
+	}
+
+	err = ew.w.Write(exportCSVHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	return ew, nil
+}
+
+// type check
+var _ entryWriter = (*csvEntryWriter)(nil)
+
+// write implements the [entryWriter] interface for *csvEntryWriter.
+func (w *csvEntryWriter) write(e *logEntry, anonFunc aghnet.IPMutFunc) (err error) {
+	ip := slices.Clone(e.IP)
+	anonFunc(ip)
+
+	var clientName string
+	if e.client != nil && ip.Equal(e.IP) {
+		clientName = e.client.Name
+	}
+
+	var rule, filterListID string
+	if len(e.Result.Rules) > 0 {
+		r := e.Result.Rules[0]
+		rule, filterListID = r.Text, strconv.FormatInt(r.FilterListID, 10)
+	}
+
+	var status string
+	if len(e.Answer) > 0 {
+		msg := &dns.Msg{}
+		if err = msg.Unpack(e.Answer); err == nil {
+			status = dns.RcodeToString[msg.Rcode]
+		}
+	}
+
+	return w.w.Write([]string{
+		e.Time.Format(time.RFC3339Nano),
+		ip.String(),
+		e.ClientID,
+		clientName,
+		string(e.ClientProto),
+		e.QHost,
+		e.QType,
+		e.QClass,
+		status,
+		e.Result.Reason.String(),
+		rule,
+		filterListID,
+		e.Result.ServiceName,
+		e.Upstream,
+		strconv.FormatFloat(e.Elapsed.Seconds()*1000, 'f', -1, 64),
+		strconv.FormatBool(e.Cached),
+	})
+}
+
+// flush implements the [entryWriter] interface for *csvEntryWriter.
+func (w *csvEntryWriter) flush() (err error) {
+	w.w.Flush()
+
+	return w.w.Error()
+}
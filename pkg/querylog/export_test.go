@@ -0,0 +1,160 @@
+package querylog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_HandleQueryLogExport(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Anonymizer:  aghnet.NewIPMut(nil),
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	// Add file entries.
+	addEntry(l, "old.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer())
+
+	start := time.Now()
+
+	addEntry(l, "first.example.org", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	addEntry(l, "first.example.com", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+	require.NoError(t, l.flushLogBuffer())
+
+	// Add memory entries.
+	addEntry(l, "second.example.org", net.IPv4(1, 1, 1, 4), net.IPv4(2, 2, 2, 4))
+
+	end := time.Now()
+
+	addEntry(l, "new.example.org", net.IPv4(1, 1, 1, 5), net.IPv4(2, 2, 2, 5))
+
+	rangeQuery := url.Values{
+		"start":  []string{start.Format(time.RFC3339Nano)},
+		"end":    []string{end.Format(time.RFC3339Nano)},
+		"search": []string{"example.org"},
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		l.handleQueryLogExport(w, newExportRequest(rangeQuery, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+
+		records, rErr := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, rErr)
+		require.Len(t, records, 3)
+
+		assert.Equal(t, exportCSVHeader, records[0])
+		assert.Equal(t, "second.example.org", records[1][5])
+		assert.Equal(t, "2.2.2.4", records[1][1])
+		assert.Equal(t, "first.example.org", records[2][5])
+		assert.Equal(t, "SomeRule", records[2][10])
+	})
+
+	t.Run("jsonl_gzip", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		l.handleQueryLogExport(w, newExportRequest(rangeQuery, url.Values{
+			"format": []string{"jsonl"},
+			"gzip":   []string{"true"},
+		}))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+
+		gzr, gzErr := gzip.NewReader(w.Body)
+		require.NoError(t, gzErr)
+
+		var names []string
+		sc := bufio.NewScanner(gzr)
+		for sc.Scan() {
+			entry := jobject{}
+			require.NoError(t, json.Unmarshal(sc.Bytes(), &entry))
+
+			question, ok := entry["question"].(jobject)
+			require.True(t, ok)
+
+			names = append(names, question["name"].(string))
+		}
+		require.NoError(t, sc.Err())
+
+		assert.Equal(t, []string{"second.example.org", "first.example.org"}, names)
+	})
+
+	t.Run("anonymized", func(t *testing.T) {
+		l.anonymizer.Store(AnonymizeIP)
+		t.Cleanup(func() { l.anonymizer.Store(nil) })
+
+		w := httptest.NewRecorder()
+		l.handleQueryLogExport(w, newExportRequest(url.Values{
+			"search": []string{"new.example.org"},
+		}, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		records, rErr := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, rErr)
+		require.Len(t, records, 2)
+
+		assert.Equal(t, "2.2.0.0", records[1][1])
+	})
+
+	badCases := []struct {
+		query url.Values
+		name  string
+	}{{
+		query: url.Values{"format": []string{"xml"}},
+		name:  "bad_format",
+	}, {
+		query: url.Values{"gzip": []string{"maybe"}},
+		name:  "bad_gzip",
+	}, {
+		query: url.Values{"start": []string{"yesterday"}},
+		name:  "bad_start",
+	}, {
+		query: url.Values{
+			"start": []string{end.Format(time.RFC3339Nano)},
+			"end":   []string{start.Format(time.RFC3339Nano)},
+		},
+		name: "end_before_start",
+	}}
+
+	for _, tc := range badCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			l.handleQueryLogExport(w, newExportRequest(tc.query, nil))
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+// newExportRequest returns a new export request with the parameters from both
+// queries.
+func newExportRequest(q, extra url.Values) (r *http.Request) {
+	vals := url.Values{}
+	for _, v := range []url.Values{q, extra} {
+		for k, vs := range v {
+			vals[k] = vs
+		}
+	}
+
+	return httptest.NewRequest(http.MethodGet, "/control/querylog/export?"+vals.Encode(), nil)
+}
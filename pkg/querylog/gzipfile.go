@@ -0,0 +1,346 @@
+package querylog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/jynychen/AdGuardHome/pkg/aghrenameio"
+)
+
+// compressedFileExt is the extension added to the name of a rotated query log
+// file when it's compressed.
+const compressedFileExt = ".gz"
+
+// The compressed query log files are sequences of gzip members, each
+// containing at most gzipMemberDataSize bytes of the log.  Such files can be
+// decompressed by any gzip implementation, but unlike the usual gzip files
+// they can also be read from any position without decompressing the whole
+// file.  For that, the header of each member contains an extra field with the
+// sizes of the member and of its uncompressed data, similar to the BGZF format.
+const (
+	// gzipMemberDataSize is the maximum size of the uncompressed data of a
+	// single gzip member.
+	gzipMemberDataSize = 64 * 1024
+
+	// gzipExtraSI1 and gzipExtraSI2 are the subfield ID of the extra field.
+	gzipExtraSI1 = 'A'
+	gzipExtraSI2 = 'G'
+
+	// gzipExtraLen is the length of the extra field: the subfield ID, the
+	// subfield length, and two 32-bit sizes.
+	gzipExtraLen = 2 + 2 + 4 + 4
+
+	// gzipHeaderLen is the length of the member header preceding the
+	// compressed data: the fixed part, the length of the extra field, and the
+	// extra field itself.
+	gzipHeaderLen = 10 + 2 + gzipExtraLen
+
+	// gzipFlagExtra is the FEXTRA flag of the gzip header.
+	gzipFlagExtra = 1 << 2
+)
+
+// errNotSeekableGzip is returned when the file isn't a compressed query log
+// file.
+const errNotSeekableGzip errors.Error = "not a seekable gzip file"
+
+// writeGzipFile atomically writes the data read from r to a new compressed
+// query log file at path.
+func writeGzipFile(path string, r io.Reader) (err error) {
+	f, err := aghrenameio.NewPendingFile(path, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { err = aghrenameio.WithDeferredCleanup(err, f) }()
+
+	data := make([]byte, gzipMemberDataSize)
+	member := &bytes.Buffer{}
+	for {
+		var n int
+		n, err = io.ReadFull(r, data)
+		if n > 0 {
+			wErr := writeGzipMember(f, member, data[:n])
+			if wErr != nil {
+				return fmt.Errorf("writing member: %w", wErr)
+			}
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading: %w", err)
+		}
+	}
+}
+
+// writeGzipMember compresses data into a single gzip member and writes it to
+// w.  buf is used as a temporary buffer.
+func writeGzipMember(w io.Writer, buf *bytes.Buffer, data []byte) (err error) {
+	buf.Reset()
+
+	gzw, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	// Reserve the extra field and fill it after the member size is known.
+	gzw.Extra = make([]byte, gzipExtraLen)
+	_, err = gzw.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = gzw.Close()
+	if err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	extra := b[gzipHeaderLen-gzipExtraLen : gzipHeaderLen]
+	extra[0], extra[1] = gzipExtraSI1, gzipExtraSI2
+	binary.LittleEndian.PutUint16(extra[2:], 8)
+	binary.LittleEndian.PutUint32(extra[4:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(extra[8:], uint32(len(data)))
+
+	_, err = w.Write(b)
+
+	return err
+}
+
+// gzipMember is a member of a compressed query log file.
+type gzipMember struct {
+	// off is the offset of the member in the compressed file.
+	off int64
+
+	// start is the offset of the member's data in the uncompressed file.
+	start int64
+
+	// size is the size of the member in the compressed file.
+	size int64
+
+	// dataSize is the size of the member's uncompressed data.
+	dataSize int64
+}
+
+// gzipFile is a compressed query log file that can be read as if it's
+// uncompressed.
+type gzipFile struct {
+	// file is the underlying compressed file.
+	file *os.File
+
+	// members are the members of the file.
+	members []*gzipMember
+
+	// data is the uncompressed data of the member with the index cur.
+	data []byte
+
+	// cur is the index of the member decompressed into data or -1.
+	cur int
+
+	// pos is the current offset in the uncompressed file.
+	pos int64
+
+	// size is the size of the uncompressed file.
+	size int64
+}
+
+// type check
+var _ logFileReader = (*gzipFile)(nil)
+
+// openGzipFile opens the compressed query log file at path.
+func openGzipFile(path string) (g *gzipFile, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g = &gzipFile{
+		file: f,
+		cur:  -1,
+	}
+
+	err = g.readMembers()
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("%q: %w", path, err), f.Close())
+	}
+
+	return g, nil
+}
+
+// readMembers reads the headers of all members of the file.
+func (g *gzipFile) readMembers() (err error) {
+	fi, err := g.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, gzipHeaderLen)
+	for off, total := int64(0), fi.Size(); off < total; {
+		_, err = g.file.ReadAt(hdr, off)
+		if err != nil {
+			return fmt.Errorf("reading member header at %d: %w", off, err)
+		}
+
+		m := &gzipMember{
+			off:   off,
+			start: g.size,
+		}
+
+		m.size, m.dataSize, err = parseGzipMemberHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("member at %d: %w", off, err)
+		}
+
+		g.members = append(g.members, m)
+		g.size += m.dataSize
+		off += m.size
+	}
+
+	return nil
+}
+
+// parseGzipMemberHeader returns the sizes of the member from its header.
+func parseGzipMemberHeader(hdr []byte) (size, dataSize int64, err error) {
+	extra := hdr[gzipHeaderLen-gzipExtraLen:]
+	if hdr[0] != 0x1f ||
+		hdr[1] != 0x8b ||
+		hdr[3]&gzipFlagExtra == 0 ||
+		binary.LittleEndian.Uint16(hdr[10:]) != gzipExtraLen ||
+		extra[0] != gzipExtraSI1 ||
+		extra[1] != gzipExtraSI2 {
+		return 0, 0, errNotSeekableGzip
+	}
+
+	size = int64(binary.LittleEndian.Uint32(extra[4:]))
+	dataSize = int64(binary.LittleEndian.Uint32(extra[8:]))
+	if size <= gzipHeaderLen {
+		return 0, 0, fmt.Errorf("bad member size %d", size)
+	}
+
+	return size, dataSize, nil
+}
+
+// Read implements the [io.Reader] interface for *gzipFile.  Unlike the
+// interface requires, it always reads len(p) bytes unless it reaches the end
+// of the file, just like reading a regular file does.
+func (g *gzipFile) Read(p []byte) (n int, err error) {
+	if g.pos >= g.size {
+		return 0, io.EOF
+	}
+
+	for n < len(p) && g.pos < g.size {
+		i := sort.Search(len(g.members), func(i int) (ok bool) {
+			m := g.members[i]
+
+			return m.start+m.dataSize > g.pos
+		})
+
+		err = g.decompress(i)
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], g.data[g.pos-g.members[i].start:])
+		n += copied
+		g.pos += int64(copied)
+	}
+
+	return n, nil
+}
+
+// decompress decompresses the data of the i-th member into g.data, unless it's
+// already there.
+func (g *gzipFile) decompress(i int) (err error) {
+	if g.cur == i {
+		return nil
+	}
+
+	m := g.members[i]
+
+	gzr, err := gzip.NewReader(io.NewSectionReader(g.file, m.off, m.size))
+	if err != nil {
+		return fmt.Errorf("member at %d: %w", m.off, err)
+	}
+
+	if int64(cap(g.data)) < m.dataSize {
+		g.data = make([]byte, m.dataSize)
+	}
+
+	g.data = g.data[:m.dataSize]
+	_, err = io.ReadFull(gzr, g.data)
+	if err != nil {
+		g.cur = -1
+
+		return fmt.Errorf("member at %d: %w", m.off, err)
+	}
+
+	g.cur = i
+
+	return nil
+}
+
+// Seek implements the [io.Seeker] interface for *gzipFile.  The offset is in
+// the uncompressed file.
+func (g *gzipFile) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = g.pos + offset
+	case io.SeekEnd:
+		pos = g.size + offset
+	default:
+		return g.pos, fmt.Errorf("bad whence %d", whence)
+	}
+
+	if pos < 0 {
+		return g.pos, fmt.Errorf("negative position %d", pos)
+	}
+
+	g.pos = pos
+
+	return pos, nil
+}
+
+// Name returns the name of the compressed file.
+func (g *gzipFile) Name() (name string) {
+	return g.file.Name()
+}
+
+// Stat returns the information about the compressed file with the size of the
+// uncompressed one.
+func (g *gzipFile) Stat() (fi fs.FileInfo, err error) {
+	fi, err = g.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &gzipFileInfo{
+		FileInfo: fi,
+		size:     g.size,
+	}, nil
+}
+
+// Close implements the [io.Closer] interface for *gzipFile.
+func (g *gzipFile) Close() (err error) {
+	return g.file.Close()
+}
+
+// gzipFileInfo is the information about a compressed query log file.
+type gzipFileInfo struct {
+	fs.FileInfo
+
+	// size is the size of the uncompressed file.
+	size int64
+}
+
+// Size implements the [fs.FileInfo] interface for *gzipFileInfo.
+func (fi *gzipFileInfo) Size() (size int64) {
+	return fi.size
+}
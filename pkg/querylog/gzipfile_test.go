@@ -0,0 +1,144 @@
+package querylog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGzipFile compresses a test query log file with linesNum lines and
+// returns the path to the compressed file and the uncompressed data.
+func newTestGzipFile(t *testing.T, linesNum int) (path string, data []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	src := prepareTestFile(t, dir, linesNum)
+
+	data, err := os.ReadFile(src)
+	require.NoError(t, err)
+
+	path = filepath.Join(dir, "querylog.json.1"+compressedFileExt)
+	require.NoError(t, writeGzipFile(path, bytes.NewReader(data)))
+
+	return path, data
+}
+
+func TestGzipFile(t *testing.T) {
+	path, data := newTestGzipFile(t, 5000)
+	require.Greater(t, len(data), 2*gzipMemberDataSize)
+
+	t.Run("gzip_compatible", func(t *testing.T) {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, f.Close)
+
+		gzr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+
+		got, err := io.ReadAll(gzr)
+		require.NoError(t, err)
+
+		assert.Equal(t, data, got)
+	})
+
+	g, err := openGzipFile(path)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, g.Close)
+
+	fi, err := g.Stat()
+	require.NoError(t, err)
+
+	size := int64(len(data))
+	assert.Equal(t, size, fi.Size())
+
+	testCases := []struct {
+		name string
+		off  int64
+		n    int
+	}{{
+		name: "start",
+		off:  0,
+		n:    100,
+	}, {
+		name: "member_boundary",
+		off:  gzipMemberDataSize - 50,
+		n:    100,
+	}, {
+		name: "several_members",
+		off:  10,
+		n:    3 * gzipMemberDataSize,
+	}, {
+		name: "end",
+		off:  size - 50,
+		n:    50,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = g.Seek(tc.off, io.SeekStart)
+			require.NoError(t, err)
+
+			buf := make([]byte, tc.n)
+			n, rErr := g.Read(buf)
+			require.NoError(t, rErr)
+			require.Equal(t, tc.n, n)
+
+			assert.Equal(t, data[tc.off:tc.off+int64(tc.n)], buf)
+		})
+	}
+
+	t.Run("eof", func(t *testing.T) {
+		_, err = g.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+
+		_, err = g.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestGzipFile_notSeekable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "querylog.json.1"+compressedFileExt)
+
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	_, err := gzw.Write([]byte("{}\n"))
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+
+	_, err = openGzipFile(path)
+	assert.ErrorIs(t, err, errNotSeekableGzip)
+}
+
+func TestQLogFile_compressed(t *testing.T) {
+	const linesNum = 5000
+
+	path, _ := newTestGzipFile(t, linesNum)
+
+	q, err := newQLogFile(path)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, q.Close)
+
+	_, err = q.SeekStart()
+	require.NoError(t, err)
+
+	read := 0
+	for {
+		_, err = q.ReadNext()
+		if err != nil {
+			break
+		}
+
+		read++
+	}
+
+	require.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, linesNum, read)
+}
@@ -7,16 +7,19 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/jynychen/AdGuardHome/pkg/aghalg"
 	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
 	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/miekg/dns"
 	"golang.org/x/net/idna"
 )
 
@@ -59,6 +62,9 @@ type getConfigResp struct {
 // Register web handlers
 func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog", l.handleQueryLog)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/stream", l.handleQueryLogStream)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/export", l.handleQueryLogExport)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/aggregate", l.handleQueryLogAggregate)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/config", l.handleGetQueryLogConfig)
 	l.conf.HTTPRegister(
@@ -290,9 +296,14 @@ func parseSearchCriterion(q url.Values, name string, ct criterionType) (
 		return false, sc, nil
 	}
 
-	strict := getDoubleQuotesEnclosedValue(&val)
+	strict := ct != ctRegexp && getDoubleQuotesEnclosedValue(&val)
+
+	sc = searchCriterion{
+		criterionType: ct,
+		value:         val,
+		strict:        strict,
+	}
 
-	var asciiVal string
 	switch ct {
 	case ctTerm:
 		// Decode lowercased value from punycode to make EqualFold and
@@ -300,33 +311,139 @@ func parseSearchCriterion(q url.Values, name string, ct criterionType) (
 		//
 		// TODO(e.burkov):  Make it work with parts of IDNAs somehow.
 		loweredVal := strings.ToLower(val)
-		if asciiVal, err = idna.ToASCII(loweredVal); err != nil {
+		if sc.asciiVal, err = idna.ToASCII(loweredVal); err != nil {
 			log.Debug("can't convert %q to ascii: %s", val, err)
-		} else if asciiVal == loweredVal {
+			sc.asciiVal = ""
+		} else if sc.asciiVal == loweredVal {
 			// Purge asciiVal to prevent checking the same value
 			// twice.
-			asciiVal = ""
+			sc.asciiVal = ""
 		}
 	case ctFilteringStatus:
 		if !stringutil.InSlice(filteringStatusValues, val) {
 			return false, sc, fmt.Errorf("invalid value %s", val)
 		}
+	case ctUpstream:
+		// Go on.
 	default:
+		err = parseCriterionValue(&sc)
+		if err != nil {
+			return false, sc, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return true, sc, nil
+}
+
+// parseCriterionValue parses and validates the value of a search criterion,
+// which isn't a string one.
+func parseCriterionValue(sc *searchCriterion) (err error) {
+	switch val := sc.value; sc.criterionType {
+	case ctQType:
+		sc.value = strings.ToUpper(val)
+		if _, ok := dns.StringToType[sc.value]; !ok && !strings.HasPrefix(sc.value, "TYPE") {
+			return fmt.Errorf("unsupported value %q", val)
+		}
+	case ctRCode:
+		rcode, ok := dns.StringToRcode[strings.ToUpper(val)]
+		if !ok {
+			return fmt.Errorf("unsupported value %q", val)
+		}
+
+		sc.num = int64(rcode)
+	case ctClientProto:
+		if val == clientProtoPlain {
+			sc.value = string(ClientProtoPlain)
+
+			return nil
+		}
+
+		_, err = NewClientProto(val)
+	case ctCached:
+		sc.cached, err = strconv.ParseBool(val)
+	case ctFilterListID:
+		sc.num, err = strconv.ParseInt(val, 10, 64)
+	case ctRegexp:
+		sc.re, err = regexp.Compile(val)
+	default:
+		return fmt.Errorf("invalid criterion type %v", sc.criterionType)
+	}
+
+	// Don't wrap the error, because it's informative enough as is.
+	return err
+}
+
+// parseElapsedCriterion parses the search criterion by the elapsed time from
+// the query parameters.
+func parseElapsedCriterion(q url.Values) (ok bool, sc searchCriterion, err error) {
+	sc = searchCriterion{
+		criterionType: ctElapsed,
+	}
+
+	for _, b := range []struct {
+		dst  *time.Duration
+		name string
+	}{{
+		dst:  &sc.minElapsed,
+		name: "elapsed_min",
+	}, {
+		dst:  &sc.maxElapsed,
+		name: "elapsed_max",
+	}} {
+		val := q.Get(b.name)
+		if val == "" {
+			continue
+		}
+
+		*b.dst, err = time.ParseDuration(val)
+		if err != nil {
+			return false, sc, fmt.Errorf("%s: %w", b.name, err)
+		} else if *b.dst <= 0 {
+			return false, sc, fmt.Errorf("%s: must be positive, got %s", b.name, *b.dst)
+		}
+
+		ok = true
+	}
+
+	if sc.maxElapsed != 0 && sc.minElapsed > sc.maxElapsed {
 		return false, sc, fmt.Errorf(
-			"invalid criterion type %v: should be one of %v",
-			ct,
-			[]criterionType{ctTerm, ctFilteringStatus},
+			"elapsed_min: must not be greater than elapsed_max %s, got %s",
+			sc.maxElapsed,
+			sc.minElapsed,
 		)
 	}
 
-	sc = searchCriterion{
-		criterionType: ct,
-		value:         val,
-		asciiVal:      asciiVal,
-		strict:        strict,
+	return ok, sc, nil
+}
+
+// parseTimeRange parses the start and the end of the searched time range from
+// the query parameters into p.  The end is only used if it's before the
+// current p.olderThan.
+func parseTimeRange(q url.Values, p *searchParams) (err error) {
+	if s := q.Get("start"); s != "" {
+		p.newerThan, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("start: %w", err)
+		}
 	}
 
-	return true, sc, nil
+	s := q.Get("end")
+	if s == "" {
+		return nil
+	}
+
+	end, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fmt.Errorf("end: %w", err)
+	} else if !p.newerThan.IsZero() && !end.After(p.newerThan) {
+		return errors.Error("end: must be after start")
+	}
+
+	if p.olderThan.IsZero() || end.Before(p.olderThan) {
+		p.olderThan = end
+	}
+
+	return nil
 }
 
 // parseSearchParams parses search parameters from the HTTP request's query
@@ -357,6 +474,12 @@ func parseSearchParams(r *http.Request) (p *searchParams, err error) {
 		p.maxFileScanEntries = 0
 	}
 
+	err = parseTimeRange(q, p)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
 	for _, v := range []struct {
 		urlField string
 		ct       criterionType
@@ -366,6 +489,27 @@ func parseSearchParams(r *http.Request) (p *searchParams, err error) {
 	}, {
 		urlField: "response_status",
 		ct:       ctFilteringStatus,
+	}, {
+		urlField: "qtype",
+		ct:       ctQType,
+	}, {
+		urlField: "rcode",
+		ct:       ctRCode,
+	}, {
+		urlField: "upstream",
+		ct:       ctUpstream,
+	}, {
+		urlField: "client_proto",
+		ct:       ctClientProto,
+	}, {
+		urlField: "cached",
+		ct:       ctCached,
+	}, {
+		urlField: "filter_list_id",
+		ct:       ctFilterListID,
+	}, {
+		urlField: "regexp",
+		ct:       ctRegexp,
 	}} {
 		var ok bool
 		var c searchCriterion
@@ -374,10 +518,28 @@ func parseSearchParams(r *http.Request) (p *searchParams, err error) {
 			return nil, err
 		}
 
-		if ok {
+		// The "all" filtering status matches anything, so it would make any
+		// combination with OR match everything.
+		if ok && !(c.criterionType == ctFilteringStatus && c.value == filteringStatusAll) {
 			p.searchCriteria = append(p.searchCriteria, c)
 		}
 	}
 
+	ok, c, err := parseElapsedCriterion(q)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		p.searchCriteria = append(p.searchCriteria, c)
+	}
+
+	switch combine := q.Get("combine"); combine {
+	case "", "and":
+		// Go on.
+	case "or":
+		p.anyCriteria = true
+	default:
+		return nil, fmt.Errorf("combine: unsupported value %q", combine)
+	}
+
 	return p, nil
 }
@@ -0,0 +1,634 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghrenameio"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+)
+
+const (
+	// indexFileExt is the extension added to the name of a query log file to
+	// get the name of its index file.
+	indexFileExt = ".idx"
+
+	// indexBlockMaxEntries is the maximum number of log entries described by a
+	// single index block.
+	indexBlockMaxEntries = 1000
+
+	// indexBlockMaxDataSize is the approximate maximum size of the encoded
+	// hosts and clients of a single index block.  It keeps the encoded blocks
+	// well below maxEntrySize, so that the index files can be read by
+	// qLogFile.
+	indexBlockMaxDataSize = 8 * 1024
+
+	// indexHostOverhead and indexClientOverhead are the approximate sizes of
+	// the JSON syntax around an encoded host and client correspondingly.
+	indexHostOverhead   = len(`"",`)
+	indexClientOverhead = len(`{"CID":"","IP":""},`)
+)
+
+// indexPath returns the path to the index file of the query log file.
+func indexPath(logPath string) (p string) {
+	return logPath + indexFileExt
+}
+
+// qLogBlock describes a contiguous block of lines of a query log file.  The
+// index file of a query log file contains the blocks covering it, encoded as
+// JSON objects, one per line, from the oldest to the newest.  The blocks are
+// used to skip the parts of the file that can't match the search.
+type qLogBlock struct {
+	// Hosts are the distinct requested hosts.
+	Hosts []string `json:"H"`
+
+	// Clients are the distinct clients.
+	Clients []qLogBlockClient `json:"C"`
+
+	// Start is the offset of the first line of the block in the file.
+	Start int64 `json:"S"`
+
+	// End is the offset right after the last line of the block in the file.
+	End int64 `json:"E"`
+
+	// MinTime is the time of the oldest entry as Unix time in nanoseconds.
+	MinTime int64 `json:"TMin"`
+
+	// MaxTime is the time of the newest entry as Unix time in nanoseconds.
+	MaxTime int64 `json:"TMax"`
+
+	// Results is the set of the filtering results, see [resultBit].
+	Results uint64 `json:"R"`
+
+	// Ratelimited is true if the block contains ratelimited requests.
+	Ratelimited bool `json:"RL,omitempty"`
+}
+
+// qLogBlockClient is a client in a query log block.
+type qLogBlockClient struct {
+	// ID is the ClientID, if any.
+	ID string `json:"CID,omitempty"`
+
+	// IP is the IP address of the client as written in the log.
+	IP string `json:"IP"`
+}
+
+// resultBit returns the bit of the filtering result in [qLogBlock.Results].
+// The unknown reasons set all bits to make sure the block is never skipped.
+func resultBit(reason filtering.Reason, isFiltered bool) (bit uint64) {
+	n := int(reason) * 2
+	if isFiltered {
+		n++
+	}
+
+	if n < 0 || n >= 64 {
+		return ^uint64(0)
+	}
+
+	return 1 << n
+}
+
+// blockBuilder builds the index blocks from the log entries.
+type blockBuilder struct {
+	// hosts are the distinct hosts of the block.
+	hosts map[string]struct{}
+
+	// clients are the distinct clients of the block.
+	clients map[qLogBlockClient]struct{}
+
+	// block is the block being built.
+	block *qLogBlock
+
+	// dataSize is the approximate size of the encoded hosts and clients of the
+	// block.
+	dataSize int
+
+	// entries is the number of entries in the block.
+	entries int
+}
+
+// newBlockBuilder returns a new *blockBuilder for the block starting at start.
+func newBlockBuilder(start int64) (bb *blockBuilder) {
+	return &blockBuilder{
+		hosts:   map[string]struct{}{},
+		clients: map[qLogBlockClient]struct{}{},
+		block: &qLogBlock{
+			Start: start,
+			End:   start,
+		},
+	}
+}
+
+// add adds e, which takes lineLen bytes in the file, to the block.
+func (bb *blockBuilder) add(e *logEntry, lineLen int) {
+	b := bb.block
+
+	ts := e.Time.UnixNano()
+	if bb.entries == 0 || ts < b.MinTime {
+		b.MinTime = ts
+	}
+
+	if bb.entries == 0 || ts > b.MaxTime {
+		b.MaxTime = ts
+	}
+
+	if _, ok := bb.hosts[e.QHost]; !ok {
+		bb.hosts[e.QHost] = struct{}{}
+		bb.dataSize += len(e.QHost) + indexHostOverhead
+	}
+
+	c := qLogBlockClient{ID: e.ClientID, IP: e.IP.String()}
+	if _, ok := bb.clients[c]; !ok {
+		bb.clients[c] = struct{}{}
+		bb.dataSize += len(c.ID) + len(c.IP) + indexClientOverhead
+	}
+
+	b.Results |= resultBit(e.Result.Reason, e.Result.IsFiltered)
+	b.Ratelimited = b.Ratelimited || e.Ratelimited
+	b.End += int64(lineLen)
+
+	bb.entries++
+}
+
+// isFull returns true if no more entries should be added to the block.
+func (bb *blockBuilder) isFull() (ok bool) {
+	return bb.entries >= indexBlockMaxEntries || bb.dataSize >= indexBlockMaxDataSize
+}
+
+// isEmpty returns true if the block has no entries.
+func (bb *blockBuilder) isEmpty() (ok bool) {
+	return bb.entries == 0
+}
+
+// finish returns the built block.
+func (bb *blockBuilder) finish() (b *qLogBlock) {
+	b = bb.block
+
+	b.Hosts = make([]string, 0, len(bb.hosts))
+	for h := range bb.hosts {
+		b.Hosts = append(b.Hosts, h)
+	}
+
+	sort.Strings(b.Hosts)
+
+	b.Clients = make([]qLogBlockClient, 0, len(bb.clients))
+	for c := range bb.clients {
+		b.Clients = append(b.Clients, c)
+	}
+
+	sort.Slice(b.Clients, func(i, j int) (less bool) {
+		ci, cj := b.Clients[i], b.Clients[j]
+		if ci.IP != cj.IP {
+			return ci.IP < cj.IP
+		}
+
+		return ci.ID < cj.ID
+	})
+
+	return b
+}
+
+// buildBlocks returns the blocks describing entries written at offset start.
+// lineLens are the lengths of the lines of entries.
+func buildBlocks(entries []*logEntry, lineLens []int, start int64) (blocks []*qLogBlock) {
+	bb := newBlockBuilder(start)
+	for i, e := range entries {
+		bb.add(e, lineLens[i])
+		if bb.isFull() {
+			blocks = append(blocks, bb.finish())
+			bb = newBlockBuilder(bb.block.End)
+		}
+	}
+
+	if !bb.isEmpty() {
+		blocks = append(blocks, bb.finish())
+	}
+
+	return blocks
+}
+
+// writeBlocks writes the encoded blocks to w.
+func writeBlocks(w io.Writer, blocks []*qLogBlock) (err error) {
+	enc := json.NewEncoder(w)
+	for _, b := range blocks {
+		err = enc.Encode(b)
+		if err != nil {
+			return fmt.Errorf("encoding block: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// updateIndexLocked appends the blocks describing the entries written to the
+// current log file at offset start to its index.  lineLens are the lengths of
+// the lines of entries.  If the index doesn't cover the file up to start, it's
+// rebuilt instead.  l.fileWriteLock is expected to be locked.
+func (l *queryLog) updateIndexLocked(entries []*logEntry, lineLens []int, start int64) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if start == 0 {
+		flags |= os.O_TRUNC
+	} else if l.indexEnd != start {
+		log.Debug("querylog: index of %q is stale", l.logFile)
+		l.rebuildIndexesAsync(l.logFile)
+
+		return
+	}
+
+	idxPath := indexPath(l.logFile)
+	err := func() (err error) {
+		f, err := os.OpenFile(idxPath, flags, 0o644)
+		if err != nil {
+			return err
+		}
+		defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+		return writeBlocks(f, buildBlocks(entries, lineLens, start))
+	}()
+	if err != nil {
+		log.Error("querylog: writing index %q: %s", idxPath, err)
+		l.indexEnd = -1
+
+		return
+	}
+
+	l.indexEnd = start
+	for _, n := range lineLens {
+		l.indexEnd += int64(n)
+	}
+}
+
+// checkIndexes rebuilds the missing or corrupted indexes of the log files.  It
+// is intended to be used as a goroutine.
+func (l *queryLog) checkIndexes() {
+	defer log.OnPanic("querylog: checking indexes")
+
+	var toRebuild []string
+	for _, logPath := range l.logFiles() {
+		ok, err := l.checkIndex(logPath)
+		if err != nil {
+			log.Info("querylog: index of %q is invalid, rebuilding: %s", logPath, err)
+		}
+
+		if !ok {
+			toRebuild = append(toRebuild, logPath)
+		}
+	}
+
+	if len(toRebuild) > 0 {
+		l.rebuildIndexesAsync(toRebuild...)
+	}
+}
+
+// checkIndex returns true if the index of the log file exists and covers the
+// whole file.  ok is true if there is no log file.
+func (l *queryLog) checkIndex(logPath string) (ok bool, err error) {
+	end, err := validateIndex(indexPath(logPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			_, err = os.Stat(logPath)
+			if errors.Is(err, os.ErrNotExist) {
+				return true, nil
+			}
+		}
+
+		return false, err
+	}
+
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	size, err := logFileSize(logPath)
+	if err != nil {
+		return false, err
+	} else if size != end {
+		return false, fmt.Errorf("index covers %d bytes of %d", end, size)
+	}
+
+	if logPath == l.logFile {
+		l.indexEnd = end
+	}
+
+	return true, nil
+}
+
+// logFileSize returns the size of the uncompressed data of the log file.
+func logFileSize(logPath string) (size int64, err error) {
+	f, err := openLogFile(logPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// validateIndex checks that the blocks in the index file are contiguous and
+// returns the end of the last one.
+func validateIndex(idxPath string) (end int64, err error) {
+	f, err := os.Open(idxPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		b := &qLogBlock{}
+		err = dec.Decode(b)
+		if errors.Is(err, io.EOF) {
+			return end, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("decoding block: %w", err)
+		}
+
+		if b.Start != end || b.End <= b.Start {
+			return 0, fmt.Errorf("block [%d, %d) is not contiguous with %d", b.Start, b.End, end)
+		}
+
+		end = b.End
+	}
+}
+
+// rebuildIndexesAsync rebuilds the indexes of the log files in a separate
+// goroutine, unless a rebuild is already in progress.
+func (l *queryLog) rebuildIndexesAsync(logPaths ...string) {
+	if !l.indexRebuilding.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer log.OnPanic("querylog: rebuilding indexes")
+		defer l.indexRebuilding.Store(false)
+
+		for _, logPath := range logPaths {
+			err := l.rebuildIndex(logPath)
+			if err != nil {
+				log.Error("querylog: rebuilding index of %q: %s", logPath, err)
+			}
+		}
+	}()
+}
+
+// rebuildIndex builds the index of the log file from scratch.  Most of the
+// current log file is read without locking l.fileWriteLock, only the entries
+// added in the meantime are read under it.
+func (l *queryLog) rebuildIndex(logPath string) (err error) {
+	// Prevent the rotation from renaming the file and the index.
+	l.rotateLock.Lock()
+	defer l.rotateLock.Unlock()
+
+	idxPath := indexPath(logPath)
+
+	f, err := openLogFile(logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// Remove the index of the missing file, if any.
+		err = os.Remove(idxPath)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+
+		return err
+	} else if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	start := time.Now()
+
+	idx, err := aghrenameio.NewPendingFile(idxPath, 0o644)
+	if err != nil {
+		return err
+	}
+
+	s := &indexScanner{
+		r:  bufio.NewReader(f),
+		bb: newBlockBuilder(0),
+		w:  idx,
+	}
+
+	err = s.scan()
+	if err == nil {
+		if logPath == l.logFile {
+			err = l.finishCurrentIndex(f, s, idx)
+		} else {
+			// The rotated files aren't modified.
+			err = s.finish()
+			if err == nil {
+				err = idx.CloseReplace()
+			}
+		}
+	}
+
+	if err != nil {
+		return errors.WithDeferred(err, idx.Cleanup())
+	}
+
+	log.Debug("querylog: rebuilt index of %q in %s", logPath, time.Since(start))
+
+	return nil
+}
+
+// finishCurrentIndex indexes the entries added to the current log file f since
+// s has been started and replaces the index with idx.
+func (l *queryLog) finishCurrentIndex(
+	f logFileReader,
+	s *indexScanner,
+	idx aghrenameio.PendingFile,
+) (err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	cur, err := os.Stat(l.logFile)
+	if err != nil {
+		return err
+	} else if !os.SameFile(fi, cur) {
+		return fmt.Errorf("file %q has been replaced during the rebuild", l.logFile)
+	}
+
+	// Read the rest of the file, including the line partially read before.
+	_, err = f.Seek(s.bb.block.End, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	s.r.Reset(f)
+	err = s.scan()
+	if err != nil {
+		return err
+	}
+
+	err = s.finish()
+	if err != nil {
+		return err
+	}
+
+	// Replace the index under the lock, so that the entries flushed after
+	// that are appended to the new index.
+	err = idx.CloseReplace()
+	if err != nil {
+		return err
+	}
+
+	l.indexEnd = s.bb.block.End
+
+	return nil
+}
+
+// indexScanner reads the log entries and writes the blocks describing them.
+type indexScanner struct {
+	// r is the reader of the log file.
+	r *bufio.Reader
+
+	// bb is the builder of the current block.
+	bb *blockBuilder
+
+	// w is the writer of the index.
+	w io.Writer
+}
+
+// scan reads the complete lines until the end of the log file and writes the
+// complete blocks.
+func (s *indexScanner) scan() (err error) {
+	for {
+		var line []byte
+		line, err = s.r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Don't add the incomplete line, it will be read again.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading log: %w", err)
+		}
+
+		e := &logEntry{}
+		decodeLogEntry(e, string(line[:len(line)-1]))
+		s.bb.add(e, len(line))
+
+		if !s.bb.isFull() {
+			continue
+		}
+
+		err = writeBlocks(s.w, []*qLogBlock{s.bb.finish()})
+		if err != nil {
+			return err
+		}
+
+		s.bb = newBlockBuilder(s.bb.block.End)
+	}
+}
+
+// finish writes the last incomplete block, if any.
+func (s *indexScanner) finish() (err error) {
+	if s.bb.isEmpty() {
+		return nil
+	}
+
+	return writeBlocks(s.w, []*qLogBlock{s.bb.finish()})
+}
+
+// qLogIndex reads the blocks of a query log file index in the reverse order,
+// in step with the reading of the file.
+type qLogIndex struct {
+	// file is the index file.
+	file *qLogFile
+
+	// cur is the last read block.  It is nil if no blocks have been read since
+	// the last reset.
+	cur *qLogBlock
+
+	// done is true if there are no more blocks to read.
+	done bool
+}
+
+// openQLogIndex opens the index of the query log file.
+func openQLogIndex(logPath string) (idx *qLogIndex, err error) {
+	f, err := newQLogFile(indexPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+
+	idx = &qLogIndex{
+		file: f,
+	}
+
+	err = idx.reset()
+	if err != nil {
+		return nil, errors.WithDeferred(err, f.Close())
+	}
+
+	return idx, nil
+}
+
+// reset makes the index start reading the blocks from the newest one again.
+func (idx *qLogIndex) reset() (err error) {
+	idx.cur = nil
+	idx.done = false
+
+	_, err = idx.file.SeekStart()
+
+	return err
+}
+
+// blockEndingAt returns the block that ends at the end offset of the query log
+// file, if any.  end must not increase between the calls unless the index is
+// reset.
+func (idx *qLogIndex) blockEndingAt(end int64) (b *qLogBlock, err error) {
+	for !idx.done {
+		cur := idx.cur
+		if cur != nil && (cur.End <= end || cur.Start < end) {
+			// Either the block is found or end is inside the block or after
+			// all blocks.
+			break
+		}
+
+		var line string
+		line, err = idx.file.ReadNext()
+		if errors.Is(err, io.EOF) {
+			idx.done = true
+
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading block: %w", err)
+		}
+
+		b = &qLogBlock{}
+		err = json.Unmarshal([]byte(line), b)
+		if err != nil {
+			return nil, fmt.Errorf("decoding block: %w", err)
+		}
+
+		if cur != nil && b.End != cur.Start {
+			return nil, fmt.Errorf("block [%d, %d) is not contiguous with %d", b.Start, b.End, cur.Start)
+		}
+
+		idx.cur = b
+	}
+
+	if idx.cur != nil && idx.cur.End == end {
+		return idx.cur, nil
+	}
+
+	return nil, nil
+}
+
+// Close closes the index file.
+func (idx *qLogIndex) Close() (err error) {
+	return idx.file.Close()
+}
@@ -0,0 +1,208 @@
+package querylog
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestIndexedQueryLog returns a query log with three index blocks in the
+// current file, each containing a single host and a single client.
+func newTestIndexedQueryLog(t *testing.T) (l *queryLog) {
+	t.Helper()
+
+	l, err := newQueryLog(Config{
+		Anonymizer:  aghnet.NewIPMut(nil),
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     3 * indexBlockMaxEntries,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	for i, host := range []string{"a.example.org", "b.example.org", "c.example.com"} {
+		client := net.IPv4(2, 2, 2, byte(i+1))
+		for j := 0; j < indexBlockMaxEntries; j++ {
+			addEntry(l, host, net.IPv4(1, 1, 1, 1), client)
+		}
+	}
+
+	require.NoError(t, l.flushLogBuffer())
+
+	return l
+}
+
+func TestQueryLog_index(t *testing.T) {
+	l := newTestIndexedQueryLog(t)
+
+	fi, err := os.Stat(l.logFile)
+	require.NoError(t, err)
+
+	end, err := validateIndex(indexPath(l.logFile))
+	require.NoError(t, err)
+
+	assert.Equal(t, fi.Size(), end)
+	assert.Equal(t, end, l.indexEnd)
+
+	testCases := []struct {
+		name      string
+		sCr       []searchCriterion
+		wantNum   int
+		wantTotal int
+	}{{
+		name: "host_strict",
+		sCr: []searchCriterion{{
+			criterionType: ctTerm,
+			strict:        true,
+			value:         "b.example.org",
+		}},
+		wantNum:   indexBlockMaxEntries,
+		wantTotal: indexBlockMaxEntries,
+	}, {
+		name: "host_non-strict",
+		sCr: []searchCriterion{{
+			criterionType: ctTerm,
+			value:         "example.org",
+		}},
+		wantNum:   2 * indexBlockMaxEntries,
+		wantTotal: 2 * indexBlockMaxEntries,
+	}, {
+		name: "client",
+		sCr: []searchCriterion{{
+			criterionType: ctTerm,
+			strict:        true,
+			value:         "2.2.2.1",
+		}},
+		wantNum:   indexBlockMaxEntries,
+		wantTotal: indexBlockMaxEntries,
+	}, {
+		name: "no_match",
+		sCr: []searchCriterion{{
+			criterionType: ctTerm,
+			value:         "example.net",
+		}},
+		wantNum:   0,
+		wantTotal: 0,
+	}, {
+		name: "status_match",
+		sCr: []searchCriterion{{
+			criterionType: ctFilteringStatus,
+			value:         filteringStatusRewritten,
+		}},
+		wantNum:   3 * indexBlockMaxEntries,
+		wantTotal: 3 * indexBlockMaxEntries,
+	}, {
+		name: "status_no_match",
+		sCr: []searchCriterion{{
+			criterionType: ctFilteringStatus,
+			value:         filteringStatusWhitelisted,
+		}},
+		wantNum:   0,
+		wantTotal: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := newSearchParams()
+			params.limit = 3 * indexBlockMaxEntries
+			params.searchCriteria = tc.sCr
+
+			entries, _, total := l.searchFiles(params, clientCache{})
+			assert.Len(t, entries, tc.wantNum)
+			assert.Equal(t, tc.wantTotal, total)
+		})
+	}
+}
+
+func TestQueryLog_rebuildIndex(t *testing.T) {
+	l := newTestIndexedQueryLog(t)
+
+	idxPath := indexPath(l.logFile)
+	want, err := os.ReadFile(idxPath)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		corrupt func(t *testing.T)
+		name    string
+	}{{
+		corrupt: func(t *testing.T) {
+			require.NoError(t, os.Remove(idxPath))
+		},
+		name: "missing",
+	}, {
+		corrupt: func(t *testing.T) {
+			require.NoError(t, os.WriteFile(idxPath, []byte("{bad json\n"), 0o644))
+		},
+		name: "corrupted",
+	}, {
+		corrupt: func(t *testing.T) {
+			require.NoError(t, os.Truncate(idxPath, int64(len(want)/2)))
+		},
+		name: "truncated",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.corrupt(t)
+
+			ok, _ := l.checkIndex(l.logFile)
+			require.False(t, ok)
+
+			require.NoError(t, l.rebuildIndex(l.logFile))
+
+			ok, err = l.checkIndex(l.logFile)
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			got, rErr := os.ReadFile(idxPath)
+			require.NoError(t, rErr)
+
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+}
+
+func TestQueryLog_rotate_index(t *testing.T) {
+	l := newTestIndexedQueryLog(t)
+
+	require.NoError(t, l.rotate())
+
+	_, err := os.Stat(indexPath(l.logFile))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	ok, err := l.checkIndex(l.logFile + ".1")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	addEntry(l, "d.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 4))
+	require.NoError(t, l.flushLogBuffer())
+
+	ok, err = l.checkIndex(l.logFile)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	params := newSearchParams()
+	params.searchCriteria = []searchCriterion{{
+		criterionType: ctTerm,
+		value:         "d.example.org",
+	}}
+
+	entries, _, total := l.searchFiles(params, clientCache{})
+	require.Len(t, entries, 1)
+
+	assert.Equal(t, "d.example.org", entries[0].QHost)
+	assert.Equal(t, 1, total)
+}
+
+func TestResultBit(t *testing.T) {
+	assert.Equal(t, uint64(1), resultBit(filtering.NotFilteredNotFound, false))
+	assert.Equal(t, uint64(1<<3), resultBit(filtering.NotFilteredAllowList, true))
+	assert.Equal(t, ^uint64(0), resultBit(filtering.Reason(100), false))
+}
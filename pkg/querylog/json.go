@@ -92,6 +92,14 @@ func entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (jsonEntry jobject)
 		}
 	}
 
+	if entry.DNSSECStatus != DNSSECStatusNone {
+		jsonEntry["dnssec_status"] = entry.DNSSECStatus
+	}
+
+	if entry.Ratelimited {
+		jsonEntry["ratelimited"] = true
+	}
+
 	if len(entry.Result.ServiceName) != 0 {
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
@@ -3,8 +3,8 @@ package querylog
 
 import (
 	"fmt"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -29,9 +29,27 @@ type queryLog struct {
 
 	findClient func(ids []string) (c *Client, err error)
 
+	// stream sends the new entries to the subscribers of the live query log.
+	stream *streamer
+
+	// syslog sends the new entries to the syslog server.  It is nil if the
+	// syslog sink is disabled.
+	syslog *syslogSink
+
 	// logFile is the path to the log file.
 	logFile string
 
+	// rotatedFiles is the number of the rotated log files kept.  It's always
+	// positive.
+	rotatedFiles int
+
+	// maxSize is the maximum total size of the log files and their indexes in
+	// bytes.  If it's zero, the size isn't limited.
+	maxSize uint64
+
+	// compress, if true, means that the rotated log files are compressed.
+	compress bool
+
 	// buffer contains recent log entries.  The entries in this buffer must not
 	// be modified.
 	buffer []*logEntry
@@ -43,6 +61,17 @@ type queryLog struct {
 	fileFlushLock sync.Mutex
 	fileWriteLock sync.Mutex
 
+	// rotateLock serializes the rotations and the other changes of the set of
+	// the log files.  It must be locked before fileWriteLock.
+	rotateLock sync.Mutex
+
+	// indexEnd is the offset in the current log file up to which its index
+	// covers it or -1 if that's unknown.  It's protected by fileWriteLock.
+	indexEnd int64
+
+	// indexRebuilding is true while the indexes are being rebuilt.
+	indexRebuilding atomic.Bool
+
 	flushPending bool
 }
 
@@ -58,6 +87,41 @@ const (
 	ClientProtoPlain    ClientProto = ""
 )
 
+// DNSSECStatus is the result of the local DNSSEC validation of a response.
+type DNSSECStatus string
+
+// DNSSEC validation statuses.
+const (
+	// DNSSECStatusNone means that the response hasn't been validated.
+	DNSSECStatusNone DNSSECStatus = ""
+
+	// DNSSECStatusSecure means that the response has been validated using the
+	// chain of trust from a trust anchor.
+	DNSSECStatusSecure DNSSECStatus = "secure"
+
+	// DNSSECStatusInsecure means that the response is proven to belong to an
+	// unsigned zone or isn't covered by any trust anchor.
+	DNSSECStatusInsecure DNSSECStatus = "insecure"
+
+	// DNSSECStatusBogus means that the response has failed the validation.
+	DNSSECStatusBogus DNSSECStatus = "bogus"
+)
+
+// NewDNSSECStatus validates that the DNSSEC status is valid and returns it as
+// a DNSSECStatus.
+func NewDNSSECStatus(s string) (st DNSSECStatus, err error) {
+	switch st = DNSSECStatus(s); st {
+	case
+		DNSSECStatusNone,
+		DNSSECStatusSecure,
+		DNSSECStatusInsecure,
+		DNSSECStatusBogus:
+		return st, nil
+	default:
+		return "", fmt.Errorf("invalid dnssec status %q", s)
+	}
+}
+
 // NewClientProto validates that the client protocol name is valid and returns
 // the name as a ClientProto.
 func NewClientProto(s string) (cp ClientProto, err error) {
@@ -81,6 +145,11 @@ func (l *queryLog) Start() {
 	}
 
 	go l.periodicRotate()
+	go l.checkIndexes()
+
+	if l.syslog != nil {
+		l.syslog.start()
+	}
 }
 
 func (l *queryLog) Close() {
@@ -93,6 +162,10 @@ func (l *queryLog) Close() {
 			log.Error("querylog: closing: %s", err)
 		}
 	}
+
+	if l.syslog != nil {
+		l.syslog.close()
+	}
 }
 
 func checkInterval(ivl time.Duration) (ok bool) {
@@ -142,17 +215,21 @@ func (l *queryLog) clear() {
 		l.flushPending = false
 	}()
 
-	oldLogFile := l.logFile + ".1"
-	err := os.Remove(oldLogFile)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("removing old log file %q: %s", oldLogFile, err)
-	}
+	l.rotateLock.Lock()
+	defer l.rotateLock.Unlock()
+
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
 
-	err = os.Remove(l.logFile)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("removing log file %q: %s", l.logFile, err)
+	// Also remove the files left after decreasing the number of rotated files.
+	for n := 1; n <= l.rotatedFiles || existingLogFile(l.rotatedPath(n)) != ""; n++ {
+		removeLogFile(l.rotatedPath(n))
 	}
 
+	removeLogFile(l.logFile)
+
+	l.indexEnd = 0
+
 	log.Debug("querylog: cleared")
 }
 
@@ -180,6 +257,8 @@ func newLogEntry(params *AddParams) (entry *logEntry) {
 
 		Cached:            params.Cached,
 		AuthenticatedData: params.AuthenticatedData,
+		DNSSECStatus:      params.DNSSECStatus,
+		Ratelimited:       params.Ratelimited,
 	}
 
 	if params.ReqECS != nil {
@@ -246,6 +325,12 @@ func (l *queryLog) Add(params *AddParams) {
 		}
 	}()
 
+	l.stream.publish(entry)
+
+	if l.syslog != nil {
+		l.syslog.emit(entry)
+	}
+
 	if needFlush {
 		go func() {
 			flushErr := l.flushLogBuffer()
@@ -3,6 +3,7 @@ package querylog
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 	"sync"
@@ -28,6 +29,31 @@ const (
 	bufferSize = 100 * maxEntrySize
 )
 
+// logFileReader is a query log file opened for reading.  The offsets and the
+// size are those of the uncompressed data, even if the file is compressed.
+type logFileReader interface {
+	io.ReadSeekCloser
+
+	// Name returns the name of the file.
+	Name() (name string)
+
+	// Stat returns the information about the file.
+	Stat() (fi fs.FileInfo, err error)
+}
+
+// type check
+var _ logFileReader = (*os.File)(nil)
+
+// openLogFile opens the query log file at path for reading, decompressing it if
+// necessary.
+func openLogFile(path string) (f logFileReader, err error) {
+	if strings.HasSuffix(path, compressedFileExt) {
+		return openGzipFile(path)
+	}
+
+	return os.Open(path)
+}
+
 // qLogFile represents a single query log file.  It allows reading from the
 // file in the reverse order.
 //
@@ -36,7 +62,14 @@ const (
 // order starting from that position.
 type qLogFile struct {
 	// file is the query log file.
-	file *os.File
+	file logFileReader
+
+	// index is the index of the file.  It is nil if the index isn't used.
+	index *qLogIndex
+
+	// blockMatch returns true if the block of the file may contain the
+	// entries being searched for.  It must not be nil if index isn't nil.
+	blockMatch func(b *qLogBlock) (ok bool)
 
 	// buffer that we've read from the file.
 	buffer []byte
@@ -56,7 +89,7 @@ type qLogFile struct {
 
 // newQLogFile initializes a new instance of the qLogFile.
 func newQLogFile(path string) (qf *qLogFile, err error) {
-	f, err := os.OpenFile(path, os.O_RDONLY, 0o644)
+	f, err := openLogFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -191,6 +224,8 @@ func (q *qLogFile) seekTS(timestamp int64) (pos int64, depth int, err error) {
 	}
 
 	q.position = lineIdx + int64(len(line))
+	q.resetIndex()
+
 	return q.position, depth, nil
 }
 
@@ -219,6 +254,8 @@ func (q *qLogFile) SeekStart() (int64, error) {
 		q.position = 0
 	}
 
+	q.resetIndex()
+
 	return q.position, nil
 }
 
@@ -230,6 +267,8 @@ func (q *qLogFile) ReadNext() (string, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	q.skipBlocks()
+
 	if q.position == 0 {
 		return "", io.EOF
 	}
@@ -250,9 +289,69 @@ func (q *qLogFile) ReadNext() (string, error) {
 	return line, err
 }
 
+// setIndex makes q skip the blocks of the file described by idx, for which
+// match returns false.
+func (q *qLogFile) setIndex(idx *qLogIndex, match func(b *qLogBlock) (ok bool)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.index, q.blockMatch = idx, match
+}
+
+// resetIndex resets the index, if any, after the position is changed not by
+// reading.  If the index can't be reset, it's not used anymore.  q.lock is
+// expected to be locked.
+func (q *qLogFile) resetIndex() {
+	if q.index == nil {
+		return
+	}
+
+	err := q.index.reset()
+	if err != nil {
+		q.dropIndex(err)
+	}
+}
+
+// skipBlocks moves the position over the blocks that end at it and don't match
+// the search.  q.lock is expected to be locked.
+func (q *qLogFile) skipBlocks() {
+	for q.index != nil && q.position > 0 {
+		// The position points at the line break ending the next line.
+		b, err := q.index.blockEndingAt(q.position + 1)
+		if err != nil {
+			q.dropIndex(err)
+
+			return
+		}
+
+		if b == nil || q.blockMatch(b) {
+			return
+		}
+
+		q.position = max(b.Start-1, 0)
+	}
+}
+
+// dropIndex closes the index, which can't be used because of err, and stops
+// using it.  q.lock is expected to be locked.
+func (q *qLogFile) dropIndex(err error) {
+	log.Debug("querylog: index of %q: %s", q.file.Name(), err)
+
+	err = q.index.Close()
+	if err != nil {
+		log.Debug("querylog: closing index of %q: %s", q.file.Name(), err)
+	}
+
+	q.index, q.blockMatch = nil, nil
+}
+
 // Close frees the underlying resources.
-func (q *qLogFile) Close() error {
-	return q.file.Close()
+func (q *qLogFile) Close() (err error) {
+	if q.index != nil {
+		err = q.index.Close()
+	}
+
+	return errors.WithDeferred(q.file.Close(), err)
 }
 
 // readNextLine reads the next line from the specified position.  This line
@@ -145,6 +145,21 @@ func (r *qLogReader) ReadNext() (string, error) {
 	return "", io.EOF
 }
 
+// useIndexes makes the reader skip the blocks of the files, for which match
+// returns false, using the files' indexes, if they exist.
+func (r *qLogReader) useIndexes(match func(b *qLogBlock) (ok bool)) {
+	for _, q := range r.qFiles {
+		idx, err := openQLogIndex(q.file.Name())
+		if err != nil {
+			log.Debug("querylog: opening index of %q: %s", q.file.Name(), err)
+
+			continue
+		}
+
+		q.setIndex(idx, match)
+	}
+}
+
 // Close closes the qLogReader.
 func (r *qLogReader) Close() error {
 	return closeQFiles(r.qFiles)
@@ -1,6 +1,7 @@
 package querylog
 
 import (
+	"crypto/x509"
 	"fmt"
 	"net"
 	"path/filepath"
@@ -52,14 +53,33 @@ type Config struct {
 	// FindClient returns client information by their IDs.
 	FindClient func(ids []string) (c *Client, err error)
 
+	// Syslog is the configuration of the syslog sink.  If it's nil or not
+	// enabled, the log entries aren't sent to a syslog server.  The entries
+	// are sent regardless of FileEnabled.
+	Syslog *SyslogConfig
+
+	// SyslogRootCAs are the root CAs used to verify the certificate of the
+	// syslog server.  If it's nil, the system ones are used.
+	SyslogRootCAs *x509.CertPool
+
 	// BaseDir is the base directory for log files.
 	BaseDir string
 
-	// RotationIvl is the interval for log rotation.  After that period, the old
-	// log file will be renamed, NOT deleted, so the actual log retention time
-	// is twice the interval.
+	// RotationIvl is the interval for log rotation.  After that period, the
+	// current log file is renamed and kept along with RotatedFiles previous
+	// ones, so the actual log retention time is RotatedFiles + 1 intervals,
+	// unless MaxSize is exceeded earlier.
 	RotationIvl time.Duration
 
+	// RotatedFiles is the number of the rotated log files to keep.  Zero is
+	// treated as one.
+	RotatedFiles uint
+
+	// MaxSize is the maximum total size of the log files, including the
+	// rotated ones, in bytes.  When it's exceeded, the oldest files are
+	// removed.  If it's zero, the size isn't limited.
+	MaxSize uint64
+
 	// MemSize is the number of entries kept in a memory buffer before they are
 	// flushed to disk.
 	MemSize uint32
@@ -73,6 +93,9 @@ type Config struct {
 	// AnonymizeClientIP tells if the query log should anonymize clients' IP
 	// addresses.
 	AnonymizeClientIP bool
+
+	// Compress tells if the rotated log files should be compressed with gzip.
+	Compress bool
 }
 
 // AddParams is the parameters for adding an entry.
@@ -110,6 +133,13 @@ type AddParams struct {
 
 	// AuthenticatedData shows if the response had the AD bit set.
 	AuthenticatedData bool
+
+	// DNSSECStatus is the result of the local DNSSEC validation of the
+	// response, if it has been validated.
+	DNSSECStatus DNSSECStatus
+
+	// Ratelimited shows if the request has exceeded the rate limit.
+	Ratelimited bool
 }
 
 // validate returns an error if the parameters aren't valid.
@@ -150,8 +180,17 @@ func newQueryLog(conf Config) (l *queryLog, err error) {
 		logFile: filepath.Join(conf.BaseDir, queryLogFileName),
 
 		anonymizer: conf.Anonymizer,
+
+		stream: newStreamer(),
+
+		rotatedFiles: int(max(conf.RotatedFiles, 1)),
+		maxSize:      conf.MaxSize,
+		compress:     conf.Compress,
+
+		indexEnd: -1,
 	}
 
+	conf.RotatedFiles = uint(l.rotatedFiles)
 	*l.conf = conf
 
 	err = validateIvl(conf.RotationIvl)
@@ -159,5 +198,14 @@ func newQueryLog(conf Config) (l *queryLog, err error) {
 		return nil, fmt.Errorf("unsupported interval: %w", err)
 	}
 
+	err = conf.Syslog.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("syslog: %w", err)
+	}
+
+	if conf.Syslog != nil && conf.Syslog.Enabled {
+		l.syslog = newSyslogSink(conf.Syslog, conf.SyslogRootCAs, conf.Anonymizer)
+	}
+
 	return l, nil
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -28,8 +30,13 @@ func (l *queryLog) flushLogBuffer() (err error) {
 	}()
 
 	err = l.flushToFile(flushBuffer)
+	if err != nil {
+		return fmt.Errorf("writing to file: %w", err)
+	}
 
-	return errors.Annotate(err, "writing to file: %w")
+	l.enforceMaxSize()
+
+	return nil
 }
 
 // flushToFile saves the specified log entries to the query log file
@@ -44,13 +51,17 @@ func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
 
 	var b bytes.Buffer
 	e := json.NewEncoder(&b)
+	lineLens := make([]int, 0, len(buffer))
 	for _, entry := range buffer {
+		prevLen := b.Len()
 		err = e.Encode(entry)
 		if err != nil {
 			log.Error("Failed to marshal entry: %s", err)
 
 			return err
 		}
+
+		lineLens = append(lineLens, b.Len()-prevLen)
 	}
 
 	elapsed := time.Since(start)
@@ -69,6 +80,11 @@ func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
 	}
 	defer func() { err = errors.WithDeferred(err, f.Close()) }()
 
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
 	n, err := f.Write(zb.Bytes())
 	if err != nil {
 		log.Error("Couldn't write to file: %s", err)
@@ -77,29 +93,261 @@ func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
 
 	log.Debug("querylog: ok \"%s\": %v bytes written", filename, n)
 
+	l.updateIndexLocked(buffer, lineLens, fi.Size())
+
+	return nil
+}
+
+// rotate renames the current log file into the first rotated one, shifting the
+// older ones and removing the oldest, and compresses the rotated files if
+// needed.
+func (l *queryLog) rotate() (err error) {
+	l.rotateLock.Lock()
+	defer l.rotateLock.Unlock()
+
+	return l.rotateLocked()
+}
+
+// rotateLocked is the implementation of [queryLog.rotate].  l.rotateLock is
+// expected to be locked.
+func (l *queryLog) rotateLocked() (err error) {
+	ok, err := l.shiftFiles()
+	if err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	if l.compress {
+		// Compress outside of l.fileWriteLock, since it may take a while.
+		l.compressRotated()
+	}
+
 	return nil
 }
 
-func (l *queryLog) rotate() error {
-	from := l.logFile
-	to := l.logFile + ".1"
+// shiftFiles renames the current log file into the first rotated one, shifting
+// the older ones.  The files that are older than the number of rotated files
+// kept are removed.  ok is false if there is no current log file.
+func (l *queryLog) shiftFiles() (ok bool, err error) {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
 
-	err := os.Rename(from, to)
+	_, err = os.Stat(l.logFile)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			log.Debug("querylog: no log to rotate")
 
-			return nil
+			return false, nil
+		}
+
+		return false, fmt.Errorf("checking current file: %w", err)
+	}
+
+	// Also remove the files left after decreasing the number of rotated files.
+	for n := l.rotatedFiles; existingLogFile(l.rotatedPath(n)) != ""; n++ {
+		removeLogFile(l.rotatedPath(n))
+	}
+
+	for n := l.rotatedFiles - 1; n > 0; n-- {
+		from := existingLogFile(l.rotatedPath(n))
+		if from == "" {
+			continue
 		}
 
-		return fmt.Errorf("failed to rename old file: %w", err)
+		// Keep the compression extension, if any.
+		to := l.rotatedPath(n+1) + strings.TrimPrefix(from, l.rotatedPath(n))
+		err = renameLogFile(from, to)
+		if err != nil {
+			return false, fmt.Errorf("shifting rotated file: %w", err)
+		}
+	}
+
+	from, to := l.logFile, l.rotatedPath(1)
+	err = renameLogFile(from, to)
+	if err != nil {
+		return false, fmt.Errorf("failed to rename old file: %w", err)
 	}
 
 	log.Debug("querylog: renamed %s into %s", from, to)
 
+	l.indexEnd = 0
+
+	return true, nil
+}
+
+// compressRotated compresses the uncompressed rotated log files.  l.rotateLock
+// is expected to be locked.
+func (l *queryLog) compressRotated() {
+	for n := 1; n <= l.rotatedFiles; n++ {
+		p := l.rotatedPath(n)
+		_, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+
+		start := time.Now()
+		err = compressLogFile(p)
+		if err != nil {
+			log.Error("querylog: compressing %q: %s", p, err)
+
+			continue
+		}
+
+		log.Debug("querylog: compressed %q in %s", p, time.Since(start))
+	}
+}
+
+// compressLogFile replaces the uncompressed rotated log file at p with the
+// compressed one.
+func compressLogFile(p string) (err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+
+	dst := p + compressedFileExt
+	err = writeGzipFile(dst, f)
+	err = errors.WithDeferred(err, f.Close())
+	if err != nil {
+		return err
+	}
+
+	// The offsets in the index are the offsets in the uncompressed data, so
+	// the index is still valid.
+	err = renameIndex(p, dst)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
+
+// enforceMaxSize removes the oldest log files until the total size of the log
+// files and their indexes fits the maximum size.  If the current log file alone
+// doesn't fit, it's rotated first.
+func (l *queryLog) enforceMaxSize() {
+	if l.maxSize == 0 {
+		return
+	}
+
+	l.rotateLock.Lock()
+	defer l.rotateLock.Unlock()
+
+	rotated := false
+	for {
+		files := l.logFiles()
+		total := diskSize(files)
+		if total <= l.maxSize {
+			return
+		}
+
+		if len(files) > 1 {
+			oldest := files[0]
+			log.Info("querylog: size %d exceeds %d, removing %q", total, l.maxSize, oldest)
+			removeLogFile(strings.TrimSuffix(oldest, compressedFileExt))
+
+			continue
+		} else if rotated {
+			return
+		}
+
+		err := l.rotateLocked()
+		if err != nil {
+			log.Error("querylog: rotating to fit max size: %s", err)
+
+			return
+		}
+
+		rotated = true
+	}
+}
+
+// rotatedPath returns the path to the n-th rotated log file, without the
+// compression extension.  The first rotated file is the newest one.
+func (l *queryLog) rotatedPath(n int) (p string) {
+	return l.logFile + "." + strconv.Itoa(n)
+}
+
+// logFiles returns the paths to the existing rotated log files, from the oldest
+// to the newest, followed by the path to the current log file, which may not
+// exist.
+func (l *queryLog) logFiles() (paths []string) {
+	for n := l.rotatedFiles; n > 0; n-- {
+		if p := existingLogFile(l.rotatedPath(n)); p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	return append(paths, l.logFile)
+}
+
+// existingLogFile returns the path to the existing log file with the path p,
+// either uncompressed or compressed, or an empty string if there is none.  The
+// uncompressed file is preferred, since the compressed one may be incomplete.
+func existingLogFile(p string) (existing string) {
+	for _, name := range []string{p, p + compressedFileExt} {
+		_, err := os.Stat(name)
+		if err == nil {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// removeLogFile removes the log file with the path p, both uncompressed and
+// compressed, along with its indexes.
+func removeLogFile(p string) {
+	for _, name := range []string{p, p + compressedFileExt} {
+		for _, rm := range []string{name, indexPath(name)} {
+			err := os.Remove(rm)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Error("querylog: removing %q: %s", rm, err)
+			}
+		}
+	}
+}
+
+// renameLogFile renames the log file along with its index.
+func renameLogFile(from, to string) (err error) {
+	err = os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+
+	return renameIndex(from, to)
+}
+
+// renameIndex moves the index of the log file from to the index of the log
+// file to.  If there is no index to move, the stale one is removed.
+func renameIndex(from, to string) (err error) {
+	err = os.Rename(indexPath(from), indexPath(to))
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.Remove(indexPath(to))
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("moving index: %w", err)
+	}
+
 	return nil
 }
 
+// diskSize returns the total size of the log files and their indexes on disk.
+func diskSize(logPaths []string) (total uint64) {
+	for _, p := range logPaths {
+		for _, name := range []string{p, indexPath(p)} {
+			fi, err := os.Stat(name)
+			if err == nil {
+				total += uint64(fi.Size())
+			}
+		}
+	}
+
+	return total
+}
+
 func (l *queryLog) readFileFirstTimeValue() (first time.Time, err error) {
 	var f *os.File
 	f, err = os.Open(l.logFile)
@@ -183,4 +431,6 @@ func (l *queryLog) checkAndRotate() {
 	}
 
 	log.Debug("querylog: rotated successfully")
+
+	l.enforceMaxSize()
 }
@@ -0,0 +1,123 @@
+package querylog
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRotatedQueryLog returns a query log with the current log file and
+// gens rotated ones.  The hosts in the files are "0.example.org" in the oldest
+// one, "1.example.org" in the next one, and so on.
+func newTestRotatedQueryLog(t *testing.T, conf Config, gens int) (l *queryLog) {
+	t.Helper()
+
+	conf.Anonymizer = aghnet.NewIPMut(nil)
+	conf.Enabled = true
+	conf.FileEnabled = true
+	conf.RotationIvl = timeutil.Day
+	conf.MemSize = 100
+	conf.BaseDir = t.TempDir()
+
+	l, err := newQueryLog(conf)
+	require.NoError(t, err)
+
+	for i := 0; i <= gens; i++ {
+		if i > 0 {
+			require.NoError(t, l.rotate())
+		}
+
+		host := fmt.Sprintf("%d.example.org", i)
+		addEntry(l, host, net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, byte(i)))
+		require.NoError(t, l.flushLogBuffer())
+	}
+
+	return l
+}
+
+// searchHosts returns the hosts of all entries in the log files.
+func searchHosts(t *testing.T, l *queryLog) (hosts []string) {
+	t.Helper()
+
+	entries, _, _ := l.searchFiles(newSearchParams(), clientCache{})
+	for _, e := range entries {
+		hosts = append(hosts, e.QHost)
+	}
+
+	return hosts
+}
+
+func TestQueryLog_rotate(t *testing.T) {
+	l := newTestRotatedQueryLog(t, Config{
+		RotatedFiles: 2,
+		Compress:     true,
+	}, 4)
+
+	assert.Equal(t, []string{
+		l.rotatedPath(2) + compressedFileExt,
+		l.rotatedPath(1) + compressedFileExt,
+		l.logFile,
+	}, l.logFiles())
+
+	for _, p := range []string{l.rotatedPath(1), l.rotatedPath(3), l.rotatedPath(3) + compressedFileExt} {
+		_, err := os.Stat(p)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	for _, p := range l.logFiles() {
+		ok, err := l.checkIndex(p)
+		require.NoError(t, err)
+
+		assert.True(t, ok)
+	}
+
+	assert.Equal(t, []string{"4.example.org", "3.example.org", "2.example.org"}, searchHosts(t, l))
+
+	params := newSearchParams()
+	params.searchCriteria = []searchCriterion{{
+		criterionType: ctTerm,
+		strict:        true,
+		value:         "3.example.org",
+	}}
+
+	entries, _, total := l.searchFiles(params, clientCache{})
+	require.Len(t, entries, 1)
+
+	assert.Equal(t, "3.example.org", entries[0].QHost)
+	assert.Equal(t, 1, total)
+
+	t.Run("clear", func(t *testing.T) {
+		l.clear()
+
+		assert.Equal(t, []string{l.logFile}, l.logFiles())
+		assert.Zero(t, diskSize(l.logFiles()))
+	})
+}
+
+func TestQueryLog_enforceMaxSize(t *testing.T) {
+	l := newTestRotatedQueryLog(t, Config{
+		RotatedFiles: 3,
+	}, 3)
+
+	require.Len(t, l.logFiles(), 4)
+
+	// Allow only the current file and the newest rotated one.
+	l.maxSize = diskSize(l.logFiles()[2:])
+	l.enforceMaxSize()
+
+	assert.Equal(t, []string{l.rotatedPath(1), l.logFile}, l.logFiles())
+	assert.Equal(t, []string{"3.example.org", "2.example.org"}, searchHosts(t, l))
+
+	// The current file alone doesn't fit, so it's rotated and removed.
+	l.maxSize = 1
+	l.enforceMaxSize()
+
+	assert.Equal(t, []string{l.logFile}, l.logFiles())
+	assert.Zero(t, diskSize(l.logFiles()))
+}
@@ -136,32 +136,36 @@ func (l *queryLog) search(params *searchParams) (entries []*logEntry, oldest tim
 	return entries, oldest
 }
 
-// seekRecord changes the current position to the next record older than the
-// provided parameter.
+// seekRecord changes the current position to the record with the provided
+// timestamp, if there is one, or to the newest record otherwise.  The records
+// that aren't older than olderThan must be skipped by the caller.
 func (r *qLogReader) seekRecord(olderThan time.Time) (err error) {
 	if olderThan.IsZero() {
 		return r.SeekStart()
 	}
 
 	err = r.seekTS(olderThan.UnixNano())
-	if err == nil {
-		// Read to the next record, because we only need the one that goes
-		// after it.
-		_, err = r.ReadNext()
+	if errors.Is(err, errTSNotFound) {
+		// The timestamp is most probably between two records, so read from
+		// the newest one and let the indexes, if any, skip the newer parts.
+		log.Debug("querylog: seeking to %s: %s, reading from start", olderThan, err)
+
+		return r.SeekStart()
 	}
 
 	return err
 }
 
 // setQLogReader creates a reader with the specified files and sets the
-// position to the next record older than the provided parameter.
-func (l *queryLog) setQLogReader(olderThan time.Time) (qr *qLogReader, err error) {
-	files := []string{
-		l.logFile + ".1",
-		l.logFile,
-	}
-
-	r, err := newQLogReader(files)
+// position to the record with the timestamp params.olderThan or before it.  If
+// the search is bounded, the reader skips the parts of the files that can't
+// match.
+func (l *queryLog) setQLogReader(
+	params *searchParams,
+	cache clientCache,
+) (qr *qLogReader, err error) {
+	olderThan := params.olderThan
+	r, err := newQLogReader(l.logFiles())
 	if err != nil {
 		return nil, fmt.Errorf("opening qlog reader: %s", err)
 	}
@@ -174,6 +178,21 @@ func (l *queryLog) setQLogReader(olderThan time.Time) (qr *qLogReader, err error
 		return nil, nil
 	}
 
+	if params.hasBounds() {
+		f := quickMatchClientFinder{
+			client: l.client,
+			cache:  cache,
+		}
+
+		r.useIndexes(func(b *qLogBlock) (ok bool) {
+			if len(cache) > maxClientCacheSize {
+				clear(cache)
+			}
+
+			return params.blockMatch(b, f.findClient)
+		})
+	}
+
 	return r, nil
 }
 
@@ -199,6 +218,14 @@ func (l *queryLog) readEntries(
 			log.Error("querylog: reading next entry: %s", rErr)
 		}
 
+		if !params.newerThan.IsZero() && ts != 0 && ts < params.newerThan.UnixNano() {
+			// The entries are read from newer to older, so the rest are out of
+			// range.
+			oldestNano = 0
+
+			break
+		}
+
 		oldestNano = ts
 		total++
 
@@ -225,7 +252,7 @@ func (l *queryLog) searchFiles(
 	params *searchParams,
 	cache clientCache,
 ) (entries []*logEntry, oldest time.Time, total int) {
-	r, err := l.setQLogReader(params.olderThan)
+	r, err := l.setQLogReader(params, cache)
 	if err != nil {
 		log.Error("querylog: %s", err)
 	}
@@ -2,10 +2,15 @@ package querylog
 
 import (
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -93,3 +98,227 @@ func TestQueryLog_Search_findClient(t *testing.T) {
 
 	assert.Equal(t, knownClientName, gotClient.Name)
 }
+
+// addCriteriaEntries adds the entries for testing the search criteria to l.
+func addCriteriaEntries(t *testing.T, l *queryLog) {
+	t.Helper()
+
+	testCases := []struct {
+		res      *filtering.Result
+		host     string
+		upstream string
+		proto    ClientProto
+		qtype    uint16
+		rcode    int
+		elapsed  time.Duration
+		cached   bool
+	}{{
+		res: &filtering.Result{
+			Rules:      []*filtering.ResultRule{{FilterListID: 1, Text: "||a.example.org^"}},
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		host:     "a.example.org",
+		upstream: "8.8.8.8:53",
+		proto:    ClientProtoPlain,
+		qtype:    dns.TypeA,
+		rcode:    dns.RcodeSuccess,
+		elapsed:  5 * time.Millisecond,
+		cached:   false,
+	}, {
+		res:      &filtering.Result{},
+		host:     "b.example.org",
+		upstream: "https://dns.google/dns-query",
+		proto:    ClientProtoDoH,
+		qtype:    dns.TypeAAAA,
+		rcode:    dns.RcodeServerFailure,
+		elapsed:  300 * time.Millisecond,
+		cached:   false,
+	}, {
+		res: &filtering.Result{
+			Rules:  []*filtering.ResultRule{{FilterListID: 2, Text: "@@||c.example.net^"}},
+			Reason: filtering.NotFilteredAllowList,
+		},
+		host:     "c.example.net",
+		upstream: "",
+		proto:    ClientProtoDoT,
+		qtype:    dns.TypeA,
+		rcode:    dns.RcodeNameError,
+		elapsed:  time.Millisecond,
+		cached:   true,
+	}}
+
+	for _, tc := range testCases {
+		q := &dns.Msg{}
+		q.SetQuestion(tc.host+".", tc.qtype)
+
+		a := &dns.Msg{}
+		a.SetRcode(q, tc.rcode)
+
+		l.Add(&AddParams{
+			Question:    q,
+			Answer:      a,
+			Result:      tc.res,
+			Upstream:    tc.upstream,
+			ClientProto: tc.proto,
+			ClientIP:    net.IP{1, 2, 3, 4},
+			Elapsed:     tc.elapsed,
+			Cached:      tc.cached,
+		})
+	}
+}
+
+func TestQueryLog_Search_criteria(t *testing.T) {
+	testCases := []struct {
+		query     url.Values
+		name      string
+		wantHosts []string
+	}{{
+		query:     url.Values{"qtype": []string{"aaaa"}},
+		name:      "qtype",
+		wantHosts: []string{"b.example.org"},
+	}, {
+		query:     url.Values{"rcode": []string{"SERVFAIL"}},
+		name:      "rcode",
+		wantHosts: []string{"b.example.org"},
+	}, {
+		query:     url.Values{"upstream": []string{"dns.google"}},
+		name:      "upstream",
+		wantHosts: []string{"b.example.org"},
+	}, {
+		query:     url.Values{"upstream": []string{`"8.8.8.8"`}},
+		name:      "upstream_strict",
+		wantHosts: nil,
+	}, {
+		query:     url.Values{"client_proto": []string{"plain"}},
+		name:      "client_proto_plain",
+		wantHosts: []string{"a.example.org"},
+	}, {
+		query:     url.Values{"cached": []string{"true"}},
+		name:      "cached",
+		wantHosts: []string{"c.example.net"},
+	}, {
+		query:     url.Values{"elapsed_min": []string{"2ms"}},
+		name:      "elapsed_min",
+		wantHosts: []string{"b.example.org", "a.example.org"},
+	}, {
+		query: url.Values{
+			"elapsed_min": []string{"2ms"},
+			"elapsed_max": []string{"10ms"},
+		},
+		name:      "elapsed_range",
+		wantHosts: []string{"a.example.org"},
+	}, {
+		query:     url.Values{"filter_list_id": []string{"2"}},
+		name:      "filter_list_id",
+		wantHosts: []string{"c.example.net"},
+	}, {
+		query:     url.Values{"regexp": []string{`^[ab]\.example\.org$`}},
+		name:      "regexp",
+		wantHosts: []string{"b.example.org", "a.example.org"},
+	}, {
+		query: url.Values{
+			"qtype":  []string{"A"},
+			"cached": []string{"false"},
+		},
+		name:      "and",
+		wantHosts: []string{"a.example.org"},
+	}, {
+		query: url.Values{
+			"rcode":   []string{"NXDOMAIN"},
+			"qtype":   []string{"AAAA"},
+			"combine": []string{"or"},
+		},
+		name:      "or",
+		wantHosts: []string{"c.example.net", "b.example.org"},
+	}, {
+		query: url.Values{
+			"response_status": []string{"all"},
+			"cached":          []string{"true"},
+			"combine":         []string{"or"},
+		},
+		name:      "or_status_all",
+		wantHosts: []string{"c.example.net"},
+	}}
+
+	for _, inFile := range []bool{false, true} {
+		l, err := newQueryLog(Config{
+			Enabled:     true,
+			FileEnabled: true,
+			RotationIvl: timeutil.Day,
+			MemSize:     100,
+			BaseDir:     t.TempDir(),
+		})
+		require.NoError(t, err)
+
+		addCriteriaEntries(t, l)
+		if inFile {
+			require.NoError(t, l.flushLogBuffer())
+		}
+
+		for _, tc := range testCases {
+			name := tc.name + "_memory"
+			if inFile {
+				name = tc.name + "_file"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, "/control/querylog?"+tc.query.Encode(), nil)
+				params, pErr := parseSearchParams(r)
+				require.NoError(t, pErr)
+
+				entries, _ := l.search(params)
+
+				var hosts []string
+				for _, e := range entries {
+					hosts = append(hosts, e.QHost)
+				}
+
+				assert.Equal(t, tc.wantHosts, hosts)
+			})
+		}
+	}
+}
+
+func TestParseSearchParams_bad(t *testing.T) {
+	testCases := []struct {
+		query      url.Values
+		name       string
+		wantErrMsg string
+	}{{
+		query:      url.Values{"qtype": []string{"BAD"}},
+		name:       "qtype",
+		wantErrMsg: `qtype: unsupported value "BAD"`,
+	}, {
+		query:      url.Values{"rcode": []string{"OOPS"}},
+		name:       "rcode",
+		wantErrMsg: `rcode: unsupported value "OOPS"`,
+	}, {
+		query:      url.Values{"regexp": []string{"("}},
+		name:       "regexp",
+		wantErrMsg: "regexp: error parsing regexp: missing closing ): `(`",
+	}, {
+		query:      url.Values{"combine": []string{"xor"}},
+		name:       "combine",
+		wantErrMsg: `combine: unsupported value "xor"`,
+	}, {
+		query: url.Values{
+			"elapsed_min": []string{"1s"},
+			"elapsed_max": []string{"1ms"},
+		},
+		name:       "elapsed",
+		wantErrMsg: "elapsed_min: must not be greater than elapsed_max 1ms, got 1s",
+	}, {
+		query:      url.Values{"client_proto": []string{"tcp"}},
+		name:       "client_proto",
+		wantErrMsg: `client_proto: invalid client proto: "tcp"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/querylog?"+tc.query.Encode(), nil)
+			_, err := parseSearchParams(r)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package querylog
 
 import (
+	"encoding/base64"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/jynychen/AdGuardHome/pkg/filtering"
@@ -19,8 +23,31 @@ const (
 	//
 	// See (*searchCriterion).ctFilteringStatusCase for details.
 	ctFilteringStatus
+	// ctQType is for searching by the question type.
+	ctQType
+	// ctRCode is for searching by the response code.
+	ctRCode
+	// ctUpstream is for searching by the address of the upstream.
+	ctUpstream
+	// ctClientProto is for searching by the client's protocol.
+	ctClientProto
+	// ctCached is for searching by whether the response was served from the
+	// cache.
+	ctCached
+	// ctElapsed is for searching by the time spent processing the request.
+	ctElapsed
+	// ctFilterListID is for searching by the ID of the filter list of any of
+	// the matched rules.
+	ctFilterListID
+	// ctRegexp is for searching by a regular expression matching the domain
+	// name, the client's IP address, the client's ID or the client's name.
+	ctRegexp
 )
 
+// clientProtoPlain is the value of the client protocol search criterion for
+// plain DNS, since [ClientProtoPlain] is empty.
+const clientProtoPlain = "plain"
+
 const (
 	filteringStatusAll      = "all"
 	filteringStatusFiltered = "filtered" // all kinds of filtering
@@ -33,6 +60,7 @@ const (
 	filteringStatusRewritten           = "rewritten"            // all kinds of rewrites
 	filteringStatusSafeSearch          = "safe_search"          // enforced safe search
 	filteringStatusProcessed           = "processed"            // not blocked, not white-listed entries
+	filteringStatusRatelimited         = "ratelimited"          // exceeded the rate limit
 )
 
 // filteringStatusValues -- array with all possible filteringStatus values
@@ -40,14 +68,30 @@ var filteringStatusValues = []string{
 	filteringStatusAll, filteringStatusFiltered, filteringStatusBlocked,
 	filteringStatusBlockedService, filteringStatusBlockedSafebrowsing, filteringStatusBlockedParental,
 	filteringStatusWhitelisted, filteringStatusRewritten, filteringStatusSafeSearch,
-	filteringStatusProcessed,
+	filteringStatusProcessed, filteringStatusRatelimited,
 }
 
 // searchCriterion is a search criterion that is used to match a record.
 type searchCriterion struct {
+	// re is the regular expression of a ctRegexp criterion.
+	re *regexp.Regexp
+
 	value         string
 	asciiVal      string
 	criterionType criterionType
+
+	// num is the response code of a ctRCode criterion or the filter list ID
+	// of a ctFilterListID one.
+	num int64
+
+	// minElapsed and maxElapsed are the inclusive bounds of a ctElapsed
+	// criterion.  Zero means no bound.
+	minElapsed time.Duration
+	maxElapsed time.Duration
+
+	// cached is the expected value of a ctCached criterion.
+	cached bool
+
 	// strict, if true, means that the criterion must be applied to the
 	// whole value rather than the part of it.  That is, equality and not
 	// containment.
@@ -108,23 +152,289 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 		// Go on, as we currently don't do quick matches against
 		// filtering statuses.
 		return true
+	case ctQType:
+		return strings.EqualFold(readJSONValue(line, `"QT":"`), c.value)
+	case ctRCode:
+		rcode, ok := quickRCode(line)
+
+		return !ok || rcode == int(c.num)
+	case ctUpstream:
+		return c.quickMatchString(readJSONValue(line, `"Upstream":"`))
+	case ctClientProto:
+		return readJSONValue(line, `"CP":"`) == c.value
+	case ctCached:
+		return strings.Contains(line, `"Cached":true`) == c.cached
+	case ctElapsed:
+		elapsed, ok := readJSONInt(line, `"Elapsed":`)
+
+		return !ok || c.elapsedMatch(time.Duration(elapsed))
+	case ctFilterListID:
+		return c.quickMatchFilterListID(line)
+	case ctRegexp:
+		return c.quickMatchRegexp(line, findClient)
+	default:
+		return true
+	}
+}
+
+// quickMatchString checks if the JSON string value s may match the criterion.
+// It returns true if s contains escape sequences, since those aren't decoded.
+func (c *searchCriterion) quickMatchString(s string) (ok bool) {
+	if strings.IndexByte(s, '\\') != -1 {
+		return true
+	}
+
+	return c.stringMatch(s)
+}
+
+// quickMatchFilterListID checks if the line may contain a rule from the filter
+// list with the ID from the criterion.
+func (c *searchCriterion) quickMatchFilterListID(line string) (ok bool) {
+	if c.num == 0 || strings.Contains(line, `"FilterID":`) {
+		// The zero ID is omitted, and the legacy entries are converted while
+		// decoding, so check those properly.
+		return true
+	}
+
+	const prefix = `"FilterListID":`
+	for i := strings.Index(line, prefix); i != -1; i = strings.Index(line, prefix) {
+		line = line[i:]
+
+		id, _ := readJSONInt(line, prefix)
+		if id == c.num {
+			return true
+		}
+
+		line = line[len(prefix):]
+	}
+
+	return false
+}
+
+// quickMatchRegexp checks if the domain name or the client's data of the line
+// match the regular expression.
+func (c *searchCriterion) quickMatchRegexp(line string, findClient quickMatchClientFunc) (ok bool) {
+	host := readJSONValue(line, `"QH":"`)
+	ip := readJSONValue(line, `"IP":"`)
+	clientID := readJSONValue(line, `"CID":"`)
+	if strings.IndexByte(host, '\\') != -1 || strings.IndexByte(clientID, '\\') != -1 {
+		return true
+	}
+
+	var name string
+	if cli := findClient(clientID, ip); cli != nil {
+		name = cli.Name
+	}
+
+	return c.regexpMatch(clientID, name, host, ip)
+}
+
+// quickRCode returns the response code of the answer from the line.  ok is
+// false if there is no answer or it can't be decoded.
+func quickRCode(line string) (rcode int, ok bool) {
+	val := readJSONValue(line, `"Answer":"`)
+
+	// Only decode the first four bytes, which contain the response code,
+	// from the base64 encoding.
+	const encLen = 8
+	if len(val) < encLen {
+		return 0, false
+	}
+
+	var hdr [6]byte
+	n, err := base64.StdEncoding.Decode(hdr[:], []byte(val[:encLen]))
+	if err != nil || n < 4 {
+		return 0, false
+	}
+
+	return int(hdr[3] & 0x0f), true
+}
+
+// readJSONInt reads a JSON integer in form of '"key":value'.  prefix must be of
+// the form '"key":'.
+func readJSONInt(s, prefix string) (n int64, ok bool) {
+	i := strings.Index(s, prefix)
+	if i == -1 {
+		return 0, false
+	}
+
+	s = s[i+len(prefix):]
+	end := strings.IndexAny(s, ",}")
+	if end == -1 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s[:end], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// blockMatch checks if the index block may contain the entries matching this
+// search criterion.
+func (c *searchCriterion) blockMatch(b *qLogBlock, findClient quickMatchClientFunc) (ok bool) {
+	switch c.criterionType {
+	case ctTerm:
+		return c.blockMatchTerm(b, findClient)
+	case ctFilteringStatus:
+		if c.value == filteringStatusRatelimited {
+			return b.Ratelimited
+		}
+
+		for bit := 0; bit < 64; bit++ {
+			if b.Results&(1<<bit) == 0 {
+				continue
+			}
+
+			if c.ctFilteringStatusCase(filtering.Reason(bit/2), bit%2 == 1) {
+				return true
+			}
+		}
+
+		return false
+	case ctRegexp:
+		return c.blockMatchRegexp(b, findClient)
 	default:
 		return true
 	}
 }
 
+// blockMatchRegexp checks if the hosts or the clients of the index block match
+// the regular expression criterion.
+func (c *searchCriterion) blockMatchRegexp(b *qLogBlock, findClient quickMatchClientFunc) (ok bool) {
+	for _, h := range b.Hosts {
+		if c.re.MatchString(h) {
+			return true
+		}
+	}
+
+	for _, cli := range b.Clients {
+		var name string
+		if found := findClient(cli.ID, cli.IP); found != nil {
+			name = found.Name
+		}
+
+		if c.regexpMatch(cli.ID, name, "", cli.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blockMatchTerm checks if the hosts or the clients of the index block match
+// the term criterion.
+func (c *searchCriterion) blockMatchTerm(b *qLogBlock, findClient quickMatchClientFunc) (ok bool) {
+	match := ctDomainOrClientCaseNonStrict
+	if c.strict {
+		match = ctDomainOrClientCaseStrict
+	}
+
+	for _, h := range b.Hosts {
+		if match(c.value, c.asciiVal, "", "", h, "") {
+			return true
+		}
+	}
+
+	for _, cli := range b.Clients {
+		var name string
+		if found := findClient(cli.ID, cli.IP); found != nil {
+			name = found.Name
+		}
+
+		if match(c.value, c.asciiVal, cli.ID, name, "", cli.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // match checks if the log entry matches this search criterion.
 func (c *searchCriterion) match(entry *logEntry) bool {
 	switch c.criterionType {
 	case ctTerm:
 		return c.ctDomainOrClientCase(entry)
 	case ctFilteringStatus:
+		if c.value == filteringStatusRatelimited {
+			return entry.Ratelimited
+		}
+
 		return c.ctFilteringStatusCase(entry.Result.Reason, entry.Result.IsFiltered)
+	case ctQType:
+		return strings.EqualFold(entry.QType, c.value)
+	case ctRCode:
+		rcode, ok := answerRCode(entry.Answer)
+
+		return ok && rcode == int(c.num)
+	case ctUpstream:
+		return c.stringMatch(entry.Upstream)
+	case ctClientProto:
+		return string(entry.ClientProto) == c.value
+	case ctCached:
+		return entry.Cached == c.cached
+	case ctElapsed:
+		return c.elapsedMatch(entry.Elapsed)
+	case ctFilterListID:
+		for _, r := range entry.Result.Rules {
+			if r.FilterListID == c.num {
+				return true
+			}
+		}
+
+		return false
+	case ctRegexp:
+		var name string
+		if entry.client != nil {
+			name = entry.client.Name
+		}
+
+		return c.regexpMatch(entry.ClientID, name, entry.QHost, entry.IP.String())
+	}
+
+	return false
+}
+
+// stringMatch checks if s is equal to the value of the criterion, if it's
+// strict, or contains it otherwise.  The case is ignored.
+func (c *searchCriterion) stringMatch(s string) (ok bool) {
+	if c.strict {
+		return strings.EqualFold(s, c.value)
+	}
+
+	return stringutil.ContainsFold(s, c.value)
+}
+
+// elapsedMatch checks if elapsed is within the bounds of the criterion.
+func (c *searchCriterion) elapsedMatch(elapsed time.Duration) (ok bool) {
+	return (c.minElapsed == 0 || elapsed >= c.minElapsed) &&
+		(c.maxElapsed == 0 || elapsed <= c.maxElapsed)
+}
+
+// regexpMatch checks if any of the non-empty values match the regular
+// expression of the criterion.
+func (c *searchCriterion) regexpMatch(clientID, name, host, ip string) (ok bool) {
+	for _, v := range []string{host, clientID, ip, name} {
+		if v != "" && c.re.MatchString(v) {
+			return true
+		}
 	}
 
 	return false
 }
 
+// answerRCode returns the response code of the packed DNS message.  ok is false
+// if the message is too short.
+func answerRCode(answer []byte) (rcode int, ok bool) {
+	if len(answer) < 4 {
+		return 0, false
+	}
+
+	return int(answer[3] & 0x0f), true
+}
+
 func (c *searchCriterion) ctDomainOrClientCase(e *logEntry) bool {
 	clientID := e.ClientID
 	host := e.QHost
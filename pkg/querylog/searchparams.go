@@ -8,10 +8,19 @@ type searchParams struct {
 	// parameter value.  If not set, disregard it and return any value.
 	olderThan time.Time
 
+	// newerThan represents a parameter for entries that are not older than
+	// this parameter value.  If not set, disregard it and return any value.
+	newerThan time.Time
+
 	// searchCriteria is a list of search criteria that we use to get filter
 	// results.
 	searchCriteria []searchCriterion
 
+	// anyCriteria, if true, means that an entry matches if it matches any of
+	// the search criteria rather than all of them.  The time bounds are always
+	// applied.
+	anyCriteria bool
+
 	// offset for the search.
 	offset int
 
@@ -41,13 +50,30 @@ type quickMatchClientFunc = func(clientID, ip string) (c *Client)
 // It returns false if the line doesn't match.  This method is only here for
 // optimization purposes.
 func (s *searchParams) quickMatch(line string, findClient quickMatchClientFunc) (ok bool) {
-	for _, c := range s.searchCriteria {
-		if !c.quickMatch(line, findClient) {
-			return false
-		}
+	return s.matchCriteria(func(c *searchCriterion) (ok bool) {
+		return c.quickMatch(line, findClient)
+	})
+}
+
+// blockMatch checks if the index block may contain the entries matching the
+// search criteria.  It returns false only if there are definitely no such
+// entries in the block.
+func (s *searchParams) blockMatch(b *qLogBlock, findClient quickMatchClientFunc) (ok bool) {
+	if !s.olderThan.IsZero() && b.MinTime >= s.olderThan.UnixNano() {
+		return false
+	} else if !s.newerThan.IsZero() && b.MaxTime < s.newerThan.UnixNano() {
+		return false
 	}
 
-	return true
+	return s.matchCriteria(func(c *searchCriterion) (ok bool) {
+		return c.blockMatch(b, findClient)
+	})
+}
+
+// hasBounds returns true if the search is limited either by the time range or
+// by the search criteria.
+func (s *searchParams) hasBounds() (ok bool) {
+	return len(s.searchCriteria) > 0 || !s.olderThan.IsZero() || !s.newerThan.IsZero()
 }
 
 // match - checks if the logEntry matches the searchParams
@@ -55,13 +81,28 @@ func (s *searchParams) match(entry *logEntry) bool {
 	if !s.olderThan.IsZero() && !entry.Time.Before(s.olderThan) {
 		// Ignore entries newer than what was requested
 		return false
+	} else if !s.newerThan.IsZero() && entry.Time.Before(s.newerThan) {
+		return false
+	}
+
+	return s.matchCriteria(func(c *searchCriterion) (ok bool) {
+		return c.match(entry)
+	})
+}
+
+// matchCriteria checks if the search criteria match using f.  It requires f
+// to return true either for all of them or, if s.anyCriteria is true, for any
+// of them.
+func (s *searchParams) matchCriteria(f func(c *searchCriterion) (ok bool)) (ok bool) {
+	if len(s.searchCriteria) == 0 {
+		return true
 	}
 
-	for _, c := range s.searchCriteria {
-		if !c.match(entry) {
-			return false
+	for i := range s.searchCriteria {
+		if f(&s.searchCriteria[i]) == s.anyCriteria {
+			return s.anyCriteria
 		}
 	}
 
-	return true
+	return !s.anyCriteria
 }
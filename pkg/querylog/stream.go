@@ -0,0 +1,228 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+)
+
+const (
+	// streamBufSize is the number of the log entries buffered for each
+	// subscriber of the stream.  Subscribers that fall behind by more than that
+	// are dropped.
+	streamBufSize = 256
+
+	// streamKeepAliveIvl is the interval between the keep-alive comments sent
+	// to the idle subscribers.
+	streamKeepAliveIvl = 15 * time.Second
+
+	// streamRetryMs is the reconnection time in milliseconds advised to the
+	// subscribers.
+	streamRetryMs = 1000
+)
+
+// subscriber is a subscriber of the live query log stream.
+type subscriber struct {
+	// entries receives the new log entries.  It's closed when the subscriber
+	// is dropped.
+	entries chan *logEntry
+}
+
+// streamer sends the new log entries to the subscribers of the live query log
+// stream.  It never blocks the adding of the entries, the subscribers that
+// can't keep up are dropped instead.
+type streamer struct {
+	// mu protects subs.
+	mu *sync.Mutex
+
+	// subs are the current subscribers.
+	subs map[*subscriber]struct{}
+}
+
+// newStreamer returns a new properly initialized *streamer.
+func newStreamer() (s *streamer) {
+	return &streamer{
+		mu:   &sync.Mutex{},
+		subs: map[*subscriber]struct{}{},
+	}
+}
+
+// subscribe adds a new subscriber to the stream.
+func (s *streamer) subscribe() (sub *subscriber) {
+	sub = &subscriber{
+		entries: make(chan *logEntry, streamBufSize),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subs[sub] = struct{}{}
+
+	return sub
+}
+
+// unsubscribe removes sub from the stream, if it hasn't been dropped yet.
+func (s *streamer) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(sub)
+}
+
+// removeLocked removes sub from the stream and closes its channel.  s.mu is
+// expected to be locked.
+func (s *streamer) removeLocked(sub *subscriber) {
+	if _, ok := s.subs[sub]; !ok {
+		return
+	}
+
+	delete(s.subs, sub)
+	close(sub.entries)
+}
+
+// publish sends e to the subscribers.  e must not be modified after that.
+func (s *streamer) publish(e *logEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subs {
+		select {
+		case sub.entries <- e:
+			// Go on.
+		default:
+			log.Debug("querylog: dropping slow stream subscriber")
+
+			s.removeLocked(sub)
+		}
+	}
+}
+
+// handleQueryLogStream is the handler for the GET /control/querylog/stream
+// HTTP API.  It sends the new log entries matching the search parameters as
+// Server-Sent Events.  Pagination parameters are ignored.
+func (l *queryLog) handleQueryLogStream(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSearchParams(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing params: %s", err)
+
+		return
+	}
+
+	// Only the new entries are streamed.
+	params.olderThan = time.Time{}
+
+	rc := http.NewResponseController(w)
+
+	// Entries must be sent as soon as they're added, so try to lift the write
+	// timeout.  If that isn't possible, the subscriber is expected to
+	// reconnect.
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Debug("querylog: stream: resetting write deadline: %s", err)
+	}
+
+	h := w.Header()
+	h.Set(httphdr.ContentType, "text/event-stream")
+	h.Set(httphdr.CacheControl, "no-cache")
+	// Prevent the compressing middlewares from buffering the events.
+	h.Set(httphdr.ContentEncoding, "identity")
+
+	w.WriteHeader(http.StatusOK)
+
+	sub := l.stream.subscribe()
+	defer l.stream.unsubscribe(sub)
+
+	_, err = fmt.Fprintf(w, "retry: %d\n\n", streamRetryMs)
+	if err == nil {
+		err = rc.Flush()
+	}
+
+	if err != nil {
+		log.Debug("querylog: stream: starting: %s", err)
+
+		return
+	}
+
+	err = l.serveStream(r, w, rc, sub, params)
+	if err != nil {
+		log.Debug("querylog: stream: %s", err)
+	}
+}
+
+// serveStream writes the entries received by sub and matching params to w
+// until the request is done or sub is dropped.
+func (l *queryLog) serveStream(
+	r *http.Request,
+	w http.ResponseWriter,
+	rc *http.ResponseController,
+	sub *subscriber,
+	params *searchParams,
+) (err error) {
+	keepAlive := time.NewTicker(streamKeepAliveIvl)
+	defer keepAlive.Stop()
+
+	cache := clientCache{}
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-sub.entries:
+			if !ok {
+				return fmt.Errorf("subscriber dropped: more than %d entries behind", streamBufSize)
+			}
+
+			if len(cache) > maxClientCacheSize {
+				cache = clientCache{}
+			}
+
+			err = l.writeStreamEntry(w, e, params, cache)
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+
+		if err != nil {
+			return fmt.Errorf("writing: %w", err)
+		}
+	}
+}
+
+// writeStreamEntry writes e as an event to w if it matches params.
+func (l *queryLog) writeStreamEntry(
+	w http.ResponseWriter,
+	e *logEntry,
+	params *searchParams,
+	cache clientCache,
+) (err error) {
+	// A shallow clone is enough, since only the client field is modified.
+	e = e.shallowClone()
+
+	e.client, err = l.client(e.ClientID, e.IP.String(), cache)
+	if err != nil {
+		log.Debug("querylog: stream: enriching record for client %q: %s", e.IP, err)
+
+		// Go on and try to match anyway.
+	}
+
+	if !params.match(e) {
+		return nil
+	}
+
+	data, err := json.Marshal(entryToJSON(e, l.anonymizer.Load()))
+	if err != nil {
+		return fmt.Errorf("encoding entry: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "event: entry\ndata: %s\n\n", data)
+
+	return err
+}
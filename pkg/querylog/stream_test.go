@@ -0,0 +1,119 @@
+package querylog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 5 * time.Second
+
+func TestQueryLog_HandleQueryLogStream(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Anonymizer:  aghnet.NewIPMut(AnonymizeIP),
+		Enabled:     true,
+		FileEnabled: false,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(l.handleQueryLogStream))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		srv.URL+"?search=example.org",
+		nil,
+	)
+	require.NoError(t, err)
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	sc := bufio.NewScanner(resp.Body)
+
+	// Wait for the subscription.
+	require.True(t, sc.Scan())
+	require.True(t, strings.HasPrefix(sc.Text(), "retry: "))
+
+	addEntry(l, "example.com", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "test.example.org", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+
+	var data string
+	for sc.Scan() {
+		var ok bool
+		data, ok = strings.CutPrefix(sc.Text(), "data: ")
+		if ok {
+			break
+		}
+	}
+	require.NoError(t, sc.Err())
+
+	entry := jobject{}
+	err = json.Unmarshal([]byte(data), &entry)
+	require.NoError(t, err)
+
+	question, ok := entry["question"].(jobject)
+	require.True(t, ok)
+
+	assert.Equal(t, "test.example.org", question["name"])
+	assert.Equal(t, "2.2.0.0", entry["client"])
+}
+
+func TestStreamer_publish(t *testing.T) {
+	s := newStreamer()
+
+	slow := s.subscribe()
+	fast := s.subscribe()
+
+	e := &logEntry{}
+	for i := 0; i < streamBufSize; i++ {
+		s.publish(e)
+		<-fast.entries
+	}
+
+	// The slow subscriber's buffer is full, so it must be dropped on the next
+	// entry.
+	s.publish(e)
+
+	n := 0
+	for range slow.entries {
+		n++
+	}
+
+	assert.Equal(t, streamBufSize, n)
+
+	got, ok := <-fast.entries
+	require.True(t, ok)
+
+	assert.Same(t, e, got)
+
+	// Unsubscribing the dropped subscriber must not panic.
+	s.unsubscribe(slow)
+	s.unsubscribe(fast)
+
+	_, ok = <-fast.entries
+	assert.False(t, ok)
+}
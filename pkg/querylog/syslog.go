@@ -0,0 +1,343 @@
+package querylog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+)
+
+// Supported networks of the syslog sink.
+const (
+	SyslogNetworkUDP = "udp"
+	SyslogNetworkTCP = "tcp"
+	SyslogNetworkTLS = "tls"
+)
+
+// Supported formats of the syslog messages.
+const (
+	// SyslogFormatRFC5424 is the format of RFC 5424 with the fields of the log
+	// entry in the structured data.
+	SyslogFormatRFC5424 = "rfc5424"
+
+	// SyslogFormatCEF is the ArcSight Common Event Format message in an RFC
+	// 5424 syslog message.
+	SyslogFormatCEF = "cef"
+)
+
+// DefaultSyslogQueueSize is the default number of the log entries waiting to be
+// sent to the syslog server.
+const DefaultSyslogQueueSize = 10_000
+
+const (
+	// syslogWriteTimeout is the timeout for connecting to the syslog server
+	// and writing a message.
+	syslogWriteTimeout = 5 * time.Second
+
+	// syslogReconnectIvl is the time between two attempts to connect to the
+	// syslog server.  The new entries are queued meanwhile.
+	syslogReconnectIvl = 5 * time.Second
+)
+
+// SyslogConfig is the configuration of the syslog sink, which sends the log
+// entries to a remote syslog server.
+type SyslogConfig struct {
+	// Network is the transport of the syslog messages, either
+	// [SyslogNetworkUDP], [SyslogNetworkTCP], or [SyslogNetworkTLS].
+	Network string `yaml:"network"`
+
+	// Address is the address of the syslog server in the host:port form.
+	Address string `yaml:"address"`
+
+	// Format is the format of the messages, either [SyslogFormatRFC5424] or
+	// [SyslogFormatCEF].
+	Format string `yaml:"format"`
+
+	// QueueSize is the maximum number of the log entries waiting to be sent.
+	// When the queue is full, the new entries are dropped.  If it's zero,
+	// [DefaultSyslogQueueSize] is used.
+	QueueSize uint32 `yaml:"queue_size"`
+
+	// Enabled defines if the log entries are sent to the syslog server.
+	Enabled bool `yaml:"enabled"`
+}
+
+// Validate returns an error if c is enabled but contains invalid values.  c
+// may be nil.
+func (c *SyslogConfig) Validate() (err error) {
+	if c == nil || !c.Enabled {
+		return nil
+	}
+
+	switch c.Network {
+	case SyslogNetworkUDP, SyslogNetworkTCP, SyslogNetworkTLS:
+		// Go on.
+	default:
+		return fmt.Errorf("network: unsupported value %q", c.Network)
+	}
+
+	switch c.Format {
+	case SyslogFormatRFC5424, SyslogFormatCEF:
+		// Go on.
+	default:
+		return fmt.Errorf("format: unsupported value %q", c.Format)
+	}
+
+	_, _, err = net.SplitHostPort(c.Address)
+	if err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+
+	return nil
+}
+
+// syslogSink sends the log entries to a remote syslog server.  A slow or
+// unavailable server never blocks adding the entries, those are queued and
+// dropped when the queue is full.
+type syslogSink struct {
+	// anonymizer processes the IP addresses of the clients.
+	anonymizer *aghnet.IPMut
+
+	// rootCAs are the root CAs used to verify the server's certificate.
+	rootCAs *x509.CertPool
+
+	// queue contains the entries waiting to be sent.
+	queue chan *logEntry
+
+	// done is closed when the sink is closed.
+	done chan struct{}
+
+	// finished is closed when the sending goroutine exits.
+	finished chan struct{}
+
+	// closeOnce makes sure that done is only closed once.
+	closeOnce *sync.Once
+
+	// dropped is the number of the entries dropped since the last report.
+	dropped atomic.Uint64
+
+	// started is true if the sending goroutine has been started.
+	started atomic.Bool
+
+	// hostname is the HOSTNAME field of the messages.
+	hostname string
+
+	// network is the transport of the messages.
+	network string
+
+	// address is the address of the server.
+	address string
+
+	// format is the format of the messages.
+	format string
+
+	// pid is the PROCID field of the messages.
+	pid int
+
+	// reconnectIvl is the time between two attempts to connect to the server.
+	reconnectIvl time.Duration
+}
+
+// newSyslogSink returns a new properly initialized *syslogSink.  conf must be
+// valid and enabled.
+func newSyslogSink(
+	conf *SyslogConfig,
+	rootCAs *x509.CertPool,
+	anonymizer *aghnet.IPMut,
+) (s *syslogSink) {
+	queueSize := int(conf.QueueSize)
+	if queueSize == 0 {
+		queueSize = DefaultSyslogQueueSize
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Debug("querylog: syslog: getting hostname: %s", err)
+	}
+
+	return &syslogSink{
+		anonymizer:   anonymizer,
+		rootCAs:      rootCAs,
+		queue:        make(chan *logEntry, queueSize),
+		done:         make(chan struct{}),
+		finished:     make(chan struct{}),
+		closeOnce:    &sync.Once{},
+		hostname:     hostname,
+		network:      conf.Network,
+		address:      conf.Address,
+		format:       conf.Format,
+		pid:          os.Getpid(),
+		reconnectIvl: syslogReconnectIvl,
+	}
+}
+
+// start starts sending the entries in a separate goroutine.
+func (s *syslogSink) start() {
+	s.started.Store(true)
+
+	go s.run()
+}
+
+// emit queues e for sending.  It never blocks, and e is dropped if the queue
+// is full.  e must not be modified after calling emit.
+func (s *syslogSink) emit(e *logEntry) {
+	select {
+	case s.queue <- e:
+		// Go on.
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close stops sending the entries and closes the connection.  It's safe to call
+// it several times.
+func (s *syslogSink) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	if s.started.Load() {
+		<-s.finished
+	}
+}
+
+// run sends the queued entries until s is closed.  It's intended to be used as
+// a goroutine.
+func (s *syslogSink) run() {
+	defer log.OnPanic("querylog: syslog")
+	defer close(s.finished)
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			s.closeConn(conn)
+		}
+	}()
+
+	var buf []byte
+	for {
+		var e *logEntry
+		select {
+		case e = <-s.queue:
+			// Go on.
+		case <-s.done:
+			return
+		}
+
+		buf = s.appendMessage(buf[:0], e)
+
+		var ok bool
+		conn, ok = s.send(conn, buf)
+		if !ok {
+			return
+		}
+
+		if n := s.dropped.Swap(0); n > 0 {
+			log.Info("querylog: syslog: dropped %d entries", n)
+		}
+	}
+}
+
+// send writes msg into conn, reconnecting if necessary, until it succeeds or s
+// is closed.  next is the connection to use for the next message.  ok is false
+// if s has been closed.
+func (s *syslogSink) send(conn net.Conn, msg []byte) (next net.Conn, ok bool) {
+	for {
+		var err error
+		if conn == nil {
+			conn, err = s.dial()
+			if err != nil {
+				log.Error("querylog: syslog: connecting to %s %q: %s", s.network, s.address, err)
+			} else {
+				log.Debug("querylog: syslog: connected to %s %q", s.network, s.address)
+			}
+		}
+
+		if conn != nil {
+			err = s.write(conn, msg)
+			if err == nil {
+				return conn, true
+			}
+
+			log.Error("querylog: syslog: writing to %s %q: %s", s.network, s.address, err)
+			s.closeConn(conn)
+			conn = nil
+		}
+
+		// Keep the message and wait for the server to become available.
+		timer := time.NewTimer(s.reconnectIvl)
+		select {
+		case <-timer.C:
+			// Go on.
+		case <-s.done:
+			timer.Stop()
+
+			return nil, false
+		}
+	}
+}
+
+// dial connects to the syslog server.
+func (s *syslogSink) dial() (conn net.Conn, err error) {
+	dialer := &net.Dialer{
+		Timeout: syslogWriteTimeout,
+	}
+
+	if s.network != SyslogNetworkTLS {
+		return dialer.Dial(s.network, s.address)
+	}
+
+	host, _, err := net.SplitHostPort(s.address)
+	if err != nil {
+		// Don't wrap the error, since the address is validated in the
+		// configuration.
+		return nil, err
+	}
+
+	tlsConn, err := tls.DialWithDialer(dialer, "tcp", s.address, &tls.Config{
+		ServerName: host,
+		RootCAs:    s.rootCAs,
+		MinVersion: tls.VersionTLS12,
+	})
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// write writes msg into conn.  The stream transports use the octet-counting
+// framing from RFC 6587.
+func (s *syslogSink) write(conn net.Conn, msg []byte) (err error) {
+	err = conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	if s.network == SyslogNetworkUDP {
+		_, err = conn.Write(msg)
+
+		return err
+	}
+
+	frame := net.Buffers{strconv.AppendInt(nil, int64(len(msg)), 10), []byte(" "), msg}
+	_, err = frame.WriteTo(conn)
+
+	return err
+}
+
+// closeConn closes conn and logs the error, if any.
+func (s *syslogSink) closeConn(conn net.Conn) {
+	err := conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Debug("querylog: syslog: closing connection: %s", err)
+	}
+}
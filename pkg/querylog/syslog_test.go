@@ -0,0 +1,266 @@
+package querylog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/jynychen/AdGuardHome/pkg/aghnet"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"github.com/jynychen/AdGuardHome/pkg/version"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogSink_appendMessage(t *testing.T) {
+	ans := &dns.Msg{
+		Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   "example.org.",
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   "example.org.",
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+			},
+			AAAA: net.ParseIP("::1"),
+		}},
+	}
+
+	packed, err := ans.Pack()
+	require.NoError(t, err)
+
+	e := &logEntry{
+		Time:        time.Date(2023, 9, 1, 12, 0, 0, 123456000, time.UTC),
+		QHost:       "example.org",
+		QType:       "A",
+		QClass:      "IN",
+		ClientID:    "cli",
+		ClientProto: ClientProtoDoH,
+		Answer:      packed,
+		Result: filtering.Result{
+			Rules: []*filtering.ResultRule{{
+				Text: `||example.org^$client="a|b"`,
+			}},
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		Upstream: "8.8.8.8:53",
+		IP:       net.IP{192, 168, 1, 2},
+		Elapsed:  1500 * time.Microsecond,
+	}
+
+	const header = "<133>1 2023-09-01T12:00:00.123456Z host AdGuardHome 42 query "
+
+	testCases := []struct {
+		name   string
+		format string
+		want   string
+	}{{
+		name:   "rfc5424",
+		format: SyslogFormatRFC5424,
+		want: header + `[query@32473 client="192.168.1.2" client_id="cli" ` +
+			`client_proto="doh" qname="example.org" qtype="A" ` +
+			`answer="1.2.3.4,::1" reason="FilteredBlackList" ` +
+			`rule="||example.org^$client=\"a|b\"" upstream="8.8.8.8:53" ` +
+			`elapsed_us="1500"] example.org A from 192.168.1.2: FilteredBlackList`,
+	}, {
+		name:   "cef",
+		format: SyslogFormatCEF,
+		want: header + "- CEF:0|AdGuard|AdGuard Home|" + version.Version() +
+			"|FilteredBlackList|DNS query|5|rt=1693569600123 src=192.168.1.2 " +
+			"cs1Label=ClientID cs1=cli app=doh dhost=example.org " +
+			"cs2Label=QueryType cs2=A cs3Label=Answer cs3=1.2.3.4,::1 " +
+			`act=FilteredBlackList cs4Label=Rule cs4=||example.org^$client\="a|b" ` +
+			"cs5Label=Upstream cs5=8.8.8.8:53 " +
+			"cn1Label=ElapsedMicroseconds cn1=1500",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &syslogSink{
+				anonymizer: aghnet.NewIPMut(nil),
+				hostname:   "host",
+				format:     tc.format,
+				pid:        42,
+			}
+
+			got := s.appendMessage(nil, e)
+			assert.Equal(t, tc.want, string(got))
+		})
+	}
+}
+
+// newTestSyslogQueryLog returns a query log sending the entries to the syslog
+// server at addr.
+func newTestSyslogQueryLog(t *testing.T, network, addr string) (l *queryLog) {
+	t.Helper()
+
+	l, err := newQueryLog(Config{
+		Anonymizer:  aghnet.NewIPMut(AnonymizeIP),
+		Enabled:     true,
+		FileEnabled: false,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+		Syslog: &SyslogConfig{
+			Network: network,
+			Address: addr,
+			Format:  SyslogFormatRFC5424,
+			Enabled: true,
+		},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, l.syslog)
+
+	l.syslog.reconnectIvl = 10 * time.Millisecond
+	l.syslog.start()
+	t.Cleanup(l.syslog.close)
+
+	return l
+}
+
+func TestQueryLog_syslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	l := newTestSyslogQueryLog(t, SyslogNetworkUDP, conn.LocalAddr().String())
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	msg := string(buf[:n])
+	assert.Contains(t, msg, `qname="example.org"`)
+	assert.Contains(t, msg, `client="2.2.0.0"`)
+	assert.Contains(t, msg, `answer="1.1.1.1"`)
+}
+
+func TestQueryLog_syslogTCP(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, lsn.Close)
+
+	l := newTestSyslogQueryLog(t, SyslogNetworkTCP, lsn.Addr().String())
+
+	addEntry(l, "first.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+
+	conn, err := lsn.Accept()
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+	msg := readSyslogFrame(t, bufio.NewReader(conn))
+	assert.Contains(t, msg, `qname="first.example.org"`)
+
+	// Drop the connection and make sure that the sink reconnects.
+	require.NoError(t, conn.Close())
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				addEntry(l, "second.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+
+	conn, err = lsn.Accept()
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+	msg = readSyslogFrame(t, bufio.NewReader(conn))
+	assert.Contains(t, msg, `qname="second.example.org"`)
+}
+
+// readSyslogFrame reads a syslog message framed using the octet counting.
+func readSyslogFrame(t *testing.T, r *bufio.Reader) (msg string) {
+	t.Helper()
+
+	lenStr, err := r.ReadString(' ')
+	require.NoError(t, err)
+
+	n, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+	require.NoError(t, err)
+
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+
+	return string(buf)
+}
+
+func TestSyslogConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		conf       *SyslogConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf: &SyslogConfig{
+			Network: SyslogNetworkTLS,
+			Address: "siem.example:6514",
+			Format:  SyslogFormatCEF,
+			Enabled: true,
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf: &SyslogConfig{
+			Network: "unix",
+			Enabled: true,
+		},
+		name:       "bad_network",
+		wantErrMsg: `network: unsupported value "unix"`,
+	}, {
+		conf: &SyslogConfig{
+			Network: SyslogNetworkUDP,
+			Format:  "json",
+			Enabled: true,
+		},
+		name:       "bad_format",
+		wantErrMsg: `format: unsupported value "json"`,
+	}, {
+		conf: &SyslogConfig{
+			Network: SyslogNetworkUDP,
+			Address: "siem.example",
+			Format:  SyslogFormatRFC5424,
+			Enabled: true,
+		},
+		name:       "bad_address",
+		wantErrMsg: "address: address siem.example: missing port in address",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.conf.Validate()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package stats
+
+// fillBreakdowns fills data with the numbers of requests by the question's
+// type, the response code, and the client protocol.  data.TimeUnits must
+// already be set by [StatsCtx.fillCollectedStats].
+func fillBreakdowns(data *StatsResp, units []*unitDB, curID uint32) {
+	data.TopQueryTypes, data.QueryTypes = breakdown(data.TimeUnits, units, curID, qTypePairs)
+	data.TopRCodes, data.RCodes = breakdown(data.TimeUnits, units, curID, rCodePairs)
+	data.TopClientProtos, data.ClientProtos = breakdown(
+		data.TimeUnits,
+		units,
+		curID,
+		clientProtoPairs,
+	)
+}
+
+// qTypePairs is a pairsGetter for the question's types.
+func qTypePairs(u *unitDB) (pairs []countPair) { return u.QTypes }
+
+// rCodePairs is a pairsGetter for the response codes.
+func rCodePairs(u *unitDB) (pairs []countPair) { return u.RCodes }
+
+// clientProtoPairs is a pairsGetter for the client protocols.
+func clientProtoPairs(u *unitDB) (pairs []countPair) { return u.ClientProtos }
+
+// breakdown returns the top values retrieved from units using pg and the
+// numbers of requests for each of those in each time unit.  Like
+// [StatsCtx.fillCollectedStats], it aggregates the hourly data into days if
+// timeUnits is [timeUnitsDays].
+func breakdown(
+	timeUnits string,
+	units []*unitDB,
+	curID uint32,
+	pg pairsGetter,
+) (top []topAddrs, series map[string][]uint64) {
+	top = topsCollector(units, maxBreakdownKeys, nil, pg)
+
+	// Only keep the series of the top values to limit the size of the
+	// response.
+	series = make(map[string][]uint64, len(top))
+	for _, t := range top {
+		for k := range t {
+			series[k] = nil
+		}
+	}
+
+	size, perUnit := len(units), 1
+	if timeUnits == timeUnitsDays {
+		size, perUnit = size/24, 24
+
+		// See the comment in fillCollectedStatsDaily.
+		units = units[len(units)-countHours(curID, size):]
+	}
+
+	for k := range series {
+		series[k] = make([]uint64, size)
+	}
+
+	for i, u := range units {
+		for _, cp := range pg(u) {
+			if s, ok := series[cp.Name]; ok {
+				s[i/perUnit] += cp.Count
+			}
+		}
+	}
+
+	return top, series
+}
@@ -0,0 +1,602 @@
+package stats
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"go.etcd.io/bbolt"
+)
+
+// maxImportSize is the maximum size of the request body of the POST
+// /control/stats/import HTTP API.  It's enough for a year of hourly units with
+// the full top lists.
+const maxImportSize = 256 * 1024 * 1024
+
+// importBatchSize is the maximum number of units merged into the database
+// within a single transaction, so that the flushing of the statistics isn't
+// blocked for long.
+const importBatchSize = 24
+
+// instanceIDLen is the length of the randomly generated ID of the statistics
+// instance in bytes.
+const instanceIDLen = 16
+
+// instanceIDKey is the key of the ID of the statistics instance within the
+// metadata bucket.  The ID is used to recognize the repeated imports of the
+// same units.
+var instanceIDKey = []byte("instance_id")
+
+// importsBucketName is the name of the bucket containing the keys of the
+// imported units, see importKey.  It's shorter than bucketNameLen, so it's
+// never taken for a unit.
+var importsBucketName = []byte("imports")
+
+// Errors of the import.
+const (
+	// errImportMalformed is returned when the imported data can't be decoded.
+	errImportMalformed errors.Error = "malformed data"
+
+	// errImportInvalid is returned when the decoded data can't be imported.
+	errImportInvalid errors.Error = "invalid data"
+)
+
+// exportVersion is the version of the format of the exported statistics.  It
+// must be incremented when the format changes incompatibly.
+const exportVersion = 1
+
+// exportData is the statistics exported by the GET /control/stats/export HTTP
+// API and imported by the POST /control/stats/import one.
+// The fields are ordered so that the units are encoded last, since the import
+// validates the rest of the fields before decoding those.
+type exportData struct {
+	// Version is the version of the format, see exportVersion.
+	Version int `json:"version"`
+
+	// InstanceID is the ID of the statistics instance the units have been
+	// exported from.
+	InstanceID string `json:"instance_id"`
+
+	// Units are the non-empty hourly units, from older to newer.
+	Units []*exportUnit `json:"units"`
+}
+
+// exportUnit is a single exported hourly unit.  The fields of unitDB are kept
+// as is, since their names and types are already fixed by the database
+// format.
+type exportUnit struct {
+	unitDB
+
+	// ID is the ID of the unit, which is the number of hours since the Unix
+	// epoch by default.
+	ID uint32 `json:"ID"`
+}
+
+// importResp is the response to the POST /control/stats/import HTTP API.
+type importResp struct {
+	// Imported is the number of the units merged into the local statistics.
+	Imported int `json:"imported"`
+
+	// Skipped is the number of the units outside of the statistics interval.
+	Skipped int `json:"skipped"`
+
+	// Duplicates is the number of the units already imported from the same
+	// instance before.
+	Duplicates int `json:"duplicates"`
+}
+
+// parseExportRange returns the IDs of the first and the last hourly units
+// requested by the start and end query parameters of r.  Those are zero and
+// the maximum ID respectively if not set.
+func parseExportRange(r *http.Request) (firstID, lastID uint32, err error) {
+	q := r.URL.Query()
+
+	lastID = ^uint32(0)
+	for _, p := range []struct {
+		id   *uint32
+		name string
+	}{{
+		id:   &firstID,
+		name: "start",
+	}, {
+		id:   &lastID,
+		name: "end",
+	}} {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", p.name, err)
+		}
+
+		*p.id = uint32(t.Unix() / int64(time.Hour/time.Second))
+	}
+
+	if firstID > lastID {
+		return 0, 0, errors.Error("start is after end")
+	}
+
+	return firstID, lastID, nil
+}
+
+// handleExport is the handler for the GET /control/stats/export HTTP API.
+func (s *StatsCtx) handleExport(w http.ResponseWriter, r *http.Request) {
+	firstID, lastID, err := parseExportRange(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing params: %s", err)
+
+		return
+	}
+
+	data := &exportData{
+		Version:    exportVersion,
+		InstanceID: s.instanceID(),
+		Units:      s.exportUnits(firstID, lastID),
+	}
+
+	w.Header().Set(httphdr.ContentDisposition, `attachment; filename="stats.json"`)
+	aghhttp.WriteJSONResponseOK(w, r, data)
+}
+
+// instanceID returns the ID of the statistics instance stored in the database.
+func (s *StatsCtx) instanceID() (id string) {
+	db := s.db.Load()
+	if db == nil {
+		return ""
+	}
+
+	_ = db.View(func(tx *bbolt.Tx) (err error) {
+		id = loadInstanceID(tx)
+
+		return nil
+	})
+
+	return id
+}
+
+// loadInstanceID returns the ID of the statistics instance stored within tx.
+func loadInstanceID(tx *bbolt.Tx) (id string) {
+	meta := tx.Bucket(metaBucketName)
+	if meta == nil {
+		return ""
+	}
+
+	return string(meta.Get(instanceIDKey))
+}
+
+// initInstanceID generates the ID of the statistics instance and stores it
+// within tx, unless there is one already.
+func initInstanceID(tx *bbolt.Tx) (err error) {
+	meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+	if err != nil {
+		return fmt.Errorf("creating meta bucket: %w", err)
+	} else if len(meta.Get(instanceIDKey)) > 0 {
+		return nil
+	}
+
+	id := make([]byte, instanceIDLen)
+	_, err = rand.Read(id)
+	if err != nil {
+		return fmt.Errorf("generating instance id: %w", err)
+	}
+
+	return meta.Put(instanceIDKey, []byte(hex.EncodeToString(id)))
+}
+
+// exportUnits returns the non-empty hourly units within the statistics
+// interval with IDs from firstID to lastID inclusively.
+func (s *StatsCtx) exportUnits(firstID, lastID uint32) (units []*exportUnit) {
+	units = []*exportUnit{}
+
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	limit := uint32(s.limit.Hours())
+	if limit == 0 {
+		return units
+	}
+
+	udbs, curID := s.loadUnits(limit)
+	for i, udb := range udbs {
+		id := curID - limit + 1 + uint32(i)
+		if udb.NTotal == 0 || id < firstID || id > lastID {
+			continue
+		}
+
+		units = append(units, &exportUnit{
+			unitDB: *udb,
+			ID:     id,
+		})
+	}
+
+	return units
+}
+
+// handleImport is the handler for the POST /control/stats/import HTTP API.
+// The size of the request body is limited by maxImportSize instead of the
+// common limit for the HTTP APIs.
+func (s *StatsCtx) handleImport(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.importFrom(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		code := http.StatusInternalServerError
+		if maxErr := (&http.MaxBytesError{}); errors.As(err, &maxErr) {
+			code = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, errImportMalformed) {
+			code = http.StatusBadRequest
+		} else if errors.Is(err, errImportInvalid) {
+			code = http.StatusUnprocessableEntity
+		}
+
+		aghhttp.Error(r, w, code, "importing: %s", err)
+
+		return
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// validate returns an error if the units of data can't be imported into the
+// statistics instance with localID.  The units themselves aren't validated.
+func (data *exportData) validate(localID string) (err error) {
+	switch {
+	case data.Version != exportVersion:
+		return fmt.Errorf("unsupported version %d, want %d", data.Version, exportVersion)
+	case data.InstanceID == "":
+		return errors.Error("instance_id: empty")
+	case data.InstanceID == localID:
+		return errors.Error("instance_id: units are exported from this instance")
+	default:
+		return nil
+	}
+}
+
+// validate returns an error if u can't be imported.
+func (u *exportUnit) validate() (err error) {
+	if u == nil {
+		return errors.Error("no unit")
+	} else if n := len(u.NResult); n > int(resultLast) {
+		return fmt.Errorf("too many results: %d", n)
+	}
+
+	return nil
+}
+
+// importer merges the exported units into the local statistics.
+type importer struct {
+	// stats is the local statistics.
+	stats *StatsCtx
+
+	// db is the database of the local statistics.
+	db *bbolt.DB
+
+	// resp is the result of the import so far.
+	resp *importResp
+
+	// localID is the ID of the local statistics instance.
+	localID string
+
+	// sourceID is the ID of the statistics instance the units have been
+	// exported from.
+	sourceID string
+
+	// batch are the decoded units not merged yet.
+	batch []*exportUnit
+
+	// limit is the number of hourly units within the statistics interval.
+	limit uint32
+}
+
+// importFrom decodes the exported statistics from r and merges them into the
+// local statistics by batches of importBatchSize units.  The decoding and the
+// preparation of the units are performed without holding the locks, so that
+// the processing of the requests isn't stalled.  The units merged before an
+// error remain merged, and importing the same data again skips them.
+func (s *StatsCtx) importFrom(r io.Reader) (resp *importResp, err error) {
+	s.importMu.Lock()
+	defer s.importMu.Unlock()
+
+	imp, err := s.newImporter()
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	err = imp.decode(json.NewDecoder(r))
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	err = imp.flush()
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	log.Debug(
+		"stats: imported %d units, skipped %d, duplicates %d",
+		imp.resp.Imported,
+		imp.resp.Skipped,
+		imp.resp.Duplicates,
+	)
+
+	return imp.resp, nil
+}
+
+// newImporter returns a new importer into s.
+func (s *StatsCtx) newImporter() (imp *importer, err error) {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	limit := uint32(s.limit.Hours())
+	if !s.enabled || limit == 0 {
+		return nil, errors.Error("statistics are disabled")
+	}
+
+	db := s.db.Load()
+	if db == nil {
+		return nil, errors.Error("no database")
+	}
+
+	return &importer{
+		stats:   s,
+		db:      db,
+		resp:    &importResp{},
+		localID: s.instanceID(),
+		batch:   make([]*exportUnit, 0, importBatchSize),
+		limit:   limit,
+	}, nil
+}
+
+// decode decodes the exported data from dec and merges its units.
+func (imp *importer) decode(dec *json.Decoder) (err error) {
+	err = expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+
+	hdr := &exportData{}
+	hasUnits := false
+	for dec.More() {
+		var key string
+		key, err = decodeKey(dec)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "version":
+			err = dec.Decode(&hdr.Version)
+		case "instance_id":
+			err = dec.Decode(&hdr.InstanceID)
+		case "units":
+			hasUnits = true
+			err = imp.decodeUnits(dec, hdr)
+		default:
+			err = dec.Decode(&json.RawMessage{})
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	if !hasUnits {
+		return fmt.Errorf("%w: no units", errImportMalformed)
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// decodeUnits validates hdr, then decodes the units from dec and merges them.
+func (imp *importer) decodeUnits(dec *json.Decoder, hdr *exportData) (err error) {
+	err = hdr.validate(imp.localID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errImportInvalid, err)
+	}
+
+	imp.sourceID = hdr.InstanceID
+
+	err = expectDelim(dec, '[')
+	if err != nil {
+		return err
+	}
+
+	for i := 0; dec.More(); i++ {
+		var eu *exportUnit
+		err = dec.Decode(&eu)
+		if err != nil {
+			return fmt.Errorf("%w: at index %d: %w", errImportMalformed, i, err)
+		}
+
+		err = eu.validate()
+		if err != nil {
+			return fmt.Errorf("%w: at index %d: %w", errImportInvalid, i, err)
+		}
+
+		imp.batch = append(imp.batch, eu)
+		if len(imp.batch) < importBatchSize {
+			continue
+		}
+
+		err = imp.flush()
+		if err != nil {
+			// Don't wrap the error, since it's informative enough as is.
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+// expectDelim returns an error if the next token of dec isn't delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) (err error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("%w: %w", errImportMalformed, err)
+	} else if tok != delim {
+		return fmt.Errorf("%w: unexpected %v, want %s", errImportMalformed, tok, delim)
+	}
+
+	return nil
+}
+
+// decodeKey returns the next key of the object being decoded by dec.
+func decodeKey(dec *json.Decoder) (key string, err error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errImportMalformed, err)
+	}
+
+	// The decoder itself ensures that the object keys are strings.
+	return tok.(string), nil
+}
+
+// flush merges the batch of the decoded units into the local statistics.  The
+// units of the current hour are merged into the current unit, the others are
+// merged into the stored ones within a single transaction.
+func (imp *importer) flush() (err error) {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+
+	defer func() { imp.batch = imp.batch[:0] }()
+
+	units, err := imp.newUnits()
+	if err != nil {
+		return fmt.Errorf("checking imported units: %w", err)
+	}
+
+	stored, merged := imp.stats.mergeCurrent(units, imp.limit)
+	imp.resp.Skipped += len(units) - len(stored) - len(merged)
+
+	err = imp.db.Update(func(tx *bbolt.Tx) (uErr error) {
+		return imp.mergeStored(tx, stored, merged)
+	})
+	imp.stats.invalidateRuleHits()
+	if err != nil {
+		return fmt.Errorf("merging units: %w", err)
+	}
+
+	imp.resp.Imported += len(stored) + len(merged)
+
+	return nil
+}
+
+// newUnits returns the units from the batch, which haven't been imported
+// before.
+func (imp *importer) newUnits() (units []*unit, err error) {
+	err = imp.db.View(func(tx *bbolt.Tx) (vErr error) {
+		bkt := tx.Bucket(importsBucketName)
+		for _, eu := range imp.batch {
+			if bkt != nil && bkt.Get(importKey(imp.sourceID, eu.ID)) != nil {
+				imp.resp.Duplicates++
+
+				continue
+			}
+
+			u := newUnit(eu.ID)
+			u.deserialize(&eu.unitDB)
+			units = append(units, u)
+		}
+
+		return nil
+	})
+
+	return units, err
+}
+
+// mergeCurrent merges the units with the ID of the current unit into it.  It
+// returns the rest of units within the statistics interval of limit hours and
+// the IDs of the merged ones.
+func (s *StatsCtx) mergeCurrent(units []*unit, limit uint32) (stored []*unit, merged []uint32) {
+	s.currMu.Lock()
+	defer s.currMu.Unlock()
+
+	curID := s.curr.id
+	for _, u := range units {
+		switch {
+		case u.id > curID || curID-u.id >= limit:
+			// Skip the units outside of the statistics interval.
+		case u.id == curID:
+			s.curr.merge(u)
+			merged = append(merged, u.id)
+		default:
+			stored = append(stored, u)
+		}
+	}
+
+	return stored, merged
+}
+
+// mergeStored merges units into the stored ones within tx and records the
+// imports of those along with the units with IDs from merged.
+func (imp *importer) mergeStored(tx *bbolt.Tx, units []*unit, merged []uint32) (err error) {
+	bkt, err := tx.CreateBucketIfNotExists(importsBucketName)
+	if err != nil {
+		return fmt.Errorf("creating imports bucket: %w", err)
+	}
+
+	for _, imported := range units {
+		u := newUnit(imported.id)
+		u.deserialize(loadUnitFromDB(tx, imported.id))
+		u.merge(imported)
+
+		err = u.serialize(imp.stats.seriesLimit).flushUnitToDB(tx, imported.id)
+		if err != nil {
+			return fmt.Errorf("unit %d: %w", imported.id, err)
+		}
+
+		merged = append(merged, imported.id)
+	}
+
+	for _, id := range merged {
+		err = bkt.Put(importKey(imp.sourceID, id), []byte{})
+		if err != nil {
+			return fmt.Errorf("recording import of unit %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// importKey returns the key of the unit with id imported from the statistics
+// instance with sourceID within the imports bucket.  The key starts with the
+// unit ID, so that the keys of the old units are easy to delete.
+func importKey(sourceID string, id uint32) (key []byte) {
+	key = binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(sourceID)), id)
+
+	return append(key, sourceID...)
+}
+
+// deleteOldImports deletes the keys of the imported units with IDs less than
+// firstID from the imports bucket within tx.
+func deleteOldImports(tx *bbolt.Tx, firstID uint32) (err error) {
+	bkt := tx.Bucket(importsBucketName)
+	if bkt == nil {
+		return nil
+	}
+
+	c := bkt.Cursor()
+	for k, _ := c.First(); len(k) >= 4 && binary.BigEndian.Uint32(k) < firstID; k, _ = c.First() {
+		err = c.Delete()
+		if err != nil {
+			return fmt.Errorf("deleting import of unit %d: %w", binary.BigEndian.Uint32(k), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+// newExportTestStats returns a new enabled *StatsCtx with the hourly unit IDs
+// from hourID.  The minute unit IDs are taken from it as well, so that the
+// minute units are rolled up on each flush.
+func newExportTestStats(t *testing.T, hourID *atomic.Uint32) (s *StatsCtx) {
+	t.Helper()
+
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            hourID.Load,
+		MinuteUnitID:      hourID.Load,
+		Filename:          filepath.Join(t.TempDir(), "stats.db"),
+		Limit:             timeutil.Day,
+		Enabled:           true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	return s
+}
+
+func TestStatsCtx_exportImport(t *testing.T) {
+	var hourID atomic.Uint32
+	hourID.Store(100)
+
+	src := newExportTestStats(t, &hourID)
+	dst := newExportTestStats(t, &hourID)
+
+	newEntry := func(domain string, res Result) (e *Entry) {
+		return &Entry{
+			Domain: domain,
+			Client: "127.0.0.1",
+			Result: res,
+			Time:   time.Millisecond,
+		}
+	}
+
+	src.Update(newEntry("example.org", RNotFiltered))
+	src.Update(newEntry("blocked.example", RFiltered))
+	dst.Update(newEntry("example.org", RNotFiltered))
+	dst.Update(newEntry("example.net", RNotFiltered))
+
+	hourID.Store(101)
+	src.flush()
+	dst.flush()
+
+	src.Update(newEntry("example.com", RNotFiltered))
+
+	w := httptest.NewRecorder()
+	src.handleExport(w, httptest.NewRequest(http.MethodGet, "/control/stats/export", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	exported := &exportData{}
+	err := json.Unmarshal(w.Body.Bytes(), exported)
+	require.NoError(t, err)
+
+	assert.Equal(t, exportVersion, exported.Version)
+	assert.Equal(t, src.instanceID(), exported.InstanceID)
+	assert.Len(t, exported.InstanceID, hex.EncodedLen(instanceIDLen))
+	require.Len(t, exported.Units, 2)
+	assert.Equal(t, uint32(100), exported.Units[0].ID)
+	assert.Equal(t, uint32(101), exported.Units[1].ID)
+
+	// Add a unit outside of the statistics interval.
+	exported.Units = append(exported.Units, &exportUnit{
+		unitDB: unitDB{NTotal: 1},
+		ID:     1,
+	})
+
+	body, err := json.Marshal(exported)
+	require.NoError(t, err)
+
+	importBody := func(t *testing.T, s *StatsCtx, body []byte) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/control/stats/import", bytes.NewReader(body))
+		s.handleImport(w, r)
+
+		return w
+	}
+
+	w = importBody(t, dst, body)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &importResp{}
+	err = json.Unmarshal(w.Body.Bytes(), resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, &importResp{Imported: 2, Skipped: 1}, resp)
+
+	t.Run("repeated", func(t *testing.T) {
+		rw := importBody(t, dst, body)
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		repResp := &importResp{}
+		err = json.Unmarshal(rw.Body.Bytes(), repResp)
+		require.NoError(t, err)
+
+		assert.Equal(t, &importResp{Skipped: 1, Duplicates: 2}, repResp)
+	})
+
+	t.Run("same_instance", func(t *testing.T) {
+		rw := importBody(t, src, body)
+		assert.Equal(t, http.StatusUnprocessableEntity, rw.Code)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		rw := importBody(t, dst, []byte(`{"version":1,"instance_id":"x","units":[{`))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	data, ok := dst.getData(timeUnitsHours, 24)
+	require.True(t, ok)
+
+	assert.Equal(t, []uint64{4, 1}, data.DNSQueries[22:])
+	assert.Equal(t, []uint64{1, 0}, data.BlockedFiltering[22:])
+	assert.Equal(t, []topAddrs{
+		{"example.org": 2},
+		{"example.com": 1},
+		{"example.net": 1},
+	}, data.TopQueried)
+	assert.Equal(t, []topAddrs{{"blocked.example": 1}}, data.TopBlocked)
+	assert.Equal(t, []topAddrs{{"127.0.0.1": 5}}, data.TopClients)
+	assert.Equal(t, float64(0.001), data.AvgProcessingTime)
+}
+
+func TestExportData_validate(t *testing.T) {
+	const localID = "local"
+
+	testCases := []struct {
+		data       *exportData
+		name       string
+		wantErrMsg string
+	}{{
+		data:       &exportData{Version: exportVersion, InstanceID: "remote"},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		data:       &exportData{Version: exportVersion + 1, InstanceID: "remote"},
+		name:       "bad_version",
+		wantErrMsg: "unsupported version 2, want 1",
+	}, {
+		data:       &exportData{Version: exportVersion},
+		name:       "no_instance_id",
+		wantErrMsg: "instance_id: empty",
+	}, {
+		data:       &exportData{Version: exportVersion, InstanceID: localID},
+		name:       "same_instance",
+		wantErrMsg: "instance_id: units are exported from this instance",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.data.validate(localID))
+		})
+	}
+}
+
+func TestExportUnit_validate(t *testing.T) {
+	testCases := []struct {
+		unit       *exportUnit
+		name       string
+		wantErrMsg string
+	}{{
+		unit:       &exportUnit{ID: 1},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		unit:       nil,
+		name:       "nil_unit",
+		wantErrMsg: "no unit",
+	}, {
+		unit: &exportUnit{
+			unitDB: unitDB{NResult: make([]uint64, resultLast+1)},
+		},
+		name:       "too_many_results",
+		wantErrMsg: "too many results: 8",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.unit.validate())
+		})
+	}
+}
+
+func TestDeleteOldImports(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "stats.db"), 0o644, nil)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, db.Close)
+
+	err = db.Update(func(tx *bbolt.Tx) (uErr error) {
+		bkt, uErr := tx.CreateBucket(importsBucketName)
+		require.NoError(t, uErr)
+
+		for _, id := range []uint32{1, 2, 3, 256} {
+			require.NoError(t, bkt.Put(importKey("a", id), []byte{}))
+			require.NoError(t, bkt.Put(importKey("b", id), []byte{}))
+		}
+
+		return deleteOldImports(tx, 3)
+	})
+	require.NoError(t, err)
+
+	var left []string
+	err = db.View(func(tx *bbolt.Tx) (vErr error) {
+		return tx.Bucket(importsBucketName).ForEach(func(k, _ []byte) (fErr error) {
+			left = append(left, fmt.Sprintf("%d%s", binary.BigEndian.Uint32(k), k[4:]))
+
+			return nil
+		})
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"3a", "3b", "256a", "256b"}, left)
+}
@@ -32,17 +32,27 @@ type StatsResp struct {
 	TopUpstreamsResponses []topAddrs      `json:"top_upstreams_responses"`
 	TopUpstreamsAvgTime   []topAddrsFloat `json:"top_upstreams_avg_time"`
 
+	TopQueryTypes   []topAddrs `json:"top_query_types"`
+	TopRCodes       []topAddrs `json:"top_rcodes"`
+	TopClientProtos []topAddrs `json:"top_client_protos"`
+
 	DNSQueries []uint64 `json:"dns_queries"`
 
 	BlockedFiltering     []uint64 `json:"blocked_filtering"`
 	ReplacedSafebrowsing []uint64 `json:"replaced_safebrowsing"`
 	ReplacedParental     []uint64 `json:"replaced_parental"`
+	Ratelimited          []uint64 `json:"ratelimited"`
+
+	QueryTypes   map[string][]uint64 `json:"query_types"`
+	RCodes       map[string][]uint64 `json:"rcodes"`
+	ClientProtos map[string][]uint64 `json:"client_protos"`
 
 	NumDNSQueries           uint64 `json:"num_dns_queries"`
 	NumBlockedFiltering     uint64 `json:"num_blocked_filtering"`
 	NumReplacedSafebrowsing uint64 `json:"num_replaced_safebrowsing"`
 	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
 	NumReplacedParental     uint64 `json:"num_replaced_parental"`
+	NumRatelimited          uint64 `json:"num_ratelimited"`
 
 	AvgProcessingTime float64 `json:"avg_processing_time"`
 }
@@ -51,6 +61,13 @@ type StatsResp struct {
 func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
+	timeUnits, err := parseTimeUnits(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
 	var (
 		resp *StatsResp
 		ok   bool
@@ -59,7 +76,7 @@ func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
 		s.confMu.RLock()
 		defer s.confMu.RUnlock()
 
-		resp, ok = s.getData(uint32(s.limit.Hours()))
+		resp, ok = s.getData(timeUnits, s.unitsLimit(timeUnits))
 	}()
 
 	log.Debug("stats: prepared data in %v", time.Since(start))
@@ -230,6 +247,10 @@ func (s *StatsCtx) initWeb() {
 	s.httpRegister(http.MethodPost, "/control/stats_reset", s.handleStatsReset)
 	s.httpRegister(http.MethodGet, "/control/stats/config", s.handleGetStatsConfig)
 	s.httpRegister(http.MethodPut, "/control/stats/config/update", s.handlePutStatsConfig)
+	s.httpRegister(http.MethodGet, "/control/stats/series/client", s.handleClientSeries)
+	s.httpRegister(http.MethodGet, "/control/stats/series/domain", s.handleDomainSeries)
+	s.httpRegister(http.MethodGet, "/control/stats/export", s.handleExport)
+	s.httpRegister(http.MethodPost, "/control/stats/import", s.handleImport)
 
 	// Deprecated handlers.
 	s.httpRegister(http.MethodGet, "/control/stats_info", s.handleStatsInfo)
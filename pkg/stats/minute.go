@@ -0,0 +1,253 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"go.etcd.io/bbolt"
+)
+
+// DefaultMinuteLimit is the default retention interval of the minute units.
+const DefaultMinuteLimit = 3 * time.Hour
+
+// maxMinuteLimit is the maximum retention interval of the minute units.
+const maxMinuteLimit = 24 * time.Hour
+
+// timeUnitsMinutes is the value of [StatsResp.TimeUnits] for the data from the
+// minute units.
+const timeUnitsMinutes = "minutes"
+
+// minutesBucketName is the name of the bucket containing the minute units.
+// It's shorter than bucketNameLen, so it's never taken for an hourly unit.
+var minutesBucketName = []byte("minutes")
+
+// newMinuteUnitID is the default UnitIDGenFunc for the minute units that
+// generates the unique id every minute.
+func newMinuteUnitID() (id uint32) {
+	const secsInMinute = int64(time.Minute / time.Second)
+
+	return uint32(time.Now().Unix() / secsInMinute)
+}
+
+// validateMinuteIvl returns an error if ivl isn't a valid retention interval of
+// the minute units.  Zero means that the minute units aren't kept.
+func validateMinuteIvl(ivl time.Duration) (err error) {
+	switch {
+	case ivl < 0:
+		return errors.Error("negative value")
+	case ivl%time.Minute != 0:
+		return errors.Error("not a whole number of minutes")
+	case ivl > maxMinuteLimit:
+		return fmt.Errorf("more than %s", maxMinuteLimit)
+	default:
+		return nil
+	}
+}
+
+// rotateMinute rolls the current minute unit up into the current hourly unit
+// and starts a new one with id, unless the current minute unit already has id.
+// finished is the previous minute unit, if it should be stored into the
+// database with [StatsCtx.flushMinute], and firstID is the ID of the oldest
+// minute unit to keep.
+func (s *StatsCtx) rotateMinute(id uint32) (finished *unit, firstID uint32) {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	s.currMu.Lock()
+	defer s.currMu.Unlock()
+
+	finished = s.currMinute
+	if finished == nil || finished.id == id {
+		return nil, 0
+	}
+
+	s.currMinute = newUnit(id)
+	s.curr.merge(finished)
+
+	limit := uint32(s.minuteLimit.Minutes())
+	if limit == 0 || finished.nTotal == 0 {
+		return nil, 0
+	}
+
+	s.flushingMinute = finished
+
+	return finished, id - limit
+}
+
+// flushMinute stores the finished minute unit into the database and deletes
+// the minute units older than firstID.  confMu and currMu are expected to be
+// unlocked, so that the requests aren't stalled by the database.
+func (s *StatsCtx) flushMinute(finished *unit, firstID uint32) {
+	defer func() {
+		s.currMu.Lock()
+		defer s.currMu.Unlock()
+
+		if s.flushingMinute == finished {
+			s.flushingMinute = nil
+		}
+	}()
+
+	db := s.db.Load()
+	if db == nil {
+		return
+	}
+
+	// The finished unit isn't modified anymore, so it's safe to serialize it
+	// without the lock.
+	udb := finished.serialize(s.seriesLimit)
+
+	err := db.Update(func(tx *bbolt.Tx) (uErr error) {
+		return udb.flushMinuteToDB(tx, finished.id, firstID)
+	})
+	if err != nil {
+		log.Error("stats: flushing minute unit: %s", err)
+	}
+}
+
+// flushMinuteToDB puts udb to the database at id and deletes the minute units
+// older than firstID.
+func (udb *unitDB) flushMinuteToDB(tx *bbolt.Tx, id, firstID uint32) (err error) {
+	log.Debug("stats: flushing minute unit with id %d and total of %d", id, udb.NTotal)
+
+	bkt, err := tx.CreateBucketIfNotExists(minutesBucketName)
+	if err != nil {
+		return fmt.Errorf("creating bucket: %w", err)
+	}
+
+	data, err := udb.encode()
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	err = bkt.Put(idToUnitName(id), data)
+	if err != nil {
+		return fmt.Errorf("putting unit to database: %w", err)
+	}
+
+	// The keys are sorted, so the oldest units come first.  Seek to the first
+	// key after each deletion, since deleting moves the cursor.
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.First() {
+		if kID, ok := unitNameToID(k); ok && kID >= firstID {
+			break
+		}
+
+		err = c.Delete()
+		if err != nil {
+			return fmt.Errorf("deleting unit: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// currHour returns the current hourly unit with the current minute unit rolled
+// up into it.  currMu is expected to be locked.
+func (s *StatsCtx) currHour() (u *unit) {
+	u = newUnit(s.curr.id)
+	u.merge(s.curr)
+	u.merge(s.currMinute)
+
+	return u
+}
+
+// loadMinuteUnits returns the stored minute units for the last limit minutes
+// and the current minute unit ID.
+func (s *StatsCtx) loadMinuteUnits(limit uint32) (units []*unitDB, curID uint32) {
+	db := s.db.Load()
+	if db == nil {
+		return nil, 0
+	}
+
+	// Use writable transaction to ensure any ongoing writable transaction is
+	// taken into account.
+	tx, err := db.Begin(true)
+	if err != nil {
+		log.Error("stats: opening transaction: %s", err)
+
+		return nil, 0
+	}
+
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	cur := s.currMinute
+	if cur != nil {
+		curID = cur.id
+	} else {
+		curID = s.minuteIDGen()
+	}
+
+	bkt := tx.Bucket(minutesBucketName)
+
+	units = make([]*unitDB, 0, limit)
+	for id := curID - limit + 1; id != curID; id++ {
+		var u *unitDB
+		if bkt != nil {
+			if data := bkt.Get(idToUnitName(id)); data != nil {
+				u = decodeUnit(data)
+			}
+		}
+
+		if u == nil && s.flushingMinute != nil && s.flushingMinute.id == id {
+			u = s.flushingMinute.serialize(s.seriesLimit)
+		}
+
+		if u == nil {
+			u = &unitDB{NResult: make([]uint64, resultLast)}
+		}
+
+		units = append(units, u)
+	}
+
+	err = finishTxn(tx, false)
+	if err != nil {
+		log.Error("stats: %s", err)
+	}
+
+	if cur != nil {
+		units = append(units, cur.serialize(s.seriesLimit))
+	} else {
+		units = append(units, &unitDB{NResult: make([]uint64, resultLast)})
+	}
+
+	return units, curID
+}
+
+// parseTimeUnits returns the time units of the data requested by the
+// resolution query parameter of r, either [timeUnitsHours] or
+// [timeUnitsMinutes].  The hourly data may be aggregated into days later.
+func parseTimeUnits(r *http.Request) (timeUnits string, err error) {
+	switch res := r.URL.Query().Get("resolution"); res {
+	case "", "hour":
+		return timeUnitsHours, nil
+	case "minute":
+		return timeUnitsMinutes, nil
+	default:
+		return "", fmt.Errorf("resolution: unsupported value %q", res)
+	}
+}
+
+// unitsLimit returns the number of the units of timeUnits to return.  s.confMu
+// is expected to be locked.
+func (s *StatsCtx) unitsLimit(timeUnits string) (limit uint32) {
+	if timeUnits == timeUnitsMinutes {
+		return uint32(s.minuteLimit.Minutes())
+	}
+
+	return uint32(s.limit.Hours())
+}
+
+// loadUnitsOf returns the last limit units of timeUnits and the current unit
+// ID.
+func (s *StatsCtx) loadUnitsOf(timeUnits string, limit uint32) (units []*unitDB, curID uint32) {
+	if timeUnits == timeUnitsMinutes {
+		return s.loadMinuteUnits(limit)
+	}
+
+	return s.loadUnits(limit)
+}
@@ -0,0 +1,318 @@
+package stats
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/jynychen/AdGuardHome/pkg/filtering"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// maxRules is the max number of the most matched rules of the filter lists to
+// keep in each unit.  The user rules are always kept, since those are bounded
+// by the configuration, and their numbers are used to find the unused ones.
+const maxRules = 1000
+
+// Rule is a filtering rule matched by the request.
+type Rule struct {
+	// Text is the text of the rule.
+	Text string
+
+	// FilterListID is the ID of the rule's filter list.
+	FilterListID int64
+}
+
+// filterListPair is a single filter list ID with the number of matched
+// requests for deserializing statistics data into the database.
+type filterListPair struct {
+	ID    int64
+	Count uint64
+}
+
+// rulePair is a single rule with the number of matched requests for
+// deserializing statistics data into the database.
+type rulePair struct {
+	Text         string
+	FilterListID int64
+	Count        uint64
+}
+
+// addRules counts the requests matched by rules in u.  The request is counted
+// only once for each filter list.
+func (u *unit) addRules(rules []Rule) {
+	for i, r := range rules {
+		if r.Text == "" {
+			continue
+		}
+
+		u.rules[r]++
+
+		countedList := slices.ContainsFunc(rules[:i], func(prev Rule) (ok bool) {
+			return prev.Text != "" && prev.FilterListID == r.FilterListID
+		})
+		if !countedList {
+			u.filterLists[r.FilterListID]++
+		}
+	}
+}
+
+// convertFilterListsToSlice returns the pairs from m sorted by ID.
+func convertFilterListsToSlice(m map[int64]uint64) (s []filterListPair) {
+	s = make([]filterListPair, 0, len(m))
+	for id, n := range m {
+		s = append(s, filterListPair{ID: id, Count: n})
+	}
+
+	slices.SortFunc(s, func(a, b filterListPair) (res int) {
+		switch {
+		case a.ID < b.ID:
+			return -1
+		case a.ID > b.ID:
+			return +1
+		default:
+			return 0
+		}
+	})
+
+	return s
+}
+
+// convertRulesToSlice returns the pairs of all the user rules and at most max
+// pairs of the other rules with the largest numbers of matched requests from m.
+func convertRulesToSlice(m map[Rule]uint64, max int) (s []rulePair) {
+	s = make([]rulePair, 0, len(m))
+	for r, n := range m {
+		s = append(s, rulePair{Text: r.Text, FilterListID: r.FilterListID, Count: n})
+	}
+
+	slices.SortFunc(s, func(a, b rulePair) (res int) {
+		switch {
+		case a.Count > b.Count:
+			return -1
+		case a.Count < b.Count:
+			return +1
+		case a.FilterListID != b.FilterListID:
+			if a.FilterListID < b.FilterListID {
+				return -1
+			}
+
+			return +1
+		default:
+			return strings.Compare(a.Text, b.Text)
+		}
+	})
+
+	kept := 0
+
+	return slices.DeleteFunc(s, func(p rulePair) (ok bool) {
+		if p.FilterListID == filtering.CustomListID {
+			return false
+		}
+
+		kept++
+
+		return kept > max
+	})
+}
+
+// ruleHits contains the numbers of requests matched by the rules of each
+// filter list and by each rule within the stored hourly units.
+type ruleHits struct {
+	// lists are the numbers of requests by the filter list IDs.
+	lists map[int64]uint64
+
+	// rules are the numbers of requests by the rule texts, grouped by the
+	// filter list IDs.
+	rules map[int64]map[string]uint64
+
+	// curID is the ID of the current unit, which isn't stored yet.
+	curID uint32
+
+	// limit is the number of hourly units including the current one.
+	limit uint32
+}
+
+// add adds the numbers of requests from the filter list pairs and the rule
+// pairs to h.
+func (h *ruleHits) add(lists []filterListPair, rules []rulePair) {
+	for _, lp := range lists {
+		h.lists[lp.ID] += lp.Count
+	}
+
+	for _, rp := range rules {
+		h.addRule(rp.FilterListID, rp.Text, rp.Count)
+	}
+}
+
+// addRule adds n requests matched by the rule with text from the filter list
+// with listID to h.
+func (h *ruleHits) addRule(listID int64, text string, n uint64) {
+	listRules := h.rules[listID]
+	if listRules == nil {
+		listRules = map[string]uint64{}
+		h.rules[listID] = listRules
+	}
+
+	listRules[text] += n
+}
+
+// clone returns a deep copy of h.
+func (h *ruleHits) clone() (c *ruleHits) {
+	c = &ruleHits{
+		lists: maps.Clone(h.lists),
+		rules: make(map[int64]map[string]uint64, len(h.rules)),
+		curID: h.curID,
+		limit: h.limit,
+	}
+
+	for id, listRules := range h.rules {
+		c.rules[id] = maps.Clone(listRules)
+	}
+
+	return c
+}
+
+// RuleHits implements the [Interface] interface for *StatsCtx.  The numbers
+// are for the statistics interval, and the rules of the filter lists with few
+// matches within an hour may be missing, see maxRules.  It returns nil maps if
+// the statistics are disabled.
+func (s *StatsCtx) RuleHits() (lists map[int64]uint64, rules map[int64]map[string]uint64) {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	limit := uint32(s.limit.Hours())
+	if !s.enabled || limit == 0 {
+		return nil, nil
+	}
+
+	stored := s.storedRuleHits(limit)
+	if stored == nil {
+		return nil, nil
+	}
+
+	h := stored.clone()
+
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	// The current unit may have been flushed after the stored numbers have
+	// been loaded, so only add it if it's still the one those are missing.
+	if s.curr == nil || s.curr.id != h.curID {
+		return h.lists, h.rules
+	}
+
+	for _, u := range []*unit{s.curr, s.currMinute} {
+		if u == nil {
+			continue
+		}
+
+		for id, n := range u.filterLists {
+			h.lists[id] += n
+		}
+
+		for r, n := range u.rules {
+			h.addRule(r.FilterListID, r.Text, n)
+		}
+	}
+
+	return h.lists, h.rules
+}
+
+// storedRuleHits returns the numbers of requests matched by the rules within
+// the stored hourly units for the last limit hours.  The numbers are cached
+// until the current unit is flushed, see [StatsCtx.invalidateRuleHits].  h
+// must not be modified.  It returns nil if the database isn't opened.
+func (s *StatsCtx) storedRuleHits(limit uint32) (h *ruleHits) {
+	gen, h := s.cachedRuleHits()
+	if h != nil && h.limit == limit && h.curID == s.currID() {
+		return h
+	}
+
+	h = s.loadRuleHits(limit)
+	if h == nil {
+		return nil
+	}
+
+	s.hitsMu.Lock()
+	defer s.hitsMu.Unlock()
+
+	// Don't cache the numbers if the stored units have been changed since
+	// those have been loaded.
+	if gen == s.hitsGen {
+		s.hits = h
+	}
+
+	return h
+}
+
+// cachedRuleHits returns the cached numbers of requests matched by the rules,
+// if any, and the current generation of the stored units.
+func (s *StatsCtx) cachedRuleHits() (gen uint64, h *ruleHits) {
+	s.hitsMu.Lock()
+	defer s.hitsMu.Unlock()
+
+	return s.hitsGen, s.hits
+}
+
+// invalidateRuleHits forgets the cached numbers of requests matched by the
+// rules.  It must be called after the stored units have been changed other
+// than by flushing the current unit.
+func (s *StatsCtx) invalidateRuleHits() {
+	s.hitsMu.Lock()
+	defer s.hitsMu.Unlock()
+
+	s.hitsGen++
+	s.hits = nil
+}
+
+// currID returns the ID of the current unit.
+func (s *StatsCtx) currID() (id uint32) {
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	if s.curr == nil {
+		return s.unitIDGen()
+	}
+
+	return s.curr.id
+}
+
+// loadRuleHits loads the numbers of requests matched by the rules within the
+// stored hourly units for the last limit hours.  It returns nil if the
+// database isn't opened.
+func (s *StatsCtx) loadRuleHits(limit uint32) (h *ruleHits) {
+	db := s.db.Load()
+	if db == nil {
+		return nil
+	}
+
+	// Use writable transaction to ensure any ongoing writable transaction is
+	// taken into account.
+	tx, err := db.Begin(true)
+	if err != nil {
+		log.Error("stats: opening transaction: %s", err)
+
+		return nil
+	}
+	defer func() {
+		if err = finishTxn(tx, false); err != nil {
+			log.Error("stats: %s", err)
+		}
+	}()
+
+	h = &ruleHits{
+		lists: map[int64]uint64{},
+		rules: map[int64]map[string]uint64{},
+		curID: s.currID(),
+		limit: limit,
+	}
+
+	for id := h.curID - limit + 1; id != h.curID; id++ {
+		if udb := loadUnitFromDB(tx, id); udb != nil {
+			h.add(udb.FilterLists, udb.Rules)
+		}
+	}
+
+	return h
+}
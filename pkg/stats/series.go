@@ -0,0 +1,217 @@
+package stats
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jynychen/AdGuardHome/pkg/aghhttp"
+	"golang.org/x/exp/slices"
+)
+
+// DefaultSeriesLimit is the default maximum number of the clients and of the
+// domains, for which the series are kept in each unit.
+const DefaultSeriesLimit = 1000
+
+// seriesPair is a single name with the numbers of requests for deserializing
+// statistics data into the database.
+type seriesPair struct {
+	Name    string
+	Count   uint64
+	Blocked uint64
+}
+
+// convertMapsToSeries returns at most max pairs with the largest numbers of
+// requests from counts, with the numbers of blocked requests from blocked.
+// max of zero means no series.
+func convertMapsToSeries(counts, blocked map[string]uint64, max int) (s []seriesPair) {
+	if max <= 0 {
+		return nil
+	}
+
+	s = make([]seriesPair, 0, len(counts))
+	for k, v := range counts {
+		s = append(s, seriesPair{Name: k, Count: v, Blocked: blocked[k]})
+	}
+
+	slices.SortFunc(s, func(a, b seriesPair) (res int) {
+		switch x, y := a.Count, b.Count; {
+		case x > y:
+			return -1
+		case x < y:
+			return +1
+		default:
+			return strings.Compare(a.Name, b.Name)
+		}
+	})
+
+	if max > len(s) {
+		max = len(s)
+	}
+
+	return s[:max]
+}
+
+// domainTotals returns the number of requests for each domain name, both
+// blocked and not.
+func (u *unit) domainTotals() (m map[string]uint64) {
+	m = make(map[string]uint64, len(u.domains)+len(u.blockedDomains))
+	for k, v := range u.domains {
+		m[k] += v
+	}
+
+	for k, v := range u.blockedDomains {
+		m[k] += v
+	}
+
+	return m
+}
+
+// SeriesResp is a response to the GET /control/stats/series/client and GET
+// /control/stats/series/domain HTTP APIs.
+type SeriesResp struct {
+	// Name is the client or the domain name of the series.
+	Name string `json:"name"`
+
+	// TimeUnits is the time unit of the series, the same as in [StatsResp].
+	TimeUnits string `json:"time_units"`
+
+	// DNSQueries is the number of requests in each time unit.
+	DNSQueries []uint64 `json:"dns_queries"`
+
+	// Blocked is the number of blocked requests in each time unit.
+	Blocked []uint64 `json:"blocked"`
+
+	// NumDNSQueries is the total number of requests.
+	NumDNSQueries uint64 `json:"num_dns_queries"`
+
+	// NumBlocked is the total number of blocked requests.
+	NumBlocked uint64 `json:"num_blocked"`
+}
+
+// seriesGetter is a signature for the function returning the series of a unit.
+type seriesGetter func(u *unitDB) (series []seriesPair)
+
+// handleClientSeries is the handler for the GET /control/stats/series/client
+// HTTP API.
+func (s *StatsCtx) handleClientSeries(w http.ResponseWriter, r *http.Request) {
+	s.handleSeries(w, r, func(u *unitDB) (series []seriesPair) { return u.ClientsSeries })
+}
+
+// handleDomainSeries is the handler for the GET /control/stats/series/domain
+// HTTP API.
+func (s *StatsCtx) handleDomainSeries(w http.ResponseWriter, r *http.Request) {
+	s.handleSeries(w, r, func(u *unitDB) (series []seriesPair) { return u.DomainsSeries })
+}
+
+// handleSeries writes the series of the name from the request's query string
+// using sg to retrieve them from units.
+func (s *StatsCtx) handleSeries(w http.ResponseWriter, r *http.Request, sg seriesGetter) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "name is required")
+
+		return
+	}
+
+	timeUnits, err := parseTimeUnits(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	var (
+		resp *SeriesResp
+		ok   bool
+	)
+	func() {
+		s.confMu.RLock()
+		defer s.confMu.RUnlock()
+
+		resp, ok = s.getSeries(name, timeUnits, s.unitsLimit(timeUnits), sg)
+	}()
+
+	if !ok {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+
+		return
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// getSeries returns the series of the name for the last limit units of
+// timeUnits, which is the same as in [StatsCtx.getData].
+func (s *StatsCtx) getSeries(
+	name string,
+	timeUnits string,
+	limit uint32,
+	sg seriesGetter,
+) (resp *SeriesResp, ok bool) {
+	if limit == 0 {
+		if timeUnits != timeUnitsMinutes {
+			timeUnits = timeUnitsDays
+		}
+
+		return &SeriesResp{
+			Name:       name,
+			TimeUnits:  timeUnits,
+			DNSQueries: []uint64{},
+			Blocked:    []uint64{},
+		}, true
+	}
+
+	units, curID := s.loadUnitsOf(timeUnits, limit)
+	if units == nil {
+		return nil, false
+	}
+
+	return seriesFromUnits(name, units, curID, timeUnits, sg), true
+}
+
+// seriesFromUnits collects the series of the name from units of timeUnits.
+// Like [StatsCtx.fillCollectedStats], it aggregates the hourly data into days
+// if there are more than seven days of them.
+func seriesFromUnits(
+	name string,
+	units []*unitDB,
+	curID uint32,
+	timeUnits string,
+	sg seriesGetter,
+) (resp *SeriesResp) {
+	size := len(units)
+	resp = &SeriesResp{
+		Name:      name,
+		TimeUnits: timeUnits,
+	}
+
+	perUnit := 1
+	if days := size / 24; timeUnits == timeUnitsHours && days > 7 {
+		size = days
+		resp.TimeUnits = timeUnitsDays
+		perUnit = 24
+
+		// See the comment in fillCollectedStatsDaily.
+		units = units[len(units)-countHours(curID, days):]
+	}
+
+	resp.DNSQueries = make([]uint64, size)
+	resp.Blocked = make([]uint64, size)
+
+	for i, u := range units {
+		for _, sp := range sg(u) {
+			if sp.Name != name {
+				continue
+			}
+
+			resp.DNSQueries[i/perUnit] += sp.Count
+			resp.Blocked[i/perUnit] += sp.Blocked
+			resp.NumDNSQueries += sp.Count
+			resp.NumBlocked += sp.Blocked
+
+			break
+		}
+	}
+
+	return resp
+}
@@ -3,6 +3,8 @@
 package stats
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net/netip"
@@ -47,6 +49,11 @@ type Config struct {
 	// nil, the default function is used, see newUnitID.
 	UnitID UnitIDGenFunc
 
+	// MinuteUnitID is the function to generate the identifier for current
+	// minute unit.  If nil, the default function is used, see
+	// newMinuteUnitID.
+	MinuteUnitID UnitIDGenFunc
+
 	// ConfigModified will be called each time the configuration changed via web
 	// interface.
 	ConfigModified func()
@@ -68,6 +75,16 @@ type Config struct {
 	// Limit is an upper limit for collecting statistics.
 	Limit time.Duration
 
+	// MinuteLimit is the retention interval of the minute units, which are
+	// kept in addition to the hourly ones.  It must be a whole number of
+	// minutes not greater than a day.  If it's zero, the minute units aren't
+	// kept.
+	MinuteLimit time.Duration
+
+	// SeriesLimit is the maximum number of the clients and of the domains, for
+	// which the hourly series are kept.  If it's zero, the series aren't kept.
+	SeriesLimit uint32
+
 	// Enabled tells if the statistics are enabled.
 	Enabled bool
 }
@@ -91,6 +108,10 @@ type Interface interface {
 
 	// ShouldCount returns true if request for the host should be counted.
 	ShouldCount(host string, qType, qClass uint16, ids []string) bool
+
+	// RuleHits returns the numbers of requests matched by the rules of each
+	// filter list and by each rule, grouped by the filter list ID.
+	RuleHits() (lists map[int64]uint64, rules map[int64]map[string]uint64)
 }
 
 // StatsCtx collects the statistics and flushes it to the database.  Its default
@@ -98,8 +119,15 @@ type Interface interface {
 type StatsCtx struct {
 	// currMu protects curr.
 	currMu *sync.RWMutex
-	// curr is the actual statistics collection result.
+	// curr is the actual statistics collection result.  It doesn't contain
+	// the data of currMinute, which is rolled up into it every minute.
 	curr *unit
+	// currMinute is the statistics collection result of the current minute.
+	currMinute *unit
+	// flushingMinute is the finished minute unit being stored into the
+	// database, if any.  It's kept to serve the minute statistics until it's
+	// stored.
+	flushingMinute *unit
 
 	// db is the opened statistics database, if any.
 	db atomic.Pointer[bbolt.DB]
@@ -108,6 +136,10 @@ type StatsCtx struct {
 	// unit.  It's here for only testing purposes.
 	unitIDGen UnitIDGenFunc
 
+	// minuteIDGen is the function that generates an identifier for the current
+	// minute unit.  It's here for only testing purposes.
+	minuteIDGen UnitIDGenFunc
+
 	// httpRegister is used to set HTTP handlers.
 	httpRegister aghhttp.RegisterFunc
 
@@ -115,6 +147,21 @@ type StatsCtx struct {
 	// interface.
 	configModified func()
 
+	// importMu serializes the imports of the statistics, so that the same units
+	// aren't imported twice concurrently.
+	importMu *sync.Mutex
+
+	// hitsMu protects hits and hitsGen.
+	hitsMu *sync.Mutex
+
+	// hits are the cached numbers of requests matched by the rules within the
+	// stored hourly units, if any.
+	hits *ruleHits
+
+	// hitsGen is incremented each time the stored hourly units are changed
+	// other than by flushing the current unit.
+	hitsGen uint64
+
 	// confMu protects ignored, limit, and enabled.
 	confMu *sync.RWMutex
 
@@ -128,9 +175,16 @@ type StatsCtx struct {
 	// filename is the name of database file.
 	filename string
 
+	// seriesLimit is the maximum number of the clients and of the domains, for
+	// which the hourly series are kept.
+	seriesLimit int
+
 	// limit is an upper limit for collecting statistics.
 	limit time.Duration
 
+	// minuteLimit is the retention interval of the minute units.
+	minuteLimit time.Duration
+
 	// enabled tells if the statistics are enabled.
 	enabled bool
 }
@@ -145,6 +199,11 @@ func New(conf Config) (s *StatsCtx, err error) {
 		return nil, fmt.Errorf("unsupported interval: %w", err)
 	}
 
+	err = validateMinuteIvl(conf.MinuteLimit)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported minute interval: %w", err)
+	}
+
 	if conf.ShouldCountClient == nil {
 		return nil, errors.Error("should count client is unspecified")
 	}
@@ -153,12 +212,16 @@ func New(conf Config) (s *StatsCtx, err error) {
 		currMu:         &sync.RWMutex{},
 		httpRegister:   conf.HTTPRegister,
 		configModified: conf.ConfigModified,
+		importMu:       &sync.Mutex{},
+		hitsMu:         &sync.Mutex{},
 		filename:       conf.Filename,
+		seriesLimit:    int(conf.SeriesLimit),
 
 		confMu:            &sync.RWMutex{},
 		ignored:           conf.Ignored,
 		shouldCountClient: conf.ShouldCountClient,
 		limit:             conf.Limit,
+		minuteLimit:       conf.MinuteLimit,
 		enabled:           conf.Enabled,
 	}
 
@@ -166,6 +229,10 @@ func New(conf Config) (s *StatsCtx, err error) {
 		s.unitIDGen = conf.UnitID
 	}
 
+	if s.minuteIDGen = newMinuteUnitID; conf.MinuteUnitID != nil {
+		s.minuteIDGen = conf.MinuteUnitID
+	}
+
 	// TODO(e.burkov):  Move the code below to the Start method.
 
 	err = s.openDB()
@@ -191,6 +258,7 @@ func New(conf Config) (s *StatsCtx, err error) {
 
 	s.curr = newUnit(id)
 	s.curr.deserialize(udb)
+	s.currMinute = newUnit(s.minuteIDGen())
 
 	log.Debug("stats: initialized")
 
@@ -252,7 +320,7 @@ func (s *StatsCtx) Close() (err error) {
 	s.currMu.RLock()
 	defer s.currMu.RUnlock()
 
-	udb := s.curr.serialize()
+	udb := s.currHour().serialize(s.seriesLimit)
 
 	return udb.flushUnitToDB(tx, s.curr.id)
 }
@@ -277,13 +345,13 @@ func (s *StatsCtx) Update(e *Entry) {
 	s.currMu.Lock()
 	defer s.currMu.Unlock()
 
-	if s.curr == nil {
+	if s.currMinute == nil {
 		log.Error("stats: current unit is nil")
 
 		return
 	}
 
-	s.curr.add(e)
+	s.currMinute.add(e)
 }
 
 // WriteDiskConfig implements the [Interface] interface for *StatsCtx.
@@ -341,6 +409,12 @@ func deleteOldUnits(tx *bbolt.Tx, firstID uint32) (deleted int) {
 	const errStop errors.Error = "stop iteration"
 
 	walk := func(name []byte, _ *bbolt.Bucket) (err error) {
+		if bytes.Equal(name, metaBucketName) ||
+			bytes.Equal(name, minutesBucketName) ||
+			bytes.Equal(name, importsBucketName) {
+			return nil
+		}
+
 		nameID, ok := unitNameToID(name)
 		if ok && nameID >= firstID {
 			return errStop
@@ -383,6 +457,18 @@ func (s *StatsCtx) openDB() (err error) {
 		return err
 	}
 
+	err = db.Update(func(tx *bbolt.Tx) (uErr error) {
+		uErr = migrateDB(tx)
+		if uErr != nil {
+			return fmt.Errorf("migrating: %w", uErr)
+		}
+
+		return initInstanceID(tx)
+	})
+	if err != nil {
+		return errors.WithDeferred(err, db.Close())
+	}
+
 	// Use defer to unlock the mutex as soon as possible.
 	defer log.Debug("stats: database opened")
 
@@ -391,9 +477,86 @@ func (s *StatsCtx) openDB() (err error) {
 	return nil
 }
 
+// metaBucketName is the name of the bucket containing the metadata of the
+// database.  It's shorter than bucketNameLen, so it's never taken for a unit.
+var metaBucketName = []byte("meta")
+
+// schemaVersionKey is the key of the schema version within the metadata
+// bucket.
+var schemaVersionKey = []byte("schema_version")
+
+// schemaVersion is the current version of the database schema.  The databases
+// without the version are of version 1.  Version 2 adds the numbers of requests
+// by the question's type, the response code, and the client protocol to the
+// units.
+const schemaVersion uint32 = 2
+
+// migrateDB upgrades the units stored in tx to the current schema version and
+// stores the version.
+func migrateDB(tx *bbolt.Tx) (err error) {
+	meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+	if err != nil {
+		return fmt.Errorf("creating meta bucket: %w", err)
+	}
+
+	var version uint32 = 1
+	if v := meta.Get(schemaVersionKey); len(v) == 4 {
+		version = binary.BigEndian.Uint32(v)
+	}
+
+	switch {
+	case version == schemaVersion:
+		return nil
+	case version > schemaVersion:
+		log.Info("stats: database schema version %d is newer than %d", version, schemaVersion)
+
+		return nil
+	}
+
+	log.Info("stats: migrating database from schema version %d to %d", version, schemaVersion)
+
+	var ids []uint32
+	err = tx.ForEach(func(name []byte, _ *bbolt.Bucket) (fErr error) {
+		if id, ok := unitNameToID(name); ok {
+			ids = append(ids, id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing units: %w", err)
+	}
+
+	// Re-encode the units, so that they're stored with the current schema.
+	// The breakdowns of the old units remain empty, since the data for them
+	// has never been collected.
+	for _, id := range ids {
+		udb := loadUnitFromDB(tx, id)
+		if udb == nil {
+			continue
+		}
+
+		err = udb.flushUnitToDB(tx, id)
+		if err != nil {
+			return fmt.Errorf("unit %d: %w", id, err)
+		}
+	}
+
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, schemaVersion)
+
+	return meta.Put(schemaVersionKey, v)
+}
+
 func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 	id := s.unitIDGen()
 
+	// Store the finished minute unit without holding the locks, since it's
+	// done every minute.
+	if finished, firstID := s.rotateMinute(s.minuteIDGen()); finished != nil {
+		s.flushMinute(finished, firstID)
+	}
+
 	s.confMu.Lock()
 	defer s.confMu.Unlock()
 
@@ -436,7 +599,7 @@ func (s *StatsCtx) flushDB(id, limit uint32, ptr *unit) (cont bool, sleepFor tim
 
 	s.curr = newUnit(id)
 
-	flushErr := ptr.serialize().flushUnitToDB(tx, ptr.id)
+	flushErr := ptr.serialize(s.seriesLimit).flushUnitToDB(tx, ptr.id)
 	if flushErr != nil {
 		log.Error("stats: flushing unit: %s", flushErr)
 		isCommitable = false
@@ -454,11 +617,18 @@ func (s *StatsCtx) flushDB(id, limit uint32, ptr *unit) (cont bool, sleepFor tim
 		}
 	}
 
+	delErr = deleteOldImports(tx, id-limit+1)
+	if delErr != nil {
+		isCommitable = false
+		log.Error("stats: %s", delErr)
+	}
+
 	return true, 0
 }
 
 // periodicFlush checks and flushes the unit to the database if the freshly
 // generated unit ID differs from the current's ID.  Flushing process includes:
+//   - rolling the current minute unit up into the current unit;
 //   - swapping the current unit with the new empty one;
 //   - writing the current unit to the database;
 //   - removing the stale unit from the database.
@@ -533,6 +703,10 @@ func (s *StatsCtx) clear() (err error) {
 	defer s.currMu.Unlock()
 
 	s.curr = newUnit(s.unitIDGen())
+	s.currMinute = newUnit(s.minuteIDGen())
+	s.flushingMinute = nil
+
+	s.invalidateRuleHits()
 
 	return nil
 }
@@ -581,7 +755,7 @@ func (s *StatsCtx) loadUnits(limit uint32) (units []*unitDB, curID uint32) {
 	}
 
 	if cur != nil {
-		units = append(units, cur.serialize())
+		units = append(units, s.currHour().serialize(s.seriesLimit))
 	}
 
 	if unitsLen := len(units); unitsLen != int(limit) {
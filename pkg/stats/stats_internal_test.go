@@ -1,6 +1,8 @@
 package stats
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"path/filepath"
 	"sync"
@@ -12,6 +14,7 @@ import (
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
 )
 
 func TestStats_races(t *testing.T) {
@@ -52,7 +55,7 @@ func TestStats_races(t *testing.T) {
 
 		<-waitCh
 
-		_, _ = s.getData(24)
+		_, _ = s.getData(timeUnitsHours, 24)
 	}
 
 	const (
@@ -164,7 +167,276 @@ func TestStatsCtx_DataFromUnits_month(t *testing.T) {
 
 	var h uint32
 	for h = 1; h <= hoursInMonth; h++ {
-		data := s.dataFromUnits(units[:h], curID)
+		data := s.dataFromUnits(units[:h], curID, timeUnitsHours)
 		require.NotNil(t, data)
 	}
 }
+
+func TestStatsCtx_migrateDB(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "stats.db")
+
+	// legacyUnitDB is the unit of schema version 1.
+	type legacyUnitDB struct {
+		NResult []uint64
+		Domains []countPair
+		NTotal  uint64
+	}
+
+	const id uint32 = 100
+
+	db, err := bbolt.Open(filename, 0o644, nil)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *bbolt.Tx) (uErr error) {
+		bkt, uErr := tx.CreateBucket(idToUnitName(id))
+		require.NoError(t, uErr)
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, gob.NewEncoder(buf).Encode(legacyUnitDB{
+			NResult: []uint64{0, 1, 0, 0, 0, 0},
+			Domains: []countPair{{Name: "example.org", Count: 1}},
+			NTotal:  1,
+		}))
+
+		return bkt.Put([]byte{0}, buf.Bytes())
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            func() (curID uint32) { return id + 1 },
+		Filename:          filename,
+		Limit:             timeutil.Day,
+		Enabled:           true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	err = s.db.Load().View(func(tx *bbolt.Tx) (vErr error) {
+		meta := tx.Bucket(metaBucketName)
+		require.NotNil(t, meta)
+
+		assert.Equal(t, []byte{0, 0, 0, 2}, meta.Get(schemaVersionKey))
+
+		udb := loadUnitFromDB(tx, id)
+		require.NotNil(t, udb)
+
+		assert.Equal(t, uint64(1), udb.NTotal)
+		assert.Len(t, udb.NResult, int(resultLast))
+		assert.Equal(t, []countPair{{Name: "example.org", Count: 1}}, udb.Domains)
+		assert.Empty(t, udb.QTypes)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Make sure that the metadata survives the deletion of the old units.
+	err = s.db.Load().Update(func(tx *bbolt.Tx) (uErr error) {
+		deleteOldUnits(tx, id+1)
+
+		assert.NotNil(t, tx.Bucket(metaBucketName))
+		assert.Nil(t, tx.Bucket(idToUnitName(id)))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBreakdown_daily(t *testing.T) {
+	const daysCount = 10
+
+	units := make([]*unitDB, 0, daysCount*24)
+	for i := 0; i < daysCount*24; i++ {
+		units = append(units, &unitDB{
+			NResult: make([]uint64, resultLast),
+			QTypes: []countPair{{
+				Name:  "A",
+				Count: 2,
+			}, {
+				Name:  "AAAA",
+				Count: 1,
+			}},
+		})
+	}
+
+	top, series := breakdown(timeUnitsDays, units, daysCount*24, qTypePairs)
+	assert.Equal(t, []topAddrs{{"A": daysCount * 48}, {"AAAA": daysCount * 24}}, top)
+
+	wantA, wantAAAA := make([]uint64, daysCount), make([]uint64, daysCount)
+	for i := range wantA {
+		wantA[i], wantAAAA[i] = 48, 24
+	}
+
+	assert.Equal(t, map[string][]uint64{"A": wantA, "AAAA": wantAAAA}, series)
+}
+
+func TestStatsCtx_minutes(t *testing.T) {
+	var hourID, minuteID atomic.Uint32
+	minuteID.Store(100)
+
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            hourID.Load,
+		MinuteUnitID:      minuteID.Load,
+		Filename:          filepath.Join(t.TempDir(), "stats.db"),
+		Limit:             timeutil.Day,
+		MinuteLimit:       10 * time.Minute,
+		Enabled:           true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	e := &Entry{
+		Domain: "example.org",
+		Client: "127.0.0.1",
+		Result: RNotFiltered,
+	}
+
+	// lastUnits returns the numbers of requests in the last two units.
+	lastUnits := func(timeUnits string, limit uint32) (got []uint64) {
+		data, ok := s.getData(timeUnits, limit)
+		require.True(t, ok)
+		require.Equal(t, timeUnits, data.TimeUnits)
+		require.Len(t, data.DNSQueries, int(limit))
+
+		return data.DNSQueries[limit-2:]
+	}
+
+	s.Update(e)
+	s.Update(e)
+	s.flush()
+
+	assert.Equal(t, []uint64{0, 2}, lastUnits(timeUnitsMinutes, 10))
+	assert.Equal(t, []uint64{0, 2}, lastUnits(timeUnitsHours, 24))
+
+	// The finished minute unit is served while it's being stored.
+	minuteID.Store(101)
+	finished, firstID := s.rotateMinute(minuteID.Load())
+	require.NotNil(t, finished)
+
+	assert.Equal(t, []uint64{2, 0}, lastUnits(timeUnitsMinutes, 10))
+
+	s.flushMinute(finished, firstID)
+	assert.Nil(t, s.flushingMinute)
+
+	s.flush()
+	s.Update(e)
+
+	assert.Equal(t, []uint64{2, 1}, lastUnits(timeUnitsMinutes, 10))
+	assert.Equal(t, []uint64{0, 3}, lastUnits(timeUnitsHours, 24))
+
+	// The minute units older than the limit are deleted, while the data rolled
+	// up into the hourly unit is kept.
+	minuteID.Store(115)
+	hourID.Store(1)
+	s.flush()
+
+	assert.Equal(t, []uint64{0, 0}, lastUnits(timeUnitsMinutes, 10))
+	assert.Equal(t, []uint64{3, 0}, lastUnits(timeUnitsHours, 24))
+
+	err = s.db.Load().View(func(tx *bbolt.Tx) (vErr error) {
+		bkt := tx.Bucket(minutesBucketName)
+		require.NotNil(t, bkt)
+
+		k, _ := bkt.Cursor().First()
+		assert.Nil(t, k)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestStatsCtx_RuleHits(t *testing.T) {
+	var hourID atomic.Uint32
+	hourID.Store(100)
+
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            hourID.Load,
+		Filename:          filepath.Join(t.TempDir(), "stats.db"),
+		Limit:             timeutil.Day,
+		Enabled:           true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	e := &Entry{
+		Domain: "blocked.example",
+		Client: "127.0.0.1",
+		Result: RFiltered,
+		Rules:  []Rule{{Text: "||blocked.example^", FilterListID: 1}},
+	}
+
+	// assertHits checks that the number of requests matched by the rule from
+	// e is n.
+	assertHits := func(t *testing.T, n uint64) {
+		t.Helper()
+
+		lists, rules := s.RuleHits()
+		assert.Equal(t, map[int64]uint64{1: n}, lists)
+		assert.Equal(t, map[int64]map[string]uint64{1: {"||blocked.example^": n}}, rules)
+	}
+
+	s.Update(e)
+	s.Update(e)
+	assertHits(t, 2)
+
+	// The stored units are loaded once, while the current one is counted
+	// on each call.
+	cached := s.hits
+	require.NotNil(t, cached)
+
+	s.Update(e)
+	assertHits(t, 3)
+	assert.Same(t, cached, s.hits)
+
+	hourID.Store(101)
+	s.flush()
+	s.Update(e)
+	assertHits(t, 4)
+	assert.NotSame(t, cached, s.hits)
+
+	err = s.clear()
+	require.NoError(t, err)
+
+	assert.Nil(t, s.hits)
+
+	lists, rules := s.RuleHits()
+	assert.Empty(t, lists)
+	assert.Empty(t, rules)
+}
+
+func TestValidateMinuteIvl(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		ivl        time.Duration
+	}{{
+		name:       "zero",
+		wantErrMsg: "",
+		ivl:        0,
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		ivl:        DefaultMinuteLimit,
+	}, {
+		name:       "negative",
+		wantErrMsg: "negative value",
+		ivl:        -time.Minute,
+	}, {
+		name:       "fraction",
+		wantErrMsg: "not a whole number of minutes",
+		ivl:        90 * time.Second,
+	}, {
+		name:       "too_long",
+		wantErrMsg: "more than 24h0m0s",
+		ivl:        25 * time.Hour,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, validateMinuteIvl(tc.ivl))
+		})
+	}
+}
@@ -58,6 +58,7 @@ func TestStats(t *testing.T) {
 		ShouldCountClient: func([]string) bool { return true },
 		Filename:          filepath.Join(t.TempDir(), "stats.db"),
 		Limit:             timeutil.Day,
+		SeriesLimit:       stats.DefaultSeriesLimit,
 		Enabled:           true,
 		UnitID:            constUnitID,
 		HTTPRegister: func(_, url string, handler http.HandlerFunc) {
@@ -76,19 +77,32 @@ func TestStats(t *testing.T) {
 		const respUpstream = "upstream"
 
 		entries := []*stats.Entry{{
-			Domain:   reqDomain,
-			Client:   cliIPStr,
-			Result:   stats.RFiltered,
-			Time:     time.Microsecond * 123456,
-			Upstream: respUpstream,
+			Domain:      reqDomain,
+			Client:      cliIPStr,
+			Result:      stats.RFiltered,
+			Time:        time.Microsecond * 123456,
+			Upstream:    respUpstream,
+			QType:       "A",
+			RCode:       "NOERROR",
+			ClientProto: "",
 		}, {
-			Domain:   reqDomain,
-			Client:   cliIPStr,
-			Result:   stats.RNotFiltered,
-			Time:     time.Microsecond * 123456,
-			Upstream: respUpstream,
+			Domain:      reqDomain,
+			Client:      cliIPStr,
+			Result:      stats.RNotFiltered,
+			Time:        time.Microsecond * 123456,
+			Upstream:    respUpstream,
+			QType:       "AAAA",
+			RCode:       "NOERROR",
+			ClientProto: "doh",
 		}}
 
+		lastHour := func(n uint64) (series []uint64) {
+			series = make([]uint64, 24)
+			series[23] = n
+
+			return series
+		}
+
 		wantData := &stats.StatsResp{
 			TimeUnits:             "hours",
 			TopQueried:            []map[string]uint64{0: {reqDomain: 1}},
@@ -96,6 +110,9 @@ func TestStats(t *testing.T) {
 			TopBlocked:            []map[string]uint64{0: {reqDomain: 1}},
 			TopUpstreamsResponses: []map[string]uint64{0: {respUpstream: 2}},
 			TopUpstreamsAvgTime:   []map[string]float64{0: {respUpstream: 0.123456}},
+			TopQueryTypes:         []map[string]uint64{{"A": 1}, {"AAAA": 1}},
+			TopRCodes:             []map[string]uint64{{"NOERROR": 2}},
+			TopClientProtos:       []map[string]uint64{{"doh": 1}, {"plain": 1}},
 			DNSQueries: []uint64{
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
@@ -112,11 +129,27 @@ func TestStats(t *testing.T) {
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 			},
+			Ratelimited: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			QueryTypes: map[string][]uint64{
+				"A":    lastHour(1),
+				"AAAA": lastHour(1),
+			},
+			RCodes: map[string][]uint64{
+				"NOERROR": lastHour(2),
+			},
+			ClientProtos: map[string][]uint64{
+				"doh":   lastHour(1),
+				"plain": lastHour(1),
+			},
 			NumDNSQueries:           2,
 			NumBlockedFiltering:     1,
 			NumReplacedSafebrowsing: 0,
 			NumReplacedSafesearch:   0,
 			NumReplacedParental:     0,
+			NumRatelimited:          0,
 			AvgProcessingTime:       0.123456,
 		}
 
@@ -131,6 +164,61 @@ func TestStats(t *testing.T) {
 		assert.Equal(t, wantData, data)
 	})
 
+	t.Run("series", func(t *testing.T) {
+		wantQueries := make([]uint64, 24)
+		wantQueries[23] = 2
+
+		wantBlocked := make([]uint64, 24)
+		wantBlocked[23] = 1
+
+		testCases := []struct {
+			want *stats.SeriesResp
+			url  string
+			name string
+		}{{
+			want: &stats.SeriesResp{
+				Name:          cliIPStr,
+				TimeUnits:     "hours",
+				DNSQueries:    wantQueries,
+				Blocked:       wantBlocked,
+				NumDNSQueries: 2,
+				NumBlocked:    1,
+			},
+			url:  "/control/stats/series/client",
+			name: cliIPStr,
+		}, {
+			want: &stats.SeriesResp{
+				Name:          "domain",
+				TimeUnits:     "hours",
+				DNSQueries:    wantQueries,
+				Blocked:       wantBlocked,
+				NumDNSQueries: 2,
+				NumBlocked:    1,
+			},
+			url:  "/control/stats/series/domain",
+			name: "domain",
+		}, {
+			want: &stats.SeriesResp{
+				Name:       "unknown.example",
+				TimeUnits:  "hours",
+				DNSQueries: make([]uint64, 24),
+				Blocked:    make([]uint64, 24),
+			},
+			url:  "/control/stats/series/domain",
+			name: "unknown.example",
+		}}
+
+		for _, tc := range testCases {
+			t.Run(tc.url+"_"+tc.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, tc.url+"?name="+tc.name, nil)
+				data := &stats.SeriesResp{}
+				assertSuccessAndUnmarshal(t, data, handlers[tc.url], req)
+
+				assert.Equal(t, tc.want, data)
+			})
+		}
+	})
+
 	t.Run("tops", func(t *testing.T) {
 		topClients := s.TopClientsIP(2)
 		require.NotEmpty(t, topClients)
@@ -138,6 +226,24 @@ func TestStats(t *testing.T) {
 		assert.Equal(t, cliIP, topClients[0])
 	})
 
+	t.Run("rules", func(t *testing.T) {
+		s.Update(&stats.Entry{
+			Domain: "blocked.example",
+			Client: cliIPStr,
+			Result: stats.RFiltered,
+			Rules: []stats.Rule{{
+				Text:         "||blocked.example^",
+				FilterListID: 1,
+			}},
+		})
+
+		lists, rules := s.RuleHits()
+		assert.Equal(t, map[int64]uint64{1: 1}, lists)
+		assert.Equal(t, map[int64]map[string]uint64{
+			1: {"||blocked.example^": 1},
+		}, rules)
+	})
+
 	t.Run("reset", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/control/stats_reset", nil)
 		assertSuccessAndUnmarshal(t, nil, handlers["/control/stats_reset"], req)
@@ -150,10 +256,17 @@ func TestStats(t *testing.T) {
 			TopBlocked:            []map[string]uint64{},
 			TopUpstreamsResponses: []map[string]uint64{},
 			TopUpstreamsAvgTime:   []map[string]float64{},
+			TopQueryTypes:         []map[string]uint64{},
+			TopRCodes:             []map[string]uint64{},
+			TopClientProtos:       []map[string]uint64{},
 			DNSQueries:            _24zeroes[:],
 			BlockedFiltering:      _24zeroes[:],
 			ReplacedSafebrowsing:  _24zeroes[:],
 			ReplacedParental:      _24zeroes[:],
+			Ratelimited:           _24zeroes[:],
+			QueryTypes:            map[string][]uint64{},
+			RCodes:                map[string][]uint64{},
+			ClientProtos:          map[string][]uint64{},
 		}
 
 		req = httptest.NewRequest(http.MethodGet, "/control/stats", nil)
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -24,8 +25,16 @@ const (
 
 	// maxUpstreams is the max number of top upstreams to return.
 	maxUpstreams = 100
+
+	// maxBreakdownKeys is the max number of query types, response codes, and
+	// client protocols to keep and to return.
+	maxBreakdownKeys = 100
 )
 
+// clientProtoPlain is the name of the plain DNS protocol used in the
+// statistics.  [Entry.ClientProto] is empty for such requests.
+const clientProtoPlain = "plain"
+
 // UnitIDGenFunc is the signature of a function that generates a unique ID for
 // the statistics unit.
 type UnitIDGenFunc func() (id uint32)
@@ -48,8 +57,9 @@ const (
 	RSafeBrowsing
 	RSafeSearch
 	RParental
+	RRatelimited
 
-	resultLast = RParental + 1
+	resultLast = RRatelimited + 1
 )
 
 // Entry is a statistics data entry.
@@ -65,6 +75,21 @@ type Entry struct {
 	// Upstream is the upstream DNS server.
 	Upstream string
 
+	// QType is the name of the question's type, e.g. "AAAA".  If it's empty,
+	// the request isn't counted by its type.
+	QType string
+
+	// RCode is the name of the response code, e.g. "NXDOMAIN".  If it's
+	// empty, the request isn't counted by its response code.
+	RCode string
+
+	// ClientProto is the name of the protocol the request has been received
+	// over, e.g. "doh".  It's empty for plain DNS.
+	ClientProto string
+
+	// Rules are the filtering rules matched by the request, if any.
+	Rules []Rule
+
 	// Result is the result of processing the request.
 	Result Result
 
@@ -100,6 +125,10 @@ type unit struct {
 	// clients stores the number of requests from each client.
 	clients map[string]uint64
 
+	// blockedClients stores the number of requests from each client that have
+	// been blocked.
+	blockedClients map[string]uint64
+
 	// upstreamsResponses stores the number of responses from each upstream.
 	upstreamsResponses map[string]uint64
 
@@ -107,6 +136,22 @@ type unit struct {
 	// responses from each upstream.
 	upstreamsTimeSum map[string]uint64
 
+	// qTypes stores the number of requests for each question's type.
+	qTypes map[string]uint64
+
+	// rCodes stores the number of responses with each response code.
+	rCodes map[string]uint64
+
+	// clientProtos stores the number of requests over each client protocol.
+	clientProtos map[string]uint64
+
+	// filterLists stores the number of requests matched by the rules of each
+	// filter list.
+	filterLists map[int64]uint64
+
+	// rules stores the number of requests matched by each rule.
+	rules map[Rule]uint64
+
 	// nResult stores the number of requests grouped by it's result.
 	nResult []uint64
 
@@ -131,8 +176,14 @@ func newUnit(id uint32) (u *unit) {
 		domains:            map[string]uint64{},
 		blockedDomains:     map[string]uint64{},
 		clients:            map[string]uint64{},
+		blockedClients:     map[string]uint64{},
 		upstreamsResponses: map[string]uint64{},
 		upstreamsTimeSum:   map[string]uint64{},
+		qTypes:             map[string]uint64{},
+		rCodes:             map[string]uint64{},
+		clientProtos:       map[string]uint64{},
+		filterLists:        map[int64]uint64{},
+		rules:              map[Rule]uint64{},
 		nResult:            make([]uint64, resultLast),
 		id:                 id,
 	}
@@ -169,6 +220,31 @@ type unitDB struct {
 	// responses from each upstream.
 	UpstreamsTimeSum []countPair
 
+	// ClientsSeries is the number of requests and of blocked requests from
+	// each client, limited by the series limit instead of maxClients.
+	ClientsSeries []seriesPair
+
+	// DomainsSeries is the number of requests and of blocked requests for each
+	// domain name, limited by the series limit instead of maxDomains.
+	DomainsSeries []seriesPair
+
+	// QTypes is the number of requests for each question's type.
+	QTypes []countPair
+
+	// RCodes is the number of responses with each response code.
+	RCodes []countPair
+
+	// ClientProtos is the number of requests over each client protocol.
+	ClientProtos []countPair
+
+	// FilterLists is the number of requests matched by the rules of each
+	// filter list.
+	FilterLists []filterListPair
+
+	// Rules is the number of requests matched by each rule.  The rules of the
+	// filter lists are limited by maxRules.
+	Rules []rulePair
+
 	// NTotal is the total number of requests.
 	NTotal uint64
 
@@ -218,7 +294,8 @@ func unitNameToID(name []byte) (id uint32, ok bool) {
 	return uint32(binary.BigEndian.Uint64(name)), true
 }
 
-// compareCount used to sort countPair by Count in descending order.
+// compareCount used to sort countPair by Count in descending order and then by
+// Name to make the order stable.
 func (a countPair) compareCount(b countPair) (res int) {
 	switch x, y := a.Count, b.Count; {
 	case x > y:
@@ -226,7 +303,7 @@ func (a countPair) compareCount(b countPair) (res int) {
 	case x < y:
 		return +1
 	default:
-		return 0
+		return strings.Compare(a.Name, b.Name)
 	}
 }
 
@@ -253,9 +330,9 @@ func convertSliceToMap(a []countPair) (m map[string]uint64) {
 	return m
 }
 
-// serialize converts u to the *unitDB.  It's safe for concurrent use.  u must
-// not be nil.
-func (u *unit) serialize() (udb *unitDB) {
+// serialize converts u to the *unitDB keeping at most seriesLimit client and
+// domain series.  It's safe for concurrent use.  u must not be nil.
+func (u *unit) serialize(seriesLimit int) (udb *unitDB) {
 	var timeAvg uint32 = 0
 	if u.nTotal != 0 {
 		timeAvg = uint32(u.timeSum / u.nTotal)
@@ -269,6 +346,13 @@ func (u *unit) serialize() (udb *unitDB) {
 		Clients:            convertMapToSlice(u.clients, maxClients),
 		UpstreamsResponses: convertMapToSlice(u.upstreamsResponses, maxUpstreams),
 		UpstreamsTimeSum:   convertMapToSlice(u.upstreamsTimeSum, maxUpstreams),
+		ClientsSeries:      convertMapsToSeries(u.clients, u.blockedClients, seriesLimit),
+		DomainsSeries:      convertMapsToSeries(u.domainTotals(), u.blockedDomains, seriesLimit),
+		QTypes:             convertMapToSlice(u.qTypes, maxBreakdownKeys),
+		RCodes:             convertMapToSlice(u.rCodes, maxBreakdownKeys),
+		ClientProtos:       convertMapToSlice(u.clientProtos, maxBreakdownKeys),
+		FilterLists:        convertFilterListsToSlice(u.filterLists),
+		Rules:              convertRulesToSlice(u.rules, maxRules),
 		TimeAvg:            timeAvg,
 	}
 }
@@ -281,17 +365,25 @@ func loadUnitFromDB(tx *bbolt.Tx, id uint32) (udb *unitDB) {
 
 	log.Tracef("Loading unit %d", id)
 
-	var buf bytes.Buffer
-	buf.Write(bkt.Get([]byte{0}))
-	udb = &unitDB{}
+	return decodeUnit(bkt.Get([]byte{0}))
+}
 
-	err := gob.NewDecoder(&buf).Decode(udb)
+// decodeUnit decodes the unit from data.  It returns nil if data can't be
+// decoded.
+func decodeUnit(data []byte) (udb *unitDB) {
+	udb = &unitDB{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(udb)
 	if err != nil {
 		log.Error("gob Decode: %s", err)
 
 		return nil
 	}
 
+	// The units stored by the previous versions may contain fewer results.
+	if n := len(udb.NResult); n < int(resultLast) {
+		udb.NResult = append(udb.NResult, make([]uint64, int(resultLast)-n)...)
+	}
+
 	return udb
 }
 
@@ -308,18 +400,56 @@ func (u *unit) deserialize(udb *unitDB) {
 	u.domains = convertSliceToMap(udb.Domains)
 	u.blockedDomains = convertSliceToMap(udb.BlockedDomains)
 	u.clients = convertSliceToMap(udb.Clients)
+	u.blockedClients = map[string]uint64{}
 	u.upstreamsResponses = convertSliceToMap(udb.UpstreamsResponses)
 	u.upstreamsTimeSum = convertSliceToMap(udb.UpstreamsTimeSum)
+	u.qTypes = convertSliceToMap(udb.QTypes)
+	u.rCodes = convertSliceToMap(udb.RCodes)
+	u.clientProtos = convertSliceToMap(udb.ClientProtos)
+
+	u.filterLists = make(map[int64]uint64, len(udb.FilterLists))
+	for _, lp := range udb.FilterLists {
+		u.filterLists[lp.ID] = lp.Count
+	}
+
+	u.rules = make(map[Rule]uint64, len(udb.Rules))
+	for _, rp := range udb.Rules {
+		u.rules[Rule{Text: rp.Text, FilterListID: rp.FilterListID}] = rp.Count
+	}
 	u.timeSum = uint64(udb.TimeAvg) * udb.NTotal
+
+	// The series contain the exact numbers for more names than the top lists,
+	// so use them to restore as much as possible.
+	for _, sp := range udb.ClientsSeries {
+		u.clients[sp.Name] = sp.Count
+		setNonZero(u.blockedClients, sp.Name, sp.Blocked)
+	}
+
+	for _, sp := range udb.DomainsSeries {
+		setNonZero(u.domains, sp.Name, sp.Count-sp.Blocked)
+		setNonZero(u.blockedDomains, sp.Name, sp.Blocked)
+	}
+}
+
+// setNonZero sets the value of key in m to n unless n is zero.
+func setNonZero(m map[string]uint64, key string, n uint64) {
+	if n != 0 {
+		m[key] = n
+	}
 }
 
 // add adds new data to u.  It's safe for concurrent use.
 func (u *unit) add(e *Entry) {
 	u.nResult[e.Result]++
-	if e.Result == RNotFiltered {
+	switch e.Result {
+	case RNotFiltered:
 		u.domains[e.Domain]++
-	} else {
+	case RRatelimited:
+		// Don't count the domains of the requests which haven't been
+		// processed.
+	default:
 		u.blockedDomains[e.Domain]++
+		u.blockedClients[e.Client]++
 	}
 
 	u.clients[e.Client]++
@@ -331,6 +461,52 @@ func (u *unit) add(e *Entry) {
 		u.upstreamsResponses[e.Upstream]++
 		u.upstreamsTimeSum[e.Upstream] += t
 	}
+
+	if e.QType != "" {
+		u.qTypes[e.QType]++
+	}
+
+	if e.RCode != "" {
+		u.rCodes[e.RCode]++
+	}
+
+	if e.ClientProto != "" {
+		u.clientProtos[e.ClientProto]++
+	} else {
+		u.clientProtos[clientProtoPlain]++
+	}
+
+	u.addRules(e.Rules)
+}
+
+// merge adds the data from other to u.  It's used to roll the minute units up
+// into the hourly ones.  u and other must not be nil.
+func (u *unit) merge(other *unit) {
+	mergeMaps(u.domains, other.domains)
+	mergeMaps(u.blockedDomains, other.blockedDomains)
+	mergeMaps(u.clients, other.clients)
+	mergeMaps(u.blockedClients, other.blockedClients)
+	mergeMaps(u.upstreamsResponses, other.upstreamsResponses)
+	mergeMaps(u.upstreamsTimeSum, other.upstreamsTimeSum)
+	mergeMaps(u.qTypes, other.qTypes)
+	mergeMaps(u.rCodes, other.rCodes)
+	mergeMaps(u.clientProtos, other.clientProtos)
+	mergeMaps(u.filterLists, other.filterLists)
+	mergeMaps(u.rules, other.rules)
+
+	for i, n := range other.nResult {
+		u.nResult[i] += n
+	}
+
+	u.nTotal += other.nTotal
+	u.timeSum += other.timeSum
+}
+
+// mergeMaps adds the numbers from src to dst.
+func mergeMaps[K comparable](dst, src map[K]uint64) {
+	for k, v := range src {
+		dst[k] += v
+	}
 }
 
 // flushUnitToDB puts udb to the database at id.
@@ -342,13 +518,13 @@ func (udb *unitDB) flushUnitToDB(tx *bbolt.Tx, id uint32) (err error) {
 		return fmt.Errorf("creating bucket: %w", err)
 	}
 
-	buf := &bytes.Buffer{}
-	err = gob.NewEncoder(buf).Encode(udb)
+	data, err := udb.encode()
 	if err != nil {
-		return fmt.Errorf("encoding unit: %w", err)
+		// Don't wrap the error, since it's informative enough as is.
+		return err
 	}
 
-	err = bkt.Put([]byte{0}, buf.Bytes())
+	err = bkt.Put([]byte{0}, data)
 	if err != nil {
 		return fmt.Errorf("putting unit to database: %w", err)
 	}
@@ -356,6 +532,17 @@ func (udb *unitDB) flushUnitToDB(tx *bbolt.Tx, id uint32) (err error) {
 	return nil
 }
 
+// encode returns the GOB encoding of udb.
+func (udb *unitDB) encode() (data []byte, err error) {
+	buf := &bytes.Buffer{}
+	err = gob.NewEncoder(buf).Encode(udb)
+	if err != nil {
+		return nil, fmt.Errorf("encoding unit: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
 func convertTopSlice(a []countPair) (m []map[string]uint64) {
 	m = make([]map[string]uint64, 0, len(a))
 	for _, it := range a {
@@ -403,37 +590,54 @@ func topsCollector(units []*unitDB, max int, ignored *aghnet.IgnoreEngine, pg pa
 //
 //     The total counters (DNS queries, blocked, etc.) are just the sum of data
 //     for all units.
-func (s *StatsCtx) getData(limit uint32) (resp *StatsResp, ok bool) {
+//
+// timeUnits is either [timeUnitsHours] for the hourly units or
+// [timeUnitsMinutes] for the minute ones, and limit is the number of those.
+func (s *StatsCtx) getData(timeUnits string, limit uint32) (resp *StatsResp, ok bool) {
 	if limit == 0 {
+		if timeUnits != timeUnitsMinutes {
+			timeUnits = timeUnitsDays
+		}
+
 		return &StatsResp{
-			TimeUnits: "days",
+			TimeUnits: timeUnits,
 
 			TopBlocked:            []topAddrs{},
 			TopClients:            []topAddrs{},
 			TopQueried:            []topAddrs{},
 			TopUpstreamsResponses: []topAddrs{},
 			TopUpstreamsAvgTime:   []topAddrsFloat{},
+			TopQueryTypes:         []topAddrs{},
+			TopRCodes:             []topAddrs{},
+			TopClientProtos:       []topAddrs{},
 
 			BlockedFiltering:     []uint64{},
 			DNSQueries:           []uint64{},
 			ReplacedParental:     []uint64{},
 			ReplacedSafebrowsing: []uint64{},
+			Ratelimited:          []uint64{},
+
+			QueryTypes:   map[string][]uint64{},
+			RCodes:       map[string][]uint64{},
+			ClientProtos: map[string][]uint64{},
 		}, true
 	}
 
-	units, curID := s.loadUnits(limit)
+	units, curID := s.loadUnitsOf(timeUnits, limit)
 	if units == nil {
 		return &StatsResp{}, false
 	}
 
-	return s.dataFromUnits(units, curID), true
+	return s.dataFromUnits(units, curID, timeUnits), true
 }
 
-// dataFromUnits collects and returns the statistics data.
-func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp) {
+// dataFromUnits collects and returns the statistics data.  timeUnits is the
+// same as in [StatsCtx.getData].
+func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32, timeUnits string) (resp *StatsResp) {
 	topUpstreamsResponses, topUpstreamsAvgTime := topUpstreamsPairs(units)
 
 	resp = &StatsResp{
+		TimeUnits:             timeUnits,
 		TopQueried:            topsCollector(units, maxDomains, s.ignored, func(u *unitDB) (pairs []countPair) { return u.Domains }),
 		TopBlocked:            topsCollector(units, maxDomains, s.ignored, func(u *unitDB) (pairs []countPair) { return u.BlockedDomains }),
 		TopUpstreamsResponses: topUpstreamsResponses,
@@ -442,6 +646,7 @@ func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp
 	}
 
 	s.fillCollectedStats(resp, units, curID)
+	fillBreakdowns(resp, units, curID)
 
 	// Total counters:
 	sum := unitDB{
@@ -458,6 +663,7 @@ func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp
 		sum.NResult[RSafeBrowsing] += u.NResult[RSafeBrowsing]
 		sum.NResult[RSafeSearch] += u.NResult[RSafeSearch]
 		sum.NResult[RParental] += u.NResult[RParental]
+		sum.NResult[RRatelimited] += u.NResult[RRatelimited]
 	}
 
 	resp.NumDNSQueries = sum.NTotal
@@ -465,6 +671,7 @@ func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp
 	resp.NumReplacedSafebrowsing = sum.NResult[RSafeBrowsing]
 	resp.NumReplacedSafesearch = sum.NResult[RSafeSearch]
 	resp.NumReplacedParental = sum.NResult[RParental]
+	resp.NumRatelimited = sum.NResult[RRatelimited]
 
 	if timeN != 0 {
 		resp.AvgProcessingTime = microsecondsToSeconds(float64(sum.TimeAvg / timeN))
@@ -473,21 +680,27 @@ func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp
 	return resp
 }
 
-// fillCollectedStats fills data with collected statistics.
+// fillCollectedStats fills data with collected statistics.  If data.TimeUnits
+// is [timeUnitsMinutes], units are the minute units, which are never aggregated.
+// Otherwise, the hourly units are aggregated into days if there are more than
+// seven days of them.
 func (s *StatsCtx) fillCollectedStats(data *StatsResp, units []*unitDB, curID uint32) {
 	size := len(units)
-	data.TimeUnits = timeUnitsHours
+	if data.TimeUnits != timeUnitsMinutes {
+		data.TimeUnits = timeUnitsHours
 
-	daysCount := size / 24
-	if daysCount > 7 {
-		size = daysCount
-		data.TimeUnits = timeUnitsDays
+		daysCount := size / 24
+		if daysCount > 7 {
+			size = daysCount
+			data.TimeUnits = timeUnitsDays
+		}
 	}
 
 	data.DNSQueries = make([]uint64, size)
 	data.BlockedFiltering = make([]uint64, size)
 	data.ReplacedSafebrowsing = make([]uint64, size)
 	data.ReplacedParental = make([]uint64, size)
+	data.Ratelimited = make([]uint64, size)
 
 	if data.TimeUnits == timeUnitsDays {
 		s.fillCollectedStatsDaily(data, units, curID, size)
@@ -500,6 +713,7 @@ func (s *StatsCtx) fillCollectedStats(data *StatsResp, units []*unitDB, curID ui
 		data.BlockedFiltering[i] += u.NResult[RFiltered]
 		data.ReplacedSafebrowsing[i] += u.NResult[RSafeBrowsing]
 		data.ReplacedParental[i] += u.NResult[RParental]
+		data.Ratelimited[i] += u.NResult[RRatelimited]
 	}
 }
 
@@ -524,6 +738,7 @@ func (s *StatsCtx) fillCollectedStatsDaily(
 		data.BlockedFiltering[day] += u.NResult[RFiltered]
 		data.ReplacedSafebrowsing[day] += u.NResult[RSafeBrowsing]
 		data.ReplacedParental[day] += u.NResult[RParental]
+		data.Ratelimited[day] += u.NResult[RRatelimited]
 	}
 }
 
@@ -18,12 +18,18 @@ func TestUnit_Deserialize(t *testing.T) {
 			domains:            map[string]uint64{},
 			blockedDomains:     map[string]uint64{},
 			clients:            map[string]uint64{},
-			nResult:            []uint64{0, 0, 0, 0, 0, 0},
+			blockedClients:     map[string]uint64{},
+			nResult:            []uint64{0, 0, 0, 0, 0, 0, 0},
 			id:                 0,
 			nTotal:             0,
 			timeSum:            0,
 			upstreamsResponses: map[string]uint64{},
 			upstreamsTimeSum:   map[string]uint64{},
+			qTypes:             map[string]uint64{},
+			rCodes:             map[string]uint64{},
+			clientProtos:       map[string]uint64{},
+			filterLists:        map[int64]uint64{},
+			rules:              map[Rule]uint64{},
 		},
 		db: &unitDB{
 			NResult:            []uint64{0, 0, 0, 0, 0, 0},
@@ -47,16 +53,33 @@ func TestUnit_Deserialize(t *testing.T) {
 			clients: map[string]uint64{
 				"127.0.0.1": 2,
 			},
-			nResult: []uint64{0, 1, 1, 0, 0, 0},
-			id:      0,
-			nTotal:  2,
-			timeSum: 246912,
+			blockedClients: map[string]uint64{},
+			nResult:        []uint64{0, 1, 1, 0, 0, 0, 0},
+			id:             0,
+			nTotal:         2,
+			timeSum:        246912,
 			upstreamsResponses: map[string]uint64{
 				"1.2.3.4": 2,
 			},
 			upstreamsTimeSum: map[string]uint64{
 				"1.2.3.4": 246912,
 			},
+			qTypes: map[string]uint64{
+				"A": 2,
+			},
+			rCodes: map[string]uint64{
+				"NOERROR":  1,
+				"NXDOMAIN": 1,
+			},
+			clientProtos: map[string]uint64{
+				"doh": 2,
+			},
+			filterLists: map[int64]uint64{
+				1: 1,
+			},
+			rules: map[Rule]uint64{
+				{Text: "||example.net^", FilterListID: 1}: 1,
+			},
 		},
 		db: &unitDB{
 			NResult: []uint64{0, 1, 1, 0, 0, 0},
@@ -77,6 +100,113 @@ func TestUnit_Deserialize(t *testing.T) {
 			UpstreamsTimeSum: []countPair{{
 				"1.2.3.4", 246912,
 			}},
+			QTypes: []countPair{{
+				"A", 2,
+			}},
+			RCodes: []countPair{{
+				"NOERROR", 1,
+			}, {
+				"NXDOMAIN", 1,
+			}},
+			ClientProtos: []countPair{{
+				"doh", 2,
+			}},
+			FilterLists: []filterListPair{{
+				ID:    1,
+				Count: 1,
+			}},
+			Rules: []rulePair{{
+				Text:         "||example.net^",
+				FilterListID: 1,
+				Count:        1,
+			}},
+		},
+	}, {
+		name: "ratelimited",
+		want: unit{
+			domains:            map[string]uint64{},
+			blockedDomains:     map[string]uint64{},
+			clients:            map[string]uint64{},
+			blockedClients:     map[string]uint64{},
+			nResult:            []uint64{0, 0, 0, 0, 0, 0, 1},
+			id:                 0,
+			nTotal:             1,
+			timeSum:            0,
+			upstreamsResponses: map[string]uint64{},
+			upstreamsTimeSum:   map[string]uint64{},
+			qTypes:             map[string]uint64{},
+			rCodes:             map[string]uint64{},
+			clientProtos:       map[string]uint64{},
+			filterLists:        map[int64]uint64{},
+			rules:              map[Rule]uint64{},
+		},
+		db: &unitDB{
+			NResult:            []uint64{0, 0, 0, 0, 0, 0, 1},
+			Domains:            []countPair{},
+			BlockedDomains:     []countPair{},
+			Clients:            []countPair{},
+			NTotal:             1,
+			TimeAvg:            0,
+			UpstreamsResponses: []countPair{},
+			UpstreamsTimeSum:   []countPair{},
+		},
+	}, {
+		name: "series",
+		want: unit{
+			domains: map[string]uint64{
+				"example.com": 2,
+			},
+			blockedDomains: map[string]uint64{
+				"example.net": 1,
+			},
+			clients: map[string]uint64{
+				"127.0.0.1": 2,
+				"127.0.0.2": 1,
+			},
+			blockedClients: map[string]uint64{
+				"127.0.0.2": 1,
+			},
+			nResult:            []uint64{0, 2, 1, 0, 0, 0, 0},
+			id:                 0,
+			nTotal:             3,
+			timeSum:            0,
+			upstreamsResponses: map[string]uint64{},
+			upstreamsTimeSum:   map[string]uint64{},
+			qTypes:             map[string]uint64{},
+			rCodes:             map[string]uint64{},
+			clientProtos:       map[string]uint64{},
+			filterLists:        map[int64]uint64{},
+			rules:              map[Rule]uint64{},
+		},
+		db: &unitDB{
+			NResult: []uint64{0, 2, 1, 0, 0, 0},
+			Domains: []countPair{{
+				"example.com", 2,
+			}},
+			BlockedDomains: []countPair{},
+			Clients: []countPair{{
+				"127.0.0.1", 2,
+			}},
+			NTotal:             3,
+			TimeAvg:            0,
+			UpstreamsResponses: []countPair{},
+			UpstreamsTimeSum:   []countPair{},
+			ClientsSeries: []seriesPair{{
+				Name:  "127.0.0.1",
+				Count: 2,
+			}, {
+				Name:    "127.0.0.2",
+				Count:   1,
+				Blocked: 1,
+			}},
+			DomainsSeries: []seriesPair{{
+				Name:  "example.com",
+				Count: 2,
+			}, {
+				Name:    "example.net",
+				Count:   1,
+				Blocked: 1,
+			}},
 		},
 	}}
 
@@ -175,3 +305,123 @@ func TestTopUpstreamsPairs(t *testing.T) {
 		})
 	}
 }
+
+func TestConvertMapsToSeries(t *testing.T) {
+	counts := map[string]uint64{
+		"a": 3,
+		"b": 1,
+		"c": 3,
+	}
+	blocked := map[string]uint64{
+		"c": 2,
+	}
+
+	got := convertMapsToSeries(counts, blocked, 2)
+	assert.Equal(t, []seriesPair{{
+		Name:  "a",
+		Count: 3,
+	}, {
+		Name:    "c",
+		Count:   3,
+		Blocked: 2,
+	}}, got)
+
+	assert.Nil(t, convertMapsToSeries(counts, blocked, 0))
+}
+
+func TestSeriesFromUnits(t *testing.T) {
+	const name = "example.org"
+
+	// Make 8 days of units with a single request per unit.
+	units := make([]*unitDB, 24*8)
+	for i := range units {
+		units[i] = &unitDB{
+			DomainsSeries: []seriesPair{{
+				Name:  name,
+				Count: 1,
+			}},
+		}
+	}
+
+	// The current hour is the first hour of a day.
+	const curID = 24*100 + 1
+
+	got := seriesFromUnits(name, units, curID, timeUnitsHours, func(u *unitDB) (s []seriesPair) {
+		return u.DomainsSeries
+	})
+	require.Equal(t, timeUnitsDays, got.TimeUnits)
+
+	assert.Equal(t, []uint64{24, 24, 24, 24, 24, 24, 24, 1}, got.DNSQueries)
+	assert.Equal(t, uint64(24*7+1), got.NumDNSQueries)
+}
+
+func TestUnit_addRules(t *testing.T) {
+	u := newUnit(0)
+
+	u.add(&Entry{
+		Domain: "example.org",
+		Client: "127.0.0.1",
+		Result: RFiltered,
+		Rules: []Rule{{
+			Text:         "||example.org^",
+			FilterListID: 1,
+		}, {
+			Text:         "example.org",
+			FilterListID: 1,
+		}, {
+			Text:         "@@||example.org^$important",
+			FilterListID: 0,
+		}},
+	})
+	u.add(&Entry{
+		Domain: "example.org",
+		Client: "127.0.0.1",
+		Result: RSafeBrowsing,
+		Rules: []Rule{{
+			Text:         "",
+			FilterListID: 2,
+		}},
+	})
+
+	assert.Equal(t, map[int64]uint64{0: 1, 1: 1}, u.filterLists)
+	assert.Equal(t, map[Rule]uint64{
+		{Text: "||example.org^", FilterListID: 1}:             1,
+		{Text: "example.org", FilterListID: 1}:                1,
+		{Text: "@@||example.org^$important", FilterListID: 0}: 1,
+	}, u.rules)
+
+	udb := u.serialize(0)
+	assert.Equal(t, []filterListPair{{ID: 0, Count: 1}, {ID: 1, Count: 1}}, udb.FilterLists)
+	assert.Equal(t, []rulePair{{
+		Text:         "@@||example.org^$important",
+		FilterListID: 0,
+		Count:        1,
+	}, {
+		Text:         "example.org",
+		FilterListID: 1,
+		Count:        1,
+	}, {
+		Text:         "||example.org^",
+		FilterListID: 1,
+		Count:        1,
+	}}, udb.Rules)
+}
+
+func TestConvertRulesToSlice(t *testing.T) {
+	m := map[Rule]uint64{
+		{Text: "||a.example^", FilterListID: 1}: 3,
+		{Text: "||b.example^", FilterListID: 1}: 2,
+		{Text: "||c.example^", FilterListID: 0}: 1,
+	}
+
+	got := convertRulesToSlice(m, 1)
+	assert.Equal(t, []rulePair{{
+		Text:         "||a.example^",
+		FilterListID: 1,
+		Count:        3,
+	}, {
+		Text:         "||c.example^",
+		FilterListID: 0,
+		Count:        1,
+	}}, got)
+}